@@ -1,15 +1,36 @@
 package main
 
 import (
+	"client/internal/logging"
 	"client/internal/model"
 	"client/internal/service"
+	"client/internal/tracing"
 	"client/internal/view"
 	"client/internal/viewmodel"
 	"fyne.io/fyne/v2/app"
+	"log"
+	"log/slog"
+	"os"
 	"time"
 )
 
 func main() {
+	logOptions, err := logging.OptionsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger, err := logging.New(os.Stderr, logOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+	tracer, err := tracing.FromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tracing.SetDefault(tracer)
+	defer tracer.Close()
+
 	a := app.New()
 	client := model.NewClient()
 	if true {
@@ -20,6 +41,7 @@ func main() {
 
 		userListVM := viewmodel.NewUserListViewModel(commService)
 		userListView := view.NewUserListView(userListVM, a)
+		userListVM.WaitForServerNotices()
 
 		chatVM := viewmodel.NewChatViewModel(commService)
 		chatView := view.NewChatView(chatVM, a)
@@ -37,6 +59,7 @@ func main() {
 				}
 			}()
 			chatVM.WaitForHandshakeMessages()
+			chatVM.WaitForKeyChangeNotices()
 		})
 
 		userListVM.SetOnSelect(func(selectedUser string) {
@@ -0,0 +1,131 @@
+// Package logging sets up the client's structured logger, like the server's. Usernames and key material
+// are redacted by default, as long as they are logged under the attribute keys below.
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Attribute keys whose values are redacted
+const (
+	KeyUser  = "user"  // A username, replaced by a pseudonym
+	KeyPeer  = "peer"  // The username of the other side of a chat or key exchange, replaced by a pseudonym
+	KeyKey   = "key"   // A *rsa.PublicKey, logged as a fingerprint when redaction is off
+	KeyToken = "token" // Login tokens and other secrets, never logged
+)
+
+const redacted = "[redacted]"
+
+type Options struct {
+	Level  slog.Level
+	Format string // "text" or "json"
+	Redact bool   // Replace usernames by pseudonyms and leave out key fingerprints
+}
+
+func DefaultOptions() Options {
+	return Options{Level: slog.LevelInfo, Format: "text", Redact: true}
+}
+
+// ParseLevel reads a level like "debug", "info", "warn" or "error"
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("log level %q must be debug, info, warn or error", value)
+	}
+	return level, nil
+}
+
+// CheckFormat makes sure the output format is one New understands
+func CheckFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("log format %q must be text or json", format)
+	}
+	return nil
+}
+
+// OptionsFromEnv reads CLIENT_LOG_LEVEL, CLIENT_LOG_FORMAT and CLIENT_LOG_REDACT over the defaults
+func OptionsFromEnv() (Options, error) {
+	options := DefaultOptions()
+	if env := os.Getenv("CLIENT_LOG_LEVEL"); env != "" {
+		level, err := ParseLevel(env)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid CLIENT_LOG_LEVEL: %v", err)
+		}
+		options.Level = level
+	}
+	if env := os.Getenv("CLIENT_LOG_FORMAT"); env != "" {
+		if err := CheckFormat(env); err != nil {
+			return Options{}, fmt.Errorf("invalid CLIENT_LOG_FORMAT: %v", err)
+		}
+		options.Format = env
+	}
+	if env := os.Getenv("CLIENT_LOG_REDACT"); env != "" {
+		redact, err := strconv.ParseBool(env)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid CLIENT_LOG_REDACT %q: must be true or false", env)
+		}
+		options.Redact = redact
+	}
+	return options, nil
+}
+
+func New(w io.Writer, options Options) (*slog.Logger, error) {
+	if err := CheckFormat(options.Format); err != nil {
+		return nil, err
+	}
+	handlerOptions := &slog.HandlerOptions{Level: options.Level, ReplaceAttr: replaceAttr(options.Redact, newPseudonymKey())}
+	if options.Format == "json" {
+		return slog.New(slog.NewJSONHandler(w, handlerOptions)), nil
+	}
+	return slog.New(slog.NewTextHandler(w, handlerOptions)), nil
+}
+
+// newPseudonymKey is a new key for every process, so pseudonyms can be followed through one run
+// of the client but can't be matched against a list of usernames
+func newPseudonymKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("error generating log pseudonym key: %v", err))
+	}
+	return key
+}
+
+func replaceAttr(redact bool, pseudonymKey []byte) func(groups []string, attr slog.Attr) slog.Attr {
+	return func(_ []string, attr slog.Attr) slog.Attr {
+		switch attr.Key {
+		case KeyUser, KeyPeer:
+			if redact && attr.Value.Kind() == slog.KindString && attr.Value.String() != "" {
+				mac := hmac.New(sha256.New, pseudonymKey)
+				mac.Write([]byte(attr.Value.String()))
+				return slog.String(attr.Key, "u-"+hex.EncodeToString(mac.Sum(nil))[:12])
+			}
+		case KeyKey:
+			if redact {
+				return slog.String(attr.Key, redacted)
+			}
+			if key, ok := attr.Value.Any().(*rsa.PublicKey); ok && key != nil {
+				return slog.String(attr.Key, Fingerprint(key))
+			}
+		case KeyToken:
+			return slog.String(attr.Key, redacted)
+		}
+		return attr
+	}
+}
+
+// Fingerprint is a short SHA-256 digest of the public key's modulus
+func Fingerprint(key *rsa.PublicKey) string {
+	digest := sha256.Sum256(key.N.Bytes())
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(digest[:]), "=")
+}
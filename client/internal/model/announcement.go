@@ -0,0 +1,54 @@
+package model
+
+import (
+	pb "client/resources/proto"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+)
+
+// announcementSignatureContext is signed before the announcement, it must match the server's
+const announcementSignatureContext = "chat announcement\x00"
+
+var errInvalidAnnouncementSignature = errors.New("invalid announcement signature")
+
+// ServerPublicKey is the public key of the certificate the server presented, which signs its announcements
+func (c *Client) ServerPublicKey() (crypto.PublicKey, error) {
+	if c.Conn == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+	certificates := c.Conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("the server presented no certificate")
+	}
+	return certificates[0].PublicKey, nil
+}
+
+// VerifyAnnouncement checks the signature of an announcement notice with the server's public key and returns
+// the announcement
+func VerifyAnnouncement(key crypto.PublicKey, notice *pb.ServerNoticePacket) (*pb.Announcement, error) {
+	message := append([]byte(announcementSignatureContext), notice.GetAnnouncement()...)
+	digest := sha256.Sum256(message)
+	valid := false
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, notice.GetSignature())
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPSS(key, crypto.SHA256, digest[:], notice.GetSignature(), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest[:], notice.GetSignature())
+	}
+	if !valid {
+		return nil, errInvalidAnnouncementSignature
+	}
+	var announcement pb.Announcement
+	if err := proto.Unmarshal(notice.GetAnnouncement(), &announcement); err != nil {
+		return nil, fmt.Errorf("error unmarshalling announcement: %v", err)
+	}
+	return &announcement, nil
+}
@@ -55,16 +55,22 @@ func (c *Chatter) Encrypt(message string) []byte {
 	return ciphertext
 }
 
-func (c *Chatter) Decrypt(encryptedMessage []byte) string {
+func (c *Chatter) Decrypt(encryptedMessage []byte) (string, error) {
+	if c.cypherBlock == nil {
+		return "", errors.New("no chat key, the handshake did not finish")
+	}
+	if len(encryptedMessage)%aes.BlockSize != 0 {
+		return "", errors.New("encrypted message is not a whole number of blocks")
+	}
 	plaintext := make([]byte, len(encryptedMessage))
 	for i := 0; i < len(encryptedMessage); i += aes.BlockSize {
 		c.cypherBlock.Decrypt(plaintext[i:i+aes.BlockSize], encryptedMessage[i:i+aes.BlockSize])
 	}
 	unpaddedPlaintext, err := pkcs7Unpad(plaintext, aes.BlockSize)
 	if err != nil {
-		return "" // Handle error appropriately in your application
+		return "", err
 	}
-	return string(unpaddedPlaintext)
+	return string(unpaddedPlaintext), nil
 }
 
 // pkcs7Pad adds PKCS#7 padding to the data
@@ -2,18 +2,19 @@ package model
 
 import (
 	pb "client/resources/proto"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/binary"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"google.golang.org/protobuf/proto"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"time"
 )
 
 type Client struct {
@@ -23,26 +24,21 @@ type Client struct {
 	isConnected bool
 	//
 	privateKey *rsa.PrivateKey
+	// Key policy status reported by the server at login
+	KeyPolicy          *pb.KeyPolicy
+	KeyExpiresAt       time.Time
+	KeyRenewalRequired bool
 }
 
 func NewClient() *Client {
 	return &Client{}
 }
 
-func (c *Client) MakeConnection(address string, privateKeyPath string) error {
-	fmt.Println("Connecting to server...")
-	cert, err := os.ReadFile("resources/auth/server-cert.pem")
+func (c *Client) MakeConnection(address string, privateKeyPath string, settings TLSSettings) error {
+	slog.Info("Connecting to server", "address", address)
+	config, err := settings.config()
 	if err != nil {
-		return fmt.Errorf("error reading server certificate: %v", err)
-	}
-
-	certPool := x509.NewCertPool()
-	if ok := certPool.AppendCertsFromPEM(cert); !ok {
-		return fmt.Errorf("failed to append certificate")
-	}
-
-	config := &tls.Config{
-		RootCAs: certPool,
+		return err
 	}
 
 	conn, err := tls.Dial("tcp", address, config)
@@ -61,17 +57,30 @@ func (c *Client) MakeConnection(address string, privateKeyPath string) error {
 }
 
 func (c *Client) SetPrivateKey(privateKeyPath string) error {
+	privateKey, err := LoadPrivateKey(privateKeyPath)
+	if err != nil {
+		return err
+	}
+
+	c.privateKey = privateKey
+	return nil
+}
+
+func LoadPrivateKey(privateKeyPath string) (*rsa.PrivateKey, error) {
 	privateKeyBytes, err := os.ReadFile(privateKeyPath)
 	if err != nil {
-		return fmt.Errorf("error reading private key: %v", err)
+		return nil, fmt.Errorf("error reading private key: %v", err)
 	}
 	key, err := ssh.ParseRawPrivateKey(privateKeyBytes)
 	if err != nil {
-		return fmt.Errorf("error parsing private key: %v", err)
+		return nil, fmt.Errorf("error parsing private key: %v", err)
 	}
 
-	c.privateKey = key.(*rsa.PrivateKey)
-	return nil
+	privateKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key is not an RSA key")
+	}
+	return privateKey, nil
 }
 
 func (c *Client) SendMessage(message *pb.Message) error {
@@ -85,14 +94,13 @@ func (c *Client) SendMessage(message *pb.Message) error {
 	}
 
 	// Write the length of the message
-	log.Println("SendMessage\t len: ", len(data))
+	slog.Debug("Sending message", "packet", PacketName(message), "bytes", len(data))
 	err = binary.Write(c.Conn, binary.BigEndian, uint32(len(data)))
 	if err != nil {
 		return err
 	}
 
 	// Write the message itself
-	//log.Println("SendMessage data: ", data)
 	_, err = c.Conn.Write(data)
 	return err
 }
@@ -108,32 +116,28 @@ func (c *Client) GetMessage() (*pb.Message, error) {
 		if err == io.EOF {
 			return nil, fmt.Errorf("connection closed by server")
 		}
-		log.Println("Error reading message length: ", err)
-		return nil, err
+		return nil, fmt.Errorf("error reading message length: %v", err)
 	}
-	log.Println("GetMessage\t len: ", length)
 
 	// Read the message data
 	data := make([]byte, length)
 	_, err = io.ReadFull(c.Conn, data)
 	if err != nil {
-		log.Println("Error reading message data: ", err)
-		return nil, err
+		return nil, fmt.Errorf("error reading message data: %v", err)
 	}
-	//log.Println("GetMessage data: ", data)
 
 	// Unmarshal the message
 	message := &pb.Message{}
 	if err := proto.Unmarshal(data, message); err != nil {
-		log.Println("Error unmarshalling message: ", err)
-		return nil, err
+		return nil, fmt.Errorf("error unmarshalling message: %v", err)
 	}
+	slog.Debug("Received message", "packet", PacketName(message), "bytes", length)
 
 	return message, nil
 }
 
 func (c *Client) Close() error {
-	fmt.Println("Closing connection...")
+	slog.Info("Closing connection")
 	c.isConnected = false
 	if c.Conn == nil {
 		return nil
@@ -153,6 +157,18 @@ func (c *Client) DecryptMessageWithPrivateKey(message []byte) ([]byte, error) {
 	return decrypted, nil
 }
 
+func (c *Client) SignWithPrivateKey(digest []byte) ([]byte, error) {
+	if c.privateKey == nil {
+		return nil, fmt.Errorf("private key not set")
+	}
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.privateKey, crypto.SHA256, digest)
+	if err != nil {
+		return nil, fmt.Errorf("signing error: %v", err)
+	}
+	return signature, nil
+}
+
 func (c *Client) GetPubKey() *rsa.PublicKey {
 	if c.isConnected == false || c.Conn == nil {
 		return nil
@@ -161,7 +177,7 @@ func (c *Client) GetPubKey() *rsa.PublicKey {
 	pubKey := c.privateKey.Public()
 	pubKeyRSA, ok := pubKey.(*rsa.PublicKey)
 	if !ok {
-		fmt.Println("Error casting public key")
+		slog.Error("Error casting public key")
 		return nil
 	}
 	return pubKeyRSA
@@ -170,3 +186,13 @@ func (c *Client) GetPubKey() *rsa.PublicKey {
 func (c *Client) IsConnected() bool {
 	return c.isConnected
 }
+
+// PacketName is the name of the message's packet field, like "loginMessage"
+func PacketName(message *pb.Message) string {
+	reflection := message.ProtoReflect()
+	field := reflection.WhichOneof(reflection.Descriptor().Oneofs().ByName("packet"))
+	if field == nil {
+		return "none"
+	}
+	return string(field.Name())
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"client/internal/model"
+	pb "client/resources/proto"
+	"log/slog"
+	"time"
+)
+
+// receiveAnnouncement keeps the announcement if its signature verifies against the server's certificate.
+// An announcement is only shown once, even when the server sends it again at login.
+func (cs *CommunicationService) receiveAnnouncement(notice *pb.ServerNoticePacket) {
+	key, err := cs.client.ServerPublicKey()
+	if err == nil {
+		var announcement *pb.Announcement
+		if announcement, err = model.VerifyAnnouncement(key, notice); err == nil {
+			cs.showAnnouncement(announcement)
+			return
+		}
+	}
+	slog.Warn("Dropping announcement", "error", err)
+}
+
+func (cs *CommunicationService) showAnnouncement(announcement *pb.Announcement) {
+	cs.announcementMutex.Lock()
+	if cs.seenAnnouncements[announcement.GetId()] || announcementExpired(announcement) {
+		cs.announcementMutex.Unlock()
+		return
+	}
+	cs.seenAnnouncements[announcement.GetId()] = true
+	// Announcements arrive in the order they were sent, the latest one replaces the banner
+	cs.announcement = announcement
+	listeners := cs.announcementListeners
+	cs.announcementMutex.Unlock()
+
+	if announcement.ExpiresAt != nil {
+		time.AfterFunc(time.Until(time.Unix(announcement.GetExpiresAt(), 0)), cs.notifyAnnouncementListeners)
+	}
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func (cs *CommunicationService) notifyAnnouncementListeners() {
+	cs.announcementMutex.Lock()
+	listeners := cs.announcementListeners
+	cs.announcementMutex.Unlock()
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+func announcementExpired(announcement *pb.Announcement) bool {
+	return announcement.ExpiresAt != nil && !time.Now().Before(time.Unix(announcement.GetExpiresAt(), 0))
+}
+
+// GetAnnouncement returns the latest announcement that has not expired or been dismissed, or nil
+func (cs *CommunicationService) GetAnnouncement() *pb.Announcement {
+	cs.announcementMutex.Lock()
+	defer cs.announcementMutex.Unlock()
+	if cs.announcement == nil || announcementExpired(cs.announcement) {
+		return nil
+	}
+	return cs.announcement
+}
+
+// DismissAnnouncement hides the announcement everywhere it is shown
+func (cs *CommunicationService) DismissAnnouncement() {
+	cs.announcementMutex.Lock()
+	cs.announcement = nil
+	cs.announcementMutex.Unlock()
+	cs.notifyAnnouncementListeners()
+}
+
+// OnAnnouncement calls listener when an announcement arrives, expires or is dismissed. It is called on the
+// goroutine that receives the messages, so it must not block.
+func (cs *CommunicationService) OnAnnouncement(listener func()) {
+	cs.announcementMutex.Lock()
+	defer cs.announcementMutex.Unlock()
+	cs.announcementListeners = append(cs.announcementListeners, listener)
+}
@@ -50,6 +50,9 @@ func (s *ChatService) GetUserList() ([]string, error) {
 	if userListMessage == nil {
 		return nil, errors.New("invalid user list response")
 	}
+	if userListMessage.GetStatus() == pb.UserListPacket_ERROR {
+		return nil, errors.New("the server refused to send the user list")
+	}
 
 	return userListMessage.GetUsers(), nil
 }
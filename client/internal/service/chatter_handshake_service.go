@@ -1,13 +1,14 @@
 package service
 
 import (
+	"client/internal/logging"
 	"client/internal/model"
-	"client/internal/utils"
+	"client/internal/tracing"
 	pb "client/resources/proto"
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
-	"fmt"
+	"log/slog"
 	"math/big"
 )
 
@@ -23,21 +24,32 @@ func NewChatterHandshakeService(commService *CommunicationService, chatters *map
 	}
 }
 
-func (s *ChatterHandshakeService) Handshake(username string) error {
+// Handshake starts a trace that the other side's handling of the handshake continues
+func (s *ChatterHandshakeService) Handshake(username string) (err error) {
+	span := tracing.Start("", "handshake", tracing.KindInternal)
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+
 	// Request Chatter's public key from server
 	publicKeyRequest := &pb.ExchangeKeyPacket{
 		Status:     pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY,
 		ToUsername: &(*s.Chatters)[username].Username,
 	}
-	err := s.sendHandshakeMessage(publicKeyRequest)
+	logger := slog.With(logging.KeyPeer, username)
+	err = s.sendHandshakeMessage(publicKeyRequest, span.Traceparent())
 	if err != nil {
-		fmt.Println("Error sending public key request: ", err)
+		logger.Error("Error sending public key request", "error", err)
 		return err
 	}
 
 	// Receive Chatter's public key
 	keyChan := s.commService.GetKeyExchangeChannel()
 	publicKeyMessage := <-keyChan
+	if publicKeyMessage != nil && publicKeyMessage.GetReason() != "" {
+		return errors.New(publicKeyMessage.GetReason())
+	}
 	if publicKeyMessage == nil || publicKeyMessage.GetStatus() != pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER {
 		return errors.New("invalid public key response")
 	}
@@ -48,14 +60,13 @@ func (s *ChatterHandshakeService) Handshake(username string) error {
 		N: pubkeyInt,
 		E: 65537, // Commonly used public exponent
 	}
-	fmt.Printf("Setting public key (%s) for %s\n", utils.DebugPrintPublicKey(sshPubKey), username)
+	logger.Debug("Setting public key", logging.KeyKey, sshPubKey)
 	(*s.Chatters)[username].SetPublicKey(sshPubKey)
 
 	// Encrypt our username with Chatter's public key
-	fmt.Printf("Encrypting with public key (%s) for %s\n", utils.DebugPrintPublicKey(sshPubKey), username)
 	encryptedUsername, err := (*s.Chatters)[username].EncryptWithPublicKey([]byte(s.commService.GetUsername()))
 	if err != nil {
-		fmt.Println("Error encrypting public key: ", err)
+		logger.Error("Error encrypting username", "error", err)
 		return err
 	}
 
@@ -65,9 +76,9 @@ func (s *ChatterHandshakeService) Handshake(username string) error {
 		EncryptedMessage: encryptedUsername,
 		ToUsername:       &(*s.Chatters)[username].Username,
 	}
-	err = s.sendHandshakeMessage(publicKeyResponse)
+	err = s.sendHandshakeMessage(publicKeyResponse, span.Traceparent())
 	if err != nil {
-		fmt.Println("Error sending public key response: ", err)
+		logger.Error("Error sending public key response", "error", err)
 		return err
 	}
 
@@ -78,10 +89,9 @@ func (s *ChatterHandshakeService) Handshake(username string) error {
 	}
 
 	// Decrypt the AES key with our private key
-	fmt.Printf("Decrpyting with private key for this public (%s) for %s\n", utils.DebugPrintPublicKey(s.commService.GetClient().GetPubKey()), s.commService.GetUsername())
 	decryptedAESKey, err := s.commService.GetClient().DecryptMessageWithPrivateKey(messageWithSymKey.GetEncryptedMessage())
 	if err != nil {
-		fmt.Println("Error decrypting AES key: ", err)
+		logger.Error("Error decrypting AES key", "error", err)
 		return err
 	}
 	(*s.Chatters)[username].SetAES256Key(decryptedAESKey)
@@ -93,21 +103,25 @@ func (s *ChatterHandshakeService) HandleReceiveHandshake(message *pb.Message) {
 	fromUsername := message.GetFromUsername()
 	exchangeKeyMessage := message.GetExchangeKeyMessage()
 	destinationUsername := exchangeKeyMessage.GetToUsername()
+	logger := slog.With(logging.KeyPeer, fromUsername)
+	span := tracing.Start(message.GetTraceparent(), "handshake "+exchangeKeyMessage.GetStatus().String(), tracing.KindInternal)
+	defer span.End()
 
 	switch exchangeKeyMessage.GetStatus() {
 	case pb.ExchangeKeyPacket_REQ_FOR_SYM_KEY:
 		// Decrypt the exchangeKeyMessage with our private key
-		fmt.Printf("Decrpyting with private key for this public (%s) for %s\n", utils.DebugPrintPublicKey(s.commService.GetClient().GetPubKey()), s.commService.GetUsername())
 		decryptedMessage, err := s.commService.GetClient().DecryptMessageWithPrivateKey(exchangeKeyMessage.GetEncryptedMessage())
 		if err != nil {
-			fmt.Println("Error decrypting exchangeKeyMessage: ", err)
+			logger.Error("Error decrypting exchangeKeyMessage", "error", err)
+			span.RecordError(err)
 			return
 		}
 
 		username := string(decryptedMessage[:])
 
 		if username != fromUsername {
-			fmt.Println("Invalid username in request for symmetric key")
+			logger.Warn("Invalid username in request for symmetric key")
+			span.RecordError(errors.New("invalid username in request for symmetric key"))
 			response = &pb.ExchangeKeyPacket{
 				Status:     pb.ExchangeKeyPacket_ERROR,
 				ToUsername: &(*s.Chatters)[fromUsername].Username,
@@ -128,7 +142,8 @@ func (s *ChatterHandshakeService) HandleReceiveHandshake(message *pb.Message) {
 	case pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER_PASSIVE:
 		// Update the chatter with the public key
 		if message.GetSource() != pb.Message_SERVER {
-			fmt.Println("Key must be from server")
+			logger.Warn("Key must be from server")
+			span.RecordError(errors.New("key must be from server"))
 			// Send error to the chatter
 			response = &pb.ExchangeKeyPacket{
 				Status:     pb.ExchangeKeyPacket_ERROR,
@@ -140,20 +155,22 @@ func (s *ChatterHandshakeService) HandleReceiveHandshake(message *pb.Message) {
 			N: new(big.Int).SetBytes(exchangeKeyMessage.GetKey()),
 			E: 65537,
 		})
-		fmt.Printf("Setting public key (%s) for %s\n", utils.DebugPrintPublicKey((*s.Chatters)[destinationUsername].GetPubKey()), destinationUsername)
+		logger = slog.With(logging.KeyPeer, destinationUsername)
+		logger.Debug("Setting public key", logging.KeyKey, (*s.Chatters)[destinationUsername].GetPubKey())
 
 		// Generate a random AES key and encrypt it with the Chatter's public key
 		randomAESKey := make([]byte, 32)
 		_, err := rand.Read(randomAESKey)
 		if err != nil {
-			fmt.Println("Error generating random AES key: ", err)
+			logger.Error("Error generating random AES key", "error", err)
+			span.RecordError(err)
 			return
 		}
 		(*s.Chatters)[destinationUsername].SetAES256Key(randomAESKey)
-		fmt.Printf("Encrypting with public key (%s) for %s\n", utils.DebugPrintPublicKey((*s.Chatters)[destinationUsername].GetPubKey()), destinationUsername)
 		encryptedAESKey, err := (*s.Chatters)[destinationUsername].EncryptWithPublicKey(randomAESKey)
 		if err != nil {
-			fmt.Println("Error encrypting AES key: ", err)
+			logger.Error("Error encrypting AES key", "error", err)
+			span.RecordError(err)
 			return
 		}
 
@@ -166,14 +183,16 @@ func (s *ChatterHandshakeService) HandleReceiveHandshake(message *pb.Message) {
 	}
 
 	if response != nil {
-		err := s.sendHandshakeMessage(response)
+		err := s.sendHandshakeMessage(response, span.Traceparent())
 		if err != nil {
-			fmt.Println("Error sending handshake exchangeKeyMessage: ", err)
+			logger.Error("Error sending handshake exchangeKeyMessage", "error", err)
+			span.RecordError(err)
 		}
 	}
 }
 
-func (s *ChatterHandshakeService) sendHandshakeMessage(message *pb.ExchangeKeyPacket) error {
+// sendHandshakeMessage sends the packet in the handshake's trace, an empty traceparent starts a new one
+func (s *ChatterHandshakeService) sendHandshakeMessage(message *pb.ExchangeKeyPacket, traceparent string) error {
 	fromUsername := s.commService.GetUsername()
 	handShakeMessage := &pb.Message{
 		Source:       pb.Message_CLIENT,
@@ -182,5 +201,8 @@ func (s *ChatterHandshakeService) sendHandshakeMessage(message *pb.ExchangeKeyPa
 			ExchangeKeyMessage: message,
 		},
 	}
+	if traceparent != "" {
+		handShakeMessage.Traceparent = &traceparent
+	}
 	return s.commService.SendMessage(handShakeMessage)
 }
@@ -2,9 +2,10 @@ package service
 
 import (
 	"client/internal/model"
+	"client/internal/tracing"
 	pb "client/resources/proto"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
 )
 
@@ -17,7 +18,17 @@ type CommunicationService struct {
 	userListChan   chan *pb.UserListPacket
 	keyChan        chan *pb.ExchangeKeyPacket
 	passiveKeyChan chan *pb.Message
+	keyRotateChan  chan *pb.KeyRotationPacket
+	keyChangedChan chan *pb.KeyRotationPacket
+	recoveryChan   chan *pb.RecoveryPacket
+	keyRevokedChan chan *pb.RecoveryPacket
+	noticeChan     chan *pb.ServerNoticePacket
 	errorChan      chan error
+	// The latest announcement, and the IDs of every announcement received so far
+	announcement          *pb.Announcement
+	seenAnnouncements     map[string]bool
+	announcementListeners []func()
+	announcementMutex     sync.Mutex
 	// Mutex to protect concurrent access
 	mu sync.Mutex
 	//
@@ -33,7 +44,14 @@ func NewCommunicationService(client *model.Client) *CommunicationService {
 		userListChan:   make(chan *pb.UserListPacket),
 		keyChan:        make(chan *pb.ExchangeKeyPacket),
 		passiveKeyChan: make(chan *pb.Message),
+		keyRotateChan:  make(chan *pb.KeyRotationPacket),
+		keyChangedChan: make(chan *pb.KeyRotationPacket),
+		recoveryChan:   make(chan *pb.RecoveryPacket),
+		keyRevokedChan: make(chan *pb.RecoveryPacket),
+		noticeChan:     make(chan *pb.ServerNoticePacket),
 		errorChan:      make(chan error),
+		//
+		seenAnnouncements: make(map[string]bool),
 	}
 
 	return cs
@@ -51,48 +69,94 @@ func (cs *CommunicationService) handleMessages() {
 	for {
 		message, err := cs.client.GetMessage()
 		if err != nil {
-			log.Printf("Error receiving message: %v", err)
+			slog.Error("Error receiving message", "error", err)
 			cs.errorChan <- fmt.Errorf("communication error: %v", err)
 			if err.Error() == "connection closed by server" {
 				// Handle disconnection
-				log.Println("Disconnected from server")
+				slog.Info("Disconnected from server")
 				// You might want to implement a reconnection mechanism here
 				return
 			}
 			return
 		}
 
-		switch msg := message.Packet.(type) {
-		case *pb.Message_LoginMessage:
-			cs.loginChan <- msg.LoginMessage
-		case *pb.Message_RegisterMessage:
-			cs.registerChan <- msg.RegisterMessage
-		case *pb.Message_ChatMessage:
-			cs.chatChan <- message
-		case *pb.Message_UserListMessage:
-			cs.userListChan <- msg.UserListMessage
-		case *pb.Message_ExchangeKeyMessage:
-			switch message.GetPacket().(*pb.Message_ExchangeKeyMessage).ExchangeKeyMessage.GetStatus() {
-			case pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY,
-				pb.ExchangeKeyPacket_REPLY_WITH_SYM_KEY,
-				pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER,
-				pb.ExchangeKeyPacket_ERROR:
-				cs.keyChan <- msg.ExchangeKeyMessage
-			case pb.ExchangeKeyPacket_REQ_FOR_SYM_KEY,
-				pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER_PASSIVE:
-				cs.passiveKeyChan <- message
-			}
+		cs.dispatch(message)
+	}
+}
+
+// dispatch passes the message to whoever waits for its packet, in a span that continues the sender's trace.
+// Messages passed on whole carry the span's traceparent, so their handling continues the trace too.
+func (cs *CommunicationService) dispatch(message *pb.Message) {
+	span := tracing.Start(message.GetTraceparent(), "receive "+model.PacketName(message), tracing.KindServer)
+	defer span.End()
+	if exchangeKeyMessage := message.GetExchangeKeyMessage(); exchangeKeyMessage != nil {
+		span.SetAttribute("chat.exchange_key.status", exchangeKeyMessage.GetStatus().String())
+		if exchangeKeyMessage.GetStatus() == pb.ExchangeKeyPacket_ERROR {
+			span.RecordError(fmt.Errorf("handshake error: %s", exchangeKeyMessage.GetReason()))
+		}
+	}
+	if traceparent := span.Traceparent(); traceparent != "" {
+		message.Traceparent = &traceparent
+	}
 
+	switch msg := message.Packet.(type) {
+	case *pb.Message_LoginMessage:
+		cs.loginChan <- msg.LoginMessage
+	case *pb.Message_RegisterMessage:
+		cs.registerChan <- msg.RegisterMessage
+	case *pb.Message_ChatMessage:
+		cs.chatChan <- message
+	case *pb.Message_UserListMessage:
+		cs.userListChan <- msg.UserListMessage
+	case *pb.Message_ExchangeKeyMessage:
+		switch message.GetPacket().(*pb.Message_ExchangeKeyMessage).ExchangeKeyMessage.GetStatus() {
+		case pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY,
+			pb.ExchangeKeyPacket_REPLY_WITH_SYM_KEY,
+			pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER,
+			pb.ExchangeKeyPacket_ERROR:
+			cs.keyChan <- msg.ExchangeKeyMessage
+		case pb.ExchangeKeyPacket_REQ_FOR_SYM_KEY,
+			pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER_PASSIVE:
+			cs.passiveKeyChan <- message
+		}
+	case *pb.Message_KeyRotationMessage:
+		switch msg.KeyRotationMessage.GetStatus() {
+		case pb.KeyRotationPacket_KEY_CHANGED:
+			cs.keyChangedChan <- msg.KeyRotationMessage
+		default:
+			cs.keyRotateChan <- msg.KeyRotationMessage
+		}
+	case *pb.Message_RecoveryMessage:
+		switch msg.RecoveryMessage.GetStatus() {
+		case pb.RecoveryPacket_KEY_REVOKED:
+			cs.keyRevokedChan <- msg.RecoveryMessage
 		default:
-			log.Printf("Received unknown message type: %T", msg)
+			cs.recoveryChan <- msg.RecoveryMessage
+		}
+	case *pb.Message_ServerNoticeMessage:
+		if msg.ServerNoticeMessage.GetType() == pb.ServerNoticePacket_ANNOUNCEMENT {
+			cs.receiveAnnouncement(msg.ServerNoticeMessage)
+			break
 		}
+		cs.noticeChan <- msg.ServerNoticeMessage
+
+	default:
+		slog.Warn("Received unknown message type", "type", fmt.Sprintf("%T", msg))
 	}
 }
 
+// SendMessage sends the message in a new span, a child of the span in its traceparent if it has one
 func (cs *CommunicationService) SendMessage(message *pb.Message) error {
+	span := tracing.Start(message.GetTraceparent(), "send "+model.PacketName(message), tracing.KindClient)
+	defer span.End()
+	if traceparent := span.Traceparent(); traceparent != "" {
+		message.Traceparent = &traceparent
+	}
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
-	return cs.client.SendMessage(message)
+	err := cs.client.SendMessage(message)
+	span.RecordError(err)
+	return err
 }
 
 func (cs *CommunicationService) GetLoginChannel() <-chan *pb.LoginPacket {
@@ -119,6 +183,26 @@ func (cs *CommunicationService) GetPassiveKeyExchangeChannel() <-chan *pb.Messag
 	return cs.passiveKeyChan
 }
 
+func (cs *CommunicationService) GetKeyRotationChannel() <-chan *pb.KeyRotationPacket {
+	return cs.keyRotateChan
+}
+
+func (cs *CommunicationService) GetKeyChangedChannel() <-chan *pb.KeyRotationPacket {
+	return cs.keyChangedChan
+}
+
+func (cs *CommunicationService) GetRecoveryChannel() <-chan *pb.RecoveryPacket {
+	return cs.recoveryChan
+}
+
+func (cs *CommunicationService) GetKeyRevokedChannel() <-chan *pb.RecoveryPacket {
+	return cs.keyRevokedChan
+}
+
+func (cs *CommunicationService) GetServerNoticeChannel() <-chan *pb.ServerNoticePacket {
+	return cs.noticeChan
+}
+
 func (cs *CommunicationService) GetClient() *model.Client {
 	return cs.client
 }
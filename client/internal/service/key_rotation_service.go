@@ -0,0 +1,70 @@
+package service
+
+import (
+	"client/internal/model"
+	"client/internal/utils"
+	pb "client/resources/proto"
+	"errors"
+	"time"
+)
+
+type KeyRotationService struct {
+	commService *CommunicationService
+}
+
+func NewKeyRotationService(commService *CommunicationService) *KeyRotationService {
+	return &KeyRotationService{
+		commService: commService,
+	}
+}
+
+func (ks *KeyRotationService) RotateKey(newPrivateKeyPath string) error {
+	newPrivateKey, err := model.LoadPrivateKey(newPrivateKeyPath)
+	if err != nil {
+		return err
+	}
+	newPublicKey := newPrivateKey.PublicKey.N.Bytes()
+
+	// Sign the new public key with the current private key
+	username := ks.commService.GetUsername()
+	signature, err := ks.commService.GetClient().SignWithPrivateKey(utils.KeyRotationDigest(username, newPublicKey))
+	if err != nil {
+		return err
+	}
+
+	message := &pb.Message{
+		Source:       pb.Message_CLIENT,
+		FromUsername: &username,
+		Packet: &pb.Message_KeyRotationMessage{
+			KeyRotationMessage: &pb.KeyRotationPacket{
+				Status:       pb.KeyRotationPacket_REQUEST_TO_ROTATE,
+				NewPublicKey: newPublicKey,
+				Signature:    signature,
+			},
+		},
+	}
+	if err := ks.commService.SendMessage(message); err != nil {
+		return err
+	}
+
+	// Wait for response on the key rotation channel
+	keyRotationMessage := <-ks.commService.GetKeyRotationChannel()
+	if keyRotationMessage != nil && keyRotationMessage.GetReason() != "" {
+		return errors.New(keyRotationMessage.GetReason())
+	}
+	if keyRotationMessage == nil || keyRotationMessage.GetStatus() != pb.KeyRotationPacket_ROTATE_SUCCESS {
+		return errors.New("key rotation failed")
+	}
+
+	// From now on the new private key is used
+	if err := ks.commService.SetPrivateKeyPath(newPrivateKeyPath); err != nil {
+		return err
+	}
+	client := ks.commService.GetClient()
+	client.KeyRenewalRequired = false
+	client.KeyExpiresAt = time.Time{}
+	if maxKeyAge := client.KeyPolicy.GetMaxKeyAgeSeconds(); maxKeyAge > 0 {
+		client.KeyExpiresAt = time.Now().Add(time.Duration(maxKeyAge+client.KeyPolicy.GetGracePeriodSeconds()) * time.Second)
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package service
 import (
 	pb "client/resources/proto"
 	"errors"
+	"fmt"
+	"time"
 )
 
 type LoginService struct {
@@ -34,6 +36,9 @@ func (ls *LoginService) Login(username string) error {
 	loginChan := ls.commService.GetLoginChannel()
 	loginMessage := <-loginChan
 
+	if err := refusal(loginMessage); err != nil {
+		return err
+	}
 	if loginMessage == nil || loginMessage.GetStatus() != pb.LoginPacket_ENCRYPTED_TOKEN {
 		return errors.New("invalid login")
 	}
@@ -61,9 +66,45 @@ func (ls *LoginService) Login(username string) error {
 	// Wait for final login response
 	loginMessage = <-loginChan
 
+	// Whether the account is locked is only told once the token proved the key is ours
+	if err := refusal(loginMessage); err != nil {
+		return err
+	}
 	if loginMessage == nil || loginMessage.GetStatus() != pb.LoginPacket_LOGIN_SUCCESS {
 		return errors.New("invalid login")
 	}
 	ls.commService.SetClientUsername(username)
+
+	// Keep the key status so the UI can prompt for a key renewal
+	client := ls.commService.GetClient()
+	client.KeyPolicy = loginMessage.GetKeyPolicy()
+	client.KeyRenewalRequired = loginMessage.GetKeyRenewalRequired()
+	client.KeyExpiresAt = time.Time{}
+	if loginMessage.KeyExpiresAt != nil {
+		client.KeyExpiresAt = time.Unix(loginMessage.GetKeyExpiresAt(), 0)
+	}
+	return nil
+}
+
+// refusal returns why the server refused the login, or nil when the reply does not refuse it
+func refusal(loginMessage *pb.LoginPacket) error {
+	if loginMessage != nil && loginMessage.GetStatus() == pb.LoginPacket_KEY_EXPIRED {
+		if loginMessage.GetReason() != "" {
+			// The key did not expire, an administrator asked for a new one
+			return errors.New(loginMessage.GetReason())
+		}
+		expiredAt := time.Unix(loginMessage.GetKeyExpiresAt(), 0).Format(time.DateOnly)
+		return fmt.Errorf("your key expired on %s, recover your account with a recovery code and a new key", expiredAt)
+	}
+	if loginMessage != nil && loginMessage.GetStatus() == pb.LoginPacket_SUSPENDED {
+		if loginMessage.GetSuspendedUntil() == 0 {
+			return fmt.Errorf("this account has been banned: %s", loginMessage.GetReason())
+		}
+		suspendedUntil := time.Unix(loginMessage.GetSuspendedUntil(), 0).Format(time.DateTime)
+		return fmt.Errorf("this account is suspended until %s: %s", suspendedUntil, loginMessage.GetReason())
+	}
+	if loginMessage != nil && loginMessage.GetReason() != "" {
+		return errors.New(loginMessage.GetReason())
+	}
 	return nil
 }
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"client/internal/model"
+	"client/internal/utils"
+	pb "client/resources/proto"
+	"errors"
+)
+
+type RecoveryService struct {
+	commService *CommunicationService
+}
+
+func NewRecoveryService(commService *CommunicationService) *RecoveryService {
+	return &RecoveryService{
+		commService: commService,
+	}
+}
+
+func (rs *RecoveryService) Recover(username string, recoveryCode string, newPrivateKeyPath string) error {
+	newPrivateKey, err := model.LoadPrivateKey(newPrivateKeyPath)
+	if err != nil {
+		return err
+	}
+
+	message := &pb.Message{
+		Source:       pb.Message_CLIENT,
+		FromUsername: &username,
+		Packet: &pb.Message_RecoveryMessage{
+			RecoveryMessage: &pb.RecoveryPacket{
+				Status:       pb.RecoveryPacket_REQUEST_TO_RECOVER,
+				RecoveryCode: utils.NormalizeRecoveryCode(recoveryCode),
+				NewPublicKey: newPrivateKey.PublicKey.N.Bytes(),
+			},
+		},
+	}
+	if err := rs.commService.SendMessage(message); err != nil {
+		return err
+	}
+
+	// Wait for response on the recovery channel
+	recoveryMessage := <-rs.commService.GetRecoveryChannel()
+	if recoveryMessage != nil && recoveryMessage.GetReason() != "" {
+		return errors.New(recoveryMessage.GetReason())
+	}
+	if recoveryMessage == nil || recoveryMessage.GetStatus() != pb.RecoveryPacket_RECOVERY_SUCCESS {
+		return errors.New("account recovery failed")
+	}
+
+	return rs.commService.SetPrivateKeyPath(newPrivateKeyPath)
+}
@@ -1,10 +1,13 @@
 package service
 
 import (
+	"client/internal/utils"
 	pb "client/resources/proto"
 	"errors"
 )
 
+const recoveryCodesCount = 8
+
 type RegisterService struct {
 	commService *CommunicationService
 }
@@ -15,15 +18,27 @@ func NewRegisterService(commService *CommunicationService) *RegisterService {
 	}
 }
 
-func (rs *RegisterService) Register(username string) error {
+func (rs *RegisterService) Register(username string) ([]string, error) {
 	pubKey := rs.commService.GetClient().GetPubKey()
 	if pubKey == nil {
-		return errors.New("public key not found")
+		return nil, errors.New("public key not found")
+	}
+	// Generate the offline recovery codes, only their verifiers are sent to the server
+	recoveryCodes, err := utils.GenerateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		return nil, err
+	}
+	recoveryVerifiers := make([][]byte, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		recoveryVerifiers = append(recoveryVerifiers, utils.RecoveryCodeVerifier(utils.NormalizeRecoveryCode(code)))
 	}
 	// Create a register packet
+	keyAlgorithm := "RSA"
 	registerState := &pb.RegisterPacket{
-		Status:    pb.RegisterPacket_REQUEST_TO_REGISTER,
-		PublicKey: pubKey.N.Bytes(),
+		Status:                pb.RegisterPacket_REQUEST_TO_REGISTER,
+		PublicKey:             pubKey.N.Bytes(),
+		RecoveryCodeVerifiers: recoveryVerifiers,
+		KeyAlgorithm:          &keyAlgorithm,
 	}
 	message := &pb.Message{
 		Source:       pb.Message_CLIENT,
@@ -32,15 +47,18 @@ func (rs *RegisterService) Register(username string) error {
 	}
 
 	if err := rs.commService.SendMessage(message); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Wait for response on the register channel
 	registerChan := rs.commService.GetRegisterChannel()
 	registerMessage := <-registerChan
 
+	if registerMessage != nil && registerMessage.GetReason() != "" {
+		return nil, errors.New(registerMessage.GetReason())
+	}
 	if registerMessage == nil || registerMessage.GetStatus() != pb.RegisterPacket_REGISTER_SUCCESS {
-		return errors.New("invalid register message")
+		return nil, errors.New("invalid register message")
 	}
-	return nil
+	return recoveryCodes, nil
 }
@@ -0,0 +1,158 @@
+package tracing
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Exporter targets besides a file path
+const (
+	ExportOff    = "off"
+	ExportStdout = "stdout"
+)
+
+// Open returns the tracer of the export target: nil for "off", standard output for "stdout",
+// and otherwise a file the spans are appended to
+func Open(service string, target string) (*Tracer, error) {
+	switch target {
+	case "", ExportOff:
+		return nil, nil
+	case ExportStdout:
+		return NewTracer(service, os.Stdout), nil
+	}
+	if dir := filepath.Dir(target); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("error creating trace export directory: %v", err)
+		}
+	}
+	file, err := os.OpenFile(target, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening trace export file: %v", err)
+	}
+	tracer := NewTracer(service, file)
+	tracer.closer = file
+	return tracer, nil
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault sets the tracer Start uses, nil turns the export off
+func SetDefault(tracer *Tracer) {
+	defaultTracer.Store(tracer)
+}
+
+// Start begins a span with the default tracer
+func Start(traceparent string, name string, kind Kind) *Span {
+	return defaultTracer.Load().Start(traceparent, name, kind)
+}
+
+// FromEnv opens the tracer CLIENT_TRACE_EXPORT asks for: "stdout", a file path, or "off" by default
+func FromEnv() (*Tracer, error) {
+	tracer, err := Open("chat-client", os.Getenv("CLIENT_TRACE_EXPORT"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CLIENT_TRACE_EXPORT: %v", err)
+	}
+	return tracer, nil
+}
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest, with only the fields the spans use
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              Kind            `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	// 64 bit integers are strings in OTLP/JSON
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+)
+
+func otlpAttributeOf(key string, value any) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int64:
+		formatted := strconv.FormatInt(v, 10)
+		attribute.Value.IntValue = &formatted
+	case bool:
+		attribute.Value.BoolValue = &v
+	default:
+		formatted := fmt.Sprint(v)
+		attribute.Value.StringValue = &formatted
+	}
+	return attribute
+}
+
+func (t *Tracer) export(span *Span, end time.Time) {
+	span.mutex.Lock()
+	encoded := otlpSpan{
+		TraceID:           span.context.TraceID.String(),
+		SpanID:            span.context.SpanID.String(),
+		Name:              span.name,
+		Kind:              span.kind,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Status:            otlpStatus{Code: span.status, Message: span.message},
+	}
+	for _, attribute := range span.attributes {
+		encoded.Attributes = append(encoded.Attributes, otlpAttributeOf(attribute.key, attribute.value))
+	}
+	span.mutex.Unlock()
+	if span.parent != (SpanID{}) {
+		encoded.ParentSpanID = span.parent.String()
+	}
+
+	line, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{otlpAttributeOf("service.name", t.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: t.service}, Spans: []otlpSpan{encoded}}},
+	}}})
+	if err != nil {
+		slog.Warn("Error encoding span", "span", span.name, "error", err)
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// One write per span, so spans of concurrent connections don't interleave
+	if _, err = t.writer.Write(append(line, '\n')); err != nil {
+		slog.Warn("Error exporting span", "span", span.name, "error", err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package tracing follows a message through the clients and the server with spans, like the server's. The spans are
+// propagated in the traceparent field of pb.Message in the W3C trace context format, and written as OTLP/JSON lines,
+// the format of the OpenTelemetry collector's file exporter, so they can be read without running a collector.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// Kind is the OTLP span kind
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2 // Handling a message received from the other side
+	KindClient   Kind = 3 // Sending a message and expecting an answer
+	KindProducer Kind = 4
+	KindConsumer Kind = 5
+)
+
+// OTLP status code of a failed span, spans that did not fail are left unset
+const statusError = 2
+
+// SpanContext identifies a span across processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Traceparent formats the context as a W3C traceparent header, empty when the context is not valid
+func (c SpanContext) Traceparent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	return "00-" + c.TraceID.String() + "-" + c.SpanID.String() + "-01"
+}
+
+// ParseTraceparent reads a W3C traceparent header, like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	var context SpanContext
+	parts := strings.Split(traceparent, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[3]) != 2 {
+		return context, fmt.Errorf("malformed traceparent")
+	}
+	// Later versions may add fields, but version 00 has exactly four
+	if parts[0] == "00" && len(parts) != 4 {
+		return context, fmt.Errorf("malformed traceparent")
+	}
+	if err := decodeID(context.TraceID[:], parts[1]); err != nil {
+		return context, fmt.Errorf("malformed trace ID: %v", err)
+	}
+	if err := decodeID(context.SpanID[:], parts[2]); err != nil {
+		return context, fmt.Errorf("malformed span ID: %v", err)
+	}
+	if !context.IsValid() {
+		return SpanContext{}, fmt.Errorf("traceparent has an all zero ID")
+	}
+	return context, nil
+}
+
+func decodeID(id []byte, value string) error {
+	if len(value) != hex.EncodedLen(len(id)) || strings.ToLower(value) != value {
+		return fmt.Errorf("expected %d lowercase hex digits", hex.EncodedLen(len(id)))
+	}
+	_, err := hex.Decode(id, []byte(value))
+	return err
+}
+
+type attribute struct {
+	key   string
+	value any // string, int64 or bool
+}
+
+// Span is one step of a message's way, like sending it or handling it on the server.
+// The spans of a nil Tracer are not exported, but still pass their parent's context on.
+type Span struct {
+	tracer  *Tracer
+	name    string
+	kind    Kind
+	context SpanContext
+	parent  SpanID
+	start   time.Time
+
+	mutex      sync.Mutex
+	ended      bool
+	attributes []attribute
+	status     int
+	message    string
+}
+
+// Context is the span's own context, or the parent's context when the span is not exported
+func (s *Span) Context() SpanContext {
+	return s.context
+}
+
+// Traceparent is what to put in the traceparent field of the messages sent within the span
+func (s *Span) Traceparent() string {
+	return s.context.Traceparent()
+}
+
+// SetAttribute adds a string, integer or boolean attribute, other values are formatted as strings.
+// Never add usernames, keys or message contents.
+func (s *Span) SetAttribute(key string, value any) {
+	if s.tracer == nil {
+		return
+	}
+	switch v := value.(type) {
+	case string, int64, bool:
+	case int:
+		value = int64(v)
+	case uint64:
+		value = int64(v)
+	case fmt.Stringer:
+		value = v.String()
+	default:
+		value = fmt.Sprint(v)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, attribute{key: key, value: value})
+}
+
+// RecordError marks the span as failed, a nil error changes nothing
+func (s *Span) RecordError(err error) {
+	if err == nil || s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = statusError
+	s.message = err.Error()
+}
+
+// End exports the span, only the first call does anything
+func (s *Span) End() {
+	if s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.mutex.Unlock()
+	s.tracer.export(s, time.Now())
+}
+
+// Tracer creates spans and writes them to its exporter when they end. A nil Tracer exports nothing.
+type Tracer struct {
+	service string
+	mutex   sync.Mutex
+	writer  io.Writer
+	closer  io.Closer
+}
+
+// NewTracer writes the spans of the service to w, one OTLP/JSON line per span
+func NewTracer(service string, w io.Writer) *Tracer {
+	return &Tracer{service: service, writer: w}
+}
+
+// Start begins a span, as a child of the traceparent when it is valid and as a new trace otherwise.
+// A malformed traceparent also starts a new trace, a client can't break the server's tracing.
+func (t *Tracer) Start(traceparent string, name string, kind Kind) *Span {
+	parent, err := ParseTraceparent(traceparent)
+	if err != nil {
+		parent = SpanContext{}
+	}
+	if t == nil {
+		return &Span{name: name, kind: kind, context: parent}
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now(), context: parent}
+	if !parent.IsValid() {
+		randomID(span.context.TraceID[:])
+	} else {
+		span.parent = parent.SpanID
+	}
+	randomID(span.context.SpanID[:])
+	return span
+}
+
+func randomID(id []byte) {
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("error generating a trace ID: %v", err))
+	}
+}
+
+// Close closes the exporter
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	if t.closer == nil {
+		return nil
+	}
+	return t.closer.Close()
+}
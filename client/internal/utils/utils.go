@@ -1,10 +1,48 @@
 package utils
 
 import (
-	"crypto/rsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
 	"fmt"
+	"strings"
 )
 
-func DebugPrintPublicKey(key *rsa.PublicKey) string {
-	return fmt.Sprintf("N: %x... (len: %d bits), E: %d", key.N.Bytes()[:20], key.N.BitLen(), key.E)
+const recoveryCodeBytes = 10
+
+// KeyRotationDigest is the digest signed with the current private key to prove ownership when rotating keys
+func KeyRotationDigest(username string, newPubKey []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte("key-rotation:" + username + ":"))
+	hasher.Write(newPubKey)
+	return hasher.Sum(nil)
+}
+
+// GenerateRecoveryCodes creates random one-time codes the user can keep offline to recover a lost private key
+func GenerateRecoveryCodes(count int) ([]string, error) {
+	codes := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		randomBytes := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(randomBytes); err != nil {
+			return nil, fmt.Errorf("error generating recovery code: %v", err)
+		}
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+	}
+	return codes, nil
+}
+
+// NormalizeRecoveryCode removes the formatting of a recovery code as typed by the user
+func NormalizeRecoveryCode(code string) []byte {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return []byte(code)
+}
+
+// RecoveryCodeVerifier is what the server stores instead of the recovery code itself
+func RecoveryCodeVerifier(recoveryCode []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte("recovery-code:"))
+	hasher.Write(recoveryCode)
+	return hasher.Sum(nil)
 }
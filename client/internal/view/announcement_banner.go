@@ -0,0 +1,51 @@
+package view
+
+import (
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// announcementSource is the part of a view model the banner needs
+type announcementSource interface {
+	GetAnnouncement() string
+	DismissAnnouncement()
+	SetOnAnnouncement(callback func())
+}
+
+// announcementBanner shows the server's latest announcement until it expires or is dismissed,
+// it is hidden when there is none
+type announcementBanner struct {
+	source  announcementSource
+	text    *widget.Label
+	content *fyne.Container
+}
+
+func newAnnouncementBanner(source announcementSource) *announcementBanner {
+	b := &announcementBanner{source: source}
+	b.text = widget.NewLabel("")
+	b.text.Importance = widget.HighImportance
+	b.text.Wrapping = fyne.TextWrapWord
+	dismiss := widget.NewButtonWithIcon("", theme.CancelIcon(), source.DismissAnnouncement)
+	dismiss.Importance = widget.LowImportance
+	b.content = container.NewBorder(nil, nil, widget.NewIcon(theme.InfoIcon()), dismiss, b.text)
+	source.SetOnAnnouncement(b.Update)
+	b.Update()
+	return b
+}
+
+// Update shows the current announcement
+func (b *announcementBanner) Update() {
+	text := b.source.GetAnnouncement()
+	b.text.SetText(text)
+	if text == "" {
+		b.content.Hide()
+		return
+	}
+	b.content.Show()
+}
+
+func (b *announcementBanner) Object() fyne.CanvasObject {
+	return b.content
+}
@@ -90,6 +90,10 @@ func (v *AuthView) Run() {
 		go v.attemptRegister()
 	})
 
+	recoverButton := widget.NewButton("Recover Account", func() {
+		v.showRecoverDialog()
+	})
+
 	v.status = canvas.NewText("", color.NRGBA{R: 255, G: 0, B: 0, A: 255})
 
 	content := container.NewVBox(
@@ -107,6 +111,7 @@ func (v *AuthView) Run() {
 		),
 		loginButton,
 		registerButton,
+		recoverButton,
 		v.status,
 	)
 
@@ -135,12 +140,37 @@ func (v *AuthView) attemptRegister() {
 	}
 	username := v.username.Text
 	v.viewModel.Username = username
-	err := v.viewModel.Register()
+	recoveryCodesPath, err := v.viewModel.Register()
 	if err != nil {
 		v.statusChan <- "Registration failed: " + err.Error()
 		return
 	}
-	v.statusChan <- "Registration successful!"
+	v.statusChan <- "Registration successful! Recovery codes saved to " + recoveryCodesPath
+}
+
+func (v *AuthView) showRecoverDialog() {
+	recoveryCode := widget.NewEntry()
+	recoveryCode.SetPlaceHolder("XXXX-XXXX-XXXX-XXXX")
+	dialog.ShowForm("Recover Account", "Recover", "Cancel",
+		[]*widget.FormItem{widget.NewFormItem("Recovery code", recoveryCode)},
+		func(confirmed bool) {
+			if confirmed {
+				go v.attemptRecover(recoveryCode.Text)
+			}
+		}, v.window)
+}
+
+// attemptRecover binds the selected private key to the account instead of the lost one
+func (v *AuthView) attemptRecover(recoveryCode string) {
+	if !v.validateInputs() {
+		return
+	}
+	v.viewModel.SetUsername(v.username.Text)
+	if err := v.viewModel.Recover(recoveryCode); err != nil {
+		v.statusChan <- "Recovery failed: " + err.Error()
+		return
+	}
+	v.statusChan <- "Recovery successful! The previous key was revoked, you can now login"
 }
 
 func (v *AuthView) validateInputs() bool {
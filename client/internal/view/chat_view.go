@@ -16,6 +16,7 @@ type ChatView struct {
 	messages  *widget.List
 	input     *widget.Entry
 	header    *widget.Label
+	banner    *announcementBanner
 	//
 	window        fyne.Window
 	isWindowShown bool
@@ -44,8 +45,11 @@ func (v *ChatView) Run() {
 	v.header = widget.NewLabel("Chat with: ")
 	v.header.TextStyle = fyne.TextStyle{Bold: true}
 
+	v.banner = newAnnouncementBanner(v.viewModel)
+
 	// Header
 	header := container.NewVBox(
+		v.banner.Object(),
 		container.NewHBox(
 			logo, layout.NewSpacer(),
 			appName, layout.NewSpacer(),
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
 )
@@ -15,7 +16,9 @@ type UserListView struct {
 	window    fyne.Window
 	userList  *widget.List
 	username  *widget.Label
+	keyNotice *widget.Label
 	status    *widget.Label
+	banner    *announcementBanner
 }
 
 func NewUserListView(vm *viewmodel.UserListViewModel, app fyne.App) *UserListView {
@@ -36,7 +39,24 @@ func (v *UserListView) Run() {
 		v.GetUsers()
 	})
 
-	header := container.NewBorder(nil, nil, nil, refreshButton,
+	rotateKeyDialog := dialog.NewFileOpen(
+		func(reader fyne.URIReadCloser, err error) {
+			if err != nil || reader == nil {
+				return
+			}
+			go v.rotateKey(reader.URI().Path())
+		}, v.window)
+	rotateKeyButton := widget.NewButtonWithIcon("", theme.AccountIcon(), func() {
+		rotateKeyDialog.Show()
+	})
+
+	v.keyNotice = widget.NewLabel("")
+	v.keyNotice.Importance = widget.WarningImportance
+	v.keyNotice.Wrapping = fyne.TextWrapWord
+
+	v.banner = newAnnouncementBanner(v.viewModel)
+
+	header := container.NewBorder(v.banner.Object(), v.keyNotice, nil, container.NewHBox(rotateKeyButton, refreshButton),
 		container.NewVBox(
 			widget.NewLabel("CryptoChat"),
 			v.username,
@@ -75,6 +95,11 @@ func (v *UserListView) Run() {
 func (v *UserListView) Update() {
 	v.userList.Refresh()
 	v.username.SetText(fmt.Sprintf("Logged in as: %s", v.viewModel.GetCurrentUsername()))
+	v.keyNotice.SetText(v.viewModel.GetKeyNotice())
+	if notice := v.viewModel.GetServerNotice(); notice != "" {
+		v.status.SetText(notice)
+		return
+	}
 	v.status.SetText(fmt.Sprintf("%d users online", len(v.viewModel.Users)))
 }
 
@@ -94,6 +119,16 @@ func (v *UserListView) Hide() {
 	v.window.Close()
 }
 
+func (v *UserListView) rotateKey(newPrivateKeyPath string) {
+	v.status.SetText("Rotating key...")
+	if err := v.viewModel.RotateKey(newPrivateKeyPath); err != nil {
+		v.status.SetText(fmt.Sprintf("Key rotation failed: %s", err.Error()))
+		return
+	}
+	v.keyNotice.SetText(v.viewModel.GetKeyNotice())
+	v.status.SetText("Key rotated successfully")
+}
+
 func (v *UserListView) onUserSelected(selectedUser string) {
 	v.status.SetText(fmt.Sprintf("Connecting to %s...", selectedUser))
 	onSelect, err := v.viewModel.SelectedUser(selectedUser)
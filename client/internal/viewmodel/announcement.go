@@ -0,0 +1,15 @@
+package viewmodel
+
+import (
+	pb "client/resources/proto"
+	"fmt"
+	"time"
+)
+
+// formatAnnouncement is the banner text of an announcement, or an empty string when there is none
+func formatAnnouncement(announcement *pb.Announcement) string {
+	if announcement == nil {
+		return ""
+	}
+	return fmt.Sprintf("Announcement (%s): %s", time.Unix(announcement.GetSentAt(), 0).Format(time.DateTime), announcement.GetText())
+}
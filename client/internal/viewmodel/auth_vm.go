@@ -1,28 +1,38 @@
 package viewmodel
 
 import (
+	"client/internal/model"
 	"client/internal/service"
 	"fmt"
 	"os"
+	"strings"
 )
 
 type AuthViewModel struct {
 	loginService    *service.LoginService
 	registerService *service.RegisterService
+	recoveryService *service.RecoveryService
 	commService     *service.CommunicationService
 	Username        string
 	onLogin         *func()
 	//
 	PrivateKeyPath string
 	ServerAddress  string
+	TLS            model.TLSSettings
 }
 
 func NewAuthViewModel(commService *service.CommunicationService) *AuthViewModel {
 	return &AuthViewModel{
 		loginService:    service.NewLoginService(commService),
 		registerService: service.NewRegisterService(commService),
+		recoveryService: service.NewRecoveryService(commService),
 		commService:     commService,
 		ServerAddress:   os.Getenv("SERVER_ADDRESS"),
+		TLS: model.TLSSettings{
+			ServerFingerprint: os.Getenv("SERVER_CERT_FINGERPRINT"),
+			ClientCertFile:    os.Getenv("CLIENT_TLS_CERT"),
+			ClientKeyFile:     os.Getenv("CLIENT_TLS_KEY"),
+		},
 	}
 }
 
@@ -59,28 +69,51 @@ func (vm *AuthViewModel) Login() (onLogin *func(), err error) {
 	return vm.onLogin, nil
 }
 
-func (vm *AuthViewModel) Register() (err error) {
+func (vm *AuthViewModel) Register() (recoveryCodesPath string, err error) {
 	if !vm.commService.GetClient().IsConnected() {
 		if err := vm.connectToServer(); err != nil {
-			return nil
+			return "", nil
 		}
 	}
 
 	if vm.Username == "" {
-		return fmt.Errorf("username cannot be empty")
+		return "", fmt.Errorf("username cannot be empty")
 	}
-	if err := vm.registerService.Register(vm.Username); err != nil {
-		return err
+	recoveryCodes, err := vm.registerService.Register(vm.Username)
+	if err != nil {
+		return "", err
 	}
 	vm.commService.GetClient().Username = vm.Username
 	if err = vm.commService.SetPrivateKeyPath(vm.PrivateKeyPath); err != nil {
-		return err
+		return "", err
+	}
+	// Keep the recovery codes next to the private key, the user should move them offline
+	recoveryCodesPath = vm.PrivateKeyPath + ".recovery"
+	if err = os.WriteFile(recoveryCodesPath, []byte(strings.Join(recoveryCodes, "\n")+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("error saving recovery codes: %v", err)
+	}
+	return recoveryCodesPath, nil
+}
+
+// Recover binds the currently selected private key to the account, using one of the recovery codes
+func (vm *AuthViewModel) Recover(recoveryCode string) error {
+	if !vm.commService.GetClient().IsConnected() {
+		if err := vm.connectToServer(); err != nil {
+			return err
+		}
+	}
+
+	if vm.Username == "" {
+		return fmt.Errorf("username cannot be empty")
+	}
+	if recoveryCode == "" {
+		return fmt.Errorf("recovery code cannot be empty")
 	}
-	return
+	return vm.recoveryService.Recover(vm.Username, recoveryCode, vm.PrivateKeyPath)
 }
 
 func (vm *AuthViewModel) connectToServer() error {
-	if err := vm.commService.GetClient().MakeConnection(vm.ServerAddress, vm.PrivateKeyPath); err != nil {
+	if err := vm.commService.GetClient().MakeConnection(vm.ServerAddress, vm.PrivateKeyPath, vm.TLS); err != nil {
 		return err
 	}
 	if vm.commService.GetClient().IsConnected() {
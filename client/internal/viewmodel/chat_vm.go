@@ -1,11 +1,16 @@
 package viewmodel
 
 import (
+	"client/internal/logging"
 	"client/internal/model"
 	"client/internal/service"
+	"client/internal/tracing"
 	pb "client/resources/proto"
 	"context"
+	"crypto/rsa"
 	"fmt"
+	"log/slog"
+	"math/big"
 	"sync"
 )
 
@@ -21,12 +26,14 @@ type ChatViewModel struct {
 	messageChan             chan model.Message
 	ctx                     context.Context
 	cancelFunc              context.CancelFunc
+	onAnnouncement          func()
+	announcementMutex       sync.Mutex
 }
 
 func NewChatViewModel(commService *service.CommunicationService) *ChatViewModel {
 	chatters := make(map[string]*model.Chatter)
 	messages := make(map[string][]model.Message)
-	return &ChatViewModel{
+	vm := &ChatViewModel{
 		chatService:             service.NewChatService(commService),
 		commService:             commService,
 		messages:                &messages,
@@ -34,6 +41,15 @@ func NewChatViewModel(commService *service.CommunicationService) *ChatViewModel
 		chatterHandshakeService: service.NewChatterHandshakeService(commService, &chatters),
 		messageChan:             make(chan model.Message),
 	}
+	commService.OnAnnouncement(func() {
+		vm.announcementMutex.Lock()
+		onAnnouncement := vm.onAnnouncement
+		vm.announcementMutex.Unlock()
+		if onAnnouncement != nil {
+			onAnnouncement()
+		}
+	})
+	return vm
 }
 
 func (vm *ChatViewModel) WaitForHandshakeMessages() {
@@ -46,6 +62,56 @@ func (vm *ChatViewModel) WaitForHandshakeMessages() {
 	}()
 }
 
+func (vm *ChatViewModel) WaitForKeyChangeNotices() {
+	go func() {
+		keyChangedChan := vm.commService.GetKeyChangedChannel()
+		keyRevokedChan := vm.commService.GetKeyRevokedChannel()
+		for {
+			select {
+			case notice := <-keyChangedChan:
+				vm.handleKeyChangedNotice(notice)
+			case notice := <-keyRevokedChan:
+				vm.handleKeyRevokedNotice(notice)
+			}
+		}
+	}()
+}
+
+func (vm *ChatViewModel) handleKeyRevokedNotice(notice *pb.RecoveryPacket) {
+	vm.messagesMutex.Lock()
+	defer vm.messagesMutex.Unlock()
+
+	// The revoked key can no longer be trusted, a new handshake is needed before chatting again.
+	// The notice is shown without an open chat too, the user may know the key from an earlier one.
+	username := notice.GetUsername()
+	delete(*vm.chatters, username)
+	(*vm.messages)[username] = append((*vm.messages)[username], model.Message{
+		Content:  username + "'s key was revoked, reopen the chat to exchange keys again",
+		Sender:   "System",
+		Receiver: username,
+	})
+}
+
+func (vm *ChatViewModel) handleKeyChangedNotice(notice *pb.KeyRotationPacket) {
+	vm.messagesMutex.Lock()
+	defer vm.messagesMutex.Unlock()
+
+	username := notice.GetUsername()
+	chatter, exists := (*vm.chatters)[username]
+	if !exists {
+		return
+	}
+	chatter.SetPublicKey(&rsa.PublicKey{
+		N: new(big.Int).SetBytes(notice.GetNewPublicKey()),
+		E: 65537,
+	})
+	(*vm.messages)[username] = append((*vm.messages)[username], model.Message{
+		Content:  username + " has changed their key",
+		Sender:   "System",
+		Receiver: username,
+	})
+}
+
 func (vm *ChatViewModel) handleHandshakeMessage(message *pb.Message) {
 	vm.messagesMutex.Lock()
 	defer vm.messagesMutex.Unlock()
@@ -149,7 +215,15 @@ func (vm *ChatViewModel) receiveMessages() {
 				continue
 			}
 
-			decryptedContent := chatter.Decrypt(chatMessage.GetMessage())
+			span := tracing.Start(message.GetTraceparent(), "decrypt chatMessage", tracing.KindInternal)
+			decryptedContent, err := chatter.Decrypt(chatMessage.GetMessage())
+			span.RecordError(err)
+			span.End()
+			if err != nil {
+				slog.Warn("Error decrypting message", logging.KeyPeer, senderUsername, "error", err)
+				vm.messageChan <- model.Message{Content: "Error decrypting message from " + senderUsername, Sender: "System", Receiver: vm.commService.GetUsername()}
+				continue
+			}
 			receivedMessage := model.Message{Content: decryptedContent, Sender: senderUsername, Receiver: vm.commService.GetUsername()}
 			vm.messageChan <- receivedMessage
 			//vm.messagesMutex.Unlock()
@@ -189,6 +263,23 @@ func (vm *ChatViewModel) GetMessageContent(index int) string {
 	return fmt.Sprintf("%s: %s", msg.Sender, msg.Content)
 }
 
+// GetAnnouncement returns the announcement to show in the banner, or an empty string
+func (vm *ChatViewModel) GetAnnouncement() string {
+	return formatAnnouncement(vm.commService.GetAnnouncement())
+}
+
+// DismissAnnouncement hides the announcement in every view
+func (vm *ChatViewModel) DismissAnnouncement() {
+	vm.commService.DismissAnnouncement()
+}
+
+// SetOnAnnouncement sets what to call when the announcement changes
+func (vm *ChatViewModel) SetOnAnnouncement(callback func()) {
+	vm.announcementMutex.Lock()
+	defer vm.announcementMutex.Unlock()
+	vm.onAnnouncement = callback
+}
+
 func (vm *ChatViewModel) SetOnBack(callback func()) {
 	vm.onBack = &callback
 }
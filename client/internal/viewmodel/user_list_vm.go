@@ -3,31 +3,52 @@ package viewmodel
 import (
 	"client/internal/model"
 	"client/internal/service"
+	pb "client/resources/proto"
 	"fmt"
+	"log/slog"
+	"sync"
+	"time"
 )
 
+// keyExpiryWarning is how long before the key expires the user is prompted to rotate it
+const keyExpiryWarning = 14 * 24 * time.Hour
+
 type UserListViewModel struct {
-	chatService *service.ChatService
-	Users       []string
-	onSelect    *func(string)
-	chatters    *map[string]model.Chatter
+	chatService        *service.ChatService
+	keyRotationService *service.KeyRotationService
+	Users              []string
+	onSelect           *func(string)
+	chatters           *map[string]model.Chatter
+	serverNotice       string
+	onAnnouncement     func()
+	noticeMutex        sync.Mutex
 	//
 	commService *service.CommunicationService
 }
 
 func NewUserListViewModel(commService *service.CommunicationService) *UserListViewModel {
-	return &UserListViewModel{
-		chatService: service.NewChatService(commService),
-		Users:       []string{},
-		commService: commService,
+	vm := &UserListViewModel{
+		chatService:        service.NewChatService(commService),
+		keyRotationService: service.NewKeyRotationService(commService),
+		Users:              []string{},
+		commService:        commService,
 	}
+	commService.OnAnnouncement(func() {
+		vm.noticeMutex.Lock()
+		onAnnouncement := vm.onAnnouncement
+		vm.noticeMutex.Unlock()
+		if onAnnouncement != nil {
+			onAnnouncement()
+		}
+	})
+	return vm
 }
 
 func (vm *UserListViewModel) FetchUsers() {
 	users, err := vm.chatService.GetUserList()
 	if err != nil {
 		// Handle error (e.g., log it)
-		fmt.Printf("Error fetching users: %v\n", err)
+		slog.Error("Error fetching users", "error", err)
 		return
 	}
 	// filter out the current user
@@ -53,6 +74,72 @@ func (vm *UserListViewModel) SelectedUser(user string) (onLogin *func(string), e
 	return vm.onSelect, nil
 }
 
+func (vm *UserListViewModel) RotateKey(newPrivateKeyPath string) error {
+	if newPrivateKeyPath == "" {
+		return fmt.Errorf("new private key path cannot be empty")
+	}
+	return vm.keyRotationService.RotateKey(newPrivateKeyPath)
+}
+
+// GetKeyNotice returns a warning when the user's key must be renewed soon, or an empty string
+func (vm *UserListViewModel) GetKeyNotice() string {
+	client := vm.commService.GetClient()
+	expiresAt := client.KeyExpiresAt
+	if client.KeyRenewalRequired {
+		if expiresAt.IsZero() {
+			return "Your key no longer meets the server's key policy, please rotate it"
+		}
+		return fmt.Sprintf("Your key must be rotated before %s", expiresAt.Format(time.DateOnly))
+	}
+	if !expiresAt.IsZero() && time.Until(expiresAt) < keyExpiryWarning {
+		return fmt.Sprintf("Your key expires on %s, please rotate it", expiresAt.Format(time.DateOnly))
+	}
+	return ""
+}
+
+// WaitForServerNotices keeps the latest notice the server sent, like a shutdown warning
+func (vm *UserListViewModel) WaitForServerNotices() {
+	go func() {
+		noticeChan := vm.commService.GetServerNoticeChannel()
+		for notice := range noticeChan {
+			vm.noticeMutex.Lock()
+			switch notice.GetType() {
+			case pb.ServerNoticePacket_GOING_AWAY:
+				vm.serverNotice = "Disconnected: " + notice.GetReason()
+			case pb.ServerNoticePacket_REQUEST_REJECTED:
+				vm.serverNotice = "Slow down: " + notice.GetReason()
+			case pb.ServerNoticePacket_KICKED:
+				vm.serverNotice = "Disconnected by an administrator: " + notice.GetReason()
+			}
+			vm.noticeMutex.Unlock()
+		}
+	}()
+}
+
+// GetServerNotice returns the latest notice from the server, or an empty string
+func (vm *UserListViewModel) GetServerNotice() string {
+	vm.noticeMutex.Lock()
+	defer vm.noticeMutex.Unlock()
+	return vm.serverNotice
+}
+
+// GetAnnouncement returns the announcement to show in the banner, or an empty string
+func (vm *UserListViewModel) GetAnnouncement() string {
+	return formatAnnouncement(vm.commService.GetAnnouncement())
+}
+
+// DismissAnnouncement hides the announcement in every view
+func (vm *UserListViewModel) DismissAnnouncement() {
+	vm.commService.DismissAnnouncement()
+}
+
+// SetOnAnnouncement sets what to call when the announcement changes
+func (vm *UserListViewModel) SetOnAnnouncement(callback func()) {
+	vm.noticeMutex.Lock()
+	defer vm.noticeMutex.Unlock()
+	vm.onAnnouncement = callback
+}
+
 func (vm *UserListViewModel) GetCurrentUsername() string {
 	return vm.commService.GetUsername()
 }
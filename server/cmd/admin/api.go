@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"server/internal/certs"
+	"server/internal/config"
+	"syscall"
+	"time"
+)
+
+// adminTokenEnv is where the admin token comes from when -token is not passed
+const adminTokenEnv = "SERVER_ADMIN_TOKEN"
+
+// localAddress is the address to reach a local listener on, localhost when it listens on every interface
+func localAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// apiFlags are the flags of the commands that a running server has to carry out itself, role is who may call them
+func apiFlags(flags *flag.FlagSet, role string) (token *string, offline *bool) {
+	token = flags.String("token", os.Getenv(adminTokenEnv), "admin token of "+role+", needed while the server is running")
+	offline = flags.Bool("offline", false, "the server is stopped, change the database without asking its admin API")
+	return token, offline
+}
+
+// serverRunning tells whether the server is running, by a TLS handshake with its admin API that only trusts the
+// server's certificate. The sessions of a running server can only be ended by the server itself, through the
+// admin API. Without an admin API, or when it can't be told whether the API answered, it is an error, unless
+// offline says the server is stopped.
+func serverRunning(cfg config.Config, offline bool) (bool, error) {
+	if offline {
+		return false, nil
+	}
+	if cfg.AdminAddress == "" {
+		return false, fmt.Errorf("can't tell whether the server is running without its admin API, set admin_address or pass -offline when the server is stopped")
+	}
+	roots, err := certs.LoadCertPool(cfg.TLSCertFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading server certificate: %v", err)
+	}
+	address := localAddress(cfg.AdminAddress)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("can't tell whether the server is running, its admin API at %s did not answer: %v (pass -offline when the server is stopped)", address, err)
+	}
+	conn.Close()
+	return true, nil
+}
+
+// adminClient calls the admin API of the running server, trusting the certificate in its tls_cert_file
+type adminClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func newAdminClient(cfg config.Config, token string) (*adminClient, error) {
+	if cfg.AdminAddress == "" {
+		return nil, fmt.Errorf("the admin API is not served, set admin_address and restart the server")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("pass a moderator's admin token with -token or %s", adminTokenEnv)
+	}
+	roots, err := certs.LoadCertPool(cfg.TLSCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading server certificate: %v", err)
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}
+	return &adminClient{
+		baseURL: "https://" + localAddress(cfg.AdminAddress),
+		token:   token,
+		client:  &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// post sends the request to the endpoint of the user and decodes the answer into reply
+func (c *adminClient) post(username string, operation string, request any, reply any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	endpoint := c.baseURL + "/v1/users/" + url.PathEscape(username) + "/" + operation
+	httpRequest, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpRequest.Header.Set("Authorization", "Bearer "+c.token)
+	httpRequest.Header.Set("Content-Type", "application/json")
+	response, err := c.client.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("error calling the admin API: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&failure)
+		return fmt.Errorf("the admin API refused to %s %q: %s %s", operation, username, response.Status, failure.Error)
+	}
+	return json.NewDecoder(response.Body).Decode(reply)
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/user"
+	"server/internal/actions"
+	"server/internal/adminapi"
+	"server/internal/audit"
+	"server/internal/blinding"
+	"server/internal/config"
+	"server/internal/db"
+	"server/internal/logging"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: admin <command> [flags]
+
+Commands:
+  rotate-blinding-key   Add a new username blinding secret, accounts are rehashed when they next log in
+  blinding-status       Show how many accounts are stored with each blinding version
+  migrate               Apply pending database migrations, or list them with -dry-run
+  audit-verify          Check that no audit record was changed or removed
+  audit-events          List audit records, filtered with -user, -type, -since and -until
+  user-list             List every account by its blinded username
+  user-info             Show the account of -user, with its key fingerprint
+  user-disable          Refuse logins of -user until the account is enabled again
+  user-enable           Allow logins of -user again
+  user-suspend          Refuse logins of -user with a -reason, -for a duration, -until a time, or for good
+  user-unsuspend        Lift the active suspensions of -user
+  user-delete           Delete the account of -user with its key history and recovery codes, confirm with -yes
+  user-reset-key        Refuse the current key of -user until it is replaced using a recovery code
+  admin-token           Generate an admin API token for -name with -role, and the entry for the credentials file
+`
+
+func main() {
+	// The admin tool shares the server configuration from the config file (SERVER_CONFIG), .env and the environment
+	cfg, err := config.Load(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Database messages, like applied migrations, follow the server's log settings
+	logger, err := logging.New(os.Stderr, cfg.LogOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
+	if len(os.Args) < 2 {
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "rotate-blinding-key":
+		err = rotateBlindingKey(cfg, os.Args[2:])
+	case "blinding-status":
+		err = blindingStatus(cfg, os.Args[2:])
+	case "migrate":
+		err = migrate(cfg, os.Args[2:])
+	case "audit-verify":
+		err = auditVerify(cfg, os.Args[2:])
+	case "audit-events":
+		err = auditEvents(cfg, os.Args[2:])
+	case "user-list":
+		err = userList(cfg, os.Args[2:])
+	case "user-info":
+		err = userInfo(cfg, os.Args[2:])
+	case "user-disable":
+		err = userSetDisabled(cfg, "user-disable", true, os.Args[2:])
+	case "user-enable":
+		err = userSetDisabled(cfg, "user-enable", false, os.Args[2:])
+	case "user-suspend":
+		err = userSuspend(cfg, os.Args[2:])
+	case "user-unsuspend":
+		err = userUnsuspend(cfg, os.Args[2:])
+	case "user-delete":
+		err = userDelete(cfg, os.Args[2:])
+	case "user-reset-key":
+		err = userResetKey(cfg, os.Args[2:])
+	case "admin-token":
+		err = adminToken(os.Args[2:])
+	default:
+		fmt.Print(usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func rotateBlindingKey(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("rotate-blinding-key", flag.ExitOnError)
+	argon := flags.Bool("argon2", false, "slow the blinding down with Argon2id")
+	keyringPath := flags.String("keyring", cfg.BlindingKeyring, "path of the blinding keyring file")
+	_ = flags.Parse(args)
+
+	keyring, err := blinding.LoadKeyring(*keyringPath)
+	if err != nil {
+		return err
+	}
+	algorithm := blinding.AlgorithmHMAC
+	if *argon {
+		algorithm = blinding.AlgorithmHMACArgon2
+	}
+	scheme, err := keyring.Rotate(*keyringPath, algorithm)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added blinding version %d (%s) to %s\n", scheme.Version, scheme.Algorithm, *keyringPath)
+	fmt.Println("Restart the server to use it, accounts are rehashed when they next log in")
+	return nil
+}
+
+func blindingStatus(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("blinding-status", flag.ExitOnError)
+	keyringPath := flags.String("keyring", cfg.BlindingKeyring, "path of the blinding keyring file")
+	_ = flags.Parse(args)
+
+	keyring, err := blinding.LoadKeyring(*keyringPath)
+	if err != nil {
+		return err
+	}
+	store, err := db.OpenExistingSQLiteStore(cfg.DBPath, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	counts, err := store.CountUsersByHashVersion()
+	if err != nil {
+		return err
+	}
+	for _, scheme := range keyring.Schemes() {
+		current := ""
+		if scheme.Version == keyring.Current().Version {
+			current = " (current)"
+		}
+		fmt.Printf("version %d %s%s: %d accounts\n", scheme.Version, scheme.Algorithm, current, counts[scheme.Version])
+		delete(counts, scheme.Version)
+	}
+	for version, count := range counts {
+		fmt.Printf("version %d (missing from keyring): %d accounts\n", version, count)
+	}
+	return nil
+}
+
+func migrate(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the pending migrations")
+	dbPath := flags.String("db", cfg.DBPath, "path of the users database")
+	_ = flags.Parse(args)
+
+	// Only applying the migrations may change the database, and a mistyped path must not create an empty one
+	conn, err := db.OpenConnection(*dbPath, *dryRun)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	version, err := db.SchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	pending, err := db.PendingMigrations(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version %d, this server supports version %d\n", version, db.LatestSchemaVersion())
+	if len(pending) == 0 {
+		fmt.Println("No pending migrations")
+		return nil
+	}
+	for _, migration := range pending {
+		fmt.Printf("pending %d: %s\n", migration.Version, migration.Description)
+	}
+	if *dryRun {
+		return nil
+	}
+	return db.Migrate(conn)
+}
+
+// openAuditRecords reads every record of the audit log, from the users database or a file
+func openAuditRecords(cfg config.Config, auditLog string) ([]audit.Record, error) {
+	switch auditLog {
+	case config.AuditLogOff:
+		return nil, fmt.Errorf("the audit log is off, pick one with -audit-log")
+	case config.AuditLogDatabase:
+		store, err := db.OpenExistingSQLiteStore(cfg.DBPath, true)
+		if err != nil {
+			return nil, err
+		}
+		defer store.Close()
+		return store.AuditSink().Records()
+	default:
+		// Not opened as a sink, the running server holds the file's lock
+		return audit.ReadFile(auditLog)
+	}
+}
+
+func auditVerify(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	auditLog := flags.String("audit-log", cfg.AuditLog, "\"db\" or the path of the audit log file")
+	_ = flags.Parse(args)
+
+	records, err := openAuditRecords(cfg, *auditLog)
+	if err != nil {
+		return err
+	}
+	if err = audit.Verify(records); err != nil {
+		return fmt.Errorf("the audit log was tampered with: %v", err)
+	}
+	if len(records) == 0 {
+		fmt.Println("The audit log is empty")
+		return nil
+	}
+	last := records[len(records)-1]
+	fmt.Printf("%d records, the chain is intact\n", len(records))
+	fmt.Printf("Last record %d at %s with hash %s\n", last.Sequence, last.Time.Format(time.RFC3339), last.Hash)
+	fmt.Println("Keep the last hash elsewhere, records cut off the end of the log can only be found by comparing it")
+	return nil
+}
+
+func auditEvents(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("audit-events", flag.ExitOnError)
+	auditLog := flags.String("audit-log", cfg.AuditLog, "\"db\" or the path of the audit log file")
+	user := flags.String("user", "", "only the events of this username, as the user or the peer")
+	eventType := flags.String("type", "", "only events of this type, like login or key_rotation")
+	since := flags.String("since", "", "only events from this time on, like 2024-01-31 or 2024-01-31T12:00:00Z")
+	until := flags.String("until", "", "only events before this time")
+	_ = flags.Parse(args)
+
+	filter := audit.Filter{Type: *eventType}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return err
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return err
+	}
+	if *user != "" {
+		keyring, err := loadKeyring(cfg)
+		if err != nil {
+			return err
+		}
+		// The records hold blinded usernames, made with whichever blinding version was current at the time
+		for _, scheme := range keyring.Schemes() {
+			filter.Users = append(filter.Users, scheme.Blind(*user))
+		}
+	}
+
+	records, err := openAuditRecords(cfg, *auditLog)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if !filter.Match(record) {
+			continue
+		}
+		fields := []string{
+			fmt.Sprintf("%d", record.Sequence),
+			record.Time.Format(time.RFC3339),
+			record.Type,
+			record.Outcome,
+		}
+		for _, field := range []struct{ name, value string }{
+			{"user", record.User}, {"peer", record.Peer}, {"remote", record.Remote}, {"detail", record.Detail},
+		} {
+			if field.value != "" {
+				fields = append(fields, fmt.Sprintf("%s=%q", field.name, field.value))
+			}
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+	return nil
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("time %q must be like 2024-01-31 or 2024-01-31T12:00:00Z", value)
+	}
+	return t, nil
+}
+
+// loadKeyring reads the configured blinding keyring, with the legacy version hashing like the server's
+func loadKeyring(cfg config.Config) (*blinding.Keyring, error) {
+	keyring, err := blinding.LoadKeyring(cfg.BlindingKeyring)
+	if err != nil {
+		return nil, err
+	}
+	return keyring.WithLegacySecrets(cfg.HashPassword, cfg.HashSalt), nil
+}
+
+// openUser opens the users database, read-only unless the account is changed, and finds the account of the username,
+// blinded with any version of the configured keyring. The caller closes the store.
+func openUser(cfg config.Config, dbPath string, username string, readOnly bool) (*db.SQLiteStore, string, error) {
+	if username == "" {
+		return nil, "", fmt.Errorf("the username is missing, pass it with -user")
+	}
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	store, err := db.OpenExistingSQLiteStore(dbPath, readOnly)
+	if err != nil {
+		return nil, "", err
+	}
+	blindedUsername, _, err := actions.LookupUsername(store, keyring, username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		store.Close()
+		return nil, "", fmt.Errorf("no account is registered as %q", username)
+	}
+	if err != nil {
+		store.Close()
+		return nil, "", err
+	}
+	return store, blindedUsername, nil
+}
+
+// userFlags are the flags of the commands that change one account
+func userFlags(cfg config.Config, name string) (*flag.FlagSet, *string, *string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	user := flags.String("user", "", "the plaintext username of the account")
+	dbPath := flags.String("db", cfg.DBPath, "path of the users database")
+	return flags, user, dbPath
+}
+
+func formatUserFlags(user db.UserInfo) string {
+	var flags []string
+	if user.Disabled {
+		flags = append(flags, "disabled")
+	}
+	if user.KeyResetRequired {
+		flags = append(flags, "key-reset-required")
+	}
+	if len(flags) == 0 {
+		return "active"
+	}
+	return strings.Join(flags, ",")
+}
+
+func userList(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("user-list", flag.ExitOnError)
+	dbPath := flags.String("db", cfg.DBPath, "path of the users database")
+	_ = flags.Parse(args)
+
+	store, err := db.OpenExistingSQLiteStore(*dbPath, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	users, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	// Usernames are only stored blinded, use user-info to find the account of a username
+	for _, user := range users {
+		fmt.Printf("%s version=%d key=%s created=%s %s\n", user.Username, user.HashVersion, user.KeyAlgorithm, user.KeyCreatedAt.Format(time.DateOnly), formatUserFlags(user))
+	}
+	fmt.Printf("%d accounts\n", len(users))
+	return nil
+}
+
+func userInfo(cfg config.Config, args []string) error {
+	flags, username, dbPath := userFlags(cfg, "user-info")
+	_ = flags.Parse(args)
+
+	store, blindedUsername, err := openUser(cfg, *dbPath, *username, true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	user, err := store.GetUser(blindedUsername)
+	if err != nil {
+		return err
+	}
+	publicKey, err := store.GetUserPubKey(blindedUsername)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Blinded username: %s\n", user.Username)
+	fmt.Printf("Blinding version: %d\n", user.HashVersion)
+	fmt.Printf("Key:              %s %d bits, registered %s\n", user.KeyAlgorithm, publicKey.N.BitLen(), user.KeyCreatedAt.Format(time.RFC3339))
+	fmt.Printf("Key fingerprint:  %s\n", logging.Fingerprint(publicKey))
+	fmt.Printf("Status:           %s\n", formatUserFlags(user))
+	suspension, err := store.ActiveSuspension(blindedUsername, time.Now())
+	if err == nil {
+		fmt.Printf("Suspended:        %s by %s: %s\n", formatSuspensionEnd(suspension), suspension.Moderator, suspension.Reason)
+	} else if !errors.Is(err, db.ErrNotSuspended) {
+		return err
+	}
+	return nil
+}
+
+func formatSuspensionEnd(suspension db.Suspension) string {
+	if suspension.ExpiresAt.IsZero() {
+		return "for good"
+	}
+	return "until " + suspension.ExpiresAt.Format(time.RFC3339)
+}
+
+// moderatorName names whoever runs the admin tool in the suspensions
+func moderatorName() string {
+	if current, err := user.Current(); err == nil {
+		return "cli:" + current.Username
+	}
+	return "cli"
+}
+
+func userSuspend(cfg config.Config, args []string) error {
+	flags, username, dbPath := userFlags(cfg, "user-suspend")
+	reason := flags.String("reason", "", "why the account is suspended, shown to the user")
+	duration := flags.Duration("for", 0, "how long the suspension lasts, like 72h")
+	until := flags.String("until", "", "when the suspension ends, like 2024-01-31 or 2024-01-31T12:00:00Z")
+	moderator := flags.String("moderator", moderatorName(), "who suspends the account, the admin API names the token's owner instead")
+	token, offline := apiFlags(flags, "a moderator")
+	_ = flags.Parse(args)
+
+	if *reason == "" {
+		return fmt.Errorf("-reason is required")
+	}
+	suspension := db.Suspension{Reason: *reason, Moderator: *moderator, CreatedAt: time.Now()}
+	expiresAt, err := parseTime(*until)
+	if err != nil {
+		return err
+	}
+	switch {
+	case *duration != 0 && !expiresAt.IsZero():
+		return fmt.Errorf("pass either -for or -until")
+	case *duration < 0:
+		return fmt.Errorf("-for must be positive")
+	case *duration > 0:
+		suspension.ExpiresAt = suspension.CreatedAt.Add(*duration)
+	case !expiresAt.IsZero():
+		if !expiresAt.After(suspension.CreatedAt) {
+			return fmt.Errorf("-until must be in the future")
+		}
+		suspension.ExpiresAt = expiresAt
+	}
+
+	// A running server has to suspend the user itself, so the sessions that are already logged in are ended
+	running, err := serverRunning(cfg, *offline)
+	if err != nil {
+		return err
+	}
+	if running {
+		api, err := newAdminClient(cfg, *token)
+		if err != nil {
+			return fmt.Errorf("the server is running, it ends the sessions of %q only when it suspends the account itself: %v", *username, err)
+		}
+		request := map[string]any{"reason": suspension.Reason}
+		if !suspension.ExpiresAt.IsZero() {
+			request["until"] = suspension.ExpiresAt
+		}
+		var reply struct {
+			Kicked int `json:"kicked"`
+		}
+		if err = api.post(*username, "suspend", request, &reply); err != nil {
+			return err
+		}
+		fmt.Printf("Suspended %q %s, %d logged-in sessions were ended\n", *username, formatSuspensionEnd(suspension), reply.Kicked)
+		return nil
+	}
+
+	store, blindedUsername, err := openUser(cfg, *dbPath, *username, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	suspension.Username = blindedUsername
+	if _, err = store.SuspendUser(suspension); err != nil {
+		return err
+	}
+	fmt.Printf("Suspended %q %s\n", *username, formatSuspensionEnd(suspension))
+	return nil
+}
+
+func userUnsuspend(cfg config.Config, args []string) error {
+	flags, username, dbPath := userFlags(cfg, "user-unsuspend")
+	moderator := flags.String("moderator", moderatorName(), "who lifts the suspension")
+	_ = flags.Parse(args)
+
+	store, blindedUsername, err := openUser(cfg, *dbPath, *username, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	lifted, err := store.LiftSuspensions(blindedUsername, *moderator, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Lifted %d suspensions of %q\n", lifted, *username)
+	return nil
+}
+
+func userSetDisabled(cfg config.Config, name string, disabled bool, args []string) error {
+	flags, username, dbPath := userFlags(cfg, name)
+	var token *string
+	var offline *bool
+	if disabled {
+		token, offline = apiFlags(flags, "a moderator")
+	}
+	_ = flags.Parse(args)
+
+	// A running server has to disable the account itself, so the sessions that are already logged in are ended
+	running := false
+	if disabled {
+		var err error
+		if running, err = serverRunning(cfg, *offline); err != nil {
+			return err
+		}
+	}
+	if running {
+		api, err := newAdminClient(cfg, *token)
+		if err != nil {
+			return fmt.Errorf("the server is running, it ends the sessions of %q only when it disables the account itself: %v", *username, err)
+		}
+		var reply struct {
+			Kicked int `json:"kicked"`
+		}
+		if err = api.post(*username, "disable", struct{}{}, &reply); err != nil {
+			return err
+		}
+		fmt.Printf("Disabled %q, the account can't log in until it is enabled again, %d logged-in sessions were ended\n", *username, reply.Kicked)
+		return nil
+	}
+
+	store, blindedUsername, err := openUser(cfg, *dbPath, *username, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err = store.SetUserDisabled(blindedUsername, disabled); err != nil {
+		return err
+	}
+	if disabled {
+		fmt.Printf("Disabled %q, the account can't log in until it is enabled again\n", *username)
+	} else {
+		fmt.Printf("Enabled %q\n", *username)
+	}
+	return nil
+}
+
+func userDelete(cfg config.Config, args []string) error {
+	flags, username, dbPath := userFlags(cfg, "user-delete")
+	confirmed := flags.Bool("yes", false, "really delete the account, it can't be undone")
+	token, offline := apiFlags(flags, "an admin")
+	_ = flags.Parse(args)
+
+	// A running server has to delete the account itself, so the sessions that are already logged in are ended
+	running, err := serverRunning(cfg, *offline)
+	if err != nil {
+		return err
+	}
+	if running {
+		if !*confirmed {
+			return fmt.Errorf("deleting %q can't be undone, run the command again with -yes", *username)
+		}
+		api, err := newAdminClient(cfg, *token)
+		if err != nil {
+			return fmt.Errorf("the server is running, it ends the sessions of %q only when it deletes the account itself: %v", *username, err)
+		}
+		var reply struct {
+			Kicked int `json:"kicked"`
+		}
+		if err = api.post(*username, "delete", struct{}{}, &reply); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %q, the username can be registered again, %d logged-in sessions were ended\n", *username, reply.Kicked)
+		return nil
+	}
+
+	store, blindedUsername, err := openUser(cfg, *dbPath, *username, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if !*confirmed {
+		return fmt.Errorf("deleting %q can't be undone, run the command again with -yes", *username)
+	}
+	if err = store.DeleteUser(blindedUsername); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %q, the username can be registered again\n", *username)
+	return nil
+}
+
+func userResetKey(cfg config.Config, args []string) error {
+	flags, username, dbPath := userFlags(cfg, "user-reset-key")
+	token, offline := apiFlags(flags, "a moderator")
+	_ = flags.Parse(args)
+
+	// A running server has to require the reset itself, so the sessions that are already logged in are ended
+	running, err := serverRunning(cfg, *offline)
+	if err != nil {
+		return err
+	}
+	if running {
+		api, err := newAdminClient(cfg, *token)
+		if err != nil {
+			return fmt.Errorf("the server is running, it ends the sessions of %q only when it requires the key reset itself: %v", *username, err)
+		}
+		var reply struct {
+			Kicked int `json:"kicked"`
+		}
+		if err = api.post(*username, "reset-key", struct{}{}, &reply); err != nil {
+			return err
+		}
+		fmt.Printf("The current key of %q is refused from now on, %d logged-in sessions were ended\n", *username, reply.Kicked)
+		fmt.Println("The user gets back in by recovering the account with a recovery code and a new key")
+		return nil
+	}
+
+	store, blindedUsername, err := openUser(cfg, *dbPath, *username, false)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err = store.RequireKeyReset(blindedUsername); err != nil {
+		return err
+	}
+	fmt.Printf("The current key of %q is refused from now on\n", *username)
+	fmt.Println("The user gets back in by recovering the account with a recovery code and a new key")
+	return nil
+}
+
+func adminToken(args []string) error {
+	flags := flag.NewFlagSet("admin-token", flag.ExitOnError)
+	name := flags.String("name", "", "who the token is for, shown in the audit log")
+	roleName := flags.String("role", "viewer", "viewer, moderator or admin")
+	_ = flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("-name is required")
+	}
+	role, err := adminapi.ParseRole(*roleName)
+	if err != nil {
+		return err
+	}
+	token, credential, err := adminapi.NewToken(*name, role)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Token: %s\n", token)
+	fmt.Println("The token is shown only once. Add this entry to the tokens of the admin credentials file and restart the server:")
+	fmt.Println(string(entry))
+	return nil
+}
@@ -1,200 +1,304 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"github.com/joho/godotenv"
 	"log"
+	"log/slog"
 	"net"
-	"server/internal/actions"
-	"server/internal/util"
-	pb "server/resources/proto"
-	"sync"
+	"net/http"
+	"os"
+	"os/signal"
+	"server/internal/certs"
+	"server/internal/config"
+	"server/internal/logging"
+	"server/pkg/chatserver"
+	"syscall"
+	"time"
 )
 
-type Server struct {
-	address       string
-	clients       map[net.Conn]bool
-	handlers      map[net.Conn]map[string]actions.MessageHandler
-	handlersMutex sync.Mutex
-	//
-	listOfLoggedInUsers map[string]net.Conn
-	loggedInUsersMutex  sync.RWMutex
-}
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func NewServer(address string) *Server {
-	return &Server{
-		address:             address,
-		clients:             make(map[net.Conn]bool),
-		handlers:            make(map[net.Conn]map[string]actions.MessageHandler),
-		listOfLoggedInUsers: make(map[string]net.Conn),
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func (s *Server) getOrCreateHandler(conn net.Conn, handlerType string) actions.MessageHandler {
-	s.handlersMutex.Lock()
-	defer s.handlersMutex.Unlock()
-
-	if _, exists := s.handlers[conn]; !exists {
-		s.handlers[conn] = make(map[string]actions.MessageHandler)
+	if err = cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
-
-	if handler, exists := s.handlers[conn][handlerType]; exists {
-		return handler
+	logger, err := logging.New(os.Stderr, cfg.LogOptions())
+	if err != nil {
+		log.Fatal(err)
 	}
+	// The packages without a logger of their own, and the log package, write to it too
+	slog.SetDefault(logger)
+	keyPolicy := cfg.KeyPolicy()
 
-	var newHandler actions.MessageHandler
-	switch handlerType {
-	case "login":
-		newHandler = actions.NewLoginMessageHandler(conn, &s.listOfLoggedInUsers)
-	case "register":
-		newHandler = actions.NewRegisterMessageHandler(conn)
-	case "user_list":
-		newHandler = actions.NewUserListMessageHandler(conn, &s.listOfLoggedInUsers)
-	case "chat":
-		newHandler = actions.NewChatMessageHandler(&s.listOfLoggedInUsers)
-	case "exchange_keys":
-		newHandler = actions.NewExchangeKeyPacket(&s.listOfLoggedInUsers)
-	default:
-		log.Printf("Unknown handler type: %s\n", handlerType)
-		return nil
+	// Load the server certificate and private key, generated on the first run if asked to
+	generated := false
+	if cfg.TLSSelfSigned {
+		if generated, err = certs.GenerateSelfSigned(cfg.TLSCertFile, cfg.TLSKeyFile, selfSignedHosts(cfg.Address)); err != nil {
+			fatal(fmt.Errorf("error generating self-signed certificate: %v", err))
+		}
 	}
-
-	s.handlers[conn][handlerType] = newHandler
-	return newHandler
-}
-
-func (s *Server) Start() error {
-	// Load the server certificate and private key
-	cert, err := tls.LoadX509KeyPair("resources/auth/server-cert.pem", "resources/auth/server-key.pem")
+	certificates, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
 	if err != nil {
-		return fmt.Errorf("error loading server certificate: %v", err)
+		fatal(err)
+	}
+	cert := certificates.Certificate()
+	fingerprint := certs.Fingerprint(cert.Certificate[0])
+	if generated {
+		slog.Warn("Generated a self-signed server certificate, clients have to trust its file or pin its fingerprint", "cert", cfg.TLSCertFile, "fingerprint", fingerprint)
+		fmt.Printf("Server certificate SHA-256 fingerprint: %s\n", fingerprint)
 	}
+	slog.Info("Server certificate loaded", "fingerprint", fingerprint, "expires", cert.Leaf.NotAfter)
+	// Renewed certificates are served to new connections, the open ones keep theirs
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go certificates.Watch(ctx, time.Duration(cfg.TLSReloadInterval), reload)
 
-	// Create the TLS configuration
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		MinVersion:   tls.VersionTLS12, // Ensure minimum TLS version 1.2
+	keyring, err := chatserver.LoadBlindingKeyring(cfg.BlindingKeyring)
+	if err != nil {
+		fatal(err)
+	}
+	decoySecret, err := chatserver.LoadDecoySecret(cfg.DecoySecret)
+	if err != nil {
+		fatal(err)
+	}
+	store, err := chatserver.OpenSQLiteStore(cfg.DBPath)
+	if err != nil {
+		fatal(err)
+	}
+	auditLog, auditSink, err := openAuditLog(cfg, store)
+	if err != nil {
+		fatal(err)
+	}
+	tracer, err := chatserver.OpenTracer(cfg.TraceExport)
+	if err != nil {
+		fatal(err)
 	}
 
-	// Create a TLS listener
-	listener, err := tls.Listen("tcp", s.address, config)
+	tlsConfig, certUsers, err := clientAuthentication(cfg, &tls.Config{
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12, // Ensure minimum TLS version 1.2
+	})
 	if err != nil {
-		return fmt.Errorf("error starting TLS server: %v", err)
+		fatal(err)
 	}
 
-	defer func(listener net.Listener) {
-		err := listener.Close()
-		if err != nil {
-			log.Printf("Error closing listener: %v\n", err)
+	server, err := chatserver.New(chatserver.Options{
+		Address:            cfg.Address,
+		TLSConfig:          tlsConfig,
+		Store:              store,
+		Keyring:            keyring,
+		HashPassword:       cfg.HashPassword,
+		HashSalt:           cfg.HashSalt,
+		KeyPolicy:          &keyPolicy,
+		DecoySecret:        decoySecret,
+		LookupResponseTime: time.Duration(cfg.LookupResponseTime),
+		MaxMessageSize:     uint32(cfg.MaxMessageSize),
+		Logger:             logger,
+		ShutdownTimeout:    time.Duration(cfg.ShutdownTimeout),
+		ConnectionLimits:   cfg.ConnectionLimits(),
+		TrustedProxies:     cfg.TrustedProxies,
+		ClientCertUsers:    certUsers,
+		RateLimiter:        chatserver.NewRateLimiter(cfg.RateLimits()),
+		AuditLog:           auditLog,
+		Tracer:             tracer,
+	})
+	// The HTTP listeners are bound before the server starts, a server that can't serve them doesn't start at all
+	var httpServers []*http.Server
+	if err == nil {
+		httpServers, err = serveHTTP(cfg, server)
+	}
+	if err == nil {
+		var adminServer *http.Server
+		if adminServer, err = serveAdmin(cfg, server, certificates, auditLog, logger); adminServer != nil {
+			httpServers = append(httpServers, adminServer)
 		}
-	}(listener)
-
-	log.Printf("TLS Server listening on %s\n", s.address)
-	s.handleConnections(listener)
-
-	return nil
-}
-
-func (s *Server) handleConnections(listener net.Listener) {
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Error accepting connection: %v\n", err)
-			continue
+	}
+	if err == nil {
+		err = server.Start(ctx)
+	}
+	for _, httpServer := range httpServers {
+		httpServer.Close()
+	}
+	if closeErr := tracer.Close(); closeErr != nil {
+		slog.Error("Error closing trace export", "error", closeErr)
+	}
+	if auditSink != nil {
+		if closeErr := auditSink.Close(); closeErr != nil {
+			slog.Error("Error closing audit log", "error", closeErr)
 		}
-
-		s.clients[conn] = true
-		go s.handleClient(conn)
 	}
+	if closeErr := store.Close(); closeErr != nil {
+		slog.Error("Error closing database", "error", closeErr)
+	}
+	if err != nil && !errors.Is(err, chatserver.ErrServerClosed) {
+		fatal(err)
+	}
+	slog.Info("Server stopped")
 }
 
-func (s *Server) addLoggedInUsers(username string, conn net.Conn) {
-	s.loggedInUsersMutex.Lock()
-	defer s.loggedInUsersMutex.Unlock()
-	s.listOfLoggedInUsers[username] = conn
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
 }
 
-func (s *Server) removeHandlers(conn net.Conn) {
-	s.handlersMutex.Lock()
-	s.loggedInUsersMutex.Lock()
-	defer s.loggedInUsersMutex.Unlock()
-	defer s.handlersMutex.Unlock()
-	delete(s.handlers, conn)
-	for username, connection := range s.listOfLoggedInUsers {
-		if connection == conn {
-			delete(s.listOfLoggedInUsers, username)
-		}
+// openAuditLog opens the audit log the config asks for, it is nil when the audit log is off
+func openAuditLog(cfg config.Config, store chatserver.Store) (*chatserver.AuditLog, chatserver.AuditSink, error) {
+	var sink chatserver.AuditSink
+	var err error
+	switch cfg.AuditLog {
+	case config.AuditLogOff:
+		return nil, nil, nil
+	case config.AuditLogDatabase:
+		sink, err = chatserver.DatabaseAuditSink(store)
+	default:
+		sink, err = chatserver.OpenAuditFile(cfg.AuditLog)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	auditLog, err := chatserver.NewAuditLog(sink)
+	if err != nil {
+		sink.Close()
+		return nil, nil, err
 	}
+	return auditLog, sink, nil
 }
 
-func (s *Server) handleClient(conn net.Conn) {
-	defer conn.Close()
-	defer delete(s.clients, conn)
-	defer s.removeHandlers(conn)
+// serveHTTP serves the Prometheus metrics on /metrics and the health checks on /healthz and /readyz until the
+// returned servers are closed. They share a listener when they are on the same address. Nothing is served when
+// one of the addresses can't be listened on.
+func serveHTTP(cfg config.Config, server *chatserver.Server) ([]*http.Server, error) {
+	muxes := make(map[string]*http.ServeMux)
+	mux := func(address string) *http.ServeMux {
+		if muxes[address] == nil {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+	if cfg.MetricsAddress != "" {
+		mux(cfg.MetricsAddress).Handle("/metrics", chatserver.MetricsHandler())
+	}
+	if cfg.HealthAddress != "" {
+		health := server.HealthHandler()
+		mux(cfg.HealthAddress).Handle("/healthz", health)
+		mux(cfg.HealthAddress).Handle("/readyz", health)
+	}
 
-	for {
-		message, err := util.ReadMessage(conn)
+	listeners := make(map[string]net.Listener)
+	for address := range muxes {
+		listener, err := net.Listen("tcp", address)
 		if err != nil {
-			log.Printf("Error reading from client: %v\n", err)
-			return
+			for _, bound := range listeners {
+				bound.Close()
+			}
+			return nil, fmt.Errorf("error listening on %s: %v", address, err)
 		}
+		listeners[address] = listener
+	}
 
-		var messageHandler actions.MessageHandler
-		switch message.GetPacket().(type) {
-		case *pb.Message_LoginMessage:
-			messageHandler = s.getOrCreateHandler(conn, "login")
-		case *pb.Message_RegisterMessage:
-			messageHandler = s.getOrCreateHandler(conn, "register")
-		case *pb.Message_UserListMessage:
-			messageHandler = s.getOrCreateHandler(conn, "user_list")
-		case *pb.Message_ChatMessage:
-			messageHandler = s.getOrCreateHandler(conn, "chat")
-		case *pb.Message_ExchangeKeyMessage:
-			messageHandler = s.getOrCreateHandler(conn, "exchange_keys")
-		default:
-			log.Printf("Unknown message type: %v\n", message)
-			continue
-		}
+	var servers []*http.Server
+	for address, handler := range muxes {
+		httpServer := &http.Server{Addr: address, Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+		listener := listeners[address]
+		go func() {
+			if err := httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Error serving HTTP", "address", address, "error", err)
+			}
+		}()
+		servers = append(servers, httpServer)
+	}
+	if cfg.MetricsAddress != "" {
+		slog.Info("Serving metrics", "url", "http://"+cfg.MetricsAddress+"/metrics")
+	}
+	if cfg.HealthAddress != "" {
+		slog.Info("Serving health checks", "url", "http://"+cfg.HealthAddress+"/readyz", "version", chatserver.ReadBuildInfo().Version)
+	}
+	return servers, nil
+}
 
-		messageContext := actions.NewMessageContext(messageHandler)
-		if err := messageContext.ExecuteStrategy(message); err != nil {
-			log.Printf("Error executing strategy: %v\n", err)
-			//errorMsg := &pb.Message{
-			//	Source: pb.Message_SERVER,
-			//	Packet: &pb.Message_LoginMessage{
-			//		LoginMessage: &pb.LoginPacket{
-			//			Status: pb.LoginPacket_LOGIN_FAILED,
-			//		},
-			//	},
-			//}
-			//if sendErr := util.SendMessage(conn, errorMsg); sendErr != nil {
-			//	log.Printf("Error sending error message to client: %v\n", sendErr)
-			//}
+// clientAuthentication makes the TLS config require a client certificate signed by the client CA, when one is
+// configured, and loads the usernames each certificate may log in as
+func clientAuthentication(cfg config.Config, tlsConfig *tls.Config) (*tls.Config, *chatserver.ClientCertUsers, error) {
+	if cfg.ClientCA == "" {
+		return tlsConfig, nil, nil
+	}
+	clientCAs, err := certs.LoadCertPool(cfg.ClientCA)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading client CA: %v", err)
+	}
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	var certUsers *chatserver.ClientCertUsers
+	if cfg.ClientCertUsers != "" {
+		if certUsers, err = chatserver.LoadClientCertUsers(cfg.ClientCertUsers); err != nil {
+			return nil, nil, err
 		}
 	}
+	slog.Info("Client certificates are required", "ca", cfg.ClientCA, "mapped_subjects", certUsers != nil)
+	return tlsConfig, certUsers, nil
 }
 
-func (s *Server) broadcast(message []byte, sender net.Conn) {
-	for client := range s.clients {
-		if client == sender {
-			continue
-		}
+// selfSignedHosts are the names a generated certificate is valid for: localhost, and the host of the listen
+// address or this machine's hostname when it listens on every interface
+func selfSignedHosts(address string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if host, _, _ := net.SplitHostPort(address); host != "" && host != "0.0.0.0" && host != "::" {
+		hosts = append(hosts, host)
+	} else if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
 
-		_, err := client.Write(message)
+// serveAdmin serves the admin API over HTTPS with the server certificate until the returned server is closed.
+// It returns nil when no admin address is configured.
+func serveAdmin(cfg config.Config, server *chatserver.Server, certificates *certs.Reloader, auditLog *chatserver.AuditLog, logger *slog.Logger) (*http.Server, error) {
+	if cfg.AdminAddress == "" {
+		return nil, nil
+	}
+	credentials, err := chatserver.LoadAdminCredentials(cfg.AdminCredentials)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certificates.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.AdminClientCA != "" {
+		clientCAs, err := certs.LoadCertPool(cfg.AdminClientCA)
 		if err != nil {
-			log.Printf("Error broadcasting to client: %v\n", err)
-			client.Close()
-			delete(s.clients, client)
+			return nil, fmt.Errorf("error loading admin client CA: %v", err)
 		}
+		tlsConfig.ClientCAs = clientCAs
+		// Callers with a token don't need a certificate, but a certificate that is sent must be valid
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
 	}
-}
 
-func main() {
-	err := godotenv.Load()
+	handler := chatserver.NewAdminHandler(server, chatserver.AdminOptions{
+		Credentials: credentials,
+		AuditLog:    auditLog,
+		Metrics:     chatserver.MetricsHandler(),
+		Logger:      logger,
+	})
+	listener, err := net.Listen("tcp", cfg.AdminAddress)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("error listening on %s for the admin API: %v", cfg.AdminAddress, err)
 	}
-	server := NewServer(":8080")
-	log.Fatal(server.Start())
+	adminServer := &http.Server{Addr: cfg.AdminAddress, Handler: handler, TLSConfig: tlsConfig, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := adminServer.ServeTLS(listener, "", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Error serving the admin API", "address", cfg.AdminAddress, "error", err)
+		}
+	}()
+	slog.Info("Serving the admin API", "url", "https://"+cfg.AdminAddress+"/v1/", "tokens", len(credentials.Tokens), "certificates", len(credentials.Certificates))
+	return adminServer, nil
 }
@@ -0,0 +1,29 @@
+package actions
+
+import (
+	"log/slog"
+	"net"
+	"server/internal/audit"
+	"server/internal/blinding"
+)
+
+// recordAudit writes an event to the audit log. A failure is logged, but does not fail the request.
+// Usernames are blinded with the current blinding version, so the audit log holds no more about the users than the database.
+func recordAudit(auditLog *audit.Log, keyring *blinding.Keyring, logger *slog.Logger, conn net.Conn, event audit.Event, username string, peer string) {
+	if auditLog == nil {
+		return
+	}
+	scheme := keyring.Current()
+	if username != "" {
+		event.User = scheme.Blind(username)
+	}
+	if peer != "" {
+		event.Peer = scheme.Blind(peer)
+	}
+	if conn != nil {
+		event.Remote = conn.RemoteAddr().String()
+	}
+	if err := auditLog.Record(event); err != nil {
+		logger.Error("Error writing audit record", "event", event.Type, "error", err)
+	}
+}
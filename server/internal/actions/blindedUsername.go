@@ -0,0 +1,36 @@
+package actions
+
+import (
+	"server/internal/blinding"
+	"server/internal/db"
+)
+
+// LookupUsername finds the blinded username the user is stored with, trying the newest blinding version first.
+// The admin tool finds accounts with it too.
+func LookupUsername(database db.Store, keyring *blinding.Keyring, username string) (string, blinding.Scheme, error) {
+	for _, scheme := range keyring.Schemes() {
+		blindedUsername := scheme.Blind(username)
+		exists, err := database.UserExists(blindedUsername)
+		if err != nil {
+			return "", blinding.Scheme{}, err
+		}
+		if exists {
+			return blindedUsername, scheme, nil
+		}
+	}
+	return "", blinding.Scheme{}, db.ErrUserNotFound
+}
+
+// rehashIfOutdated moves a user that was blinded with an older version to the current one.
+// It returns the blinded username the account is stored under afterwards.
+func rehashIfOutdated(database db.Store, keyring *blinding.Keyring, username string, blindedUsername string, scheme blinding.Scheme) (string, error) {
+	current := keyring.Current()
+	if scheme.Version == current.Version {
+		return blindedUsername, nil
+	}
+	rehashedUsername := current.Blind(username)
+	if err := database.RehashUser(blindedUsername, rehashedUsername, current.Version); err != nil {
+		return blindedUsername, err
+	}
+	return rehashedUsername, nil
+}
@@ -0,0 +1,50 @@
+package actions
+
+import "sync"
+
+// ChatPeers keeps track of which logged-in users have active chats with each other
+type ChatPeers struct {
+	peers map[string]map[string]bool
+	mutex sync.RWMutex
+}
+
+func NewChatPeers() *ChatPeers {
+	return &ChatPeers{peers: make(map[string]map[string]bool)}
+}
+
+func (cp *ChatPeers) Add(firstUser string, secondUser string) {
+	if firstUser == "" || secondUser == "" || firstUser == secondUser {
+		return
+	}
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.add(firstUser, secondUser)
+	cp.add(secondUser, firstUser)
+}
+
+func (cp *ChatPeers) add(user string, peer string) {
+	if _, exists := cp.peers[user]; !exists {
+		cp.peers[user] = make(map[string]bool)
+	}
+	cp.peers[user][peer] = true
+}
+
+func (cp *ChatPeers) Peers(user string) []string {
+	cp.mutex.RLock()
+	defer cp.mutex.RUnlock()
+	peers := make([]string, 0, len(cp.peers[user]))
+	for peer := range cp.peers[user] {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Remove forgets all the chats of the user (e.g. when the user disconnects)
+func (cp *ChatPeers) Remove(user string) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	for peer := range cp.peers[user] {
+		delete(cp.peers[peer], user)
+	}
+	delete(cp.peers, user)
+}
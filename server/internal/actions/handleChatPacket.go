@@ -2,20 +2,19 @@ package actions
 
 import (
 	"fmt"
-	"net"
 	"server/internal/util"
 	pb "server/resources/proto"
 )
 
 type ChatMessageHandler struct {
-	listOfLoggedInUsers *map[string]net.Conn
+	loggedInUsers *LoggedInUsers
 }
 
-func NewChatMessageHandler(listOfLoggedInUsers *map[string]net.Conn) *ChatMessageHandler {
-	return &ChatMessageHandler{listOfLoggedInUsers: listOfLoggedInUsers}
+func NewChatMessageHandler(loggedInUsers *LoggedInUsers) *ChatMessageHandler {
+	return &ChatMessageHandler{loggedInUsers: loggedInUsers}
 }
 
-func (cmh *ChatMessageHandler) handleMessage(message *pb.Message) error {
+func (cmh *ChatMessageHandler) HandleMessage(message *pb.Message) error {
 	if message == nil {
 		return fmt.Errorf("received nil message")
 	}
@@ -39,14 +38,14 @@ func (cmh *ChatMessageHandler) handleMessage(message *pb.Message) error {
 		return fmt.Errorf("recipient username is empty")
 	}
 
-	toConn, exists := (*cmh.listOfLoggedInUsers)[toUsername]
+	toConn, exists := cmh.loggedInUsers.Get(toUsername)
 	if !exists || toConn == nil {
-		return fmt.Errorf("recipient %s is not logged in or connection is nil", toUsername)
+		return fmt.Errorf("recipient is not logged in or connection is nil")
 	}
 
 	// Forward the message as is to the recipient
 	if err := util.SendMessage(toConn, message); err != nil {
-		return fmt.Errorf("failed to send message to %s: %v", toUsername, err)
+		return fmt.Errorf("failed to send message to the recipient: %v", err)
 	}
 
 	return nil
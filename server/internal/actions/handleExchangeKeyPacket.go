@@ -1,22 +1,39 @@
 package actions
 
 import (
+	"crypto/rsa"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"server/internal/audit"
+	"server/internal/blinding"
 	"server/internal/db"
+	"server/internal/decoy"
+	"server/internal/keypolicy"
+	"server/internal/logging"
 	"server/internal/util"
 	pb "server/resources/proto"
+	"time"
 )
 
 type ExchangeKeyPacket struct {
-	listOfLoggedInUsers *map[string]net.Conn
+	conn          net.Conn
+	store         db.Store
+	keyring       *blinding.Keyring
+	policy        keypolicy.KeyPolicy
+	decoys        *decoy.Generator
+	loggedInUsers *LoggedInUsers
+	chatPeers     *ChatPeers
+	logger        *slog.Logger
+	auditLog      *audit.Log
 }
 
-func NewExchangeKeyPacket(listOfLoggedInUsers *map[string]net.Conn) *ExchangeKeyPacket {
-	return &ExchangeKeyPacket{listOfLoggedInUsers: listOfLoggedInUsers}
+func NewExchangeKeyPacket(conn net.Conn, store db.Store, keyring *blinding.Keyring, policy keypolicy.KeyPolicy, decoys *decoy.Generator, loggedInUsers *LoggedInUsers, chatPeers *ChatPeers, logger *slog.Logger, auditLog *audit.Log) *ExchangeKeyPacket {
+	return &ExchangeKeyPacket{conn: conn, store: store, keyring: keyring, policy: policy, decoys: decoys, loggedInUsers: loggedInUsers, chatPeers: chatPeers, logger: logger, auditLog: auditLog}
 }
 
-func (ekp *ExchangeKeyPacket) handleMessage(message *pb.Message) error {
+func (ekp *ExchangeKeyPacket) HandleMessage(message *pb.Message) error {
 	var exchangeKeyReply *pb.ExchangeKeyPacket
 	var destinationConn net.Conn
 	exchangeKeyMessage := message.GetExchangeKeyMessage()
@@ -25,88 +42,142 @@ func (ekp *ExchangeKeyPacket) handleMessage(message *pb.Message) error {
 	}
 	sourceUser := message.GetFromUsername()
 	destinationUser := exchangeKeyMessage.GetToUsername()
+	logger := ekp.logger.With(logging.KeyPeer, destinationUser)
 
+	lookupStart := time.Now()
 	switch exchangeKeyMessage.GetStatus() {
 	case pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY:
-		fmt.Println("Received request for user public key")
+		logger.Debug("Received request for user public key")
 		// Pull from database the client's public key (Use the username hash to get the public key)
-		hashedUsername := util.HashString(message.GetExchangeKeyMessage().GetToUsername())
-		clientPublicKey, err := db.GetDatabase().GetUserPubKey(hashedUsername)
-		fmt.Printf("Got public key (%s) for %s by request from %s\n", util.DebugPrintPublicKey(clientPublicKey), message.GetExchangeKeyMessage().GetToUsername(), message.GetFromUsername())
+		clientPublicKey, known, err := ekp.getUserPubKey(destinationUser)
+		ekp.recordLookup(sourceUser, destinationUser, known, err, "")
 		if err != nil {
 			exchangeKeyReply = &pb.ExchangeKeyPacket{
 				Status: pb.ExchangeKeyPacket_ERROR,
 			}
-			fmt.Printf("error getting public key from database: %v\n", err)
-			destinationConn = (*ekp.listOfLoggedInUsers)[message.GetFromUsername()] // Return to sender
+			logger.Error("Error getting public key from database", "error", err)
+			destinationConn, _ = ekp.loggedInUsers.Get(message.GetFromUsername()) // Return to sender
 			break
 		}
+		logger.Debug("Got public key", logging.KeyKey, clientPublicKey)
 
 		exchangeKeyReply = &pb.ExchangeKeyPacket{
 			Status:     pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER,
 			Key:        clientPublicKey.N.Bytes(),
 			ToUsername: &destinationUser,
 		}
-		destinationConn = (*ekp.listOfLoggedInUsers)[message.GetFromUsername()] // Return to sender
+		destinationConn, _ = ekp.loggedInUsers.Get(message.GetFromUsername()) // Return to sender
 		break
 	case pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY_PASSIVE:
-		fmt.Println("Received request for user public key")
+		logger.Debug("Received request for user public key")
 		// Pull from database the client's public key (Use the username hash to get the public key)
-		hashedUsername := util.HashString(message.GetExchangeKeyMessage().GetToUsername())
-		clientPublicKey, err := db.GetDatabase().GetUserPubKey(hashedUsername)
-		fmt.Printf("Got public key (%s) for %s by request from %s\n", util.DebugPrintPublicKey(clientPublicKey), message.GetExchangeKeyMessage().GetToUsername(), message.GetFromUsername())
+		clientPublicKey, known, err := ekp.getUserPubKey(destinationUser)
+		ekp.recordLookup(sourceUser, destinationUser, known, err, "passive")
 		if err != nil {
 			exchangeKeyReply = &pb.ExchangeKeyPacket{
 				Status: pb.ExchangeKeyPacket_ERROR,
 			}
-			fmt.Printf("error getting public key from database: %v\n", err)
-			destinationConn = (*ekp.listOfLoggedInUsers)[message.GetFromUsername()] // Return to sender
+			logger.Error("Error getting public key from database", "error", err)
+			destinationConn, _ = ekp.loggedInUsers.Get(message.GetFromUsername()) // Return to sender
 			break
 		}
+		logger.Debug("Got public key", logging.KeyKey, clientPublicKey)
 
 		exchangeKeyReply = &pb.ExchangeKeyPacket{
 			Status:     pb.ExchangeKeyPacket_PUB_KEY_FROM_SERVER_PASSIVE,
 			Key:        clientPublicKey.N.Bytes(),
 			ToUsername: &destinationUser,
 		}
-		destinationConn = (*ekp.listOfLoggedInUsers)[message.GetFromUsername()] // Return to sender
+		destinationConn, _ = ekp.loggedInUsers.Get(message.GetFromUsername()) // Return to sender
 		break
 	case pb.ExchangeKeyPacket_REQ_FOR_SYM_KEY:
-		fmt.Println("Received request for symmetric key")
+		logger.Debug("Received request for symmetric key")
 		// Forward the message as is to the recipient
 		exchangeKeyReply = exchangeKeyMessage
-		destinationConn = (*ekp.listOfLoggedInUsers)[exchangeKeyMessage.GetToUsername()]
+		destinationConn, _ = ekp.loggedInUsers.Get(exchangeKeyMessage.GetToUsername())
 		break
 	case pb.ExchangeKeyPacket_REPLY_WITH_SYM_KEY:
-		fmt.Println("Received reply with symmetric key")
+		logger.Debug("Received reply with symmetric key")
 		// Forward the message as is to the recipient
 		exchangeKeyReply = exchangeKeyMessage
-		destinationConn = (*ekp.listOfLoggedInUsers)[exchangeKeyMessage.GetToUsername()]
+		destinationConn, _ = ekp.loggedInUsers.Get(exchangeKeyMessage.GetToUsername())
+		// The handshake is complete, both users now have an active chat
+		ekp.chatPeers.Add(sourceUser, destinationUser)
+		ekp.addContact(sourceUser, destinationUser, logger)
 		break
 	case pb.ExchangeKeyPacket_ERROR:
-		fmt.Println("Received error message")
+		logger.Debug("Received error message")
+		recordAudit(ekp.auditLog, ekp.keyring, logger, ekp.conn, audit.Event{Type: audit.EventHandshakeError, Outcome: audit.OutcomeFailure, Detail: exchangeKeyMessage.GetReason()}, sourceUser, destinationUser)
 		// Forward the message as is to the recipient
 		exchangeKeyReply = exchangeKeyMessage
-		destinationConn = (*ekp.listOfLoggedInUsers)[exchangeKeyMessage.GetToUsername()]
+		destinationConn, _ = ekp.loggedInUsers.Get(exchangeKeyMessage.GetToUsername())
 		break
 	default:
 		exchangeKeyReply = &pb.ExchangeKeyPacket{
 			Status: pb.ExchangeKeyPacket_ERROR,
 		}
-		destinationConn = (*ekp.listOfLoggedInUsers)[message.GetFromUsername()]
-		fmt.Printf("invalid exchange key message status (%d)\n", exchangeKeyMessage.GetStatus())
+		destinationConn, _ = ekp.loggedInUsers.Get(message.GetFromUsername())
+		logger.Warn("Invalid exchange key message status", "status", exchangeKeyMessage.GetStatus())
 	}
 
 	if destinationConn == nil {
 		return fmt.Errorf("destination connection not found")
 	}
-	return ekp.sendExchangeKeyMessage(exchangeKeyReply, destinationConn, sourceUser)
+	switch exchangeKeyMessage.GetStatus() {
+	case pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY, pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY_PASSIVE:
+		// Every lookup takes as long, whether the user is registered or gets a decoy key
+		ekp.decoys.Pad(lookupStart)
+	}
+	return ekp.sendExchangeKeyMessage(exchangeKeyReply, destinationConn, sourceUser, message.Traceparent)
+}
+
+// getUserPubKey returns the user's public key, or a decoy key when nobody is registered with the username.
+// known tells which one it is, only for the audit log.
+func (ekp *ExchangeKeyPacket) getUserPubKey(username string) (key *rsa.PublicKey, known bool, err error) {
+	hashedUsername, _, err := LookupUsername(ekp.store, ekp.keyring, username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		key, err = ekp.decoys.PublicKey(username, ekp.policy.MinRSABits)
+		return key, false, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	// Made up for registered users too, so the first lookup of a username takes as long either way
+	if _, err = ekp.decoys.PublicKey(username, ekp.policy.MinRSABits); err != nil {
+		return nil, false, err
+	}
+	key, err = ekp.store.GetUserPubKey(hashedUsername)
+	return key, true, err
+}
+
+// addContact remembers that the users exchanged keys, so each of them hears about it when the other's key is revoked
+func (ekp *ExchangeKeyPacket) addContact(sourceUser string, destinationUser string, logger *slog.Logger) {
+	source, sourceOnline := ekp.loggedInUsers.BlindedUsername(sourceUser)
+	destination, destinationOnline := ekp.loggedInUsers.BlindedUsername(destinationUser)
+	if !sourceOnline || !destinationOnline {
+		return
+	}
+	if err := ekp.store.AddContact(source, destination); err != nil {
+		logger.Error("Error adding contact", "error", err)
+	}
+}
+
+func (ekp *ExchangeKeyPacket) recordLookup(sourceUser string, destinationUser string, known bool, err error, detail string) {
+	event := audit.Event{Type: audit.EventKeyLookup, Outcome: audit.OutcomeSuccess, Detail: detail}
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+	} else if !known {
+		event.Outcome = audit.OutcomeUnknownUser
+	}
+	recordAudit(ekp.auditLog, ekp.keyring, ekp.logger, ekp.conn, event, sourceUser, destinationUser)
 }
 
-func (ekp *ExchangeKeyPacket) sendExchangeKeyMessage(exchangeKeyMessage *pb.ExchangeKeyPacket, destination net.Conn, sourceUser string) error {
+// sendExchangeKeyMessage sends the reply in the trace of the request, so the handshake can be followed across both clients
+func (ekp *ExchangeKeyPacket) sendExchangeKeyMessage(exchangeKeyMessage *pb.ExchangeKeyPacket, destination net.Conn, sourceUser string, traceparent *string) error {
 	message := &pb.Message{
 		Source:       pb.Message_SERVER,
 		FromUsername: &sourceUser,
+		Traceparent:  traceparent,
 		Packet: &pb.Message_ExchangeKeyMessage{
 			ExchangeKeyMessage: exchangeKeyMessage,
 		},
@@ -0,0 +1,129 @@
+package actions
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"server/internal/audit"
+	"server/internal/blinding"
+	"server/internal/db"
+	"server/internal/keypolicy"
+	"server/internal/logging"
+	"server/internal/util"
+	pb "server/resources/proto"
+)
+
+type KeyRotationMessageHandler struct {
+	conn          net.Conn
+	store         db.Store
+	keyring       *blinding.Keyring
+	policy        keypolicy.KeyPolicy
+	loggedInUsers *LoggedInUsers
+	chatPeers     *ChatPeers
+	logger        *slog.Logger
+	auditLog      *audit.Log
+}
+
+func NewKeyRotationMessageHandler(conn net.Conn, store db.Store, keyring *blinding.Keyring, policy keypolicy.KeyPolicy, loggedInUsers *LoggedInUsers, chatPeers *ChatPeers, logger *slog.Logger, auditLog *audit.Log) *KeyRotationMessageHandler {
+	return &KeyRotationMessageHandler{conn: conn, store: store, keyring: keyring, policy: policy, loggedInUsers: loggedInUsers, chatPeers: chatPeers, logger: logger, auditLog: auditLog}
+}
+
+func (h *KeyRotationMessageHandler) HandleMessage(message *pb.Message) error {
+	keyRotationMessage := message.GetKeyRotationMessage()
+	if keyRotationMessage == nil || message.GetFromUsername() == "" {
+		return fmt.Errorf("unable to parse key rotation message")
+	}
+
+	switch keyRotationMessage.GetStatus() {
+	case pb.KeyRotationPacket_REQUEST_TO_ROTATE:
+		h.logger.Debug("Received request to rotate key")
+		username := message.GetFromUsername()
+		if err := h.policy.CheckNewKey(keypolicy.AlgorithmRSA, keyRotationMessage.GetNewPublicKey()); err != nil {
+			h.recordRotation(username, audit.OutcomeFailure, err.Error())
+			reason := err.Error()
+			_ = h.sendKeyRotationMessage(&pb.KeyRotationPacket{Status: pb.KeyRotationPacket_ROTATE_FAILED, Reason: &reason})
+			return err
+		}
+		if err := h.rotateKey(username, keyRotationMessage); err != nil {
+			h.recordRotation(username, audit.OutcomeFailure, err.Error())
+			_ = h.sendKeyRotationMessage(&pb.KeyRotationPacket{Status: pb.KeyRotationPacket_ROTATE_FAILED})
+			return err
+		}
+		h.recordRotation(username, audit.OutcomeSuccess, "")
+		if err := h.sendKeyRotationMessage(&pb.KeyRotationPacket{Status: pb.KeyRotationPacket_ROTATE_SUCCESS}); err != nil {
+			return err
+		}
+		h.notifyChatPeers(username, keyRotationMessage.GetNewPublicKey())
+		return nil
+	default:
+		_ = h.sendKeyRotationMessage(&pb.KeyRotationPacket{Status: pb.KeyRotationPacket_ROTATE_FAILED})
+		return fmt.Errorf("invalid key rotation message status")
+	}
+}
+
+func (h *KeyRotationMessageHandler) recordRotation(username string, outcome string, detail string) {
+	recordAudit(h.auditLog, h.keyring, h.logger, h.conn, audit.Event{Type: audit.EventKeyRotation, Outcome: outcome, Detail: detail}, username, "")
+}
+
+func (h *KeyRotationMessageHandler) rotateKey(username string, keyRotationMessage *pb.KeyRotationPacket) error {
+	// Only the logged-in owner of the key may rotate it
+	if conn, _ := h.loggedInUsers.Get(username); conn != h.conn {
+		return fmt.Errorf("the user is not logged in on this connection")
+	}
+
+	newPublicKey := keyRotationMessage.GetNewPublicKey()
+	if len(newPublicKey) == 0 {
+		return fmt.Errorf("new public key is empty")
+	}
+
+	// Verify that the new key was signed with the current private key
+	database := h.store
+	hashedUsername, _, err := LookupUsername(database, h.keyring, username)
+	if err != nil {
+		return err
+	}
+	currentPublicKey, err := database.GetUserPubKey(hashedUsername)
+	if err != nil {
+		return fmt.Errorf("error getting public key from database: %v", err)
+	}
+	if err = util.VerifyKeyRotationSignature(currentPublicKey, username, newPublicKey, keyRotationMessage.GetSignature()); err != nil {
+		return err
+	}
+
+	return database.RotateUserPubKey(hashedUsername, currentPublicKey.N.Bytes(), newPublicKey)
+}
+
+// notifyChatPeers lets every user that has an active chat with the rotating user know that its key has changed
+func (h *KeyRotationMessageHandler) notifyChatPeers(username string, newPublicKey []byte) {
+	for _, peer := range h.chatPeers.Peers(username) {
+		peerConn, exists := h.loggedInUsers.Get(peer)
+		if !exists || peerConn == nil {
+			continue
+		}
+		notice := &pb.Message{
+			Source:       pb.Message_SERVER,
+			FromUsername: &username,
+			Packet: &pb.Message_KeyRotationMessage{
+				KeyRotationMessage: &pb.KeyRotationPacket{
+					Status:       pb.KeyRotationPacket_KEY_CHANGED,
+					NewPublicKey: newPublicKey,
+					Username:     &username,
+				},
+			},
+		}
+		if err := util.SendMessage(peerConn, notice); err != nil {
+			h.logger.Warn("Error sending key changed notice", logging.KeyPeer, peer, "error", err)
+		}
+	}
+}
+
+func (h *KeyRotationMessageHandler) sendKeyRotationMessage(reply *pb.KeyRotationPacket) error {
+	message := &pb.Message{
+		Source: pb.Message_SERVER,
+		Packet: &pb.Message_KeyRotationMessage{
+			KeyRotationMessage: reply,
+		},
+	}
+
+	return util.SendMessage(h.conn, message)
+}
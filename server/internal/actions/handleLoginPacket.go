@@ -4,28 +4,52 @@ import (
 	"bytes"
 	"crypto/rsa"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"google.golang.org/protobuf/proto"
+	"log/slog"
 	"net"
+	"server/internal/audit"
+	"server/internal/blinding"
+	"server/internal/clientcert"
 	"server/internal/db"
+	"server/internal/decoy"
+	"server/internal/keypolicy"
+	"server/internal/logging"
 	"server/internal/util"
 	pb "server/resources/proto"
+	"time"
 )
 
 type LoginMessageHandler struct {
-	conn net.Conn
+	conn     net.Conn
+	store    db.Store
+	keyring  *blinding.Keyring
+	policy   keypolicy.KeyPolicy
+	decoys   *decoy.Generator
+	logger   *slog.Logger
+	auditLog *audit.Log
+	// certUsers, if set, are the usernames each client certificate may log in as
+	certUsers *clientcert.Users
 	//
-	loggingInUser       string
-	randomToken         []byte
-	listOfLoggedInUsers *map[string]net.Conn
+	loggingInUser   string
+	blindedUsername string
+	blindingScheme  blinding.Scheme
+	publicKey       *rsa.PublicKey
+	keyStatus       keypolicy.KeyStatus
+	randomToken     []byte
+	loggedInUsers   *LoggedInUsers
 }
 
-func NewLoginMessageHandler(conn net.Conn, listOfLoggedInUsers *map[string]net.Conn) *LoginMessageHandler {
-	return &LoginMessageHandler{conn: conn, listOfLoggedInUsers: listOfLoggedInUsers}
+func NewLoginMessageHandler(conn net.Conn, store db.Store, keyring *blinding.Keyring, policy keypolicy.KeyPolicy, decoys *decoy.Generator, loggedInUsers *LoggedInUsers, logger *slog.Logger, auditLog *audit.Log, certUsers *clientcert.Users) *LoginMessageHandler {
+	return &LoginMessageHandler{conn: conn, store: store, keyring: keyring, policy: policy, decoys: decoys, loggedInUsers: loggedInUsers, logger: logger, auditLog: auditLog, certUsers: certUsers}
 }
 
-func (h *LoginMessageHandler) handleMessage(message *pb.Message) error {
+func (h *LoginMessageHandler) HandleMessage(message *pb.Message) error {
 	var err error
 	var loginReply *pb.LoginPacket
+	var lookupStart time.Time
+	var refusal string // Why an administrator's flag refused the login, for the audit log
 	loginMessage := message.GetLoginMessage()
 	if loginMessage == nil {
 		return fmt.Errorf("unable to parse login message")
@@ -36,21 +60,48 @@ func (h *LoginMessageHandler) handleMessage(message *pb.Message) error {
 		var clientPublicKey *rsa.PublicKey
 		var encryptedToken []byte
 
-		fmt.Println("Received request to login")
+		lookupStart = time.Now()
 		h.loggingInUser = message.GetFromUsername()
+		h.randomToken = nil
+		logger := h.logger.With(logging.KeyUser, h.loggingInUser)
+		logger.Debug("Received request to login")
+
+		// Checked before the lookup, so it doesn't tell which usernames are registered either
+		if refusal = h.certificateRefusal(); refusal != "" {
+			loginReply = &pb.LoginPacket{
+				Status: pb.LoginPacket_LOGIN_FAILED,
+				Reason: proto.String("This device's certificate may not log in as this user"),
+			}
+			logger.Info("Login rejected by the client certificate", "reason", refusal)
+			break
+		}
 
 		// Pull from database the client's public key (Use the username hash to get the public key)
-		hashedUsername := util.HashString(h.loggingInUser)
-		database := db.GetDatabase()
-		clientPublicKey, err = database.GetUserPubKey(hashedUsername)
+		database := h.store
+		h.blindedUsername, h.blindingScheme, err = LookupUsername(database, h.keyring, h.loggingInUser)
+		if errors.Is(err, db.ErrUserNotFound) {
+			// Unknown users get a challenge too, so the reply doesn't tell which usernames are registered
+			logger.Info("Login requested for an unknown user, sending a decoy challenge")
+			h.recordLogin(audit.OutcomeUnknownUser, "")
+			loginReply, err = h.decoyChallenge()
+			break
+		}
+		if err == nil {
+			// Made up for registered users too, so the first login request of a username takes as long either way
+			_, err = h.decoys.PublicKey(h.loggingInUser, h.policy.MinRSABits)
+		}
+		if err == nil {
+			clientPublicKey, err = database.GetUserPubKey(h.blindedUsername)
+		}
 		if err != nil {
 			loginReply = &pb.LoginPacket{
 				Status: pb.LoginPacket_LOGIN_FAILED,
 			}
-			fmt.Printf("error getting public key from database: %v", err)
+			logger.Error("Error getting public key from database", "error", err)
 			break
 		}
-		fmt.Printf("Got public key (%s) for %s by request from %s\n", util.DebugPrintPublicKey(clientPublicKey), h.loggingInUser, message.GetFromUsername())
+		logger.Debug("Got public key", logging.KeyKey, clientPublicKey)
+		h.publicKey = clientPublicKey
 
 		maxTokenLength := clientPublicKey.Size() - 2*sha256.Size - 2
 		// Generate a random token with client's public key
@@ -59,18 +110,17 @@ func (h *LoginMessageHandler) handleMessage(message *pb.Message) error {
 			loginReply = &pb.LoginPacket{
 				Status: pb.LoginPacket_LOGIN_FAILED,
 			}
-			fmt.Printf("error generating random token: %v\n", err)
+			logger.Error("Error generating random token", "error", err)
 			break
 		}
 
 		// Encrypt the random token with the client's public key
-		fmt.Printf("Encoding message with public key (%s) for %s by request from %s\n", util.DebugPrintPublicKey(clientPublicKey), h.loggingInUser, message.GetFromUsername())
 		encryptedToken, err = util.EncodeUsingPubK(h.randomToken, clientPublicKey)
 		if err != nil {
 			loginReply = &pb.LoginPacket{
 				Status: pb.LoginPacket_LOGIN_FAILED,
 			}
-			fmt.Printf("error encrypting random token: %v\n", err)
+			logger.Error("Error encrypting random token", "error", err)
 			break
 		}
 
@@ -84,17 +134,36 @@ func (h *LoginMessageHandler) handleMessage(message *pb.Message) error {
 	//	fmt.Println("Received encrypted token")
 	//	break
 	case pb.LoginPacket_DECRYPTED_TOKEN:
-		fmt.Println("Received decrypted token")
+		logger := h.logger.With(logging.KeyUser, h.loggingInUser)
+		logger.Debug("Received decrypted token")
 		decodedToken := loginMessage.GetToken()
 
-		if bytes.Compare(h.randomToken, decodedToken) == 0 {
-			fmt.Println("Login successful")
-			(*h.listOfLoggedInUsers)[h.loggingInUser] = h.conn
+		// The token can only be used once
+		expectedToken := h.randomToken
+		h.randomToken = nil
+
+		if len(expectedToken) > 0 && bytes.Equal(expectedToken, decodedToken) {
+			// Only someone who owns the key learns that the account is locked, to everyone else it looks unknown
+			if loginReply, refusal, err = h.accountRefusal(logger); loginReply != nil {
+				break
+			}
+			logger.Info("Login successful")
+			// Move the account to the current blinding version now that the user proved it owns it
+			blindedUsername, err := rehashIfOutdated(h.store, h.keyring, h.loggingInUser, h.blindedUsername, h.blindingScheme)
+			if err != nil {
+				logger.Error("Error rehashing user", "error", err)
+			}
+			h.loggedInUsers.Set(h.loggingInUser, blindedUsername, h.conn)
 			loginReply = &pb.LoginPacket{
-				Status: pb.LoginPacket_LOGIN_SUCCESS,
+				Status:             pb.LoginPacket_LOGIN_SUCCESS,
+				KeyPolicy:          h.policy.ToPacket(),
+				KeyRenewalRequired: proto.Bool(h.keyStatus.RenewalRequired),
+			}
+			if !h.keyStatus.ExpiresAt.IsZero() {
+				loginReply.KeyExpiresAt = proto.Int64(h.keyStatus.ExpiresAt.Unix())
 			}
 		} else {
-			fmt.Println("Login failed")
+			logger.Info("Login failed")
 			loginReply = &pb.LoginPacket{
 				Status: pb.LoginPacket_LOGIN_FAILED,
 			}
@@ -103,10 +172,144 @@ func (h *LoginMessageHandler) handleMessage(message *pb.Message) error {
 	default:
 		return fmt.Errorf("unknown login message status")
 	}
+	if !lookupStart.IsZero() {
+		h.decoys.Pad(lookupStart)
+	}
+	switch loginReply.GetStatus() {
+	case pb.LoginPacket_LOGIN_SUCCESS:
+		logins.Inc("success")
+		h.recordLogin(audit.OutcomeSuccess, "")
+	case pb.LoginPacket_LOGIN_FAILED:
+		logins.Inc("failure")
+		detail := "wrong token"
+		if refusal != "" {
+			detail = refusal
+		} else if err != nil {
+			detail = err.Error()
+		}
+		h.recordLogin(audit.OutcomeFailure, detail)
+	case pb.LoginPacket_KEY_EXPIRED:
+		logins.Inc("key_expired")
+		h.recordLogin(audit.OutcomeKeyExpired, refusal)
+	case pb.LoginPacket_SUSPENDED:
+		logins.Inc("suspended")
+		h.recordLogin(audit.OutcomeSuspended, refusal)
+	}
 	_ = h.sendLoginPacket(loginReply)
 	return err
 }
 
+// accountRefusal checks the flags an administrator set on the account and the age of its key. It returns the reply
+// that refuses the login and why, or a nil reply when the user may log in.
+func (h *LoginMessageHandler) accountRefusal(logger *slog.Logger) (*pb.LoginPacket, string, error) {
+	database := h.store
+	user, err := database.GetUser(h.blindedUsername)
+	if err != nil {
+		logger.Error("Error getting user from database", "error", err)
+		return &pb.LoginPacket{Status: pb.LoginPacket_LOGIN_FAILED}, "", err
+	}
+	if user.Disabled {
+		logger.Info("Login rejected, the account is disabled")
+		return &pb.LoginPacket{
+			Status: pb.LoginPacket_LOGIN_FAILED,
+			Reason: proto.String("This account has been disabled by an administrator"),
+		}, "account disabled", nil
+	}
+	suspension, err := database.ActiveSuspension(h.blindedUsername, time.Now())
+	if err == nil {
+		logger.Info("Login rejected, the account is suspended", "until", suspension.ExpiresAt)
+		return SuspendedReply(suspension), fmt.Sprintf("suspended by %s", suspension.Moderator), nil
+	}
+	if !errors.Is(err, db.ErrNotSuspended) {
+		logger.Error("Error getting suspension from database", "error", err)
+		return &pb.LoginPacket{Status: pb.LoginPacket_LOGIN_FAILED}, "", err
+	}
+	if user.KeyResetRequired {
+		// Like an expired key, only a recovery code and a new key get the user back in
+		logger.Info("Login rejected, a key reset is required")
+		return &pb.LoginPacket{
+			Status:    pb.LoginPacket_KEY_EXPIRED,
+			Reason:    proto.String("An administrator requires a new key, recover your account with a recovery code and a new key"),
+			KeyPolicy: h.policy.ToPacket(),
+		}, "key reset required", nil
+	}
+
+	// Check the key against the key policy
+	keyAlgorithm, keyCreatedAt, err := database.GetUserKeyInfo(h.blindedUsername)
+	if err != nil {
+		logger.Error("Error getting key info from database", "error", err)
+		return &pb.LoginPacket{Status: pb.LoginPacket_LOGIN_FAILED}, "", err
+	}
+	h.keyStatus = h.policy.Status(keyAlgorithm, h.publicKey.N.Bytes(), keyCreatedAt, time.Now())
+	if h.keyStatus.Expired {
+		logger.Info("Login rejected, the key has expired")
+		return &pb.LoginPacket{
+			Status:       pb.LoginPacket_KEY_EXPIRED,
+			KeyPolicy:    h.policy.ToPacket(),
+			KeyExpiresAt: proto.Int64(h.keyStatus.ExpiresAt.Unix()),
+		}, "", nil
+	}
+	return nil, "", nil
+}
+
+// certificateRefusal returns why the client certificate may not log in as the user, or "" when it may
+func (h *LoginMessageHandler) certificateRefusal() string {
+	if h.certUsers == nil {
+		return ""
+	}
+	certificate := clientcert.PeerCertificate(h.conn)
+	if certificate == nil {
+		return "no verified client certificate"
+	}
+	if !h.certUsers.Allows(certificate, h.loggingInUser) {
+		return fmt.Sprintf("client certificate %s may not log in as this user", certificate.Subject.CommonName)
+	}
+	return ""
+}
+
+// SuspendedReply tells a suspended user why and until when they can't log in
+func SuspendedReply(suspension db.Suspension) *pb.LoginPacket {
+	reply := &pb.LoginPacket{
+		Status:         pb.LoginPacket_SUSPENDED,
+		Reason:         proto.String(suspension.Reason),
+		SuspendedUntil: proto.Int64(0),
+	}
+	if !suspension.ExpiresAt.IsZero() {
+		reply.SuspendedUntil = proto.Int64(suspension.ExpiresAt.Unix())
+	}
+	return reply
+}
+
+// SuspensionMessage tells a suspended user why and until when in one sentence, for the notice that kicks them
+func SuspensionMessage(suspension db.Suspension) string {
+	if suspension.ExpiresAt.IsZero() {
+		return "This account has been banned: " + suspension.Reason
+	}
+	return fmt.Sprintf("This account has been suspended until %s: %s", suspension.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), suspension.Reason)
+}
+
+func (h *LoginMessageHandler) recordLogin(outcome string, detail string) {
+	recordAudit(h.auditLog, h.keyring, h.logger, h.conn, audit.Event{Type: audit.EventLogin, Outcome: outcome, Detail: detail}, h.loggingInUser, "")
+}
+
+// decoyChallenge encrypts a token with the decoy key of an unknown user. Nobody can decrypt it,
+// so the login fails on the decrypted token like it does for a registered user with the wrong key.
+func (h *LoginMessageHandler) decoyChallenge() (*pb.LoginPacket, error) {
+	decoyKey, err := h.decoys.PublicKey(h.loggingInUser, h.policy.MinRSABits)
+	if err != nil {
+		return &pb.LoginPacket{Status: pb.LoginPacket_LOGIN_FAILED}, fmt.Errorf("error making up a decoy key: %v", err)
+	}
+	token, err := util.GenerateRandomToken(decoyKey.Size() - 2*sha256.Size - 2)
+	if err != nil {
+		return &pb.LoginPacket{Status: pb.LoginPacket_LOGIN_FAILED}, fmt.Errorf("error generating random token: %v", err)
+	}
+	encryptedToken, err := util.EncodeUsingPubK(token, decoyKey)
+	if err != nil {
+		return &pb.LoginPacket{Status: pb.LoginPacket_LOGIN_FAILED}, fmt.Errorf("error encrypting random token: %v", err)
+	}
+	return &pb.LoginPacket{Status: pb.LoginPacket_ENCRYPTED_TOKEN, Token: encryptedToken}, nil
+}
+
 func (h *LoginMessageHandler) sendLoginPacket(reply *pb.LoginPacket) error {
 	message := &pb.Message{
 		Source: pb.Message_SERVER,
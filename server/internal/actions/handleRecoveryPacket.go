@@ -0,0 +1,148 @@
+package actions
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"server/internal/audit"
+	"server/internal/blinding"
+	"server/internal/db"
+	"server/internal/keypolicy"
+	"server/internal/logging"
+	"server/internal/util"
+	pb "server/resources/proto"
+	"time"
+)
+
+type RecoveryMessageHandler struct {
+	conn          net.Conn
+	store         db.Store
+	keyring       *blinding.Keyring
+	policy        keypolicy.KeyPolicy
+	loggedInUsers *LoggedInUsers
+	chatPeers     *ChatPeers
+	logger        *slog.Logger
+	auditLog      *audit.Log
+}
+
+func NewRecoveryMessageHandler(conn net.Conn, store db.Store, keyring *blinding.Keyring, policy keypolicy.KeyPolicy, loggedInUsers *LoggedInUsers, chatPeers *ChatPeers, logger *slog.Logger, auditLog *audit.Log) *RecoveryMessageHandler {
+	return &RecoveryMessageHandler{conn: conn, store: store, keyring: keyring, policy: policy, loggedInUsers: loggedInUsers, chatPeers: chatPeers, logger: logger, auditLog: auditLog}
+}
+
+func (h *RecoveryMessageHandler) HandleMessage(message *pb.Message) error {
+	recoveryMessage := message.GetRecoveryMessage()
+	if recoveryMessage == nil || message.GetFromUsername() == "" {
+		return fmt.Errorf("unable to parse recovery message")
+	}
+
+	switch recoveryMessage.GetStatus() {
+	case pb.RecoveryPacket_REQUEST_TO_RECOVER:
+		h.logger.Debug("Received request to recover account", logging.KeyUser, message.GetFromUsername())
+		username := message.GetFromUsername()
+		newPublicKey := recoveryMessage.GetNewPublicKey()
+		if len(newPublicKey) == 0 || len(recoveryMessage.GetRecoveryCode()) == 0 {
+			h.recordRecovery(username, audit.OutcomeFailure, "recovery code or new public key is empty")
+			_ = h.sendRecoveryMessage(&pb.RecoveryPacket{Status: pb.RecoveryPacket_RECOVERY_FAILED})
+			return fmt.Errorf("recovery code or new public key is empty")
+		}
+
+		if err := h.policy.CheckNewKey(keypolicy.AlgorithmRSA, newPublicKey); err != nil {
+			h.recordRecovery(username, audit.OutcomeFailure, err.Error())
+			reason := err.Error()
+			_ = h.sendRecoveryMessage(&pb.RecoveryPacket{Status: pb.RecoveryPacket_RECOVERY_FAILED, Reason: &reason})
+			return err
+		}
+		blindedUsername, err := h.recover(username, recoveryMessage.GetRecoveryCode(), newPublicKey)
+		if err != nil {
+			h.recordRecovery(username, audit.OutcomeFailure, err.Error())
+			_ = h.sendRecoveryMessage(&pb.RecoveryPacket{Status: pb.RecoveryPacket_RECOVERY_FAILED})
+			return fmt.Errorf("error recovering account: %v", err)
+		}
+		h.logger.Info("Account recovered, the previous key was revoked", logging.KeyUser, username)
+		h.recordRecovery(username, audit.OutcomeSuccess, "previous key revoked")
+
+		h.notifyKeyRevoked(username, blindedUsername)
+		h.dropRevokedSession(username)
+		return h.sendRecoveryMessage(&pb.RecoveryPacket{Status: pb.RecoveryPacket_RECOVERY_SUCCESS})
+	default:
+		_ = h.sendRecoveryMessage(&pb.RecoveryPacket{Status: pb.RecoveryPacket_RECOVERY_FAILED})
+		return fmt.Errorf("invalid recovery message status")
+	}
+}
+
+func (h *RecoveryMessageHandler) recordRecovery(username string, outcome string, detail string) {
+	recordAudit(h.auditLog, h.keyring, h.logger, h.conn, audit.Event{Type: audit.EventRecovery, Outcome: outcome, Detail: detail}, username, "")
+}
+
+// recover binds the new key and returns the blinded username the account is stored under
+func (h *RecoveryMessageHandler) recover(username string, recoveryCode []byte, newPublicKey []byte) (string, error) {
+	database := h.store
+	hashedUsername, scheme, err := LookupUsername(database, h.keyring, username)
+	if err != nil {
+		return "", err
+	}
+	if err = database.RecoverUser(hashedUsername, util.RecoveryCodeVerifier(recoveryCode), newPublicKey); err != nil {
+		return "", err
+	}
+	return rehashIfOutdated(database, h.keyring, username, hashedUsername, scheme)
+}
+
+// dropRevokedSession disconnects a session that was authenticated with the revoked key
+func (h *RecoveryMessageHandler) dropRevokedSession(username string) {
+	revokedConn, exists := h.loggedInUsers.Get(username)
+	if !exists || revokedConn == nil || revokedConn == h.conn {
+		return
+	}
+	if err := revokedConn.Close(); err != nil {
+		h.logger.Warn("Error closing revoked session", logging.KeyUser, username, "error", err)
+	}
+}
+
+// notifyKeyRevoked tells every contact of the user, everyone it ever exchanged keys with, that its previous key must
+// no longer be trusted. The contacts that are logged in are told right away, the others when they next log in.
+func (h *RecoveryMessageHandler) notifyKeyRevoked(username string, blindedUsername string) {
+	h.chatPeers.Remove(username)
+	contacts, err := h.store.AddKeyRevocations(blindedUsername, username, time.Now())
+	if err != nil {
+		h.logger.Error("Error queueing key revoked notices", logging.KeyUser, username, "error", err)
+		return
+	}
+	for _, contact := range contacts {
+		peer, peerConn, online := h.loggedInUsers.Find(contact)
+		if !online || peerConn == nil || peerConn == h.conn {
+			continue
+		}
+		if err = util.SendMessage(peerConn, KeyRevokedNotice(username)); err != nil {
+			h.logger.Warn("Error sending key revoked notice", logging.KeyPeer, peer, "error", err)
+			continue
+		}
+		if err = h.store.DeleteKeyRevocation(contact, username); err != nil {
+			h.logger.Error("Error deleting delivered key revoked notice", logging.KeyPeer, peer, "error", err)
+		}
+	}
+}
+
+// KeyRevokedNotice tells a contact of the user that the user's previous key was revoked
+func KeyRevokedNotice(username string) *pb.Message {
+	return &pb.Message{
+		Source:       pb.Message_SERVER,
+		FromUsername: &username,
+		Packet: &pb.Message_RecoveryMessage{
+			RecoveryMessage: &pb.RecoveryPacket{
+				Status:   pb.RecoveryPacket_KEY_REVOKED,
+				Username: &username,
+			},
+		},
+	}
+}
+
+func (h *RecoveryMessageHandler) sendRecoveryMessage(reply *pb.RecoveryPacket) error {
+	message := &pb.Message{
+		Source: pb.Message_SERVER,
+		Packet: &pb.Message_RecoveryMessage{
+			RecoveryMessage: reply,
+		},
+	}
+
+	return util.SendMessage(h.conn, message)
+}
@@ -2,21 +2,31 @@ package actions
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
+	"server/internal/audit"
+	"server/internal/blinding"
 	"server/internal/db"
+	"server/internal/keypolicy"
+	"server/internal/logging"
 	"server/internal/util"
 	pb "server/resources/proto"
 )
 
 type RegisterMessageHandler struct {
-	conn net.Conn
+	conn     net.Conn
+	store    db.Store
+	keyring  *blinding.Keyring
+	policy   keypolicy.KeyPolicy
+	logger   *slog.Logger
+	auditLog *audit.Log
 }
 
-func NewRegisterMessageHandler(conn net.Conn) *RegisterMessageHandler {
-	return &RegisterMessageHandler{conn: conn}
+func NewRegisterMessageHandler(conn net.Conn, store db.Store, keyring *blinding.Keyring, policy keypolicy.KeyPolicy, logger *slog.Logger, auditLog *audit.Log) *RegisterMessageHandler {
+	return &RegisterMessageHandler{conn: conn, store: store, keyring: keyring, policy: policy, logger: logger, auditLog: auditLog}
 }
 
-func (h *RegisterMessageHandler) handleMessage(message *pb.Message) error {
+func (h *RegisterMessageHandler) HandleMessage(message *pb.Message) error {
 	var err error
 	registerMessage := message.GetRegisterMessage()
 	if registerMessage == nil || message.GetFromUsername() == "" {
@@ -25,18 +35,34 @@ func (h *RegisterMessageHandler) handleMessage(message *pb.Message) error {
 
 	switch registerMessage.GetStatus() {
 	case pb.RegisterPacket_REQUEST_TO_REGISTER:
-		fmt.Println("Received request to register")
-		database := db.GetDatabase()
-		hashedUsername := util.HashString(message.GetFromUsername())
-		if err := database.CreateNewUser(hashedUsername, registerMessage.GetPublicKey()); err != nil {
+		logger := h.logger.With(logging.KeyUser, message.GetFromUsername())
+		logger.Debug("Received request to register")
+		username := message.GetFromUsername()
+		event := audit.Event{Type: audit.EventRegistration, Outcome: audit.OutcomeFailure}
+		policy := h.policy
+		if err := policy.CheckNewKey(registerMessage.GetKeyAlgorithm(), registerMessage.GetPublicKey()); err != nil {
+			logger.Info("Rejected key at registration", "error", err)
+			event.Detail = err.Error()
+			reason := err.Error()
+			registerMessage = &pb.RegisterPacket{
+				Status:    pb.RegisterPacket_REGISTER_FAILED,
+				Reason:    &reason,
+				KeyPolicy: policy.ToPacket(),
+			}
+		} else if err := h.createUser(username, registerMessage); err != nil {
+			logger.Warn("Error registering user", "error", err)
+			event.Detail = err.Error()
 			registerMessage = &pb.RegisterPacket{
 				Status: pb.RegisterPacket_REGISTER_FAILED,
 			}
 		} else {
+			logger.Info("User registered")
+			event.Outcome = audit.OutcomeSuccess
 			registerMessage = &pb.RegisterPacket{
 				Status: pb.RegisterPacket_REGISTER_SUCCESS,
 			}
 		}
+		recordAudit(h.auditLog, h.keyring, logger, h.conn, event, username, "")
 		err = h.sendRegisterMessage(registerMessage)
 		break
 	default:
@@ -45,6 +71,20 @@ func (h *RegisterMessageHandler) handleMessage(message *pb.Message) error {
 	return err
 }
 
+func (h *RegisterMessageHandler) createUser(username string, registerMessage *pb.RegisterPacket) error {
+	database := h.store
+	// The username must not exist under any blinding version
+	if _, _, err := LookupUsername(database, h.keyring, username); err == nil {
+		return db.ErrUserExists
+	}
+	keyAlgorithm := registerMessage.GetKeyAlgorithm()
+	if keyAlgorithm == "" {
+		keyAlgorithm = keypolicy.AlgorithmRSA
+	}
+	scheme := h.keyring.Current()
+	return database.CreateNewUser(scheme.Blind(username), scheme.Version, keyAlgorithm, registerMessage.GetPublicKey(), registerMessage.GetRecoveryCodeVerifiers())
+}
+
 func (h *RegisterMessageHandler) sendRegisterMessage(reply *pb.RegisterPacket) error {
 	message := &pb.Message{
 		Source: pb.Message_SERVER,
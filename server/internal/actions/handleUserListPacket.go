@@ -2,6 +2,7 @@ package actions
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
 	"server/internal/util"
 	pb "server/resources/proto"
@@ -9,14 +10,15 @@ import (
 
 type UserListMessageHandler struct {
 	conn     net.Conn
-	userList *map[string]net.Conn
+	userList *LoggedInUsers
+	logger   *slog.Logger
 }
 
-func NewUserListMessageHandler(conn net.Conn, userList *map[string]net.Conn) *UserListMessageHandler {
-	return &UserListMessageHandler{conn: conn, userList: userList}
+func NewUserListMessageHandler(conn net.Conn, userList *LoggedInUsers, logger *slog.Logger) *UserListMessageHandler {
+	return &UserListMessageHandler{conn: conn, userList: userList, logger: logger}
 }
 
-func (h *UserListMessageHandler) handleMessage(message *pb.Message) error {
+func (h *UserListMessageHandler) HandleMessage(message *pb.Message) error {
 	var err error
 	var reply *pb.UserListPacket
 	registerMessage := message.GetUserListMessage()
@@ -26,9 +28,9 @@ func (h *UserListMessageHandler) handleMessage(message *pb.Message) error {
 
 	switch registerMessage.GetStatus() {
 	case pb.UserListPacket_REQUEST_USER_LIST:
-		fmt.Println("Received request for user list")
+		h.logger.Debug("Received request for user list")
 		users := make([]string, 0)
-		for user := range *h.userList {
+		for user := range h.userList.Snapshot() {
 			users = append(users, user)
 		}
 		reply = &pb.UserListPacket{
@@ -36,7 +38,7 @@ func (h *UserListMessageHandler) handleMessage(message *pb.Message) error {
 			Users:  users,
 		}
 	default:
-		fmt.Println("invalid register message status")
+		h.logger.Warn("Invalid user list message status", "status", registerMessage.GetStatus())
 		reply = &pb.UserListPacket{
 			Status: pb.UserListPacket_ERROR,
 		}
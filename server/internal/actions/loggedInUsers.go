@@ -0,0 +1,104 @@
+package actions
+
+import (
+	"net"
+	"sync"
+)
+
+// LoggedInUsers keeps track of the connection each logged-in user is on. The handlers, the admin API
+// and the metrics use it from different goroutines.
+type LoggedInUsers struct {
+	users   map[string]net.Conn
+	blinded map[string]string // The blinded username each user's account is stored under
+	mutex   sync.RWMutex
+}
+
+func NewLoggedInUsers() *LoggedInUsers {
+	return &LoggedInUsers{users: make(map[string]net.Conn), blinded: make(map[string]string)}
+}
+
+// Get returns the connection the user is logged in on
+func (u *LoggedInUsers) Get(username string) (net.Conn, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	conn, exists := u.users[username]
+	return conn, exists
+}
+
+func (u *LoggedInUsers) Set(username string, blindedUsername string, conn net.Conn) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.users[username] = conn
+	u.blinded[username] = blindedUsername
+}
+
+func (u *LoggedInUsers) Delete(username string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	delete(u.users, username)
+	delete(u.blinded, username)
+}
+
+// BlindedUsername returns the blinded username the logged-in user's account is stored under
+func (u *LoggedInUsers) BlindedUsername(username string) (string, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	blindedUsername, exists := u.blinded[username]
+	return blindedUsername, exists
+}
+
+// Find returns the logged-in user whose account is stored under the blinded username, and its connection
+func (u *LoggedInUsers) Find(blindedUsername string) (string, net.Conn, bool) {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	for username, blinded := range u.blinded {
+		if blinded == blindedUsername {
+			return username, u.users[username], true
+		}
+	}
+	return "", nil, false
+}
+
+// Username returns the user logged in on the connection, or an empty string
+func (u *LoggedInUsers) Username(conn net.Conn) string {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	for username, connection := range u.users {
+		if connection == conn {
+			return username
+		}
+	}
+	return ""
+}
+
+// DeleteConn forgets the users logged in on the connection (e.g. when it is closed) and returns them
+func (u *LoggedInUsers) DeleteConn(conn net.Conn) []string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	var usernames []string
+	for username, connection := range u.users {
+		if connection == conn {
+			delete(u.users, username)
+			delete(u.blinded, username)
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// Snapshot returns a copy of the logged-in users and their connections
+func (u *LoggedInUsers) Snapshot() map[string]net.Conn {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	users := make(map[string]net.Conn, len(u.users))
+	for username, conn := range u.users {
+		users[username] = conn
+	}
+	return users
+}
+
+func (u *LoggedInUsers) Len() int {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return len(u.users)
+}
@@ -1,19 +1,24 @@
 package actions
 
-import (
-	pb "server/resources/proto"
-)
-
 type MessageContext struct {
-	strategy MessageHandler
+	strategy   MessageHandler
+	middleware []Middleware
 }
 
-func NewMessageContext(strategy MessageHandler) *MessageContext {
+// NewMessageContext wraps the handler in the middleware, the first middleware is the outermost one
+func NewMessageContext(strategy MessageHandler, middleware ...Middleware) *MessageContext {
 	return &MessageContext{
-		strategy: strategy,
+		strategy:   strategy,
+		middleware: middleware,
 	}
 }
 
-func (c *MessageContext) ExecuteStrategy(message *pb.Message) error {
-	return c.strategy.handleMessage(message)
+func (c *MessageContext) ExecuteStrategy(request *Request) error {
+	handle := func(request *Request) error {
+		return c.strategy.HandleMessage(request.Message)
+	}
+	for i := len(c.middleware) - 1; i >= 0; i-- {
+		handle = c.middleware[i](handle)
+	}
+	return handle(request)
 }
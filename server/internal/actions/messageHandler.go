@@ -2,6 +2,7 @@ package actions
 
 import pb "server/resources/proto"
 
+// MessageHandler handles one packet type for one client connection
 type MessageHandler interface {
-	handleMessage(message *pb.Message) error
+	HandleMessage(message *pb.Message) error
 }
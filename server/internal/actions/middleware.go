@@ -0,0 +1,156 @@
+package actions
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"server/internal/logging"
+	"server/internal/tracing"
+	pb "server/resources/proto"
+	"time"
+)
+
+// Request is one packet received from a client, as seen by the middleware
+type Request struct {
+	Conn     net.Conn
+	Message  *pb.Message
+	Packet   string       // Name of the packet field in pb.Message, like "loginMessage"
+	Public   bool         // Whether the packet may be sent before the user logged in
+	Username string       // The user logged in on the connection, empty before the login
+	Logger   *slog.Logger // Logs with the connection's ID, slog.Default() when nil
+}
+
+// HandleFunc handles a request, it is the handler itself or the rest of the middleware chain
+type HandleFunc func(request *Request) error
+
+// Middleware wraps the handling of every request, like the handlers it only returns errors to be logged
+type Middleware func(next HandleFunc) HandleFunc
+
+// Logging logs every request at debug level, and every request that failed with how long it took.
+// Rejected requests are only warnings.
+func Logging() Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(request *Request) error {
+			logger := request.Logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger = logger.With("packet", request.Packet)
+			if request.Username != "" {
+				logger = logger.With(logging.KeyUser, request.Username)
+			}
+			logger.Debug("Handling request")
+
+			start := time.Now()
+			err := next(request)
+			if err != nil {
+				level := slog.LevelError
+				if isRejected(err) {
+					level = slog.LevelWarn
+				}
+				logger.Log(context.Background(), level, "Error handling request", "duration", time.Since(start), "error", err)
+			}
+			return err
+		}
+	}
+}
+
+// Recovery turns a panic in a handler into an error, so it doesn't take the whole server down
+func Recovery() Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(request *Request) (err error) {
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					err = fmt.Errorf("panic handling %s: %v", request.Packet, recovered)
+				}
+			}()
+			return next(request)
+		}
+	}
+}
+
+// Authentication rejects packets that need a logged-in user when nobody is logged in on the connection,
+// or when they claim to come from a different user
+func Authentication() Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(request *Request) error {
+			if !request.Public {
+				var rejected *RejectedError
+				if request.Username == "" {
+					rejected = &RejectedError{Reason: request.Packet + " requires a logged in user"}
+				} else if request.Message.GetFromUsername() != request.Username {
+					rejected = &RejectedError{Reason: request.Packet + " claims to be from another user than the one logged in"}
+				}
+				if rejected != nil {
+					// The client gets the failure reply of its packet instead of waiting for one
+					if sendErr := sendRejection(request, rejected); sendErr != nil {
+						return fmt.Errorf("%v (error sending the rejection: %v)", rejected, sendErr)
+					}
+					return rejected
+				}
+			}
+			return next(request)
+		}
+	}
+}
+
+// Limiter decides whether a request may be handled, an error rejects it
+type Limiter interface {
+	Allow(request *Request) error
+}
+
+// RateLimit rejects the requests the limiter does not allow.
+// When the limiter returns a RejectedError the client gets the failure reply of its packet.
+func RateLimit(limiter Limiter) Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(request *Request) error {
+			if err := limiter.Allow(request); err != nil {
+				var rejected *RejectedError
+				if errors.As(err, &rejected) {
+					if sendErr := sendRejection(request, rejected); sendErr != nil {
+						return fmt.Errorf("%v (error sending the rejection: %v)", err, sendErr)
+					}
+				}
+				return err
+			}
+			return next(request)
+		}
+	}
+}
+
+// Metrics counts the requests, errors, rejections and handling time of every packet type
+func Metrics(metrics *PacketMetrics) Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(request *Request) error {
+			requestsInFlight.Add(1)
+			defer requestsInFlight.Add(-1)
+			start := time.Now()
+			err := next(request)
+			metrics.observe(request.Packet, time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// Tracing handles every request in a span that continues the trace of the message. The message gets the span's
+// traceparent, so the messages the handler relays to another client carry on the same trace.
+func Tracing(tracer *tracing.Tracer) Middleware {
+	return func(next HandleFunc) HandleFunc {
+		return func(request *Request) error {
+			span := tracer.Start(request.Message.GetTraceparent(), "handle "+request.Packet, tracing.KindInternal)
+			defer span.End()
+			if exchangeKeyMessage := request.Message.GetExchangeKeyMessage(); exchangeKeyMessage != nil {
+				// Tells the steps of a handshake apart
+				span.SetAttribute("chat.exchange_key.status", exchangeKeyMessage.GetStatus().String())
+			}
+			if traceparent := span.Traceparent(); traceparent != "" {
+				request.Message.Traceparent = &traceparent
+			}
+			err := next(request)
+			span.RecordError(err)
+			return err
+		}
+	}
+}
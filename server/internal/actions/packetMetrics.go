@@ -0,0 +1,68 @@
+package actions
+
+import (
+	"server/internal/metrics"
+	"sync"
+	"time"
+)
+
+// The process-wide metrics, PacketMetrics only counts the packets of one server
+var (
+	requestsInFlight = metrics.Default.NewGauge("chat_requests_in_flight", "Packets read from clients that are still being handled.")
+	handlingTime     = metrics.Default.NewHistogram("chat_handler_duration_seconds", "Time spent handling a packet, by packet type.", metrics.DefaultBuckets, "packet")
+	handlerErrors    = metrics.Default.NewCounter("chat_handler_errors_total", "Packets whose handling failed, by packet type.", "packet")
+	requestsRejected = metrics.Default.NewCounter("chat_requests_rejected_total", "Packets turned away by the rate limiter, by packet type.", "packet")
+	logins           = metrics.Default.NewCounter("chat_logins_total", "Answered login steps, by result (success, failure, key_expired or suspended).", "result")
+)
+
+// PacketStats are the totals for one packet type
+type PacketStats struct {
+	Requests     uint64
+	Errors       uint64
+	Rejected     uint64 // Requests a Limiter turned away, they are counted in Errors too
+	HandlingTime time.Duration
+}
+
+// PacketMetrics collects the PacketStats of every packet type
+type PacketMetrics struct {
+	mutex sync.Mutex
+	stats map[string]PacketStats
+}
+
+func NewPacketMetrics() *PacketMetrics {
+	return &PacketMetrics{stats: make(map[string]PacketStats)}
+}
+
+func (m *PacketMetrics) observe(packet string, duration time.Duration, err error) {
+	handlingTime.Observe(duration.Seconds(), packet)
+	if err != nil {
+		handlerErrors.Inc(packet)
+	}
+	if isRejected(err) {
+		requestsRejected.Inc(packet)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats := m.stats[packet]
+	stats.Requests++
+	if err != nil {
+		stats.Errors++
+	}
+	if isRejected(err) {
+		stats.Rejected++
+	}
+	stats.HandlingTime += duration
+	m.stats[packet] = stats
+}
+
+// Snapshot returns a copy of the stats, by packet type
+func (m *PacketMetrics) Snapshot() map[string]PacketStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	snapshot := make(map[string]PacketStats, len(m.stats))
+	for packet, stats := range m.stats {
+		snapshot[packet] = stats
+	}
+	return snapshot
+}
@@ -0,0 +1,132 @@
+package actions
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"server/internal/audit"
+	"server/internal/blinding"
+	"server/internal/clientcert"
+	"server/internal/db"
+	"server/internal/decoy"
+	"server/internal/keypolicy"
+	"server/internal/util"
+	pb "server/resources/proto"
+	"sync"
+)
+
+// Connection is the client connection a handler is created for, with the server state the handlers share
+type Connection struct {
+	Conn          net.Conn
+	Store         db.Store
+	Keyring       *blinding.Keyring   // Blinds the usernames the store and the audit log hold
+	KeyPolicy     keypolicy.KeyPolicy // Decides which user keys are accepted
+	Decoys        *decoy.Generator    // Makes up the public keys of unknown usernames
+	LoggedInUsers *LoggedInUsers
+	ChatPeers     *ChatPeers
+	Logger        *slog.Logger // Logs with the connection's ID
+	AuditLog      *audit.Log   // Records the security events, nil when there is no audit log
+	// ClientCertUsers are the usernames each client certificate may log in as, nil when any certificate may log in as anyone
+	ClientCertUsers *clientcert.Users
+}
+
+// HandlerFactory creates the handler of a packet type for a new connection.
+// The handler is kept for the lifetime of the connection, so it can keep state between packets.
+type HandlerFactory func(connection *Connection) MessageHandler
+
+type Registration struct {
+	Packet  string // Name of the packet field in pb.Message, like "loginMessage"
+	Public  bool   // Whether the packet may be sent before the user logged in
+	Factory HandlerFactory
+}
+
+// Registry maps the packet types of pb.Message to their handlers
+type Registry struct {
+	mutex         sync.RWMutex
+	registrations map[reflect.Type]Registration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{registrations: make(map[reflect.Type]Registration)}
+}
+
+// Register adds the handler of a packet that can only be sent by a logged-in user.
+// packet is a value of the packet's oneof wrapper type, like (*pb.Message_ChatMessage)(nil).
+func (r *Registry) Register(packet any, factory HandlerFactory) error {
+	return r.register(packet, false, factory)
+}
+
+// RegisterPublic adds the handler of a packet that can be sent before the user logged in
+func (r *Registry) RegisterPublic(packet any, factory HandlerFactory) error {
+	return r.register(packet, true, factory)
+}
+
+func (r *Registry) register(packet any, public bool, factory HandlerFactory) error {
+	packetType := reflect.TypeOf(packet)
+	oneofType, _ := reflect.TypeOf(pb.Message{}).FieldByName("Packet")
+	if packetType == nil || !packetType.Implements(oneofType.Type) {
+		return fmt.Errorf("%v is not a packet type of pb.Message", packetType)
+	}
+	if factory == nil {
+		return fmt.Errorf("no handler factory given for %v", packetType)
+	}
+
+	// Find the name of the packet field by setting it on an empty message
+	message := &pb.Message{}
+	reflect.ValueOf(message).Elem().FieldByName("Packet").Set(reflect.New(packetType.Elem()))
+	name := util.PacketName(message)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, exists := r.registrations[packetType]; exists {
+		return fmt.Errorf("a handler for %s is already registered", name)
+	}
+	r.registrations[packetType] = Registration{Packet: name, Public: public, Factory: factory}
+	return nil
+}
+
+// Lookup returns the registration of the message's packet type
+func (r *Registry) Lookup(message *pb.Message) (Registration, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	registration, exists := r.registrations[reflect.TypeOf(message.GetPacket())]
+	return registration, exists
+}
+
+// RegisterBuiltinHandlers adds the handlers of every packet the server supports out of the box
+func RegisterBuiltinHandlers(r *Registry) error {
+	registrations := []struct {
+		packet  any
+		public  bool
+		factory HandlerFactory
+	}{
+		{(*pb.Message_LoginMessage)(nil), true, func(c *Connection) MessageHandler {
+			return NewLoginMessageHandler(c.Conn, c.Store, c.Keyring, c.KeyPolicy, c.Decoys, c.LoggedInUsers, c.Logger, c.AuditLog, c.ClientCertUsers)
+		}},
+		{(*pb.Message_RegisterMessage)(nil), true, func(c *Connection) MessageHandler {
+			return NewRegisterMessageHandler(c.Conn, c.Store, c.Keyring, c.KeyPolicy, c.Logger, c.AuditLog)
+		}},
+		{(*pb.Message_RecoveryMessage)(nil), true, func(c *Connection) MessageHandler {
+			return NewRecoveryMessageHandler(c.Conn, c.Store, c.Keyring, c.KeyPolicy, c.LoggedInUsers, c.ChatPeers, c.Logger, c.AuditLog)
+		}},
+		{(*pb.Message_UserListMessage)(nil), false, func(c *Connection) MessageHandler {
+			return NewUserListMessageHandler(c.Conn, c.LoggedInUsers, c.Logger)
+		}},
+		{(*pb.Message_ChatMessage)(nil), false, func(c *Connection) MessageHandler {
+			return NewChatMessageHandler(c.LoggedInUsers)
+		}},
+		{(*pb.Message_ExchangeKeyMessage)(nil), false, func(c *Connection) MessageHandler {
+			return NewExchangeKeyPacket(c.Conn, c.Store, c.Keyring, c.KeyPolicy, c.Decoys, c.LoggedInUsers, c.ChatPeers, c.Logger, c.AuditLog)
+		}},
+		{(*pb.Message_KeyRotationMessage)(nil), false, func(c *Connection) MessageHandler {
+			return NewKeyRotationMessageHandler(c.Conn, c.Store, c.Keyring, c.KeyPolicy, c.LoggedInUsers, c.ChatPeers, c.Logger, c.AuditLog)
+		}},
+	}
+	for _, registration := range registrations {
+		if err := r.register(registration.packet, registration.public, registration.factory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package actions
+
+import (
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"math"
+	"server/internal/util"
+	pb "server/resources/proto"
+	"time"
+)
+
+// RejectedError is returned by a Limiter to turn a request away before it reaches its handler.
+// The client gets the failure reply of the packet it sent, with the reason and when to retry.
+type RejectedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return e.Reason
+}
+
+func isRejected(err error) bool {
+	var rejected *RejectedError
+	return errors.As(err, &rejected)
+}
+
+// sendRejection answers a rejected request, so the client is not left waiting for a reply that never comes
+func sendRejection(request *Request, rejection *RejectedError) error {
+	reason := rejection.Reason
+	retryAfter := proto.Int64(int64(math.Ceil(rejection.RetryAfter.Seconds())))
+	reply := &pb.Message{Source: pb.Message_SERVER}
+
+	switch packet := request.Message.GetPacket().(type) {
+	case *pb.Message_LoginMessage:
+		reply.Packet = &pb.Message_LoginMessage{LoginMessage: &pb.LoginPacket{
+			Status:            pb.LoginPacket_LOGIN_FAILED,
+			Reason:            &reason,
+			RetryAfterSeconds: retryAfter,
+		}}
+	case *pb.Message_RegisterMessage:
+		reply.Packet = &pb.Message_RegisterMessage{RegisterMessage: &pb.RegisterPacket{
+			Status:            pb.RegisterPacket_REGISTER_FAILED,
+			Reason:            &reason,
+			RetryAfterSeconds: retryAfter,
+		}}
+	case *pb.Message_RecoveryMessage:
+		reply.Packet = &pb.Message_RecoveryMessage{RecoveryMessage: &pb.RecoveryPacket{
+			Status:            pb.RecoveryPacket_RECOVERY_FAILED,
+			Reason:            &reason,
+			RetryAfterSeconds: retryAfter,
+		}}
+	case *pb.Message_KeyRotationMessage:
+		reply.Packet = &pb.Message_KeyRotationMessage{KeyRotationMessage: &pb.KeyRotationPacket{
+			Status:            pb.KeyRotationPacket_ROTATE_FAILED,
+			Reason:            &reason,
+			RetryAfterSeconds: retryAfter,
+		}}
+	case *pb.Message_ExchangeKeyMessage:
+		reply.Packet = &pb.Message_ExchangeKeyMessage{ExchangeKeyMessage: &pb.ExchangeKeyPacket{
+			Status:            pb.ExchangeKeyPacket_ERROR,
+			ToUsername:        packet.ExchangeKeyMessage.ToUsername,
+			Reason:            &reason,
+			RetryAfterSeconds: retryAfter,
+		}}
+	case *pb.Message_UserListMessage:
+		reply.Packet = &pb.Message_UserListMessage{UserListMessage: &pb.UserListPacket{
+			Status: pb.UserListPacket_ERROR,
+		}}
+	default:
+		reply.Packet = &pb.Message_ServerNoticeMessage{ServerNoticeMessage: &pb.ServerNoticePacket{
+			Type:              pb.ServerNoticePacket_REQUEST_REJECTED,
+			Reason:            &reason,
+			RetryAfterSeconds: retryAfter,
+		}}
+	}
+	return util.SendMessage(request.Conn, reply)
+}
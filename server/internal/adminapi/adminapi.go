@@ -0,0 +1,451 @@
+// Package adminapi serves the remote administration of a chat server over HTTPS. Callers authenticate with a
+// bearer token or a client certificate, and their role decides which operations they may use. Every call,
+// allowed or not, is written to the audit log.
+package adminapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"server/internal/audit"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is wrapped by the Server errors for a session or user that does not exist
+var ErrNotFound = errors.New("not found")
+
+// maxBodySize bounds the JSON body of a call
+const maxBodySize = 64 << 10
+
+// maxAnnouncementLength bounds an announcement, in bytes
+const maxAnnouncementLength = 1024
+
+// maxReasonLength bounds the reason of a suspension, in bytes
+const maxReasonLength = 512
+
+// Session is a client connection, with the user logged in on it
+type Session struct {
+	ID          uint64    `json:"id"` // The conn attribute of the server's log lines
+	Remote      string    `json:"remote"`
+	User        string    `json:"user,omitempty"` // Empty until the client logs in
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// Announcement is a message to every user
+type Announcement struct {
+	ID         string     `json:"id"`
+	Message    string     `json:"message"`
+	SendAt     time.Time  `json:"send_at"`              // Now, or when a scheduled announcement is sent
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"` // When the clients stop showing it
+	Persistent bool       `json:"persistent"`           // Also delivered at their next login to the users who are offline
+	SentAt     *time.Time `json:"sent_at,omitempty"`    // Not set until it was sent
+}
+
+// Suspension keeps a user from logging in until it expires or a moderator lifts it
+type Suspension struct {
+	ID        int64      `json:"id"`
+	Reason    string     `json:"reason"`    // Shown to the user
+	Moderator string     `json:"moderator"` // The name of the caller who suspended the user
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Not set for a ban
+	LiftedAt  *time.Time `json:"lifted_at,omitempty"`
+	LiftedBy  string     `json:"lifted_by,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+// Server is what the API manages
+type Server interface {
+	// Sessions returns the open client connections
+	Sessions() []Session
+	// Kick disconnects a session, with a reason shown to the user
+	Kick(id uint64, reason string) error
+	// DisableUser disables or enables an account, disabling also kicks the user's sessions
+	DisableUser(username string, disabled bool) (kicked int, err error)
+	// RequireKeyReset refuses the current key of an account until the user recovers it, and kicks the user's sessions
+	RequireKeyReset(username string) (kicked int, err error)
+	// DeleteUser deletes an account and kicks the user's sessions
+	DeleteUser(username string) (kicked int, err error)
+	// Announce sends a signed announcement to every connected client, or schedules it when SendAt is in the future.
+	// It returns the announcement as it was stored and how many clients it was sent to right away.
+	Announce(announcement Announcement) (Announcement, int, error)
+	// Announcements returns every announcement, in the order they are sent
+	Announcements() ([]Announcement, error)
+	// Suspend keeps a user from logging in until ExpiresAt, or for good when it is nil, and kicks the user's
+	// sessions. It returns the stored suspension and how many sessions were kicked.
+	Suspend(username string, suspension Suspension) (Suspension, int, error)
+	// LiftSuspensions lets a suspended user log in again and returns how many suspensions were lifted
+	LiftSuspensions(username string, moderator string) (int, error)
+	// Suspensions returns every suspension of a user, oldest first
+	Suspensions(username string) ([]Suspension, error)
+	// BlindUsername returns the username blinded like the users database and the audit log hold it
+	BlindUsername(username string) string
+}
+
+type Options struct {
+	// Credentials are the callers, a call without valid credentials is refused
+	Credentials *Credentials
+	// AuditLog, if set, records every call
+	AuditLog *audit.Log
+	// Metrics serves GET /v1/metrics, the endpoint is left out when it is nil
+	Metrics http.Handler
+	// Logger gets the errors of the API, slog.Default() is used when it is nil
+	Logger *slog.Logger
+}
+
+type handler struct {
+	server  Server
+	options Options
+	logger  *slog.Logger
+}
+
+// operation is an endpoint of the API
+type operation func(w http.ResponseWriter, r *http.Request) (target string)
+
+// callerKey holds the authenticated Caller in the context of the request
+type callerKey struct{}
+
+func callerOf(r *http.Request) Caller {
+	caller, _ := r.Context().Value(callerKey{}).(Caller)
+	return caller
+}
+
+// NewHandler serves the API:
+//
+//	GET  /v1/sessions                        viewer     the open sessions
+//	GET  /v1/metrics                         viewer     the server metrics in the Prometheus text format
+//	POST /v1/sessions/{id}/kick              moderator  {"reason": "..."} disconnects a session
+//	POST /v1/users/{username}/disable        moderator  disables an account and kicks its sessions
+//	POST /v1/users/{username}/enable         moderator  enables an account again
+//	POST /v1/users/{username}/suspend        moderator  {"reason": "...", "duration": "72h"} or {"reason": "...", "until": "..."}
+//	                                                    suspends an account and kicks its sessions, it is a ban without either
+//	POST /v1/users/{username}/unsuspend      moderator  lifts the active suspensions of an account
+//	GET  /v1/users/{username}/suspensions    moderator  the suspensions of an account
+//	GET  /v1/announcements                   viewer     the sent and scheduled announcements
+//	POST /v1/announcements                   admin      {"message": "...", "send_at": "...", "expires_at": "...", "persistent": true}
+//	                                                    sends an announcement to every user, the other fields are optional
+func NewHandler(server Server, options Options) http.Handler {
+	if options.Credentials == nil {
+		options.Credentials = &Credentials{}
+	}
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+	h := &handler{server: server, options: options, logger: options.Logger}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/sessions", h.authorize("list_sessions", RoleViewer, h.listSessions))
+	mux.Handle("POST /v1/sessions/{id}/kick", h.authorize("kick_session", RoleModerator, h.kickSession))
+	mux.Handle("POST /v1/users/{username}/disable", h.authorize("disable_user", RoleModerator, h.setUserDisabled(true)))
+	mux.Handle("POST /v1/users/{username}/enable", h.authorize("enable_user", RoleModerator, h.setUserDisabled(false)))
+	mux.Handle("POST /v1/users/{username}/reset-key", h.authorize("reset_user_key", RoleModerator, h.resetUserKey))
+	mux.Handle("POST /v1/users/{username}/delete", h.authorize("delete_user", RoleAdmin, h.deleteUser))
+	mux.Handle("POST /v1/users/{username}/suspend", h.authorize("suspend_user", RoleModerator, h.suspendUser))
+	mux.Handle("POST /v1/users/{username}/unsuspend", h.authorize("unsuspend_user", RoleModerator, h.unsuspendUser))
+	mux.Handle("GET /v1/users/{username}/suspensions", h.authorize("list_suspensions", RoleModerator, h.listSuspensions))
+	mux.Handle("GET /v1/announcements", h.authorize("list_announcements", RoleViewer, h.listAnnouncements))
+	mux.Handle("POST /v1/announcements", h.authorize("announce", RoleAdmin, h.announce))
+	if options.Metrics != nil {
+		mux.Handle("GET /v1/metrics", h.authorize("read_metrics", RoleViewer, func(w http.ResponseWriter, r *http.Request) string {
+			options.Metrics.ServeHTTP(w, r)
+			return ""
+		}))
+	}
+	return mux
+}
+
+// statusRecorder keeps the status code of the response for the audit log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// authorize runs the operation when the caller's role allows it, and audits the call either way
+func (h *handler) authorize(name string, role Role, op operation) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		caller, authenticated := h.caller(r)
+		switch {
+		case !authenticated:
+			recorder.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(recorder, http.StatusUnauthorized, "missing or unknown credentials")
+			h.audit(r, caller, name, "", recorder.status)
+		case caller.Role < role:
+			writeError(recorder, http.StatusForbidden, fmt.Sprintf("the %s role is required", role))
+			h.audit(r, caller, name, "", recorder.status)
+		default:
+			r.Body = http.MaxBytesReader(recorder, r.Body, maxBodySize)
+			r = r.WithContext(context.WithValue(r.Context(), callerKey{}, caller))
+			target := op(recorder, r)
+			h.audit(r, caller, name, target, recorder.status)
+		}
+	})
+}
+
+// caller authenticates the request by its bearer token, or else by its verified client certificate
+func (h *handler) caller(r *http.Request) (Caller, bool) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		token, found := strings.CutPrefix(authorization, "Bearer ")
+		if !found {
+			return Caller{}, false
+		}
+		return h.options.Credentials.tokenCaller(token)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return h.options.Credentials.certificateCaller(r.TLS.VerifiedChains[0][0])
+	}
+	return Caller{}, false
+}
+
+// audit records the call. target is the user the call was about, which is blinded like in the users database.
+func (h *handler) audit(r *http.Request, caller Caller, name string, target string, status int) {
+	if h.options.AuditLog == nil {
+		return
+	}
+	event := audit.Event{Type: audit.EventAdminCall, Outcome: audit.OutcomeSuccess, Remote: r.RemoteAddr}
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		event.Outcome = audit.OutcomeDenied
+	case status >= http.StatusBadRequest:
+		event.Outcome = audit.OutcomeFailure
+	}
+	if target != "" {
+		event.Peer = h.server.BlindUsername(target)
+	}
+	callerName := caller.Name
+	if callerName == "" {
+		callerName = "-"
+	}
+	event.Detail = fmt.Sprintf("caller=%s role=%s op=%s status=%d", callerName, caller.Role, name, status)
+	if err := h.options.AuditLog.Record(event); err != nil {
+		h.logger.Error("Error writing audit record", "event", event.Type, "error", err)
+	}
+}
+
+func (h *handler) listSessions(w http.ResponseWriter, r *http.Request) string {
+	writeJSON(w, http.StatusOK, map[string]any{"sessions": h.server.Sessions()})
+	return ""
+}
+
+func (h *handler) kickSession(w http.ResponseWriter, r *http.Request) string {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "the session ID must be a number")
+		return ""
+	}
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if !readJSON(w, r, &request) {
+		return ""
+	}
+	target := h.sessionUser(id)
+	if err = h.server.Kick(id, request.Reason); err != nil {
+		h.writeServerError(w, err)
+		return target
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"kicked": id})
+	return target
+}
+
+// sessionUser returns the user logged in on a session, for the audit log
+func (h *handler) sessionUser(id uint64) string {
+	for _, session := range h.server.Sessions() {
+		if session.ID == id {
+			return session.User
+		}
+	}
+	return ""
+}
+
+func (h *handler) setUserDisabled(disabled bool) operation {
+	return func(w http.ResponseWriter, r *http.Request) string {
+		username := r.PathValue("username")
+		kicked, err := h.server.DisableUser(username, disabled)
+		if err != nil {
+			h.writeServerError(w, err)
+			return username
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"disabled": disabled, "kicked": kicked})
+		return username
+	}
+}
+
+func (h *handler) resetUserKey(w http.ResponseWriter, r *http.Request) string {
+	username := r.PathValue("username")
+	kicked, err := h.server.RequireKeyReset(username)
+	if err != nil {
+		h.writeServerError(w, err)
+		return username
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"key_reset_required": true, "kicked": kicked})
+	return username
+}
+
+func (h *handler) deleteUser(w http.ResponseWriter, r *http.Request) string {
+	username := r.PathValue("username")
+	kicked, err := h.server.DeleteUser(username)
+	if err != nil {
+		h.writeServerError(w, err)
+		return username
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": true, "kicked": kicked})
+	return username
+}
+
+func (h *handler) suspendUser(w http.ResponseWriter, r *http.Request) string {
+	username := r.PathValue("username")
+	var request struct {
+		Reason   string     `json:"reason"`
+		Duration string     `json:"duration"`
+		Until    *time.Time `json:"until"`
+	}
+	if !readJSON(w, r, &request) {
+		return username
+	}
+	if request.Reason == "" || len(request.Reason) > maxReasonLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("the reason must be 1 to %d bytes", maxReasonLength))
+		return username
+	}
+	suspension := Suspension{Reason: request.Reason, Moderator: callerOf(r).Name, ExpiresAt: request.Until}
+	if request.Duration != "" {
+		if request.Until != nil {
+			writeError(w, http.StatusBadRequest, "pass either duration or until")
+			return username
+		}
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			writeError(w, http.StatusBadRequest, "the duration must be positive, like 90m or 72h")
+			return username
+		}
+		expiresAt := time.Now().Add(duration)
+		suspension.ExpiresAt = &expiresAt
+	}
+	if suspension.ExpiresAt != nil && !suspension.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "until must be in the future")
+		return username
+	}
+
+	suspension, kicked, err := h.server.Suspend(username, suspension)
+	if err != nil {
+		h.writeServerError(w, err)
+		return username
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"suspension": suspension, "kicked": kicked})
+	return username
+}
+
+func (h *handler) unsuspendUser(w http.ResponseWriter, r *http.Request) string {
+	username := r.PathValue("username")
+	lifted, err := h.server.LiftSuspensions(username, callerOf(r).Name)
+	if err != nil {
+		h.writeServerError(w, err)
+		return username
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"lifted": lifted})
+	return username
+}
+
+func (h *handler) listSuspensions(w http.ResponseWriter, r *http.Request) string {
+	username := r.PathValue("username")
+	suspensions, err := h.server.Suspensions(username)
+	if err != nil {
+		h.writeServerError(w, err)
+		return username
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"suspensions": suspensions})
+	return username
+}
+
+func (h *handler) listAnnouncements(w http.ResponseWriter, r *http.Request) string {
+	announcements, err := h.server.Announcements()
+	if err != nil {
+		h.writeServerError(w, err)
+		return ""
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"announcements": announcements})
+	return ""
+}
+
+func (h *handler) announce(w http.ResponseWriter, r *http.Request) string {
+	var request struct {
+		Message    string     `json:"message"`
+		SendAt     *time.Time `json:"send_at"`
+		ExpiresAt  *time.Time `json:"expires_at"`
+		Persistent bool       `json:"persistent"`
+	}
+	if !readJSON(w, r, &request) {
+		return ""
+	}
+	if request.Message == "" || len(request.Message) > maxAnnouncementLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("the message must be 1 to %d bytes", maxAnnouncementLength))
+		return ""
+	}
+	announcement := Announcement{Message: request.Message, SendAt: time.Now(), ExpiresAt: request.ExpiresAt, Persistent: request.Persistent}
+	if request.SendAt != nil && request.SendAt.After(announcement.SendAt) {
+		announcement.SendAt = *request.SendAt
+	}
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(announcement.SendAt) {
+		writeError(w, http.StatusBadRequest, "expires_at must be after the announcement is sent")
+		return ""
+	}
+
+	announcement, delivered, err := h.server.Announce(announcement)
+	if err != nil {
+		h.writeServerError(w, err)
+		return ""
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"announcement": announcement, "delivered": delivered})
+	return ""
+}
+
+// writeServerError answers 404 for ErrNotFound and hides the details of other errors from the caller
+func (h *handler) writeServerError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	h.logger.Error("Admin API call failed", "error", err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
+
+// readJSON decodes the request body, an empty body leaves v as it is
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("malformed request: %v", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,204 @@
+package adminapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"server/internal/audit"
+	"strings"
+	"testing"
+)
+
+type fakeServer struct {
+	sessions  []Session
+	kicked    []uint64
+	disabled  map[string]bool
+	keyResets []string
+	deleted   []string
+	announced []Announcement
+	suspended []Suspension
+}
+
+func (f *fakeServer) Sessions() []Session { return f.sessions }
+
+func (f *fakeServer) Kick(id uint64, reason string) error {
+	for _, session := range f.sessions {
+		if session.ID == id {
+			f.kicked = append(f.kicked, id)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (f *fakeServer) DisableUser(username string, disabled bool) (int, error) {
+	if _, exists := f.disabled[username]; !exists {
+		return 0, ErrNotFound
+	}
+	f.disabled[username] = disabled
+	return 0, nil
+}
+
+func (f *fakeServer) RequireKeyReset(username string) (int, error) {
+	if _, exists := f.disabled[username]; !exists {
+		return 0, ErrNotFound
+	}
+	f.keyResets = append(f.keyResets, username)
+	return 0, nil
+}
+
+func (f *fakeServer) DeleteUser(username string) (int, error) {
+	if _, exists := f.disabled[username]; !exists {
+		return 0, ErrNotFound
+	}
+	f.deleted = append(f.deleted, username)
+	return 0, nil
+}
+
+func (f *fakeServer) Announce(announcement Announcement) (Announcement, int, error) {
+	announcement.ID = "1"
+	f.announced = append(f.announced, announcement)
+	return announcement, len(f.sessions), nil
+}
+
+func (f *fakeServer) Announcements() ([]Announcement, error) { return f.announced, nil }
+
+func (f *fakeServer) Suspend(username string, suspension Suspension) (Suspension, int, error) {
+	if _, exists := f.disabled[username]; !exists {
+		return Suspension{}, 0, ErrNotFound
+	}
+	f.suspended = append(f.suspended, suspension)
+	return suspension, 0, nil
+}
+
+func (f *fakeServer) LiftSuspensions(username string, moderator string) (int, error) {
+	lifted := len(f.suspended)
+	f.suspended = nil
+	return lifted, nil
+}
+
+func (f *fakeServer) Suspensions(username string) ([]Suspension, error) { return f.suspended, nil }
+
+func (f *fakeServer) BlindUsername(username string) string { return "blinded:" + username }
+
+func TestRoles(t *testing.T) {
+	credentials := &Credentials{Certificates: []CertificateCredential{{Subject: "ops", Role: "moderator"}}}
+	tokens := make(map[Role]string)
+	for _, role := range []Role{RoleViewer, RoleModerator, RoleAdmin} {
+		token, credential, err := NewToken(role.String()+"-bot", role)
+		if err != nil {
+			t.Fatalf("Error generating token: %v", err)
+		}
+		tokens[role] = token
+		credentials.Tokens = append(credentials.Tokens, credential)
+	}
+	if err := credentials.validate(); err != nil {
+		t.Fatalf("Expected generated credentials to be valid, got %v", err)
+	}
+
+	sink, err := audit.OpenFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("Error opening audit log: %v", err)
+	}
+	defer sink.Close()
+	auditLog, err := audit.New(sink)
+	if err != nil {
+		t.Fatalf("Error starting audit log: %v", err)
+	}
+	server := &fakeServer{sessions: []Session{{ID: 7, Remote: "127.0.0.1:5000", User: "alice"}}, disabled: map[string]bool{"alice": false}}
+	handler := NewHandler(server, Options{Credentials: credentials, AuditLog: auditLog})
+
+	call := func(method string, path string, body string, authorize func(r *http.Request)) int {
+		request := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorize != nil {
+			authorize(request)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+	bearer := func(role Role) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tokens[role]) }
+	}
+
+	for _, test := range []struct {
+		name      string
+		method    string
+		path      string
+		body      string
+		authorize func(r *http.Request)
+		status    int
+	}{
+		{"no credentials", "GET", "/v1/sessions", "", nil, http.StatusUnauthorized},
+		{"unknown token", "GET", "/v1/sessions", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+		{"viewer lists sessions", "GET", "/v1/sessions", "", bearer(RoleViewer), http.StatusOK},
+		{"viewer can't kick", "POST", "/v1/sessions/7/kick", `{"reason":"spam"}`, bearer(RoleViewer), http.StatusForbidden},
+		{"moderator kicks", "POST", "/v1/sessions/7/kick", `{"reason":"spam"}`, bearer(RoleModerator), http.StatusOK},
+		{"unknown session", "POST", "/v1/sessions/8/kick", "", bearer(RoleModerator), http.StatusNotFound},
+		{"moderator can't announce", "POST", "/v1/announcements", `{"message":"hi"}`, bearer(RoleModerator), http.StatusForbidden},
+		{"admin announces", "POST", "/v1/announcements", `{"message":"Maintenance at noon"}`, bearer(RoleAdmin), http.StatusOK},
+		{"empty announcement", "POST", "/v1/announcements", `{}`, bearer(RoleAdmin), http.StatusBadRequest},
+		{"expires before it is sent", "POST", "/v1/announcements", `{"message":"hi","send_at":"2999-01-02T00:00:00Z","expires_at":"2999-01-01T00:00:00Z"}`, bearer(RoleAdmin), http.StatusBadRequest},
+		{"viewer lists announcements", "GET", "/v1/announcements", "", bearer(RoleViewer), http.StatusOK},
+		{"viewer can't suspend", "POST", "/v1/users/alice/suspend", `{"reason":"spam"}`, bearer(RoleViewer), http.StatusForbidden},
+		{"suspension without a reason", "POST", "/v1/users/alice/suspend", `{"duration":"72h"}`, bearer(RoleModerator), http.StatusBadRequest},
+		{"moderator suspends", "POST", "/v1/users/alice/suspend", `{"reason":"spam","duration":"72h"}`, bearer(RoleModerator), http.StatusOK},
+		{"moderator resets a key", "POST", "/v1/users/alice/reset-key", "", bearer(RoleModerator), http.StatusOK},
+		{"moderator can't delete", "POST", "/v1/users/alice/delete", "", bearer(RoleModerator), http.StatusForbidden},
+		{"admin deletes", "POST", "/v1/users/alice/delete", "", bearer(RoleAdmin), http.StatusOK},
+		{"certificate disables", "POST", "/v1/users/alice/disable", "", func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "ops"}}}}}
+		}, http.StatusOK},
+	} {
+		if status := call(test.method, test.path, test.body, test.authorize); status != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, status)
+		}
+	}
+	if len(server.kicked) != 1 || len(server.announced) != 1 || !server.disabled["alice"] {
+		t.Errorf("Expected one kick, one announcement and a disabled user, got %+v", server)
+	}
+	if len(server.keyResets) != 1 || len(server.deleted) != 1 {
+		t.Errorf("Expected one key reset and one deletion, got %+v", server)
+	}
+	if len(server.suspended) != 1 || server.suspended[0].Moderator != "moderator-bot" || server.suspended[0].ExpiresAt == nil {
+		t.Errorf("Expected a suspension for 72 hours by the caller, got %+v", server.suspended)
+	}
+
+	records, err := sink.Records()
+	if err != nil || len(records) != 18 {
+		t.Fatalf("Expected every call to be audited, got %d records (%v)", len(records), err)
+	}
+	outcomes := make(map[string]int)
+	for _, record := range records {
+		outcomes[record.Outcome]++
+		if record.Type != audit.EventAdminCall || strings.Contains(record.Detail, "alice") || record.Peer == "alice" {
+			t.Errorf("Expected an admin call record without plaintext usernames, got %+v", record)
+		}
+	}
+	if outcomes[audit.OutcomeDenied] != 6 || outcomes[audit.OutcomeFailure] != 4 || outcomes[audit.OutcomeSuccess] != 8 {
+		t.Errorf("Expected 6 denied, 4 failed and 8 successful calls, got %v", outcomes)
+	}
+	if last := records[len(records)-1]; last.Peer == "" || !strings.Contains(last.Detail, "caller=cert:ops role=moderator op=disable_user status=200") {
+		t.Errorf("Expected the caller, operation and target of the last call, got %+v", last)
+	}
+}
+
+func TestLoadCredentials(t *testing.T) {
+	for _, malformed := range []string{
+		`{"tokens": [{"name": "bot", "role": "root", "sha256": "` + strings.Repeat("a", 64) + `"}]}`,
+		`{"tokens": [{"name": "bot", "role": "admin", "sha256": "abc"}]}`,
+		`{"certificates": [{"role": "admin"}]}`,
+	} {
+		var credentials Credentials
+		if err := json.Unmarshal([]byte(malformed), &credentials); err != nil {
+			t.Fatal(err)
+		}
+		if err := credentials.validate(); err == nil {
+			t.Errorf("Expected %s to be rejected", malformed)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package adminapi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Role decides which operations a caller may use, every role may use the operations of the roles below it
+type Role int
+
+const (
+	RoleViewer    Role = iota + 1 // Lists sessions and reads the metrics
+	RoleModerator                 // Also kicks sessions and disables users
+	RoleAdmin                     // Also broadcasts announcements
+)
+
+var roleNames = map[Role]string{RoleViewer: "viewer", RoleModerator: "moderator", RoleAdmin: "admin"}
+
+func (r Role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+func ParseRole(name string) (Role, error) {
+	for role, roleName := range roleNames {
+		if roleName == name {
+			return role, nil
+		}
+	}
+	return 0, fmt.Errorf("role %q must be viewer, moderator or admin", name)
+}
+
+// TokenCredential is an admin token. Only the SHA-256 of the token is stored, so the file can't be used to log in.
+type TokenCredential struct {
+	Name   string `json:"name"`
+	Role   string `json:"role"`
+	SHA256 string `json:"sha256"` // Hex encoded
+}
+
+// CertificateCredential gives the client certificates with this subject common name a role.
+// The certificates must be signed by the admin client CA.
+type CertificateCredential struct {
+	Subject string `json:"subject"`
+	Role    string `json:"role"`
+}
+
+// Credentials are the callers of the admin API, read from a JSON file
+type Credentials struct {
+	Tokens       []TokenCredential       `json:"tokens"`
+	Certificates []CertificateCredential `json:"certificates"`
+}
+
+// Caller is who made a call
+type Caller struct {
+	Name string
+	Role Role
+}
+
+func LoadCredentials(path string) (*Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading admin credentials: %v", err)
+	}
+	var credentials Credentials
+	if err = json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("error parsing admin credentials %s: %v", path, err)
+	}
+	if err = credentials.validate(); err != nil {
+		return nil, fmt.Errorf("invalid admin credentials %s: %v", path, err)
+	}
+	return &credentials, nil
+}
+
+func (c *Credentials) validate() error {
+	for _, token := range c.Tokens {
+		if token.Name == "" {
+			return fmt.Errorf("a token has no name")
+		}
+		if _, err := ParseRole(token.Role); err != nil {
+			return fmt.Errorf("token %s: %v", token.Name, err)
+		}
+		if digest, err := hex.DecodeString(token.SHA256); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("token %s: sha256 must be 64 hex digits", token.Name)
+		}
+	}
+	for _, certificate := range c.Certificates {
+		if certificate.Subject == "" {
+			return fmt.Errorf("a certificate has no subject")
+		}
+		if _, err := ParseRole(certificate.Role); err != nil {
+			return fmt.Errorf("certificate %s: %v", certificate.Subject, err)
+		}
+	}
+	return nil
+}
+
+// tokenCaller returns the caller the token belongs to
+func (c *Credentials) tokenCaller(token string) (Caller, bool) {
+	digest := sha256.Sum256([]byte(token))
+	for _, credential := range c.Tokens {
+		expected, _ := hex.DecodeString(credential.SHA256)
+		if subtle.ConstantTimeCompare(digest[:], expected) == 1 {
+			role, _ := ParseRole(credential.Role)
+			return Caller{Name: credential.Name, Role: role}, true
+		}
+	}
+	return Caller{}, false
+}
+
+// certificateCaller returns the caller of a client certificate the TLS handshake verified
+func (c *Credentials) certificateCaller(certificate *x509.Certificate) (Caller, bool) {
+	for _, credential := range c.Certificates {
+		if credential.Subject == certificate.Subject.CommonName {
+			role, _ := ParseRole(credential.Role)
+			return Caller{Name: "cert:" + credential.Subject, Role: role}, true
+		}
+	}
+	return Caller{}, false
+}
+
+// NewToken makes up a random admin token and the credential to add to the credentials file for it
+func NewToken(name string, role Role) (string, TokenCredential, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", TokenCredential{}, fmt.Errorf("error generating token: %v", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	digest := sha256.Sum256([]byte(token))
+	return token, TokenCredential{Name: name, Role: role.String(), SHA256: hex.EncodeToString(digest[:])}, nil
+}
@@ -0,0 +1,99 @@
+// Package announcement signs the messages the administrators send to every user. They are signed with the key of
+// the server's TLS certificate, which the clients already trust, so a client only shows announcements that come
+// from the server it is connected to.
+package announcement
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"server/internal/db"
+	pb "server/resources/proto"
+)
+
+// signatureContext is signed before the announcement, so the signature can't be passed off as another one of the key
+const signatureContext = "chat announcement\x00"
+
+var errInvalidSignature = errors.New("invalid announcement signature")
+
+// Notice signs the announcement and wraps it in a server notice. The reason repeats the text for older clients.
+func Notice(signer crypto.Signer, announcement db.Announcement) (*pb.Message, error) {
+	signed := &pb.Announcement{
+		Id:     announcement.ID,
+		Text:   announcement.Text,
+		SentAt: announcement.SentAt.Unix(),
+	}
+	if !announcement.ExpiresAt.IsZero() {
+		signed.ExpiresAt = proto.Int64(announcement.ExpiresAt.Unix())
+	}
+	payload, err := proto.Marshal(signed)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling announcement: %v", err)
+	}
+	signature, err := sign(signer, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.Message{
+		Source: pb.Message_SERVER,
+		Packet: &pb.Message_ServerNoticeMessage{
+			ServerNoticeMessage: &pb.ServerNoticePacket{
+				Type:         pb.ServerNoticePacket_ANNOUNCEMENT,
+				Reason:       &announcement.Text,
+				Announcement: payload,
+				Signature:    signature,
+			},
+		},
+	}, nil
+}
+
+func sign(signer crypto.Signer, payload []byte) ([]byte, error) {
+	message := append([]byte(signatureContext), payload...)
+	var signature []byte
+	var err error
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		signature, err = signer.Sign(rand.Reader, message, crypto.Hash(0))
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256})
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("can't sign announcements with a %T key", signer.Public())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing announcement: %v", err)
+	}
+	return signature, nil
+}
+
+// Verify checks the signature of an announcement notice with the server's public key and returns the announcement
+func Verify(key crypto.PublicKey, notice *pb.ServerNoticePacket) (*pb.Announcement, error) {
+	message := append([]byte(signatureContext), notice.GetAnnouncement()...)
+	digest := sha256.Sum256(message)
+	valid := false
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, notice.GetSignature())
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPSS(key, crypto.SHA256, digest[:], notice.GetSignature(), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(key, digest[:], notice.GetSignature())
+	}
+	if !valid {
+		return nil, errInvalidSignature
+	}
+	var announcement pb.Announcement
+	if err := proto.Unmarshal(notice.GetAnnouncement(), &announcement); err != nil {
+		return nil, fmt.Errorf("error unmarshalling announcement: %v", err)
+	}
+	return &announcement, nil
+}
@@ -0,0 +1,159 @@
+// Package audit keeps an append-only record of security events, like logins and key rotations.
+// Every record holds the hash of the record before it, so changing or removing a record breaks the chain.
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	EventRegistration   = "registration"
+	EventLogin          = "login"
+	EventKeyLookup      = "key_lookup"
+	EventKeyRotation    = "key_rotation"
+	EventRecovery       = "recovery"
+	EventHandshakeError = "handshake_error" // An ExchangeKeyPacket error relayed from one client to another
+	EventAdminCall      = "admin_call"      // A call to the admin API, the caller and operation are in the detail
+)
+
+// Outcomes of an event
+const (
+	OutcomeSuccess     = "success"
+	OutcomeFailure     = "failure"
+	OutcomeKeyExpired  = "key_expired"
+	OutcomeUnknownUser = "unknown_user"
+	OutcomeSuspended   = "suspended"
+	OutcomeDenied      = "denied" // The admin API caller was not authenticated or its role does not allow the operation
+)
+
+// Event is what happened. Users are stored blinded, like in the users database.
+type Event struct {
+	Type    string `json:"type"`
+	Outcome string `json:"outcome"`
+	User    string `json:"user,omitempty"`
+	Peer    string `json:"peer,omitempty"` // The user whose key was looked up, or who a handshake error was sent to
+	Remote  string `json:"remote,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Record is an event in the chain
+type Record struct {
+	Sequence uint64    `json:"seq"`
+	Time     time.Time `json:"time"`
+	Event
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// Sink stores the records, like a file or a database table
+type Sink interface {
+	Append(record Record) error
+	// Last returns the newest record, false when there is none yet
+	Last() (Record, bool, error)
+	// Records returns every record, oldest first
+	Records() ([]Record, error)
+	Close() error
+}
+
+// ComputeHash is the SHA-256 of the record without its own hash, which includes the hash of the record before it
+func (r Record) ComputeHash() string {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		panic(fmt.Sprintf("error encoding audit record: %v", err))
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// Log chains the events and appends them to its sink. A nil Log records nothing.
+type Log struct {
+	sink Sink
+	now  func() time.Time
+
+	mutex sync.Mutex
+	last  Record
+}
+
+// New continues the chain of the records already in the sink
+func New(sink Sink) (*Log, error) {
+	last, _, err := sink.Last()
+	if err != nil {
+		return nil, fmt.Errorf("error reading the last audit record: %v", err)
+	}
+	return &Log{sink: sink, now: time.Now, last: last}, nil
+}
+
+func (l *Log) Record(event Event) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	record := Record{
+		Sequence: l.last.Sequence + 1,
+		Time:     l.now().UTC(),
+		Event:    event,
+		PrevHash: l.last.Hash,
+	}
+	record.Hash = record.ComputeHash()
+	if err := l.sink.Append(record); err != nil {
+		return fmt.Errorf("error appending audit record: %v", err)
+	}
+	l.last = record
+	return nil
+}
+
+// Verify checks that the records form an unbroken chain starting at the first record.
+// It can't tell whether records were cut off the end, so keep the last hash somewhere else to compare it.
+func Verify(records []Record) error {
+	previous := Record{}
+	for _, record := range records {
+		if record.Sequence != previous.Sequence+1 {
+			return fmt.Errorf("record %d follows record %d, records are missing", record.Sequence, previous.Sequence)
+		}
+		if record.PrevHash != previous.Hash {
+			return fmt.Errorf("record %d does not point to the hash of record %d", record.Sequence, previous.Sequence)
+		}
+		if record.ComputeHash() != record.Hash {
+			return fmt.Errorf("record %d was changed, its hash does not match", record.Sequence)
+		}
+		previous = record
+	}
+	return nil
+}
+
+// Filter selects records, empty fields match everything
+type Filter struct {
+	Users []string // Blinded usernames, matched against the user and the peer
+	Type  string
+	Since time.Time
+	Until time.Time
+}
+
+func (f Filter) Match(record Record) bool {
+	if f.Type != "" && record.Type != f.Type {
+		return false
+	}
+	if !f.Since.IsZero() && record.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !record.Time.Before(f.Until) {
+		return false
+	}
+	if len(f.Users) == 0 {
+		return true
+	}
+	for _, user := range f.Users {
+		if record.User == user || record.Peer == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := OpenFile(path)
+	if err != nil {
+		t.Fatalf("Error opening audit log: %v", err)
+	}
+	log, err := New(sink)
+	if err != nil {
+		t.Fatalf("Error starting audit log: %v", err)
+	}
+	log.now = func() time.Time { return time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC) }
+	for _, outcome := range []string{OutcomeSuccess, OutcomeFailure} {
+		if err = log.Record(Event{Type: EventLogin, Outcome: outcome, User: "alice"}); err != nil {
+			t.Fatalf("Error recording event: %v", err)
+		}
+	}
+	sink.Close()
+
+	// A new log continues the chain of the file
+	sink, _ = OpenFile(path)
+	defer sink.Close()
+	// Only one sink appends to the file at a time, another one would fork the chain
+	if second, err := OpenFile(path); err == nil {
+		second.Close()
+		t.Error("Expected the audit log to be locked by the open sink")
+	}
+	log, err = New(sink)
+	if err != nil {
+		t.Fatalf("Error reopening audit log: %v", err)
+	}
+	if err = log.Record(Event{Type: EventKeyLookup, Outcome: OutcomeUnknownUser, User: "alice", Peer: "bob"}); err != nil {
+		t.Fatalf("Error recording event: %v", err)
+	}
+	records, err := sink.Records()
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %d (%v)", len(records), err)
+	}
+	if err = Verify(records); err != nil {
+		t.Errorf("Expected the chain to be intact, got %v", err)
+	}
+	if matched := (Filter{Users: []string{"bob"}}); !matched.Match(records[2]) || matched.Match(records[0]) {
+		t.Error("Expected the filter to match the peer only in the key lookup")
+	}
+	if matched := (Filter{Since: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}); matched.Match(records[0]) || !matched.Match(records[2]) {
+		t.Error("Expected the filter to leave out the records before February")
+	}
+
+	// Changing a record, or removing one, breaks the chain
+	data, _ := os.ReadFile(path)
+	if err = os.WriteFile(path, []byte(strings.Replace(string(data), `"outcome":"failure"`, `"outcome":"success"`, 1)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ = sink.Records(); Verify(records) == nil {
+		t.Error("Expected a changed record to be found")
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if err = os.WriteFile(path, []byte(lines[0]+lines[2]), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if records, _ = sink.Records(); Verify(records) == nil {
+		t.Error("Expected a removed record to be found")
+	}
+}
@@ -0,0 +1,89 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileSink appends the records to a file, one JSON object per line. It holds a lock on the file while it is open,
+// because the Log continues the chain from the last record it knows and the records of another process would fork it.
+type FileSink struct {
+	path  string
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func OpenFile(path string) (*FileSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating audit log directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &FileSink{path: path, file: file}, nil
+}
+
+func (s *FileSink) Append(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// One write per record, so a crash can't leave half a record in the middle of the file
+	if _, err = s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *FileSink) Last() (Record, bool, error) {
+	records, err := s.Records()
+	if err != nil || len(records) == 0 {
+		return Record{}, false, err
+	}
+	return records[len(records)-1], true, nil
+}
+
+func (s *FileSink) Records() ([]Record, error) {
+	return ReadFile(s.path)
+}
+
+// ReadFile returns the records of an audit log file without locking it, so it can be read while a server appends to it
+func ReadFile(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err = json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("line %d of %s is not an audit record: %v", line, path, err)
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+	return records, nil
+}
+
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
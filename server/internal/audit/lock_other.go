@@ -0,0 +1,10 @@
+//go:build !unix
+
+package audit
+
+import "os"
+
+// lockFile does nothing where flock is not available, only one process may append to the file there
+func lockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file for as long as it is open, so no other process appends to it
+func lockFile(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("audit log %s is in use by another process", file.Name())
+		}
+		return fmt.Errorf("error locking audit log: %v", err)
+	}
+	return nil
+}
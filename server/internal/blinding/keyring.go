@@ -0,0 +1,182 @@
+package blinding
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// AlgorithmLegacy is the original unkeyed SHA-256 over SERVER_HASH_PASSWORD, the username and SERVER_HASH_SALT
+	AlgorithmLegacy = "legacy-sha256"
+	// AlgorithmHMAC is an HMAC-SHA256 of the username with a secret key
+	AlgorithmHMAC = "hmac-sha256"
+	// AlgorithmHMACArgon2 slows the HMAC down with Argon2id to make offline guessing expensive
+	AlgorithmHMACArgon2 = "hmac-argon2id"
+
+	LegacyVersion = 1
+
+	DefaultKeyringPath = "resources/auth/blinding.keys"
+	keyLength          = 32
+)
+
+// Scheme is one version of the username blinding
+type Scheme struct {
+	Version   int
+	Algorithm string
+	key       []byte
+	// The password and salt of the legacy version
+	password, salt string
+}
+
+// Blind returns the form of the username that is stored in the database
+func (s Scheme) Blind(username string) string {
+	switch s.Algorithm {
+	case AlgorithmLegacy:
+		hashed := sha256.Sum256([]byte(s.password + username + s.salt))
+		return base64.StdEncoding.EncodeToString(hashed[:])
+	case AlgorithmHMACArgon2:
+		salt := sha256.Sum256(append([]byte("blinding-salt:"), s.key...))
+		blinded := argon2.IDKey(s.hmac(username), salt[:16], 2, 19*1024, 1, keyLength)
+		return base64.StdEncoding.EncodeToString(blinded)
+	default:
+		return base64.StdEncoding.EncodeToString(s.hmac(username))
+	}
+}
+
+func (s Scheme) hmac(username string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(username))
+	return mac.Sum(nil)
+}
+
+// Keyring holds every blinding version the server knows, so accounts blinded with an older secret can still be found
+type Keyring struct {
+	schemes []Scheme // Newest version first
+}
+
+// LoadKeyring reads the keyring file. Every line holds "<version> <algorithm> <base64 key>".
+// The legacy version is always part of the keyring, a missing file leaves it as the only version.
+func LoadKeyring(path string) (*Keyring, error) {
+	keyring := LegacyKeyring()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return keyring, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening blinding keyring: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		scheme, err := parseScheme(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blinding keyring line %d: %v", lineNumber, err)
+		}
+		for _, existing := range keyring.schemes {
+			if existing.Version == scheme.Version {
+				return nil, fmt.Errorf("invalid blinding keyring line %d: duplicate version %d", lineNumber, scheme.Version)
+			}
+		}
+		keyring.schemes = append(keyring.schemes, scheme)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading blinding keyring: %v", err)
+	}
+
+	sort.Slice(keyring.schemes, func(i, j int) bool {
+		return keyring.schemes[i].Version > keyring.schemes[j].Version
+	})
+	return keyring, nil
+}
+
+// LegacyKeyring holds only the legacy version, like a keyring whose file doesn't exist
+func LegacyKeyring() *Keyring {
+	return &Keyring{schemes: []Scheme{{Version: LegacyVersion, Algorithm: AlgorithmLegacy}}}
+}
+
+// WithLegacySecrets returns a copy of the keyring whose legacy version hashes with the password and salt,
+// SERVER_HASH_PASSWORD and SERVER_HASH_SALT
+func (k *Keyring) WithLegacySecrets(password string, salt string) *Keyring {
+	schemes := make([]Scheme, len(k.schemes))
+	copy(schemes, k.schemes)
+	for i := range schemes {
+		if schemes[i].Algorithm == AlgorithmLegacy {
+			schemes[i].password, schemes[i].salt = password, salt
+		}
+	}
+	return &Keyring{schemes: schemes}
+}
+
+func parseScheme(line string) (Scheme, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return Scheme{}, fmt.Errorf("expected \"<version> <algorithm> <key>\"")
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version <= LegacyVersion {
+		return Scheme{}, fmt.Errorf("version must be a number greater than %d", LegacyVersion)
+	}
+	if fields[1] != AlgorithmHMAC && fields[1] != AlgorithmHMACArgon2 {
+		return Scheme{}, fmt.Errorf("unknown algorithm %s", fields[1])
+	}
+	key, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil || len(key) < keyLength {
+		return Scheme{}, fmt.Errorf("key must be at least %d base64 encoded bytes", keyLength)
+	}
+	return Scheme{Version: version, Algorithm: fields[1], key: key}, nil
+}
+
+// Current is the version new and rehashed accounts are stored with
+func (k *Keyring) Current() Scheme {
+	return k.schemes[0]
+}
+
+// Schemes returns all the versions, newest first
+func (k *Keyring) Schemes() []Scheme {
+	return k.schemes
+}
+
+// Rotate generates a new secret key, appends it to the keyring file and makes it the current version.
+// Accounts are moved to the new version the next time they log in.
+func (k *Keyring) Rotate(path string, algorithm string) (Scheme, error) {
+	if algorithm != AlgorithmHMAC && algorithm != AlgorithmHMACArgon2 {
+		return Scheme{}, fmt.Errorf("unknown algorithm %s", algorithm)
+	}
+	key := make([]byte, keyLength)
+	if _, err := rand.Read(key); err != nil {
+		return Scheme{}, fmt.Errorf("error generating blinding key: %v", err)
+	}
+	scheme := Scheme{Version: k.Current().Version + 1, Algorithm: algorithm, key: key}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return Scheme{}, fmt.Errorf("error creating keyring directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return Scheme{}, fmt.Errorf("error opening blinding keyring: %v", err)
+	}
+	defer file.Close()
+	line := fmt.Sprintf("%d %s %s\n", scheme.Version, scheme.Algorithm, base64.StdEncoding.EncodeToString(key))
+	if _, err = file.WriteString(line); err != nil {
+		return Scheme{}, fmt.Errorf("error writing blinding keyring: %v", err)
+	}
+
+	k.schemes = append([]Scheme{scheme}, k.schemes...)
+	return scheme, nil
+}
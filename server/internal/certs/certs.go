@@ -0,0 +1,239 @@
+// Package certs serves the server certificate, reloads it when the files are renewed and generates a
+// self-signed one for a first run
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selfSignedValidity is how long a generated certificate is valid
+const selfSignedValidity = 2 * 365 * 24 * time.Hour
+
+// Fingerprint is the SHA-256 of a DER certificate, written like "AB:CD:..." as openssl does
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	encoded := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(encoded); i += 2 {
+		pairs = append(pairs, encoded[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// LoadCertPool reads the PEM certificates of a CA file. A file without a single certificate is an error,
+// an empty pool would refuse every client certificate without saying why.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s holds no PEM certificate", path)
+	}
+	return pool, nil
+}
+
+// GenerateSelfSigned writes a new self-signed certificate for hosts and its private key to the files,
+// unless both files exist already. It reports whether it generated one.
+func GenerateSelfSigned(certFile string, keyFile string, hosts []string) (bool, error) {
+	certExists, keyExists := exists(certFile), exists(keyFile)
+	if certExists && keyExists {
+		return false, nil
+	}
+	if certExists || keyExists {
+		return false, fmt.Errorf("only one of %s and %s exists, remove it to generate a new certificate", certFile, keyFile)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, fmt.Errorf("error generating private key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return false, fmt.Errorf("error generating serial number: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "chat server", Organization: []string{"GolangSecuredChat"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		// The clients trust the certificate itself, so it is its own CA
+		IsCA: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return false, fmt.Errorf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return false, fmt.Errorf("error encoding private key: %v", err)
+	}
+
+	// The key is written first, so a certificate never exists without it
+	if err = writePEM(keyFile, "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return false, err
+	}
+	if err = writePEM(certFile, "CERTIFICATE", der, 0o644); err != nil {
+		os.Remove(keyFile)
+		return false, err
+	}
+	return true, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func writePEM(path string, blockType string, der []byte, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating directory of %s: %v", path, err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %v", path, err)
+	}
+	if err = pem.Encode(file, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing %s: %v", path, err)
+	}
+	return file.Close()
+}
+
+// Reloader serves the certificate in a pair of files, and loads it again when they change. Connections that
+// are open keep the certificate they were made with.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   *slog.Logger
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+// NewReloader loads the certificate and its private key
+func NewReloader(certFile string, keyFile string, logger *slog.Logger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate is a tls.Config GetCertificate that returns the current certificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.Certificate(), nil
+}
+
+// Certificate returns the current certificate
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert
+}
+
+// Reload loads the files again and reports whether the certificate changed. When they don't hold a valid pair,
+// like while they are being replaced, the current certificate is kept.
+func (r *Reloader) Reload() (bool, error) {
+	modTimes := [2]time.Time{modTime(r.certFile), modTime(r.keyFile)}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading server certificate: %v", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, fmt.Errorf("error parsing server certificate: %v", err)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.modTimes = modTimes
+	if r.cert != nil && bytes.Equal(r.cert.Certificate[0], cert.Certificate[0]) {
+		return false, nil
+	}
+	r.cert = &cert
+	return true, nil
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func (r *Reloader) filesChanged() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return modTime(r.certFile) != r.modTimes[0] || modTime(r.keyFile) != r.modTimes[1]
+}
+
+// Watch reloads the certificate when a value arrives on reload, like a SIGHUP, and when the files change,
+// which is checked every interval (never when it is zero). It returns when ctx is done.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, reload <-chan os.Signal) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			r.reload("signal")
+		case <-tick:
+			if r.filesChanged() {
+				r.reload("files changed")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reload(trigger string) {
+	changed, err := r.Reload()
+	switch {
+	case err != nil:
+		r.logger.Error("Error reloading server certificate, keeping the current one", "trigger", trigger, "error", err)
+	case changed:
+		cert := r.Certificate()
+		r.logger.Info("Server certificate reloaded", "trigger", trigger, "fingerprint", Fingerprint(cert.Certificate[0]), "expires", cert.Leaf.NotAfter)
+	default:
+		r.logger.Debug("Server certificate unchanged", "trigger", trigger)
+	}
+}
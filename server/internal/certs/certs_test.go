@@ -0,0 +1,110 @@
+package certs
+
+import (
+	"crypto/x509"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGenerateSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "auth", "cert.pem"), filepath.Join(dir, "auth", "key.pem")
+	generated, err := GenerateSelfSigned(certFile, keyFile, []string{"localhost", "127.0.0.1"})
+	if err != nil || !generated {
+		t.Fatalf("Expected a certificate to be generated, got %v (%v)", generated, err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a private key only the owner can read, got %v (%v)", info.Mode(), err)
+	}
+	if generated, err = GenerateSelfSigned(certFile, keyFile, nil); err != nil || generated {
+		t.Errorf("Expected an existing certificate to be kept, got %v (%v)", generated, err)
+	}
+
+	reloader, err := NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("Error loading generated certificate: %v", err)
+	}
+	leaf := reloader.Certificate().Leaf
+	if err = leaf.VerifyHostname("localhost"); err != nil {
+		t.Errorf("Expected the certificate to be valid for localhost: %v", err)
+	}
+	// The clients put the certificate itself in their pool of roots
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	if _, err = leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "127.0.0.1"}); err != nil {
+		t.Errorf("Expected the certificate to verify as its own root: %v", err)
+	}
+	if fingerprint := Fingerprint(leaf.Raw); len(fingerprint) != 95 || strings.ToUpper(fingerprint) != fingerprint {
+		t.Errorf("Expected 32 upper case hex pairs, got %q", fingerprint)
+	}
+
+	os.Remove(certFile)
+	if _, err = GenerateSelfSigned(certFile, keyFile, nil); err == nil {
+		t.Error("Expected a key without its certificate to be left alone")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if _, err := GenerateSelfSigned(certFile, keyFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	reloader, err := NewReloader(certFile, keyFile, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := reloader.Certificate()
+	if changed, err := reloader.Reload(); changed || err != nil {
+		t.Errorf("Expected the same files not to change the certificate, got %v (%v)", changed, err)
+	}
+
+	// A half written renewal keeps the current certificate
+	if err = os.WriteFile(certFile, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloader.Reload(); err == nil || reloader.Certificate() != first {
+		t.Errorf("Expected an invalid certificate to be rejected and the current one kept, got %v", err)
+	}
+
+	renewed := t.TempDir()
+	if _, err = GenerateSelfSigned(filepath.Join(renewed, "cert.pem"), filepath.Join(renewed, "key.pem"), nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cert.pem", "key.pem"} {
+		if err = os.Rename(filepath.Join(renewed, name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if changed, err := reloader.Reload(); !changed || err != nil {
+		t.Fatalf("Expected the renewed certificate to be loaded, got %v (%v)", changed, err)
+	}
+	served, _ := reloader.GetCertificate(nil)
+	if served == first {
+		t.Error("Expected the renewed certificate to be served")
+	}
+}
+
+func TestLoadCertPool(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+	if _, err := GenerateSelfSigned(certFile, filepath.Join(dir, "ca-key.pem"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertPool(certFile); err != nil {
+		t.Errorf("Expected the CA file to be loaded, got %v", err)
+	}
+
+	// A CA file without a certificate would refuse every client certificate
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCertPool(empty); err == nil {
+		t.Error("Expected a CA file without a certificate to be rejected")
+	}
+}
@@ -0,0 +1,72 @@
+// Package clientcert maps the client certificates of a mutual TLS deployment to the usernames they may log in as
+package clientcert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+)
+
+// AnyUser in the usernames of a certificate lets it log in as every user
+const AnyUser = "*"
+
+// Certificate lets the client certificates with this subject common name log in as the usernames.
+// The certificates must be signed by the client CA.
+type Certificate struct {
+	Subject   string   `json:"subject"`
+	Usernames []string `json:"usernames"`
+}
+
+// Users are the usernames each client certificate may log in as, read from a JSON file.
+// A certificate whose subject is not listed can't log in at all.
+type Users struct {
+	Certificates []Certificate `json:"certificates"`
+}
+
+func LoadUsers(path string) (*Users, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading client certificate users: %v", err)
+	}
+	var users Users
+	if err = json.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("error parsing client certificate users %s: %v", path, err)
+	}
+	for _, certificate := range users.Certificates {
+		if certificate.Subject == "" {
+			return nil, fmt.Errorf("invalid client certificate users %s: a certificate has no subject", path)
+		}
+	}
+	return &users, nil
+}
+
+// Allows reports whether the certificate may log in as username
+func (u *Users) Allows(certificate *x509.Certificate, username string) bool {
+	for _, entry := range u.Certificates {
+		if entry.Subject != certificate.Subject.CommonName {
+			continue
+		}
+		for _, allowed := range entry.Usernames {
+			if allowed == username || allowed == AnyUser {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PeerCertificate returns the client certificate the TLS handshake of conn verified, or nil
+func PeerCertificate(conn net.Conn) *x509.Certificate {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
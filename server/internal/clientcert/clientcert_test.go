@@ -0,0 +1,42 @@
+package clientcert
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	users := &Users{Certificates: []Certificate{
+		{Subject: "alice-laptop", Usernames: []string{"alice"}},
+		{Subject: "help-desk", Usernames: []string{AnyUser}},
+	}}
+	laptop := &x509.Certificate{Subject: pkix.Name{CommonName: "alice-laptop"}}
+	if !users.Allows(laptop, "alice") || users.Allows(laptop, "bob") {
+		t.Error("Expected the laptop to only log in as alice")
+	}
+	if !users.Allows(&x509.Certificate{Subject: pkix.Name{CommonName: "help-desk"}}, "bob") {
+		t.Error("Expected the help desk to log in as anyone")
+	}
+	if users.Allows(&x509.Certificate{Subject: pkix.Name{CommonName: "unknown"}}, "alice") {
+		t.Error("Expected a certificate that is not listed not to log in")
+	}
+}
+
+func TestLoadUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(`{"certificates": [{"subject": "alice-laptop", "usernames": ["alice"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := LoadUsers(path); err != nil || len(users.Certificates) != 1 {
+		t.Errorf("Expected one certificate, got %v (%v)", users, err)
+	}
+	if err := os.WriteFile(path, []byte(`{"certificates": [{"usernames": ["alice"]}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadUsers(path); err == nil {
+		t.Error("Expected a certificate without a subject to be rejected")
+	}
+}
@@ -0,0 +1,756 @@
+package config
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/joho/godotenv"
+	"math"
+	"net"
+	"os"
+	"server/internal/adminapi"
+	"server/internal/blinding"
+	"server/internal/certs"
+	"server/internal/clientcert"
+	"server/internal/decoy"
+	"server/internal/keypolicy"
+	"server/internal/logging"
+	"server/internal/netlimit"
+	"server/internal/ratelimit"
+	"server/internal/tracing"
+	"server/internal/util"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit log settings that are not a file path
+const (
+	AuditLogDatabase = "db"
+	AuditLogOff      = "off"
+)
+
+// Config is everything the server needs to start. Values are read, from lowest to highest precedence,
+// from the defaults, the JSON config file, the environment (and .env) and the command-line flags.
+type Config struct {
+	Address     string `json:"address"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// TLSSelfSigned generates a self-signed certificate and key when neither file exists
+	TLSSelfSigned bool `json:"tls_self_signed"`
+	// ClientCA is the PEM file of the CAs that sign the client certificates. When it is set, every client needs one.
+	ClientCA string `json:"client_ca"`
+	// ClientCertUsers is the JSON file of the usernames each client certificate subject may log in as
+	ClientCertUsers string `json:"client_cert_users"`
+	// TLSReloadInterval is how often the certificate files are checked for changes, 0 only reloads them on SIGHUP
+	TLSReloadInterval Duration `json:"tls_reload_interval"`
+	DBPath            string   `json:"db_path"`
+	MaxMessageSize    int      `json:"max_message_size"` // Largest packet, in bytes, the server reads from a client
+	HashPassword      string   `json:"hash_password"`
+	HashSalt          string   `json:"hash_salt"`
+	BlindingKeyring   string   `json:"blinding_keyring"`
+	ShutdownTimeout   Duration `json:"shutdown_timeout"` // How long connected clients get to drain on shutdown
+
+	// Token buckets written like "10/1m", see ratelimit.Config for what each one counts
+	RateLimitConnection ratelimit.Limit `json:"rate_limit_connection"`
+	RateLimitIP         ratelimit.Limit `json:"rate_limit_ip"`
+	RateLimitUsername   ratelimit.Limit `json:"rate_limit_username"`
+	RateLimitAccount    ratelimit.Limit `json:"rate_limit_account"`
+	RateLimitKeyLookups ratelimit.Limit `json:"rate_limit_key_lookups"`
+	RateLimitLockout    Duration        `json:"rate_limit_lockout"` // How long a client that went over a limit is turned away
+
+	// Which client connections are served, checked before the TLS handshake. Zero turns a limit off.
+	AllowCIDRs          netlimit.Prefixes `json:"allow_cidrs"` // Only these addresses may connect, when it is not empty
+	DenyCIDRs           netlimit.Prefixes `json:"deny_cidrs"`  // These addresses may never connect
+	MaxConnections      int               `json:"max_connections"`
+	MaxConnectionsPerIP int               `json:"max_connections_per_ip"`
+	HandshakeTimeout    Duration          `json:"handshake_timeout"` // How long a client gets to finish the TLS handshake
+	// TrustedProxies are the load balancers that send a PROXY protocol header with the client's address
+	TrustedProxies netlimit.Prefixes `json:"trusted_proxies"`
+
+	// How long every login request and key lookup takes at least, so unknown usernames don't answer faster
+	LookupResponseTime Duration `json:"lookup_response_time"`
+	// DecoySecret is the file of the secret the decoy keys of unknown usernames are derived from, created on the first run
+	DecoySecret string `json:"decoy_secret"`
+
+	// The key policy, see keypolicy.KeyPolicy. KeyMaxAge zero never expires keys.
+	KeyMinRSABits        int      `json:"key_min_rsa_bits"`
+	KeyAllowedAlgorithms List     `json:"key_allowed_algorithms"`
+	KeyMaxAge            Duration `json:"key_max_age"`
+	KeyGracePeriod       Duration `json:"key_grace_period"` // How long an expired key is still accepted, with a warning
+
+	// MetricsAddress is where the Prometheus metrics are served over HTTP, they are not served when it is empty
+	MetricsAddress string `json:"metrics_address"`
+	// HealthAddress is where the liveness and readiness checks are served over HTTP, they are not served when it is empty.
+	// It can be the same as MetricsAddress.
+	HealthAddress string `json:"health_address"`
+
+	// AdminAddress is where the admin API is served over HTTPS with the server certificate, it is not served when it is empty
+	AdminAddress string `json:"admin_address"`
+	// AdminCredentials is the JSON file of the admin tokens and client certificate subjects, and their roles
+	AdminCredentials string `json:"admin_credentials"`
+	// AdminClientCA is the PEM file of the CAs that sign the admin client certificates, only tokens are accepted without it
+	AdminClientCA string `json:"admin_client_ca"`
+
+	LogLevel  string `json:"log_level"`  // debug, info, warn or error
+	LogFormat string `json:"log_format"` // text or json
+	LogRedact bool   `json:"log_redact"` // Replace usernames by pseudonyms and leave key fingerprints out of the logs
+
+	// AuditLog is where the security events are recorded: "db" for the users database, a file path, or "off"
+	AuditLog string `json:"audit_log"`
+
+	// TraceExport is where the spans of every packet are written as OTLP/JSON lines: "stdout", a file path, or "off"
+	TraceExport string `json:"trace_export"`
+}
+
+// Duration is a time.Duration written as a string like "10s" in the config file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\"")
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// List is a list of values written as a JSON array in the config file, and comma separated elsewhere
+type List []string
+
+func (l *List) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *List) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// setting describes where a value can be set, so errors can tell the user how to fix it
+type setting struct {
+	field string
+	env   string
+	flag  string
+}
+
+var (
+	addressSetting         = setting{"address", "SERVER_LISTEN_ADDRESS", "address"}
+	tlsCertSetting         = setting{"tls_cert_file", "SERVER_TLS_CERT", "tls-cert"}
+	tlsKeySetting          = setting{"tls_key_file", "SERVER_TLS_KEY", "tls-key"}
+	tlsSelfSignedSetting   = setting{"tls_self_signed", "SERVER_TLS_SELF_SIGNED", "tls-self-signed"}
+	tlsReloadSetting       = setting{"tls_reload_interval", "SERVER_TLS_RELOAD_INTERVAL", "tls-reload-interval"}
+	clientCASetting        = setting{"client_ca", "SERVER_CLIENT_CA", "client-ca"}
+	clientCertUsersSetting = setting{"client_cert_users", "SERVER_CLIENT_CERT_USERS", "client-cert-users"}
+	dbPathSetting          = setting{"db_path", "SERVER_DB_PATH", "db"}
+	maxMessageSizeSetting  = setting{"max_message_size", "SERVER_MAX_MESSAGE_SIZE", "max-message-size"}
+	hashPasswordSetting    = setting{"hash_password", "SERVER_HASH_PASSWORD", ""}
+	hashSaltSetting        = setting{"hash_salt", "SERVER_HASH_SALT", ""}
+	blindingKeyringSetting = setting{"blinding_keyring", "SERVER_BLINDING_KEYRING", "blinding-keyring"}
+	shutdownTimeoutSetting = setting{"shutdown_timeout", "SERVER_SHUTDOWN_TIMEOUT", "shutdown-timeout"}
+
+	rateLimitConnectionSetting = setting{"rate_limit_connection", "SERVER_RATE_LIMIT_CONNECTION", "rate-limit-connection"}
+	rateLimitIPSetting         = setting{"rate_limit_ip", "SERVER_RATE_LIMIT_IP", "rate-limit-ip"}
+	rateLimitUsernameSetting   = setting{"rate_limit_username", "SERVER_RATE_LIMIT_USERNAME", "rate-limit-username"}
+	rateLimitAccountSetting    = setting{"rate_limit_account", "SERVER_RATE_LIMIT_ACCOUNT", "rate-limit-account"}
+	rateLimitKeyLookupsSetting = setting{"rate_limit_key_lookups", "SERVER_RATE_LIMIT_KEY_LOOKUPS", "rate-limit-key-lookups"}
+	rateLimitLockoutSetting    = setting{"rate_limit_lockout", "SERVER_RATE_LIMIT_LOCKOUT", "rate-limit-lockout"}
+	allowCIDRsSetting          = setting{"allow_cidrs", "SERVER_ALLOW_CIDRS", "allow-cidrs"}
+	denyCIDRsSetting           = setting{"deny_cidrs", "SERVER_DENY_CIDRS", "deny-cidrs"}
+	maxConnectionsSetting      = setting{"max_connections", "SERVER_MAX_CONNECTIONS", "max-connections"}
+	maxConnectionsPerIPSetting = setting{"max_connections_per_ip", "SERVER_MAX_CONNECTIONS_PER_IP", "max-connections-per-ip"}
+	handshakeTimeoutSetting    = setting{"handshake_timeout", "SERVER_HANDSHAKE_TIMEOUT", "handshake-timeout"}
+	trustedProxiesSetting      = setting{"trusted_proxies", "SERVER_TRUSTED_PROXIES", "trusted-proxies"}
+	lookupResponseTimeSetting  = setting{"lookup_response_time", "SERVER_LOOKUP_RESPONSE_TIME", "lookup-response-time"}
+	decoySecretSetting         = setting{"decoy_secret", "SERVER_DECOY_SECRET", "decoy-secret"}
+	keyMinRSABitsSetting       = setting{"key_min_rsa_bits", "SERVER_KEY_MIN_RSA_BITS", "key-min-rsa-bits"}
+	keyAlgorithmsSetting       = setting{"key_allowed_algorithms", "SERVER_KEY_ALLOWED_ALGORITHMS", "key-allowed-algorithms"}
+	keyMaxAgeSetting           = setting{"key_max_age", "SERVER_KEY_MAX_AGE", "key-max-age"}
+	keyGracePeriodSetting      = setting{"key_grace_period", "SERVER_KEY_GRACE_PERIOD", "key-grace-period"}
+	metricsAddressSetting      = setting{"metrics_address", "SERVER_METRICS_ADDRESS", "metrics-address"}
+	healthAddressSetting       = setting{"health_address", "SERVER_HEALTH_ADDRESS", "health-address"}
+	adminAddressSetting        = setting{"admin_address", "SERVER_ADMIN_ADDRESS", "admin-address"}
+	adminCredentialsSetting    = setting{"admin_credentials", "SERVER_ADMIN_CREDENTIALS", "admin-credentials"}
+	adminClientCASetting       = setting{"admin_client_ca", "SERVER_ADMIN_CLIENT_CA", "admin-client-ca"}
+	logLevelSetting            = setting{"log_level", "SERVER_LOG_LEVEL", "log-level"}
+	logFormatSetting           = setting{"log_format", "SERVER_LOG_FORMAT", "log-format"}
+	logRedactSetting           = setting{"log_redact", "SERVER_LOG_REDACT", "log-redact"}
+	auditLogSetting            = setting{"audit_log", "SERVER_AUDIT_LOG", "audit-log"}
+	traceExportSetting         = setting{"trace_export", "SERVER_TRACE_EXPORT", "trace-export"}
+)
+
+func (s setting) String() string {
+	if s.flag == "" {
+		return fmt.Sprintf("%s (set with %s or %s in the config file)", s.field, s.env, s.field)
+	}
+	return fmt.Sprintf("%s (set with -%s, %s or %s in the config file)", s.field, s.flag, s.env, s.field)
+}
+
+func Default() Config {
+	rateLimits := ratelimit.DefaultConfig()
+	keyPolicy := keypolicy.DefaultKeyPolicy()
+	return Config{
+		Address:           ":8080",
+		TLSCertFile:       "resources/auth/server-cert.pem",
+		TLSKeyFile:        "resources/auth/server-key.pem",
+		TLSReloadInterval: Duration(time.Minute),
+		DBPath:            "server/resources/db/users.db",
+		MaxMessageSize:    util.DefaultMaxMessageSize,
+		BlindingKeyring:   blinding.DefaultKeyringPath,
+		ShutdownTimeout:   Duration(10 * time.Second),
+
+		RateLimitConnection: rateLimits.PerConnection,
+		RateLimitIP:         rateLimits.PerIP,
+		RateLimitUsername:   rateLimits.PerUsername,
+		RateLimitAccount:    rateLimits.PerAccount,
+		RateLimitKeyLookups: rateLimits.KeyLookups,
+		RateLimitLockout:    Duration(rateLimits.Lockout),
+		LookupResponseTime:  Duration(decoy.DefaultMinResponseTime),
+		DecoySecret:         decoy.DefaultSecretPath,
+
+		KeyMinRSABits:        keyPolicy.MinRSABits,
+		KeyAllowedAlgorithms: keyPolicy.AllowedAlgorithms,
+		KeyMaxAge:            Duration(keyPolicy.MaxKeyAge),
+		KeyGracePeriod:       Duration(keyPolicy.GracePeriod),
+
+		MaxConnections:      1000,
+		MaxConnectionsPerIP: 20,
+		HandshakeTimeout:    Duration(10 * time.Second),
+
+		LogLevel:    "info",
+		LogFormat:   "text",
+		LogRedact:   true,
+		AuditLog:    AuditLogDatabase,
+		TraceExport: tracing.ExportOff,
+	}
+}
+
+// Load builds the configuration from the command-line arguments, the environment and the config file.
+// The config file is given with -config or SERVER_CONFIG, the .env file is optional.
+func Load(args []string) (Config, error) {
+	if err := godotenv.Load(); err != nil && !os.IsNotExist(err) {
+		return Config{}, fmt.Errorf("error loading .env file: %v", err)
+	}
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("SERVER_CONFIG"), "path of the JSON config file (env SERVER_CONFIG)")
+	var flagValues Config
+	flags.StringVar(&flagValues.Address, addressSetting.flag, "", "address to listen on (env "+addressSetting.env+")")
+	flags.StringVar(&flagValues.TLSCertFile, tlsCertSetting.flag, "", "server certificate file (env "+tlsCertSetting.env+")")
+	flags.StringVar(&flagValues.TLSKeyFile, tlsKeySetting.flag, "", "server private key file (env "+tlsKeySetting.env+")")
+	flags.BoolVar(&flagValues.TLSSelfSigned, tlsSelfSignedSetting.flag, false, "generate a self-signed certificate when the certificate and key files don't exist (env "+tlsSelfSignedSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.TLSReloadInterval), tlsReloadSetting.flag, 0, "how often the certificate files are checked for changes, 0 for only on SIGHUP (env "+tlsReloadSetting.env+")")
+	flags.StringVar(&flagValues.ClientCA, clientCASetting.flag, "", "PEM file of the CAs of the client certificates, every client needs one when it is set (env "+clientCASetting.env+")")
+	flags.StringVar(&flagValues.ClientCertUsers, clientCertUsersSetting.flag, "", "JSON file of the usernames each client certificate may log in as (env "+clientCertUsersSetting.env+")")
+	flags.StringVar(&flagValues.DBPath, dbPathSetting.flag, "", "path of the users database (env "+dbPathSetting.env+")")
+	flags.IntVar(&flagValues.MaxMessageSize, maxMessageSizeSetting.flag, 0, "largest packet in bytes (env "+maxMessageSizeSetting.env+")")
+	flags.StringVar(&flagValues.BlindingKeyring, blindingKeyringSetting.flag, "", "path of the username blinding keyring (env "+blindingKeyringSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.ShutdownTimeout), shutdownTimeoutSetting.flag, 0, "how long clients get to drain on shutdown (env "+shutdownTimeoutSetting.env+")")
+	flags.Var(&flagValues.RateLimitConnection, rateLimitConnectionSetting.flag, "packets per connection, like \"50/1s\" or \"off\" (env "+rateLimitConnectionSetting.env+")")
+	flags.Var(&flagValues.RateLimitIP, rateLimitIPSetting.flag, "login, registration, recovery and key requests per source IP (env "+rateLimitIPSetting.env+")")
+	flags.Var(&flagValues.RateLimitUsername, rateLimitUsernameSetting.flag, "login, registration and recovery attempts per username from one source IP (env "+rateLimitUsernameSetting.env+")")
+	flags.Var(&flagValues.RateLimitAccount, rateLimitAccountSetting.flag, "login and recovery attempts per username from every source IP together (env "+rateLimitAccountSetting.env+")")
+	flags.Var(&flagValues.RateLimitKeyLookups, rateLimitKeyLookupsSetting.flag, "public key lookups per logged-in user (env "+rateLimitKeyLookupsSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.RateLimitLockout), rateLimitLockoutSetting.flag, 0, "how long a client over a rate limit is locked out (env "+rateLimitLockoutSetting.env+")")
+	flags.Var(&flagValues.AllowCIDRs, allowCIDRsSetting.flag, "only accept connections from these CIDR ranges, like \"10.0.0.0/8,192.0.2.7\" (env "+allowCIDRsSetting.env+")")
+	flags.Var(&flagValues.DenyCIDRs, denyCIDRsSetting.flag, "refuse connections from these CIDR ranges (env "+denyCIDRsSetting.env+")")
+	flags.IntVar(&flagValues.MaxConnections, maxConnectionsSetting.flag, 0, "most open client connections, 0 for no limit (env "+maxConnectionsSetting.env+")")
+	flags.IntVar(&flagValues.MaxConnectionsPerIP, maxConnectionsPerIPSetting.flag, 0, "most open client connections from one IP, 0 for no limit (env "+maxConnectionsPerIPSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.HandshakeTimeout), handshakeTimeoutSetting.flag, 0, "how long a client gets to finish the TLS handshake, 0 for no limit (env "+handshakeTimeoutSetting.env+")")
+	flags.Var(&flagValues.TrustedProxies, trustedProxiesSetting.flag, "CIDR ranges of the load balancers that send a PROXY protocol header (env "+trustedProxiesSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.LookupResponseTime), lookupResponseTimeSetting.flag, 0, "minimum time of a login request or key lookup (env "+lookupResponseTimeSetting.env+")")
+	flags.StringVar(&flagValues.DecoySecret, decoySecretSetting.flag, "", "file of the secret the decoy keys of unknown usernames are derived from (env "+decoySecretSetting.env+")")
+	flags.IntVar(&flagValues.KeyMinRSABits, keyMinRSABitsSetting.flag, 0, "smallest RSA key in bits users may register (env "+keyMinRSABitsSetting.env+")")
+	flags.Var(&flagValues.KeyAllowedAlgorithms, keyAlgorithmsSetting.flag, "comma separated key algorithms users may register, like \"RSA\" (env "+keyAlgorithmsSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.KeyMaxAge), keyMaxAgeSetting.flag, 0, "how old a user key may get before it must be rotated, 0 for never (env "+keyMaxAgeSetting.env+")")
+	flags.DurationVar((*time.Duration)(&flagValues.KeyGracePeriod), keyGracePeriodSetting.flag, 0, "how long an expired key is still accepted with a warning (env "+keyGracePeriodSetting.env+")")
+	flags.StringVar(&flagValues.MetricsAddress, metricsAddressSetting.flag, "", "address to serve the Prometheus metrics on, like \"localhost:9090\" (env "+metricsAddressSetting.env+")")
+	flags.StringVar(&flagValues.HealthAddress, healthAddressSetting.flag, "", "address to serve /healthz and /readyz on, like \"localhost:8081\" (env "+healthAddressSetting.env+")")
+	flags.StringVar(&flagValues.AdminAddress, adminAddressSetting.flag, "", "address to serve the admin API on over HTTPS, like \"localhost:8443\" (env "+adminAddressSetting.env+")")
+	flags.StringVar(&flagValues.AdminCredentials, adminCredentialsSetting.flag, "", "JSON file of the admin API tokens and certificate subjects (env "+adminCredentialsSetting.env+")")
+	flags.StringVar(&flagValues.AdminClientCA, adminClientCASetting.flag, "", "PEM file of the CAs of the admin client certificates (env "+adminClientCASetting.env+")")
+	flags.StringVar(&flagValues.LogLevel, logLevelSetting.flag, "", "debug, info, warn or error (env "+logLevelSetting.env+")")
+	flags.StringVar(&flagValues.LogFormat, logFormatSetting.flag, "", "text or json (env "+logFormatSetting.env+")")
+	flags.BoolVar(&flagValues.LogRedact, logRedactSetting.flag, true, "replace usernames by pseudonyms and leave key fingerprints out of the logs (env "+logRedactSetting.env+")")
+	flags.StringVar(&flagValues.AuditLog, auditLogSetting.flag, "", "\"db\", a file path or \"off\" (env "+auditLogSetting.env+")")
+	flags.StringVar(&flagValues.TraceExport, traceExportSetting.flag, "", "\"stdout\", a file path or \"off\" (env "+traceExportSetting.env+")")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := Default()
+	if *configPath != "" {
+		if err := config.loadFile(*configPath); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := config.loadEnv(); err != nil {
+		return Config{}, err
+	}
+	// Only the flags that were given override the other sources
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case addressSetting.flag:
+			config.Address = flagValues.Address
+		case tlsCertSetting.flag:
+			config.TLSCertFile = flagValues.TLSCertFile
+		case tlsKeySetting.flag:
+			config.TLSKeyFile = flagValues.TLSKeyFile
+		case tlsSelfSignedSetting.flag:
+			config.TLSSelfSigned = flagValues.TLSSelfSigned
+		case tlsReloadSetting.flag:
+			config.TLSReloadInterval = flagValues.TLSReloadInterval
+		case clientCASetting.flag:
+			config.ClientCA = flagValues.ClientCA
+		case clientCertUsersSetting.flag:
+			config.ClientCertUsers = flagValues.ClientCertUsers
+		case dbPathSetting.flag:
+			config.DBPath = flagValues.DBPath
+		case maxMessageSizeSetting.flag:
+			config.MaxMessageSize = flagValues.MaxMessageSize
+		case blindingKeyringSetting.flag:
+			config.BlindingKeyring = flagValues.BlindingKeyring
+		case shutdownTimeoutSetting.flag:
+			config.ShutdownTimeout = flagValues.ShutdownTimeout
+		case rateLimitConnectionSetting.flag:
+			config.RateLimitConnection = flagValues.RateLimitConnection
+		case rateLimitIPSetting.flag:
+			config.RateLimitIP = flagValues.RateLimitIP
+		case rateLimitUsernameSetting.flag:
+			config.RateLimitUsername = flagValues.RateLimitUsername
+		case rateLimitAccountSetting.flag:
+			config.RateLimitAccount = flagValues.RateLimitAccount
+		case rateLimitKeyLookupsSetting.flag:
+			config.RateLimitKeyLookups = flagValues.RateLimitKeyLookups
+		case rateLimitLockoutSetting.flag:
+			config.RateLimitLockout = flagValues.RateLimitLockout
+		case allowCIDRsSetting.flag:
+			config.AllowCIDRs = flagValues.AllowCIDRs
+		case denyCIDRsSetting.flag:
+			config.DenyCIDRs = flagValues.DenyCIDRs
+		case maxConnectionsSetting.flag:
+			config.MaxConnections = flagValues.MaxConnections
+		case maxConnectionsPerIPSetting.flag:
+			config.MaxConnectionsPerIP = flagValues.MaxConnectionsPerIP
+		case handshakeTimeoutSetting.flag:
+			config.HandshakeTimeout = flagValues.HandshakeTimeout
+		case trustedProxiesSetting.flag:
+			config.TrustedProxies = flagValues.TrustedProxies
+		case lookupResponseTimeSetting.flag:
+			config.LookupResponseTime = flagValues.LookupResponseTime
+		case decoySecretSetting.flag:
+			config.DecoySecret = flagValues.DecoySecret
+		case keyMinRSABitsSetting.flag:
+			config.KeyMinRSABits = flagValues.KeyMinRSABits
+		case keyAlgorithmsSetting.flag:
+			config.KeyAllowedAlgorithms = flagValues.KeyAllowedAlgorithms
+		case keyMaxAgeSetting.flag:
+			config.KeyMaxAge = flagValues.KeyMaxAge
+		case keyGracePeriodSetting.flag:
+			config.KeyGracePeriod = flagValues.KeyGracePeriod
+		case metricsAddressSetting.flag:
+			config.MetricsAddress = flagValues.MetricsAddress
+		case healthAddressSetting.flag:
+			config.HealthAddress = flagValues.HealthAddress
+		case adminAddressSetting.flag:
+			config.AdminAddress = flagValues.AdminAddress
+		case adminCredentialsSetting.flag:
+			config.AdminCredentials = flagValues.AdminCredentials
+		case adminClientCASetting.flag:
+			config.AdminClientCA = flagValues.AdminClientCA
+		case logLevelSetting.flag:
+			config.LogLevel = flagValues.LogLevel
+		case logFormatSetting.flag:
+			config.LogFormat = flagValues.LogFormat
+		case logRedactSetting.flag:
+			config.LogRedact = flagValues.LogRedact
+		case auditLogSetting.flag:
+			config.AuditLog = flagValues.AuditLog
+		case traceExportSetting.flag:
+			config.TraceExport = flagValues.TraceExport
+		}
+	})
+	return config, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening config file: %v", err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	for _, value := range []struct {
+		setting setting
+		target  *string
+	}{
+		{addressSetting, &c.Address},
+		{tlsCertSetting, &c.TLSCertFile},
+		{tlsKeySetting, &c.TLSKeyFile},
+		{clientCASetting, &c.ClientCA},
+		{clientCertUsersSetting, &c.ClientCertUsers},
+		{dbPathSetting, &c.DBPath},
+		{hashPasswordSetting, &c.HashPassword},
+		{hashSaltSetting, &c.HashSalt},
+		{blindingKeyringSetting, &c.BlindingKeyring},
+		{decoySecretSetting, &c.DecoySecret},
+		{metricsAddressSetting, &c.MetricsAddress},
+		{healthAddressSetting, &c.HealthAddress},
+		{adminAddressSetting, &c.AdminAddress},
+		{adminCredentialsSetting, &c.AdminCredentials},
+		{adminClientCASetting, &c.AdminClientCA},
+		{logLevelSetting, &c.LogLevel},
+		{logFormatSetting, &c.LogFormat},
+		{auditLogSetting, &c.AuditLog},
+		{traceExportSetting, &c.TraceExport},
+	} {
+		if env, exists := os.LookupEnv(value.setting.env); exists {
+			*value.target = env
+		}
+	}
+
+	if env := os.Getenv(maxMessageSizeSetting.env); env != "" {
+		size, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be a number of bytes", maxMessageSizeSetting.env, env)
+		}
+		c.MaxMessageSize = size
+	}
+	if env := os.Getenv(keyMinRSABitsSetting.env); env != "" {
+		bits, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be a number of bits", keyMinRSABitsSetting.env, env)
+		}
+		c.KeyMinRSABits = bits
+	}
+	if env, exists := os.LookupEnv(keyAlgorithmsSetting.env); exists {
+		c.KeyAllowedAlgorithms.Set(env)
+	}
+	for _, value := range []struct {
+		setting setting
+		target  *int
+	}{
+		{maxConnectionsSetting, &c.MaxConnections},
+		{maxConnectionsPerIPSetting, &c.MaxConnectionsPerIP},
+	} {
+		if env := os.Getenv(value.setting.env); env != "" {
+			count, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: must be a number of connections", value.setting.env, env)
+			}
+			*value.target = count
+		}
+	}
+	for _, value := range []struct {
+		setting setting
+		target  *netlimit.Prefixes
+	}{
+		{allowCIDRsSetting, &c.AllowCIDRs},
+		{denyCIDRsSetting, &c.DenyCIDRs},
+		{trustedProxiesSetting, &c.TrustedProxies},
+	} {
+		if env, exists := os.LookupEnv(value.setting.env); exists {
+			if err := value.target.Set(env); err != nil {
+				return fmt.Errorf("invalid %s: %v", value.setting.env, err)
+			}
+		}
+	}
+	if env := os.Getenv(tlsSelfSignedSetting.env); env != "" {
+		selfSigned, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be true or false", tlsSelfSignedSetting.env, env)
+		}
+		c.TLSSelfSigned = selfSigned
+	}
+	if env := os.Getenv(logRedactSetting.env); env != "" {
+		redact, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: must be true or false", logRedactSetting.env, env)
+		}
+		c.LogRedact = redact
+	}
+	for _, value := range []struct {
+		setting setting
+		target  *Duration
+	}{
+		{shutdownTimeoutSetting, &c.ShutdownTimeout},
+		{tlsReloadSetting, &c.TLSReloadInterval},
+		{rateLimitLockoutSetting, &c.RateLimitLockout},
+		{handshakeTimeoutSetting, &c.HandshakeTimeout},
+		{lookupResponseTimeSetting, &c.LookupResponseTime},
+		{keyMaxAgeSetting, &c.KeyMaxAge},
+		{keyGracePeriodSetting, &c.KeyGracePeriod},
+	} {
+		if env := os.Getenv(value.setting.env); env != "" {
+			duration, err := time.ParseDuration(env)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: must be a duration like \"10s\"", value.setting.env, env)
+			}
+			*value.target = Duration(duration)
+		}
+	}
+	for _, value := range []struct {
+		setting setting
+		target  *ratelimit.Limit
+	}{
+		{rateLimitConnectionSetting, &c.RateLimitConnection},
+		{rateLimitIPSetting, &c.RateLimitIP},
+		{rateLimitUsernameSetting, &c.RateLimitUsername},
+		{rateLimitAccountSetting, &c.RateLimitAccount},
+		{rateLimitKeyLookupsSetting, &c.RateLimitKeyLookups},
+	} {
+		if env := os.Getenv(value.setting.env); env != "" {
+			if err := value.target.Set(env); err != nil {
+				return fmt.Errorf("invalid %s: %v", value.setting.env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks every value and reports all the problems at once
+func (c Config) Validate() error {
+	var problems []error
+	problems = append(problems, checkAddress(addressSetting, c.Address))
+	if c.MetricsAddress != "" {
+		problems = append(problems, checkAddress(metricsAddressSetting, c.MetricsAddress))
+	}
+	if c.HealthAddress != "" {
+		problems = append(problems, checkAddress(healthAddressSetting, c.HealthAddress))
+	}
+	if c.AdminAddress != "" {
+		problems = append(problems, checkAddress(adminAddressSetting, c.AdminAddress))
+		// The admin API is served over HTTPS, the plain HTTP endpoints can't share its listener
+		if c.AdminAddress == c.MetricsAddress || c.AdminAddress == c.HealthAddress {
+			problems = append(problems, fmt.Errorf("%v: must not be the metrics or health address", adminAddressSetting))
+		}
+		if err := checkFile(adminCredentialsSetting, c.AdminCredentials); err != nil {
+			problems = append(problems, err)
+		} else if _, err = adminapi.LoadCredentials(c.AdminCredentials); err != nil {
+			problems = append(problems, fmt.Errorf("%v: %v", adminCredentialsSetting, err))
+		}
+		if c.AdminClientCA != "" {
+			if err := checkFile(adminClientCASetting, c.AdminClientCA); err != nil {
+				problems = append(problems, err)
+			} else if _, err = certs.LoadCertPool(c.AdminClientCA); err != nil {
+				problems = append(problems, fmt.Errorf("%v: %v", adminClientCASetting, err))
+			}
+		}
+	}
+
+	certErr := checkFile(tlsCertSetting, c.TLSCertFile)
+	keyErr := checkFile(tlsKeySetting, c.TLSKeyFile)
+	// Neither file exists on the first run, the certificate is generated then
+	bootstrap := c.TLSSelfSigned && c.TLSCertFile != "" && c.TLSKeyFile != "" && errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist)
+	if !bootstrap {
+		problems = append(problems, certErr, keyErr)
+	}
+	if certErr == nil && keyErr == nil {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			problems = append(problems, fmt.Errorf("%s and %s are not a valid certificate and key pair: %v", tlsCertSetting.field, tlsKeySetting.field, err))
+		}
+	}
+
+	if c.ClientCA != "" {
+		if err := checkFile(clientCASetting, c.ClientCA); err != nil {
+			problems = append(problems, err)
+		} else if _, err = certs.LoadCertPool(c.ClientCA); err != nil {
+			problems = append(problems, fmt.Errorf("%v: %v", clientCASetting, err))
+		}
+	}
+	if c.ClientCertUsers != "" {
+		if c.ClientCA == "" {
+			problems = append(problems, fmt.Errorf("%v: needs %s, only verified certificates can be mapped to users", clientCertUsersSetting, clientCASetting.field))
+		}
+		if err := checkFile(clientCertUsersSetting, c.ClientCertUsers); err != nil {
+			problems = append(problems, err)
+		} else if _, err = clientcert.LoadUsers(c.ClientCertUsers); err != nil {
+			problems = append(problems, fmt.Errorf("%v: %v", clientCertUsersSetting, err))
+		}
+	}
+
+	if c.DBPath == "" {
+		problems = append(problems, fmt.Errorf("%v: must not be empty", dbPathSetting))
+	} else if info, err := os.Stat(c.DBPath); err == nil && info.IsDir() {
+		problems = append(problems, fmt.Errorf("%v: %s is a directory", dbPathSetting, c.DBPath))
+	}
+
+	if c.MaxMessageSize <= 0 || int64(c.MaxMessageSize) > math.MaxUint32 {
+		problems = append(problems, fmt.Errorf("%v: must be between 1 and %d bytes", maxMessageSizeSetting, uint32(math.MaxUint32)))
+	}
+
+	if c.ShutdownTimeout < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", shutdownTimeoutSetting))
+	}
+	if c.TLSReloadInterval < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", tlsReloadSetting))
+	}
+	if c.RateLimitLockout < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", rateLimitLockoutSetting))
+	}
+	if c.MaxConnections < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", maxConnectionsSetting))
+	}
+	if c.MaxConnectionsPerIP < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", maxConnectionsPerIPSetting))
+	}
+	if c.HandshakeTimeout < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", handshakeTimeoutSetting))
+	}
+	if c.LookupResponseTime < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", lookupResponseTimeSetting))
+	}
+
+	if c.DecoySecret == "" {
+		problems = append(problems, fmt.Errorf("%v: must not be empty", decoySecretSetting))
+	} else if info, err := os.Stat(c.DecoySecret); err == nil && info.IsDir() {
+		problems = append(problems, fmt.Errorf("%v: %s is a directory", decoySecretSetting, c.DecoySecret))
+	} else if err == nil {
+		if _, err = decoy.LoadSecret(c.DecoySecret); err != nil {
+			problems = append(problems, fmt.Errorf("%v: %v", decoySecretSetting, err))
+		}
+	}
+
+	if c.KeyMinRSABits <= 0 {
+		problems = append(problems, fmt.Errorf("%v: must be a positive number of bits", keyMinRSABitsSetting))
+	}
+	if len(c.KeyAllowedAlgorithms) == 0 {
+		problems = append(problems, fmt.Errorf("%v: must allow at least one algorithm", keyAlgorithmsSetting))
+	}
+	for _, algorithm := range c.KeyAllowedAlgorithms {
+		// RSA is the only algorithm the clients generate keys with
+		if !strings.EqualFold(algorithm, keypolicy.AlgorithmRSA) {
+			problems = append(problems, fmt.Errorf("%v: unsupported key algorithm %q", keyAlgorithmsSetting, algorithm))
+		}
+	}
+	if c.KeyMaxAge < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", keyMaxAgeSetting))
+	}
+	if c.KeyGracePeriod < 0 {
+		problems = append(problems, fmt.Errorf("%v: must not be negative", keyGracePeriodSetting))
+	}
+
+	switch c.AuditLog {
+	case AuditLogDatabase, AuditLogOff:
+	case "":
+		problems = append(problems, fmt.Errorf("%v: must be \"db\", a file path or \"off\"", auditLogSetting))
+	default:
+		if info, err := os.Stat(c.AuditLog); err == nil && info.IsDir() {
+			problems = append(problems, fmt.Errorf("%v: %s is a directory", auditLogSetting, c.AuditLog))
+		}
+	}
+
+	switch c.TraceExport {
+	case tracing.ExportStdout, tracing.ExportOff:
+	case "":
+		problems = append(problems, fmt.Errorf("%v: must be \"stdout\", a file path or \"off\"", traceExportSetting))
+	default:
+		if info, err := os.Stat(c.TraceExport); err == nil && info.IsDir() {
+			problems = append(problems, fmt.Errorf("%v: %s is a directory", traceExportSetting, c.TraceExport))
+		}
+	}
+
+	if _, err := logging.ParseLevel(c.LogLevel); err != nil {
+		problems = append(problems, fmt.Errorf("%v: %v", logLevelSetting, err))
+	}
+	if err := logging.CheckFormat(c.LogFormat); err != nil {
+		problems = append(problems, fmt.Errorf("%v: %v", logFormatSetting, err))
+	}
+
+	// The legacy username blinding still needs the secrets to find accounts that were never rehashed
+	if c.HashPassword == "" {
+		problems = append(problems, fmt.Errorf("%v: must not be empty", hashPasswordSetting))
+	}
+	if c.HashSalt == "" {
+		problems = append(problems, fmt.Errorf("%v: must not be empty", hashSaltSetting))
+	}
+	return errors.Join(problems...)
+}
+
+func checkAddress(s setting, address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%v: %q is not a host:port address", s, address)
+	}
+	if _, err = strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("%v: invalid port %q", s, port)
+	}
+	return nil
+}
+
+func checkFile(s setting, path string) error {
+	if path == "" {
+		return fmt.Errorf("%v: must not be empty", s)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%v: %w", s, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%v: %s is a directory", s, path)
+	}
+	return nil
+}
+
+// RateLimits returns the rate limiter settings
+func (c Config) RateLimits() ratelimit.Config {
+	return ratelimit.Config{
+		PerConnection: c.RateLimitConnection,
+		PerIP:         c.RateLimitIP,
+		PerUsername:   c.RateLimitUsername,
+		PerAccount:    c.RateLimitAccount,
+		KeyLookups:    c.RateLimitKeyLookups,
+		Lockout:       time.Duration(c.RateLimitLockout),
+	}
+}
+
+// ConnectionLimits returns the settings that decide which client connections are served
+func (c Config) ConnectionLimits() netlimit.Config {
+	return netlimit.Config{
+		Allow:               c.AllowCIDRs,
+		Deny:                c.DenyCIDRs,
+		MaxConnections:      c.MaxConnections,
+		MaxConnectionsPerIP: c.MaxConnectionsPerIP,
+		HandshakeTimeout:    time.Duration(c.HandshakeTimeout),
+	}
+}
+
+// KeyPolicy returns the policy that decides which user keys are accepted, the values must have been validated
+func (c Config) KeyPolicy() keypolicy.KeyPolicy {
+	algorithms := make([]string, 0, len(c.KeyAllowedAlgorithms))
+	for _, algorithm := range c.KeyAllowedAlgorithms {
+		algorithms = append(algorithms, strings.ToUpper(algorithm))
+	}
+	return keypolicy.KeyPolicy{
+		MinRSABits:        c.KeyMinRSABits,
+		AllowedAlgorithms: algorithms,
+		MaxKeyAge:         time.Duration(c.KeyMaxAge),
+		GracePeriod:       time.Duration(c.KeyGracePeriod),
+	}
+}
+
+// LogOptions returns the logger settings, the level must have been validated
+func (c Config) LogOptions() logging.Options {
+	level, _ := logging.ParseLevel(c.LogLevel)
+	return logging.Options{Level: level, Format: c.LogFormat, Redact: c.LogRedact}
+}
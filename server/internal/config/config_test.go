@@ -0,0 +1,95 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(configPath, []byte(`{"address": ":9000", "db_path": "file.db", "max_message_size": 4096}`), 0600)
+	if err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	t.Setenv("SERVER_CONFIG", configPath)
+	t.Setenv("SERVER_DB_PATH", "env.db")
+	t.Setenv("SERVER_MAX_MESSAGE_SIZE", "8192")
+
+	config, err := Load([]string{"-max-message-size", "16384"})
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if config.Address != ":9000" {
+		t.Errorf("Expected the address from the config file, got %q", config.Address)
+	}
+	if config.DBPath != "env.db" {
+		t.Errorf("Expected the environment to override the config file, got %q", config.DBPath)
+	}
+	if config.MaxMessageSize != 16384 {
+		t.Errorf("Expected the flag to override the environment, got %d", config.MaxMessageSize)
+	}
+	if config.TLSCertFile != Default().TLSCertFile {
+		t.Errorf("Expected the default certificate path, got %q", config.TLSCertFile)
+	}
+}
+
+func TestLoadRejectsUnknownFields(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.json")
+	if err := os.WriteFile(configPath, []byte(`{"adress": ":9000"}`), 0600); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	if _, err := Load([]string{"-config", configPath}); err == nil {
+		t.Error("Expected a misspelled setting to be rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	config := Default()
+	config.Address = "8080"
+	config.TLSCertFile = filepath.Join(t.TempDir(), "missing.pem")
+	config.MaxMessageSize = 0
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid config to fail validation")
+	}
+	// Every problem is reported, with a hint on how to set the value
+	for _, expected := range []string{"-address", "SERVER_TLS_CERT", "max_message_size", "SERVER_HASH_PASSWORD"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the validation error to mention %s, got:\n%v", expected, err)
+		}
+	}
+}
+
+func TestLoadKeyPolicy(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(configPath, []byte(`{"key_min_rsa_bits": 3072, "key_allowed_algorithms": ["rsa"], "key_max_age": "8760h"}`), 0600)
+	if err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	t.Setenv("SERVER_KEY_MAX_AGE", "4380h")
+
+	config, err := Load([]string{"-config", configPath, "-key-grace-period", "24h"})
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	policy := config.KeyPolicy()
+	if policy.MinRSABits != 3072 || len(policy.AllowedAlgorithms) != 1 || policy.AllowedAlgorithms[0] != "RSA" {
+		t.Errorf("Expected the key size and algorithms from the config file, got %+v", policy)
+	}
+	if policy.MaxKeyAge != 4380*time.Hour || policy.GracePeriod != 24*time.Hour {
+		t.Errorf("Expected the key ages from the environment and the flags, got %+v", policy)
+	}
+
+	config.KeyMinRSABits = 0
+	config.KeyAllowedAlgorithms = List{"DSA"}
+	err = config.Validate()
+	for _, expected := range []string{"-key-min-rsa-bits", "SERVER_KEY_ALLOWED_ALGORITHMS"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the validation error to mention %s, got:\n%v", expected, err)
+		}
+	}
+}
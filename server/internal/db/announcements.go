@@ -0,0 +1,138 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const createAnnouncementsTableSQL = `CREATE TABLE IF NOT EXISTS Announcements(
+    id TEXT PRIMARY KEY,
+    message TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    send_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL DEFAULT 0,
+    persistent INTEGER NOT NULL DEFAULT 0,
+    sent_at INTEGER NOT NULL DEFAULT 0
+)`
+
+const createAnnouncementDeliveriesTableSQL = `CREATE TABLE IF NOT EXISTS AnnouncementDeliveries(
+    announcement_id TEXT NOT NULL,
+    username TEXT NOT NULL,
+    PRIMARY KEY (announcement_id, username)
+)`
+
+const selectAnnouncementSQL = `SELECT id, message, created_at, send_at, expires_at, persistent, sent_at FROM Announcements`
+
+// Announcement is a message from the administrators to every user
+type Announcement struct {
+	ID         string
+	Text       string
+	CreatedAt  time.Time
+	SendAt     time.Time
+	ExpiresAt  time.Time // Zero when it does not expire
+	Persistent bool      // Delivered at the next login to the users who were offline when it was sent
+	SentAt     time.Time // Zero until it was sent
+}
+
+// Expired reports whether the announcement is no longer shown at now
+func (a Announcement) Expired(now time.Time) bool {
+	return !a.ExpiresAt.IsZero() && !now.Before(a.ExpiresAt)
+}
+
+// unixOrZero stores a zero time as 0, like the columns without a time
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
+
+func scanAnnouncement(row interface{ Scan(dest ...any) error }) (Announcement, error) {
+	var announcement Announcement
+	var createdAt, sendAt, expiresAt, sentAt int64
+	err := row.Scan(&announcement.ID, &announcement.Text, &createdAt, &sendAt, &expiresAt, &announcement.Persistent, &sentAt)
+	announcement.CreatedAt = time.Unix(createdAt, 0)
+	announcement.SendAt = time.Unix(sendAt, 0)
+	announcement.ExpiresAt = timeOrZero(expiresAt)
+	announcement.SentAt = timeOrZero(sentAt)
+	return announcement, err
+}
+
+func (db *SQLiteStore) queryAnnouncements(query string, args ...any) ([]Announcement, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading announcements: %v", err)
+	}
+	defer rows.Close()
+
+	var announcements []Announcement
+	for rows.Next() {
+		announcement, err := scanAnnouncement(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading announcement: %v", err)
+		}
+		announcements = append(announcements, announcement)
+	}
+	return announcements, rows.Err()
+}
+
+func (db *SQLiteStore) AddAnnouncement(announcement Announcement) error {
+	_, err := db.conn.Exec(
+		"INSERT INTO Announcements(id, message, created_at, send_at, expires_at, persistent) VALUES(?, ?, ?, ?, ?, ?)",
+		announcement.ID, announcement.Text, announcement.CreatedAt.Unix(), announcement.SendAt.Unix(), unixOrZero(announcement.ExpiresAt), announcement.Persistent,
+	)
+	if err != nil {
+		return fmt.Errorf("error inserting announcement: %v", err)
+	}
+	return nil
+}
+
+func (db *SQLiteStore) ListAnnouncements() ([]Announcement, error) {
+	return db.queryAnnouncements(selectAnnouncementSQL + " ORDER BY send_at, created_at")
+}
+
+func (db *SQLiteStore) DueAnnouncements(now time.Time) ([]Announcement, error) {
+	return db.queryAnnouncements(selectAnnouncementSQL+" WHERE sent_at = 0 AND send_at <= ? ORDER BY send_at, created_at", now.Unix())
+}
+
+func (db *SQLiteStore) MarkAnnouncementSent(id string, sentAt time.Time) error {
+	result, err := db.conn.Exec("UPDATE Announcements SET sent_at = ? WHERE id = ?", sentAt.Unix(), id)
+	if err != nil {
+		return fmt.Errorf("error marking announcement sent: %v", err)
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return fmt.Errorf("announcement %s not found", id)
+	}
+	return nil
+}
+
+func (db *SQLiteStore) UndeliveredAnnouncements(username string, now time.Time) ([]Announcement, error) {
+	return db.queryAnnouncements(selectAnnouncementSQL+` WHERE persistent = 1 AND sent_at != 0 AND (expires_at = 0 OR expires_at > ?)
+        AND id NOT IN (SELECT announcement_id FROM AnnouncementDeliveries WHERE username = ?) ORDER BY send_at, created_at`, now.Unix(), username)
+}
+
+func (db *SQLiteStore) RecordAnnouncementDeliveries(id string, usernames []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, username := range usernames {
+		if _, err = tx.Exec("INSERT OR IGNORE INTO AnnouncementDeliveries(announcement_id, username) VALUES(?, ?)", id, username); err != nil {
+			return fmt.Errorf("error recording announcement delivery: %v", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing announcement deliveries: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"server/internal/audit"
+	"time"
+)
+
+const createAuditLogTableSQL = `CREATE TABLE IF NOT EXISTS AuditLog(
+    seq INTEGER PRIMARY KEY,
+    time INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    outcome TEXT NOT NULL,
+    username TEXT NOT NULL,
+    peer_username TEXT NOT NULL,
+    remote TEXT NOT NULL,
+    detail TEXT NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+)`
+
+// The audit records can only be added, changing or deleting them has to go around the database
+const createAuditLogTriggersSQL = `
+CREATE TRIGGER IF NOT EXISTS AuditLogNoUpdate BEFORE UPDATE ON AuditLog
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;
+CREATE TRIGGER IF NOT EXISTS AuditLogNoDelete BEFORE DELETE ON AuditLog
+BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END;`
+
+const selectAuditRecordSQL = `SELECT seq, time, type, outcome, username, peer_username, remote, detail, prev_hash, hash FROM AuditLog`
+
+// auditTable is an audit.Sink that keeps the records in the AuditLog table
+type auditTable struct {
+	conn *sql.DB
+}
+
+// AuditSink keeps the audit log in the same database as the users. Closing it leaves the store open.
+func (db *SQLiteStore) AuditSink() audit.Sink {
+	return &auditTable{conn: db.conn}
+}
+
+func (t *auditTable) Append(record audit.Record) error {
+	_, err := t.conn.Exec(
+		"INSERT INTO AuditLog(seq, time, type, outcome, username, peer_username, remote, detail, prev_hash, hash) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		record.Sequence, record.Time.UnixNano(), record.Type, record.Outcome, record.User, record.Peer, record.Remote, record.Detail, record.PrevHash, record.Hash,
+	)
+	if err != nil {
+		return fmt.Errorf("error inserting audit record: %v", err)
+	}
+	return nil
+}
+
+func (t *auditTable) Last() (audit.Record, bool, error) {
+	record, err := scanAuditRecord(t.conn.QueryRow(selectAuditRecordSQL + " ORDER BY seq DESC LIMIT 1"))
+	if err == sql.ErrNoRows {
+		return audit.Record{}, false, nil
+	}
+	if err != nil {
+		return audit.Record{}, false, fmt.Errorf("error reading audit record: %v", err)
+	}
+	return record, true, nil
+}
+
+func (t *auditTable) Records() ([]audit.Record, error) {
+	rows, err := t.conn.Query(selectAuditRecordSQL + " ORDER BY seq")
+	if err != nil {
+		return nil, fmt.Errorf("error reading audit log: %v", err)
+	}
+	defer rows.Close()
+
+	var records []audit.Record
+	for rows.Next() {
+		record, err := scanAuditRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading audit record: %v", err)
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (t *auditTable) Close() error {
+	return nil
+}
+
+func scanAuditRecord(row interface{ Scan(dest ...any) error }) (audit.Record, error) {
+	var record audit.Record
+	var nanos int64
+	err := row.Scan(&record.Sequence, &nanos, &record.Type, &record.Outcome, &record.User, &record.Peer, &record.Remote, &record.Detail, &record.PrevHash, &record.Hash)
+	record.Time = time.Unix(0, nanos).UTC()
+	return record, err
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+const createContactsTableSQL = `CREATE TABLE IF NOT EXISTS Contacts(
+    username TEXT NOT NULL,
+    contact TEXT NOT NULL,
+    PRIMARY KEY (username, contact)
+)`
+
+const createKeyRevocationNoticesTableSQL = `CREATE TABLE IF NOT EXISTS KeyRevocationNotices(
+    contact TEXT NOT NULL,
+    username TEXT NOT NULL,
+    revoked_at INTEGER NOT NULL,
+    PRIMARY KEY (contact, username)
+)`
+
+// KeyRevocation tells a contact of a user that the user's previous key was revoked
+type KeyRevocation struct {
+	Contact string // Blinded, who is told
+	// Username is whose key was revoked. It is kept in plaintext until the notice is delivered,
+	// because the contact's client needs it to know which key to distrust.
+	Username  string
+	RevokedAt time.Time
+}
+
+func (db *SQLiteStore) AddContact(username string, contact string) error {
+	if username == contact {
+		return nil
+	}
+	_, err := db.conn.Exec("INSERT OR IGNORE INTO Contacts(username, contact) VALUES(?, ?), (?, ?)", username, contact, contact, username)
+	if err != nil {
+		return fmt.Errorf("error inserting contact: %v", err)
+	}
+	return nil
+}
+
+func (db *SQLiteStore) AddKeyRevocations(username string, revokedUsername string, revokedAt time.Time) ([]string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT contact FROM Contacts WHERE username = ? ORDER BY contact", username)
+	if err != nil {
+		return nil, fmt.Errorf("error reading contacts: %v", err)
+	}
+	var contacts []string
+	for rows.Next() {
+		var contact string
+		if err = rows.Scan(&contact); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error reading contact: %v", err)
+		}
+		contacts = append(contacts, contact)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading contacts: %v", err)
+	}
+	for _, contact := range contacts {
+		_, err = tx.Exec("INSERT OR REPLACE INTO KeyRevocationNotices(contact, username, revoked_at) VALUES(?, ?, ?)", contact, revokedUsername, revokedAt.Unix())
+		if err != nil {
+			return nil, fmt.Errorf("error inserting key revocation notice: %v", err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error committing key revocation notices: %v", err)
+	}
+	return contacts, nil
+}
+
+func (db *SQLiteStore) PendingKeyRevocations(contact string) ([]KeyRevocation, error) {
+	rows, err := db.conn.Query("SELECT contact, username, revoked_at FROM KeyRevocationNotices WHERE contact = ? ORDER BY revoked_at, username", contact)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key revocation notices: %v", err)
+	}
+	defer rows.Close()
+
+	var revocations []KeyRevocation
+	for rows.Next() {
+		var revocation KeyRevocation
+		var revokedAt int64
+		if err = rows.Scan(&revocation.Contact, &revocation.Username, &revokedAt); err != nil {
+			return nil, fmt.Errorf("error reading key revocation notice: %v", err)
+		}
+		revocation.RevokedAt = time.Unix(revokedAt, 0)
+		revocations = append(revocations, revocation)
+	}
+	return revocations, rows.Err()
+}
+
+func (db *SQLiteStore) DeleteKeyRevocation(contact string, revokedUsername string) error {
+	if _, err := db.conn.Exec("DELETE FROM KeyRevocationNotices WHERE contact = ? AND username = ?", contact, revokedUsername); err != nil {
+		return fmt.Errorf("error deleting key revocation notice: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"crypto/rsa"
+	"errors"
+	"server/internal/metrics"
+	"time"
+)
+
+var databaseErrors = metrics.Default.NewCounter("chat_database_errors_total", "Failed database operations, by operation.", "operation")
+
+// instrumentedStore counts the errors of a Store. Expected outcomes, like an unknown user, are not counted.
+type instrumentedStore struct {
+	store Store
+}
+
+// Instrument wraps the store so its errors show up in the metrics
+func Instrument(store Store) Store {
+	return instrumentedStore{store: store}
+}
+
+func countError(operation string, err error) {
+	if err == nil {
+		return
+	}
+	for _, expected := range []error{ErrUserNotFound, ErrUserExists, ErrPubKeyInUse, ErrPubKeyChanged, ErrInvalidRecoveryCode, ErrNotSuspended} {
+		if errors.Is(err, expected) {
+			return
+		}
+	}
+	databaseErrors.Inc(operation)
+}
+
+func (s instrumentedStore) GetUserPubKey(username string) (*rsa.PublicKey, error) {
+	key, err := s.store.GetUserPubKey(username)
+	countError("get_user_pub_key", err)
+	return key, err
+}
+
+func (s instrumentedStore) GetUserKeyInfo(username string) (string, time.Time, error) {
+	algorithm, createdAt, err := s.store.GetUserKeyInfo(username)
+	countError("get_user_key_info", err)
+	return algorithm, createdAt, err
+}
+
+func (s instrumentedStore) UserExists(username string) (bool, error) {
+	exists, err := s.store.UserExists(username)
+	countError("user_exists", err)
+	return exists, err
+}
+
+func (s instrumentedStore) CreateNewUser(username string, hashVersion int, keyAlgorithm string, pubkey []byte, recoveryVerifiers [][]byte) error {
+	err := s.store.CreateNewUser(username, hashVersion, keyAlgorithm, pubkey, recoveryVerifiers)
+	countError("create_new_user", err)
+	return err
+}
+
+func (s instrumentedStore) RotateUserPubKey(username string, oldPubkey []byte, newPubkey []byte) error {
+	err := s.store.RotateUserPubKey(username, oldPubkey, newPubkey)
+	countError("rotate_user_pub_key", err)
+	return err
+}
+
+func (s instrumentedStore) RecoverUser(username string, recoveryVerifier []byte, newPubkey []byte) error {
+	err := s.store.RecoverUser(username, recoveryVerifier, newPubkey)
+	countError("recover_user", err)
+	return err
+}
+
+func (s instrumentedStore) RehashUser(oldUsername string, newUsername string, hashVersion int) error {
+	err := s.store.RehashUser(oldUsername, newUsername, hashVersion)
+	countError("rehash_user", err)
+	return err
+}
+
+func (s instrumentedStore) CountUsersByHashVersion() (map[int]int, error) {
+	counts, err := s.store.CountUsersByHashVersion()
+	countError("count_users_by_hash_version", err)
+	return counts, err
+}
+
+func (s instrumentedStore) GetUser(username string) (UserInfo, error) {
+	user, err := s.store.GetUser(username)
+	countError("get_user", err)
+	return user, err
+}
+
+func (s instrumentedStore) ListUsers() ([]UserInfo, error) {
+	users, err := s.store.ListUsers()
+	countError("list_users", err)
+	return users, err
+}
+
+func (s instrumentedStore) SetUserDisabled(username string, disabled bool) error {
+	err := s.store.SetUserDisabled(username, disabled)
+	countError("set_user_disabled", err)
+	return err
+}
+
+func (s instrumentedStore) RequireKeyReset(username string) error {
+	err := s.store.RequireKeyReset(username)
+	countError("require_key_reset", err)
+	return err
+}
+
+func (s instrumentedStore) DeleteUser(username string) error {
+	err := s.store.DeleteUser(username)
+	countError("delete_user", err)
+	return err
+}
+
+func (s instrumentedStore) AddAnnouncement(announcement Announcement) error {
+	err := s.store.AddAnnouncement(announcement)
+	countError("add_announcement", err)
+	return err
+}
+
+func (s instrumentedStore) ListAnnouncements() ([]Announcement, error) {
+	announcements, err := s.store.ListAnnouncements()
+	countError("list_announcements", err)
+	return announcements, err
+}
+
+func (s instrumentedStore) DueAnnouncements(now time.Time) ([]Announcement, error) {
+	announcements, err := s.store.DueAnnouncements(now)
+	countError("due_announcements", err)
+	return announcements, err
+}
+
+func (s instrumentedStore) MarkAnnouncementSent(id string, sentAt time.Time) error {
+	err := s.store.MarkAnnouncementSent(id, sentAt)
+	countError("mark_announcement_sent", err)
+	return err
+}
+
+func (s instrumentedStore) UndeliveredAnnouncements(username string, now time.Time) ([]Announcement, error) {
+	announcements, err := s.store.UndeliveredAnnouncements(username, now)
+	countError("undelivered_announcements", err)
+	return announcements, err
+}
+
+func (s instrumentedStore) RecordAnnouncementDeliveries(id string, usernames []string) error {
+	err := s.store.RecordAnnouncementDeliveries(id, usernames)
+	countError("record_announcement_deliveries", err)
+	return err
+}
+
+func (s instrumentedStore) Close() error {
+	err := s.store.Close()
+	countError("close", err)
+	return err
+}
+
+func (s instrumentedStore) SuspendUser(suspension Suspension) (int64, error) {
+	id, err := s.store.SuspendUser(suspension)
+	countError("suspend_user", err)
+	return id, err
+}
+
+func (s instrumentedStore) ActiveSuspension(username string, now time.Time) (Suspension, error) {
+	suspension, err := s.store.ActiveSuspension(username, now)
+	countError("active_suspension", err)
+	return suspension, err
+}
+
+func (s instrumentedStore) LiftSuspensions(username string, liftedBy string, now time.Time) (int, error) {
+	lifted, err := s.store.LiftSuspensions(username, liftedBy, now)
+	countError("lift_suspensions", err)
+	return lifted, err
+}
+
+func (s instrumentedStore) ListSuspensions(username string) ([]Suspension, error) {
+	suspensions, err := s.store.ListSuspensions(username)
+	countError("list_suspensions", err)
+	return suspensions, err
+}
+
+func (s instrumentedStore) AddContact(username string, contact string) error {
+	err := s.store.AddContact(username, contact)
+	countError("add_contact", err)
+	return err
+}
+
+func (s instrumentedStore) AddKeyRevocations(username string, revokedUsername string, revokedAt time.Time) ([]string, error) {
+	contacts, err := s.store.AddKeyRevocations(username, revokedUsername, revokedAt)
+	countError("add_key_revocations", err)
+	return contacts, err
+}
+
+func (s instrumentedStore) PendingKeyRevocations(contact string) ([]KeyRevocation, error) {
+	revocations, err := s.store.PendingKeyRevocations(contact)
+	countError("pending_key_revocations", err)
+	return revocations, err
+}
+
+func (s instrumentedStore) DeleteKeyRevocation(contact string, revokedUsername string) error {
+	err := s.store.DeleteKeyRevocation(contact, revokedUsername)
+	countError("delete_key_revocation", err)
+	return err
+}
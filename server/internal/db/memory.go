@@ -0,0 +1,536 @@
+package db
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryUser struct {
+	hashVersion      int
+	keyAlgorithm     string
+	keyCreatedAt     time.Time
+	pubkey           []byte
+	disabled         bool
+	keyResetRequired bool
+}
+
+func (u *memoryUser) info(username string) UserInfo {
+	return UserInfo{
+		Username:         username,
+		HashVersion:      u.hashVersion,
+		KeyAlgorithm:     u.keyAlgorithm,
+		KeyCreatedAt:     u.keyCreatedAt,
+		Disabled:         u.disabled,
+		KeyResetRequired: u.keyResetRequired,
+	}
+}
+
+type memoryKeyHistory struct {
+	username   string
+	pubkey     []byte
+	replacedAt time.Time
+	reason     string
+}
+
+type memoryRecoveryCode struct {
+	username string
+	verifier []byte
+	used     bool
+}
+
+// announcementDelivery is an announcement delivered to a user
+type announcementDelivery struct {
+	id       string
+	username string
+}
+
+// contact is a user and one of its contacts, every contact is stored both ways
+type contact struct {
+	username string
+	contact  string
+}
+
+// MemoryStore keeps everything in memory, it is meant for tests
+type MemoryStore struct {
+	users         map[string]*memoryUser
+	keyHistory    []memoryKeyHistory
+	recoveryCodes []*memoryRecoveryCode
+	announcements []Announcement
+	deliveries    map[announcementDelivery]bool
+	suspensions   []Suspension
+	contacts      map[contact]bool
+	revocations   []KeyRevocation
+	mutex         sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      make(map[string]*memoryUser),
+		deliveries: make(map[announcementDelivery]bool),
+		contacts:   make(map[contact]bool),
+	}
+}
+
+func (m *MemoryStore) GetUserPubKey(username string) (*rsa.PublicKey, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	user, exists := m.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return publicKeyFromBytes(user.pubkey), nil
+}
+
+func (m *MemoryStore) GetUserKeyInfo(username string) (string, time.Time, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	user, exists := m.users[username]
+	if !exists {
+		return "", time.Time{}, ErrUserNotFound
+	}
+	return user.keyAlgorithm, user.keyCreatedAt, nil
+}
+
+func (m *MemoryStore) UserExists(username string) (bool, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	_, exists := m.users[username]
+	return exists, nil
+}
+
+func (m *MemoryStore) CreateNewUser(username string, hashVersion int, keyAlgorithm string, pubkey []byte, recoveryVerifiers [][]byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.users[username]; exists {
+		return ErrUserExists
+	}
+	if m.pubKeyInUse(pubkey) {
+		return ErrPubKeyInUse
+	}
+
+	m.users[username] = &memoryUser{
+		hashVersion:  hashVersion,
+		keyAlgorithm: keyAlgorithm,
+		keyCreatedAt: time.Now(),
+		pubkey:       bytes.Clone(pubkey),
+	}
+	for _, verifier := range recoveryVerifiers {
+		m.recoveryCodes = append(m.recoveryCodes, &memoryRecoveryCode{username: username, verifier: bytes.Clone(verifier)})
+	}
+	return nil
+}
+
+func (m *MemoryStore) RotateUserPubKey(username string, oldPubkey []byte, newPubkey []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if !bytes.Equal(user.pubkey, oldPubkey) {
+		return ErrPubKeyChanged
+	}
+	if m.pubKeyInUse(newPubkey) {
+		return ErrPubKeyInUse
+	}
+	m.replacePubKey(username, user, newPubkey, KeyReplacedByRotation)
+	return nil
+}
+
+func (m *MemoryStore) RecoverUser(username string, recoveryVerifier []byte, newPubkey []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var recoveryCode *memoryRecoveryCode
+	for _, code := range m.recoveryCodes {
+		if code.username == username && !code.used && bytes.Equal(code.verifier, recoveryVerifier) {
+			recoveryCode = code
+			break
+		}
+	}
+	if recoveryCode == nil {
+		return ErrInvalidRecoveryCode
+	}
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if m.pubKeyInUse(newPubkey) {
+		return ErrPubKeyInUse
+	}
+	recoveryCode.used = true
+	m.replacePubKey(username, user, newPubkey, KeyReplacedByRecovery)
+	return nil
+}
+
+func (m *MemoryStore) RehashUser(oldUsername string, newUsername string, hashVersion int) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, exists := m.users[oldUsername]
+	if !exists {
+		return ErrUserNotFound
+	}
+	if _, exists = m.users[newUsername]; exists && newUsername != oldUsername {
+		return ErrUserExists
+	}
+	delete(m.users, oldUsername)
+	user.hashVersion = hashVersion
+	m.users[newUsername] = user
+	for i := range m.keyHistory {
+		if m.keyHistory[i].username == oldUsername {
+			m.keyHistory[i].username = newUsername
+		}
+	}
+	for _, code := range m.recoveryCodes {
+		if code.username == oldUsername {
+			code.username = newUsername
+		}
+	}
+	for delivery := range m.deliveries {
+		if delivery.username == oldUsername {
+			delete(m.deliveries, delivery)
+			m.deliveries[announcementDelivery{id: delivery.id, username: newUsername}] = true
+		}
+	}
+	for i := range m.suspensions {
+		if m.suspensions[i].Username == oldUsername {
+			m.suspensions[i].Username = newUsername
+		}
+	}
+	for pair := range m.contacts {
+		if pair.username == oldUsername || pair.contact == oldUsername {
+			delete(m.contacts, pair)
+			m.contacts[contact{username: rename(pair.username, oldUsername, newUsername), contact: rename(pair.contact, oldUsername, newUsername)}] = true
+		}
+	}
+	for i := range m.revocations {
+		m.revocations[i].Contact = rename(m.revocations[i].Contact, oldUsername, newUsername)
+	}
+	return nil
+}
+
+// rename returns newUsername when username is oldUsername
+func rename(username string, oldUsername string, newUsername string) string {
+	if username == oldUsername {
+		return newUsername
+	}
+	return username
+}
+
+func (m *MemoryStore) CountUsersByHashVersion() (map[int]int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	counts := make(map[int]int)
+	for _, user := range m.users {
+		counts[user.hashVersion]++
+	}
+	return counts, nil
+}
+
+func (m *MemoryStore) GetUser(username string) (UserInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	user, exists := m.users[username]
+	if !exists {
+		return UserInfo{}, ErrUserNotFound
+	}
+	return user.info(username), nil
+}
+
+func (m *MemoryStore) ListUsers() ([]UserInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var users []UserInfo
+	for username, user := range m.users {
+		users = append(users, user.info(username))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+func (m *MemoryStore) SetUserDisabled(username string, disabled bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.disabled = disabled
+	return nil
+}
+
+func (m *MemoryStore) RequireKeyReset(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return ErrUserNotFound
+	}
+	user.keyResetRequired = true
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.users[username]; !exists {
+		return ErrUserNotFound
+	}
+	delete(m.users, username)
+	keyHistory := m.keyHistory[:0]
+	for _, entry := range m.keyHistory {
+		if entry.username != username {
+			keyHistory = append(keyHistory, entry)
+		}
+	}
+	m.keyHistory = keyHistory
+	recoveryCodes := m.recoveryCodes[:0]
+	for _, code := range m.recoveryCodes {
+		if code.username != username {
+			recoveryCodes = append(recoveryCodes, code)
+		}
+	}
+	m.recoveryCodes = recoveryCodes
+	for delivery := range m.deliveries {
+		if delivery.username == username {
+			delete(m.deliveries, delivery)
+		}
+	}
+	suspensions := m.suspensions[:0]
+	for _, suspension := range m.suspensions {
+		if suspension.Username != username {
+			suspensions = append(suspensions, suspension)
+		}
+	}
+	m.suspensions = suspensions
+	for pair := range m.contacts {
+		if pair.username == username || pair.contact == username {
+			delete(m.contacts, pair)
+		}
+	}
+	revocations := m.revocations[:0]
+	for _, revocation := range m.revocations {
+		if revocation.Contact != username {
+			revocations = append(revocations, revocation)
+		}
+	}
+	m.revocations = revocations
+	return nil
+}
+
+func (m *MemoryStore) AddAnnouncement(announcement Announcement) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, existing := range m.announcements {
+		if existing.ID == announcement.ID {
+			return fmt.Errorf("announcement %s already exists", announcement.ID)
+		}
+	}
+	announcement.SentAt = time.Time{}
+	m.announcements = append(m.announcements, announcement)
+	sort.SliceStable(m.announcements, func(i, j int) bool {
+		return m.announcements[i].SendAt.Before(m.announcements[j].SendAt)
+	})
+	return nil
+}
+
+// filterAnnouncements returns the announcements keep returns true for, in the order they are sent
+func (m *MemoryStore) filterAnnouncements(keep func(announcement Announcement) bool) []Announcement {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var announcements []Announcement
+	for _, announcement := range m.announcements {
+		if keep(announcement) {
+			announcements = append(announcements, announcement)
+		}
+	}
+	return announcements
+}
+
+func (m *MemoryStore) ListAnnouncements() ([]Announcement, error) {
+	return m.filterAnnouncements(func(Announcement) bool { return true }), nil
+}
+
+func (m *MemoryStore) DueAnnouncements(now time.Time) ([]Announcement, error) {
+	return m.filterAnnouncements(func(announcement Announcement) bool {
+		return announcement.SentAt.IsZero() && !announcement.SendAt.After(now)
+	}), nil
+}
+
+func (m *MemoryStore) MarkAnnouncementSent(id string, sentAt time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i := range m.announcements {
+		if m.announcements[i].ID == id {
+			m.announcements[i].SentAt = sentAt
+			return nil
+		}
+	}
+	return fmt.Errorf("announcement %s not found", id)
+}
+
+func (m *MemoryStore) UndeliveredAnnouncements(username string, now time.Time) ([]Announcement, error) {
+	return m.filterAnnouncements(func(announcement Announcement) bool {
+		return announcement.Persistent && !announcement.SentAt.IsZero() && !announcement.Expired(now) &&
+			!m.deliveries[announcementDelivery{id: announcement.ID, username: username}]
+	}), nil
+}
+
+func (m *MemoryStore) RecordAnnouncementDeliveries(id string, usernames []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, username := range usernames {
+		m.deliveries[announcementDelivery{id: id, username: username}] = true
+	}
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func (m *MemoryStore) pubKeyInUse(pubkey []byte) bool {
+	for _, user := range m.users {
+		if bytes.Equal(user.pubkey, pubkey) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) replacePubKey(username string, user *memoryUser, newPubkey []byte, reason string) {
+	m.keyHistory = append(m.keyHistory, memoryKeyHistory{
+		username:   username,
+		pubkey:     user.pubkey,
+		replacedAt: time.Now(),
+		reason:     reason,
+	})
+	user.pubkey = bytes.Clone(newPubkey)
+	user.keyCreatedAt = time.Now()
+	user.keyResetRequired = false
+}
+
+func (m *MemoryStore) SuspendUser(suspension Suspension) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.users[suspension.Username]; !exists {
+		return 0, ErrUserNotFound
+	}
+	suspension.ID = 1
+	if count := len(m.suspensions); count > 0 {
+		suspension.ID = m.suspensions[count-1].ID + 1
+	}
+	suspension.CreatedAt = time.Unix(suspension.CreatedAt.Unix(), 0)
+	suspension.ExpiresAt = timeOrZero(unixOrZero(suspension.ExpiresAt))
+	suspension.LiftedAt, suspension.LiftedBy = time.Time{}, ""
+	m.suspensions = append(m.suspensions, suspension)
+	return suspension.ID, nil
+}
+
+func (m *MemoryStore) ActiveSuspension(username string, now time.Time) (Suspension, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var active *Suspension
+	for i, suspension := range m.suspensions {
+		if suspension.Username == username && suspension.Active(now) && (active == nil || suspension.outlasts(*active)) {
+			active = &m.suspensions[i]
+		}
+	}
+	if active == nil {
+		return Suspension{}, ErrNotSuspended
+	}
+	return *active, nil
+}
+
+func (m *MemoryStore) LiftSuspensions(username string, liftedBy string, now time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	lifted := 0
+	for i := range m.suspensions {
+		if m.suspensions[i].Username == username && m.suspensions[i].Active(now) {
+			m.suspensions[i].LiftedAt = time.Unix(now.Unix(), 0)
+			m.suspensions[i].LiftedBy = liftedBy
+			lifted++
+		}
+	}
+	return lifted, nil
+}
+
+func (m *MemoryStore) ListSuspensions(username string) ([]Suspension, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var suspensions []Suspension
+	for _, suspension := range m.suspensions {
+		if suspension.Username == username {
+			suspensions = append(suspensions, suspension)
+		}
+	}
+	return suspensions, nil
+}
+
+func (m *MemoryStore) AddContact(username string, other string) error {
+	if username == other {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.contacts[contact{username: username, contact: other}] = true
+	m.contacts[contact{username: other, contact: username}] = true
+	return nil
+}
+
+func (m *MemoryStore) AddKeyRevocations(username string, revokedUsername string, revokedAt time.Time) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var contacts []string
+	for pair := range m.contacts {
+		if pair.username == username {
+			contacts = append(contacts, pair.contact)
+		}
+	}
+	sort.Strings(contacts)
+	for _, other := range contacts {
+		revocations := m.revocations[:0]
+		for _, revocation := range m.revocations {
+			if revocation.Contact != other || revocation.Username != revokedUsername {
+				revocations = append(revocations, revocation)
+			}
+		}
+		m.revocations = append(revocations, KeyRevocation{Contact: other, Username: revokedUsername, RevokedAt: time.Unix(revokedAt.Unix(), 0)})
+	}
+	return contacts, nil
+}
+
+func (m *MemoryStore) PendingKeyRevocations(contact string) ([]KeyRevocation, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var revocations []KeyRevocation
+	for _, revocation := range m.revocations {
+		if revocation.Contact == contact {
+			revocations = append(revocations, revocation)
+		}
+	}
+	sort.Slice(revocations, func(i, j int) bool {
+		if !revocations[i].RevokedAt.Equal(revocations[j].RevokedAt) {
+			return revocations[i].RevokedAt.Before(revocations[j].RevokedAt)
+		}
+		return revocations[i].Username < revocations[j].Username
+	})
+	return revocations, nil
+}
+
+func (m *MemoryStore) DeleteKeyRevocation(contact string, revokedUsername string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	revocations := m.revocations[:0]
+	for _, revocation := range m.revocations {
+		if revocation.Contact != contact || revocation.Username != revokedUsername {
+			revocations = append(revocations, revocation)
+		}
+	}
+	m.revocations = revocations
+	return nil
+}
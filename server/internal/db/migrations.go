@@ -0,0 +1,199 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const createSchemaVersionTableSQL = `CREATE TABLE IF NOT EXISTS SchemaVersion(
+    version INTEGER PRIMARY KEY,
+    description TEXT NOT NULL,
+    applied_at INTEGER NOT NULL
+)`
+
+// Migration is one numbered step of the database schema. Applied migrations are recorded in the
+// SchemaVersion table and must never be changed, new schema changes are added as a new migration.
+type Migration struct {
+	Version     int
+	Description string
+	up          func(tx *sql.Tx) error
+}
+
+// The first migrations also bring databases created before the SchemaVersion table existed up to date,
+// so they only create what is missing.
+var migrations = []Migration{
+	{1, "create Users table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(createUsersTableSQL)
+		return err
+	}},
+	{2, "create KeyHistory table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(createKeyHistoryTableSQL)
+		return err
+	}},
+	{3, "create RecoveryCodes table and record why keys were replaced", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createRecoveryCodesTableSQL); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "KeyHistory", "reason", "TEXT NOT NULL DEFAULT 'rotated'")
+	}},
+	{4, "add username blinding version to Users", func(tx *sql.Tx) error {
+		return addColumnIfMissing(tx, "Users", "hash_version", "INTEGER NOT NULL DEFAULT 1")
+	}},
+	{5, "add key algorithm and creation time to Users", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "Users", "key_algorithm", "TEXT NOT NULL DEFAULT 'RSA'"); err != nil {
+			return err
+		}
+		if err := addColumnIfMissing(tx, "Users", "key_created_at", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		// Keys registered before their creation time was recorded start aging now
+		_, err := tx.Exec("UPDATE Users SET key_created_at = ? WHERE key_created_at = 0", time.Now().Unix())
+		return err
+	}},
+	{6, "create append-only AuditLog table", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createAuditLogTableSQL); err != nil {
+			return err
+		}
+		_, err := tx.Exec(createAuditLogTriggersSQL)
+		return err
+	}},
+	{7, "add disabled and key reset flags to Users", func(tx *sql.Tx) error {
+		if err := addColumnIfMissing(tx, "Users", "disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			return err
+		}
+		return addColumnIfMissing(tx, "Users", "key_reset_required", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{8, "create Announcements and AnnouncementDeliveries tables", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createAnnouncementsTableSQL); err != nil {
+			return err
+		}
+		_, err := tx.Exec(createAnnouncementDeliveriesTableSQL)
+		return err
+	}},
+	{9, "create Suspensions table", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createSuspensionsTableSQL); err != nil {
+			return err
+		}
+		_, err := tx.Exec(createSuspensionsIndexSQL)
+		return err
+	}},
+	{10, "create Contacts and KeyRevocationNotices tables", func(tx *sql.Tx) error {
+		if _, err := tx.Exec(createContactsTableSQL); err != nil {
+			return err
+		}
+		_, err := tx.Exec(createKeyRevocationNoticesTableSQL)
+		return err
+	}},
+}
+
+// LatestSchemaVersion is the schema version this binary migrates databases to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// SchemaVersion returns the version of the database schema, 0 for a database that was never migrated
+func SchemaVersion(conn *sql.DB) (int, error) {
+	var exists int
+	err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'SchemaVersion'").Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %v", err)
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	if err = conn.QueryRow("SELECT MAX(version) FROM SchemaVersion").Scan(&version); err != nil {
+		return 0, fmt.Errorf("error reading schema version: %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+// PendingMigrations returns the migrations that have not been applied to the database yet, without changing it.
+// It fails if the database was migrated by a newer version of the server.
+func PendingMigrations(conn *sql.DB) ([]Migration, error) {
+	version, err := SchemaVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if version > LatestSchemaVersion() {
+		return nil, fmt.Errorf("database schema version %d is newer than version %d supported by this server, upgrade the server", version, LatestSchemaVersion())
+	}
+
+	var pending []Migration
+	for _, migration := range migrations {
+		if migration.Version > version {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order, each one in its own transaction
+func Migrate(conn *sql.DB) error {
+	pending, err := PendingMigrations(conn)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	if _, err = conn.Exec(createSchemaVersionTableSQL); err != nil {
+		return fmt.Errorf("failed to create SchemaVersion table: %v", err)
+	}
+
+	for _, migration := range pending {
+		if err = applyMigration(conn, migration); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", migration.Version, migration.Description, err)
+		}
+		slog.Info("Applied database migration", "version", migration.Version, "description", migration.Description)
+	}
+	return nil
+}
+
+func applyMigration(conn *sql.DB, migration Migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err = migration.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO SchemaVersion(version, description, applied_at) VALUES(?, ?, ?)", migration.Version, migration.Description, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("error recording schema version: %v", err)
+	}
+	return tx.Commit()
+}
+
+// addColumnIfMissing adds a column to a table created by an older version of the server
+func addColumnIfMissing(tx *sql.Tx, table string, column string, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMigrateNewDatabase(t *testing.T) {
+	conn, err := CreateConnection(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer conn.Close()
+
+	pending, err := PendingMigrations(conn)
+	if err != nil {
+		t.Fatalf("Error listing pending migrations: %v", err)
+	}
+	if len(pending) != len(migrations) {
+		t.Errorf("Expected %d pending migrations on a new database, got %d", len(migrations), len(pending))
+	}
+	if version, _ := SchemaVersion(conn); version != 0 {
+		t.Errorf("Listing pending migrations must not change the database, schema version is %d", version)
+	}
+
+	if err = Migrate(conn); err != nil {
+		t.Fatalf("Error migrating database: %v", err)
+	}
+	if version, _ := SchemaVersion(conn); version != LatestSchemaVersion() {
+		t.Errorf("Expected schema version %d, got %d", LatestSchemaVersion(), version)
+	}
+	if pending, _ = PendingMigrations(conn); len(pending) != 0 {
+		t.Errorf("Expected no pending migrations, got %d", len(pending))
+	}
+	// Migrating an up to date database does nothing
+	if err = Migrate(conn); err != nil {
+		t.Errorf("Error migrating up to date database: %v", err)
+	}
+}
+
+func TestMigrateUnversionedDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	conn, err := CreateConnection(dbPath)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	// A database created before migrations existed, with the original Users table only
+	if _, err = conn.Exec("CREATE TABLE Users(username TEXT PRIMARY KEY, pubkey BLOB)"); err != nil {
+		t.Fatalf("Error creating Users table: %v", err)
+	}
+	if _, err = conn.Exec("INSERT INTO Users(username, pubkey) VALUES('alice', x'0102')"); err != nil {
+		t.Fatalf("Error inserting user: %v", err)
+	}
+	conn.Close()
+
+	store, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error opening unversioned database: %v", err)
+	}
+	defer store.Close()
+
+	keyAlgorithm, keyCreatedAt, err := store.GetUserKeyInfo("alice")
+	if err != nil {
+		t.Fatalf("Error reading migrated user: %v", err)
+	}
+	if keyAlgorithm != "RSA" || keyCreatedAt.Unix() == 0 {
+		t.Errorf("Unexpected key info after migration: %s %v", keyAlgorithm, keyCreatedAt)
+	}
+	counts, err := store.CountUsersByHashVersion()
+	if err != nil || counts[1] != 1 {
+		t.Errorf("Expected the migrated user at blinding version 1, got %v (%v)", counts, err)
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	store, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	_, err = store.conn.Exec("INSERT INTO SchemaVersion(version, description, applied_at) VALUES(?, 'from the future', 0)", LatestSchemaVersion()+1)
+	store.Close()
+	if err != nil {
+		t.Fatalf("Error recording schema version: %v", err)
+	}
+
+	store, err = OpenSQLiteStore(dbPath)
+	if err == nil {
+		store.Close()
+		t.Fatal("Expected opening a database with a newer schema to fail")
+	}
+	if !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
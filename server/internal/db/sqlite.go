@@ -1,33 +1,48 @@
 package db
 
 import (
+	"bytes"
+	"context"
 	"crypto/rsa"
 	"database/sql"
+	"errors"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
-	"math/big"
+	"github.com/mattn/go-sqlite3"
+	"log/slog"
 	"os"
-	"sync"
+	"path/filepath"
+	"time"
 )
 
-type Database struct {
+type SQLiteStore struct {
 	conn *sql.DB
 }
 
-var instance *Database
-var once sync.Once
-
-const UsersDBPath = "server/resources/db/users.db"
 const createUsersTableSQL = `CREATE TABLE IF NOT EXISTS Users(
     username TEXT PRIMARY KEY,
     pubkey BLOB
 )`
+const createKeyHistoryTableSQL = `CREATE TABLE IF NOT EXISTS KeyHistory(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL,
+    pubkey BLOB NOT NULL,
+    replaced_at INTEGER NOT NULL
+)`
+const createRecoveryCodesTableSQL = `CREATE TABLE IF NOT EXISTS RecoveryCodes(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL,
+    verifier BLOB NOT NULL,
+    used_at INTEGER
+)`
 
 func CreateConnection(dbPath string) (*sql.DB, error) {
 	// Check if the file exists
 	_, err := os.Stat(dbPath)
 	if os.IsNotExist(err) {
-		fmt.Println("Database file does not exist. Creating it...")
+		slog.Info("Database file does not exist, creating it", "path", dbPath)
+		if err := os.MkdirAll(filepath.Dir(dbPath), 0700); err != nil {
+			return nil, fmt.Errorf("error creating database directory: %v", err)
+		}
 		// Create the file
 		file, err := os.Create(dbPath)
 		if err != nil {
@@ -44,89 +59,427 @@ func CreateConnection(dbPath string) (*sql.DB, error) {
 
 	// Ping the database to verify the connection
 	if err = db.Ping(); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("error connecting to database: %v", err)
 	}
 
-	fmt.Println("Database created/opened successfully")
+	slog.Debug("Database opened", "path", dbPath)
 	return db, nil
 }
 
-func GetDatabase() *Database {
-	once.Do(func() {
-		conn, err := CreateConnection(UsersDBPath)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to create database connection: %v", err))
-		}
-		_, err = conn.Exec(createUsersTableSQL)
+// OpenConnection opens the SQLite database at dbPath without ever creating it. A read-only connection can't change it.
+func OpenConnection(dbPath string, readOnly bool) (*sql.DB, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	mode := "rw"
+	if readOnly {
+		mode = "ro"
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=%s", dbPath, mode))
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	if err = db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	slog.Debug("Database opened", "path", dbPath, "mode", mode)
+	return db, nil
+}
+
+// OpenExistingSQLiteStore opens the SQLite database at dbPath like OpenConnection. It doesn't apply pending
+// migrations, and fails when there are any, so they are only applied when an operator asks for it.
+func OpenExistingSQLiteStore(dbPath string, readOnly bool) (*SQLiteStore, error) {
+	conn, err := OpenConnection(dbPath, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := PendingMigrations(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(pending) > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("the database has %d pending migrations, apply them with the migrate command first", len(pending))
+	}
+	return &SQLiteStore{conn: conn}, nil
+}
+
+// OpenSQLiteStore opens (or creates) the SQLite database at dbPath and applies any pending migrations
+func OpenSQLiteStore(dbPath string) (*SQLiteStore, error) {
+	conn, err := CreateConnection(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = Migrate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &SQLiteStore{conn: conn}, nil
+}
+
+// CheckHealth fails when the database can't be reached or its schema is not the one this server migrates to
+func (db *SQLiteStore) CheckHealth(ctx context.Context) error {
+	if err := db.conn.PingContext(ctx); err != nil {
+		return fmt.Errorf("database is unreachable: %v", err)
+	}
+	pending, err := PendingMigrations(db.conn)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%d database migrations are pending", len(pending))
+	}
+	return nil
+}
+
+func (db *SQLiteStore) Close() error {
+	return db.conn.Close()
+}
+
+func (db *SQLiteStore) GetUserPubKey(username string) (*rsa.PublicKey, error) {
+	var pubkeyBytes []byte
+	err := db.conn.QueryRow("SELECT pubkey FROM Users WHERE username = ?", username).Scan(&pubkeyBytes)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return publicKeyFromBytes(pubkeyBytes), nil
+}
+
+func (db *SQLiteStore) CreateNewUser(username string, hashVersion int, keyAlgorithm string, pubkey []byte, recoveryVerifiers [][]byte) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// First, check that neither the username nor the public key is taken
+	var existingUsername string
+	err = tx.QueryRow("SELECT username FROM Users WHERE username = ?", username).Scan(&existingUsername)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error checking for existing user: %v", err)
+	}
+	if err == nil {
+		return ErrUserExists
+	}
+	err = tx.QueryRow("SELECT username FROM Users WHERE pubkey = ?", pubkey).Scan(&existingUsername)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error checking for existing public key: %v", err)
+	}
+	if err == nil {
+		return ErrPubKeyInUse
+	}
+
+	// If we've reached here, no user with this public key exists, so we can proceed with insertion
+	stmt, err := tx.Prepare("INSERT INTO Users(username, hash_version, key_algorithm, key_created_at, pubkey) VALUES(?, ?, ?, ?, ?)")
+	if err != nil {
+		return fmt.Errorf("error preparing statement: %v", err)
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(username, hashVersion, keyAlgorithm, time.Now().Unix(), pubkey)
+	if isConstraintViolation(err) {
+		// Registered by someone else since the check
+		return ErrUserExists
+	}
+	if err != nil {
+		return fmt.Errorf("error executing insert: %v", err)
+	}
+
+	for _, verifier := range recoveryVerifiers {
+		_, err = tx.Exec("INSERT INTO RecoveryCodes(username, verifier) VALUES(?, ?)", username, verifier)
 		if err != nil {
-			panic(fmt.Sprintf("Failed to create Users table: %v", err))
+			return fmt.Errorf("error saving recovery code: %v", err)
 		}
-		fmt.Println("Users table created successfully")
-		instance = &Database{conn: conn}
-	})
-	return instance
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing new user: %v", err)
+	}
+	slog.Debug("User inserted")
+	return nil
 }
 
-func (db *Database) query(sqlStatement string) (*sql.Rows, error) {
-	rows, err := db.conn.Query(sqlStatement)
+// GetUserKeyInfo returns the algorithm of the user's public key and when it was registered
+func (db *SQLiteStore) GetUserKeyInfo(username string) (string, time.Time, error) {
+	var keyAlgorithm string
+	var keyCreatedAt int64
+	err := db.conn.QueryRow("SELECT key_algorithm, key_created_at FROM Users WHERE username = ?", username).Scan(&keyAlgorithm, &keyCreatedAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, ErrUserNotFound
+	}
 	if err != nil {
-		return nil, err
+		return "", time.Time{}, fmt.Errorf("error reading key info: %v", err)
 	}
-	return rows, nil
+	return keyAlgorithm, time.Unix(keyCreatedAt, 0), nil
 }
 
-func (db *Database) GetUserPubKey(username string) (*rsa.PublicKey, error) {
-	var err error
-	var rows *sql.Rows
-	rows, err = db.query(fmt.Sprintf("SELECT pubkey FROM Users WHERE username = '%s';", username))
+func (db *SQLiteStore) UserExists(username string) (bool, error) {
+	var existingUsername string
+	err := db.conn.QueryRow("SELECT username FROM Users WHERE username = ?", username).Scan(&existingUsername)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up user: %v", err)
+	}
+	return true, nil
+}
+
+// RehashUser moves the user, with everything stored under its blinded username, to a new blinding version
+func (db *SQLiteStore) RehashUser(oldUsername string, newUsername string, hashVersion int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE Users SET username = ?, hash_version = ? WHERE username = ?", newUsername, hashVersion, oldUsername)
+	if isConstraintViolation(err) {
+		return ErrUserExists
+	}
+	if err != nil {
+		return fmt.Errorf("error rehashing user: %v", err)
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return ErrUserNotFound
+	}
+	for _, table := range []string{"KeyHistory", "RecoveryCodes", "AnnouncementDeliveries", "Suspensions", "Contacts"} {
+		if _, err = tx.Exec(fmt.Sprintf("UPDATE %s SET username = ? WHERE username = ?", table), newUsername, oldUsername); err != nil {
+			return fmt.Errorf("error rehashing %s: %v", table, err)
+		}
+	}
+	// The user is also the contact of others, and the recipient of their key revocation notices
+	for _, table := range []string{"Contacts", "KeyRevocationNotices"} {
+		if _, err = tx.Exec(fmt.Sprintf("UPDATE %s SET contact = ? WHERE contact = ?", table), newUsername, oldUsername); err != nil {
+			return fmt.Errorf("error rehashing %s: %v", table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing rehash: %v", err)
+	}
+	slog.Debug("User rehashed")
+	return nil
+}
+
+// isConstraintViolation reports whether err is a violated constraint, like a username that is taken
+func isConstraintViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint
+}
+
+// CountUsersByHashVersion reports how many accounts are still stored with each blinding version
+func (db *SQLiteStore) CountUsersByHashVersion() (map[int]int, error) {
+	rows, err := db.conn.Query("SELECT hash_version, COUNT(*) FROM Users GROUP BY hash_version")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	counts := make(map[int]int)
 	for rows.Next() {
-		var pubkeyBytes []byte
-		if err = rows.Scan(&pubkeyBytes); err != nil {
+		var version, count int
+		if err = rows.Scan(&version, &count); err != nil {
 			return nil, err
 		}
+		counts[version] = count
+	}
+	return counts, rows.Err()
+}
 
-		// Convert the big integer bytes to a big.Int
-		pubkeyInt := new(big.Int).SetBytes(pubkeyBytes)
+// RotateUserPubKey replaces the user's public key with newPubkey, as long as the stored key is still oldPubkey.
+// The replaced key is kept in the KeyHistory table.
+func (db *SQLiteStore) RotateUserPubKey(username string, oldPubkey []byte, newPubkey []byte) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
 
-		// Construct the RSA public key
-		sshPubKey := &rsa.PublicKey{
-			N: pubkeyInt,
-			E: 65537, // Commonly used public exponent
-		}
+	var currentPubkey []byte
+	err = tx.QueryRow("SELECT pubkey FROM Users WHERE username = ?", username).Scan(&currentPubkey)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error reading current public key: %v", err)
+	}
+	if !bytes.Equal(currentPubkey, oldPubkey) {
+		return ErrPubKeyChanged
+	}
+
+	var existingUsername string
+	err = tx.QueryRow("SELECT username FROM Users WHERE pubkey = ?", newPubkey).Scan(&existingUsername)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error checking for existing public key: %v", err)
+	}
+	if err == nil {
+		return ErrPubKeyInUse
+	}
+
+	if err = replacePubKey(tx, username, currentPubkey, newPubkey, KeyReplacedByRotation); err != nil {
+		return err
+	}
 
-		return sshPubKey, nil
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing key rotation: %v", err)
 	}
-	return nil, fmt.Errorf("user not found")
+	slog.Debug("User public key rotated")
+	return nil
 }
 
-func (db *Database) CreateNewUser(username string, pubkey []byte) error {
-	// First, check if a user with the same public key already exists
+// RecoverUser consumes one of the user's unused recovery codes, revokes the current public key and binds newPubkey instead
+func (db *SQLiteStore) RecoverUser(username string, recoveryVerifier []byte, newPubkey []byte) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE RecoveryCodes SET used_at = ? WHERE username = ? AND verifier = ? AND used_at IS NULL", time.Now().Unix(), username, recoveryVerifier)
+	if err != nil {
+		return fmt.Errorf("error consuming recovery code: %v", err)
+	}
+	if consumed, err := result.RowsAffected(); err != nil || consumed == 0 {
+		return ErrInvalidRecoveryCode
+	}
+
+	var currentPubkey []byte
+	err = tx.QueryRow("SELECT pubkey FROM Users WHERE username = ?", username).Scan(&currentPubkey)
+	if err == sql.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("error reading current public key: %v", err)
+	}
+
 	var existingUsername string
-	err := db.conn.QueryRow("SELECT username FROM Users WHERE pubkey = ?", pubkey).Scan(&existingUsername)
+	err = tx.QueryRow("SELECT username FROM Users WHERE pubkey = ?", newPubkey).Scan(&existingUsername)
 	if err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("error checking for existing public key: %v", err)
 	}
 	if err == nil {
-		return fmt.Errorf("a user with this public key already exists: %s", existingUsername)
+		return ErrPubKeyInUse
 	}
 
-	// If we've reached here, no user with this public key exists, so we can proceed with insertion
-	stmt, err := db.conn.Prepare("INSERT INTO Users(username, pubkey) VALUES(?, ?)")
+	if err = replacePubKey(tx, username, currentPubkey, newPubkey, KeyReplacedByRecovery); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing recovery: %v", err)
+	}
+	slog.Debug("User public key revoked and replaced")
+	return nil
+}
+
+func replacePubKey(tx *sql.Tx, username string, currentPubkey []byte, newPubkey []byte, reason string) error {
+	_, err := tx.Exec("INSERT INTO KeyHistory(username, pubkey, replaced_at, reason) VALUES(?, ?, ?, ?)", username, currentPubkey, time.Now().Unix(), reason)
 	if err != nil {
-		return fmt.Errorf("error preparing statement: %v", err)
+		return fmt.Errorf("error saving key history: %v", err)
 	}
-	defer stmt.Close()
+	// A new key is what a required key reset asks for
+	_, err = tx.Exec("UPDATE Users SET pubkey = ?, key_created_at = ?, key_reset_required = 0 WHERE username = ?", newPubkey, time.Now().Unix(), username)
+	if err != nil {
+		return fmt.Errorf("error updating public key: %v", err)
+	}
+	return nil
+}
+
+const selectUserInfoSQL = `SELECT username, hash_version, key_algorithm, key_created_at, disabled, key_reset_required FROM Users`
 
-	_, err = stmt.Exec(username, pubkey)
+func scanUserInfo(row interface{ Scan(dest ...any) error }) (UserInfo, error) {
+	var user UserInfo
+	var keyCreatedAt int64
+	err := row.Scan(&user.Username, &user.HashVersion, &user.KeyAlgorithm, &keyCreatedAt, &user.Disabled, &user.KeyResetRequired)
+	user.KeyCreatedAt = time.Unix(keyCreatedAt, 0)
+	return user, err
+}
+
+func (db *SQLiteStore) GetUser(username string) (UserInfo, error) {
+	user, err := scanUserInfo(db.conn.QueryRow(selectUserInfoSQL+" WHERE username = ?", username))
+	if err == sql.ErrNoRows {
+		return UserInfo{}, ErrUserNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("error executing insert: %v", err)
+		return UserInfo{}, fmt.Errorf("error reading user: %v", err)
+	}
+	return user, nil
+}
+
+func (db *SQLiteStore) ListUsers() ([]UserInfo, error) {
+	rows, err := db.conn.Query(selectUserInfoSQL + " ORDER BY username")
+	if err != nil {
+		return nil, fmt.Errorf("error listing users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []UserInfo
+	for rows.Next() {
+		user, err := scanUserInfo(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading user: %v", err)
+		}
+		users = append(users, user)
 	}
+	return users, rows.Err()
+}
+
+func (db *SQLiteStore) SetUserDisabled(username string, disabled bool) error {
+	return db.updateUser("UPDATE Users SET disabled = ? WHERE username = ?", disabled, username)
+}
+
+func (db *SQLiteStore) RequireKeyReset(username string) error {
+	return db.updateUser("UPDATE Users SET key_reset_required = 1 WHERE username = ?", username)
+}
+
+// updateUser runs an update of one user's row, ErrUserNotFound when there is no such user
+func (db *SQLiteStore) updateUser(query string, args ...any) error {
+	result, err := db.conn.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("error updating user: %v", err)
+	}
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
 
-	fmt.Println("User inserted successfully")
+func (db *SQLiteStore) DeleteUser(username string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM Users WHERE username = ?", username)
+	if err != nil {
+		return fmt.Errorf("error deleting user: %v", err)
+	}
+	if deleted, err := result.RowsAffected(); err != nil || deleted == 0 {
+		return ErrUserNotFound
+	}
+	for _, table := range []string{"KeyHistory", "RecoveryCodes", "AnnouncementDeliveries", "Suspensions"} {
+		if _, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE username = ?", table), username); err != nil {
+			return fmt.Errorf("error deleting %s of user: %v", table, err)
+		}
+	}
+	if _, err = tx.Exec("DELETE FROM Contacts WHERE username = ? OR contact = ?", username, username); err != nil {
+		return fmt.Errorf("error deleting Contacts of user: %v", err)
+	}
+	if _, err = tx.Exec("DELETE FROM KeyRevocationNotices WHERE contact = ?", username); err != nil {
+		return fmt.Errorf("error deleting KeyRevocationNotices of user: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error committing user deletion: %v", err)
+	}
+	slog.Debug("User deleted")
 	return nil
 }
@@ -1,11 +1,120 @@
 package db
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"server/internal/audit"
+	"testing"
+)
 
-func TestOpenUsersDB(t *testing.T) {
-	if db, err := OpenUsersDB(); err != nil {
-		t.Errorf("Error opening users database: %v", err)
-	} else {
-		defer db.conn.Close()
+func TestOpenSQLiteStore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	store, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error opening users database: %v", err)
+	}
+	if err = store.Close(); err != nil {
+		t.Errorf("Error closing users database: %v", err)
+	}
+
+	// Opening an existing database must keep working
+	store, err = OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error reopening users database: %v", err)
+	}
+	defer store.Close()
+}
+
+func TestOpenExistingSQLiteStore(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	if _, err := OpenExistingSQLiteStore(dbPath, true); err == nil {
+		t.Fatal("Expected a missing database to be refused")
+	}
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected a missing database not to be created, got %v", err)
+	}
+
+	// A database of an older version is not migrated behind the operator's back
+	conn, err := CreateConnection(dbPath)
+	if err != nil {
+		t.Fatalf("Error creating database: %v", err)
+	}
+	conn.Close()
+	if _, err = OpenExistingSQLiteStore(dbPath, false); err == nil {
+		t.Fatal("Expected a database with pending migrations to be refused")
+	}
+	if conn, err = OpenConnection(dbPath, true); err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	if version, _ := SchemaVersion(conn); version != 0 {
+		t.Errorf("Expected the database to be left unmigrated, got version %d", version)
+	}
+	conn.Close()
+
+	migrated, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error migrating database: %v", err)
+	}
+	migrated.Close()
+	store, err := OpenExistingSQLiteStore(dbPath, true)
+	if err != nil {
+		t.Fatalf("Error opening migrated database: %v", err)
+	}
+	defer store.Close()
+	if _, err = store.ListUsers(); err != nil {
+		t.Errorf("Expected a read-only database to be readable: %v", err)
+	}
+	if err = store.CreateNewUser("alice", 1, "RSA", []byte{1}, nil); err == nil {
+		t.Error("Expected a read-only database to refuse changes")
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Error opening users database: %v", err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestAuditTable(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "users.db")
+	store, err := OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error opening users database: %v", err)
+	}
+	auditLog, err := audit.New(store.AuditSink())
+	if err != nil {
+		t.Fatalf("Error opening audit log: %v", err)
+	}
+	if err = auditLog.Record(audit.Event{Type: audit.EventLogin, Outcome: audit.OutcomeSuccess, User: "alice"}); err != nil {
+		t.Fatalf("Error recording event: %v", err)
+	}
+	store.Close()
+
+	// The chain goes on after a restart
+	store, err = OpenSQLiteStore(dbPath)
+	if err != nil {
+		t.Fatalf("Error reopening users database: %v", err)
+	}
+	defer store.Close()
+	auditLog, _ = audit.New(store.AuditSink())
+	if err = auditLog.Record(audit.Event{Type: audit.EventLogin, Outcome: audit.OutcomeFailure, User: "alice"}); err != nil {
+		t.Fatalf("Error recording event: %v", err)
+	}
+	records, err := store.AuditSink().Records()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d (%v)", len(records), err)
+	}
+	if err = audit.Verify(records); err != nil {
+		t.Errorf("Expected the chain to be intact, got %v", err)
+	}
+
+	if _, err = store.conn.Exec("UPDATE AuditLog SET outcome = 'success' WHERE seq = 2"); err == nil {
+		t.Error("Expected audit records to be read-only")
+	}
+	if _, err = store.conn.Exec("DELETE FROM AuditLog"); err == nil {
+		t.Error("Expected audit records not to be deleted")
 	}
 }
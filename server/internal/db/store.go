@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"math/big"
+	"time"
+)
+
+const (
+	KeyReplacedByRotation = "rotated"
+	KeyReplacedByRecovery = "revoked"
+)
+
+var (
+	ErrUserNotFound        = errors.New("user not found")
+	ErrUserExists          = errors.New("user already exists")
+	ErrPubKeyInUse         = errors.New("a user with this public key already exists")
+	ErrPubKeyChanged       = errors.New("public key was changed concurrently")
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+)
+
+// Store is the server's persistent state. Users are identified by their blinded username.
+type Store interface {
+	GetUserPubKey(username string) (*rsa.PublicKey, error)
+	// GetUserKeyInfo returns the algorithm of the user's public key and when it was registered
+	GetUserKeyInfo(username string) (string, time.Time, error)
+	UserExists(username string) (bool, error)
+	CreateNewUser(username string, hashVersion int, keyAlgorithm string, pubkey []byte, recoveryVerifiers [][]byte) error
+	// RotateUserPubKey replaces the user's public key with newPubkey, as long as the stored key is still oldPubkey
+	RotateUserPubKey(username string, oldPubkey []byte, newPubkey []byte) error
+	// RecoverUser consumes one of the user's unused recovery codes, revokes the current public key and binds newPubkey instead
+	RecoverUser(username string, recoveryVerifier []byte, newPubkey []byte) error
+	// RehashUser moves the user, with everything stored under its blinded username, to a new blinding version
+	RehashUser(oldUsername string, newUsername string, hashVersion int) error
+	// CountUsersByHashVersion reports how many accounts are still stored with each blinding version
+	CountUsersByHashVersion() (map[int]int, error)
+	// GetUser returns what is stored about the user, apart from its keys
+	GetUser(username string) (UserInfo, error)
+	// ListUsers returns every user, ordered by blinded username
+	ListUsers() ([]UserInfo, error)
+	// SetUserDisabled disables the account, so the user can't log in, or enables it again
+	SetUserDisabled(username string, disabled bool) error
+	// RequireKeyReset refuses logins with the current key until the user binds a new one with a recovery code
+	RequireKeyReset(username string) error
+	// DeleteUser removes the user with its key history, recovery codes, announcement deliveries, suspensions,
+	// contacts and key revocation notices
+	DeleteUser(username string) error
+	// AddAnnouncement schedules an announcement, it is sent once its SendAt has passed
+	AddAnnouncement(announcement Announcement) error
+	// ListAnnouncements returns every announcement, in the order they are sent
+	ListAnnouncements() ([]Announcement, error)
+	// DueAnnouncements returns the announcements that were not sent yet and are due at now
+	DueAnnouncements(now time.Time) ([]Announcement, error)
+	// MarkAnnouncementSent records when the announcement was sent
+	MarkAnnouncementSent(id string, sentAt time.Time) error
+	// UndeliveredAnnouncements returns the persistent announcements that were sent, have not expired at now
+	// and were not delivered to the user yet
+	UndeliveredAnnouncements(username string, now time.Time) ([]Announcement, error)
+	// RecordAnnouncementDeliveries records that the announcement was delivered to the users
+	RecordAnnouncementDeliveries(id string, usernames []string) error
+	// SuspendUser records a suspension of an existing user and returns its ID
+	SuspendUser(suspension Suspension) (int64, error)
+	// ActiveSuspension returns the suspension that keeps the user out the longest at now, or ErrNotSuspended
+	ActiveSuspension(username string, now time.Time) (Suspension, error)
+	// LiftSuspensions ends the user's active suspensions and returns how many there were
+	LiftSuspensions(username string, liftedBy string, now time.Time) (int, error)
+	// ListSuspensions returns every suspension of the user, oldest first
+	ListSuspensions(username string) ([]Suspension, error)
+	// AddContact records that the users exchanged keys, so each hears about the other's revoked keys
+	AddContact(username string, contact string) error
+	// AddKeyRevocations queues a notice that the key of revokedUsername, the plaintext of username, was revoked
+	// for every contact of username, and returns the contacts
+	AddKeyRevocations(username string, revokedUsername string, revokedAt time.Time) ([]string, error)
+	// PendingKeyRevocations returns the key revocation notices not delivered to the contact yet, oldest first
+	PendingKeyRevocations(contact string) ([]KeyRevocation, error)
+	// DeleteKeyRevocation removes a key revocation notice once it was delivered to the contact
+	DeleteKeyRevocation(contact string, revokedUsername string) error
+	Close() error
+}
+
+// UserInfo is what administrators get to see about a user
+type UserInfo struct {
+	Username         string // Blinded
+	HashVersion      int
+	KeyAlgorithm     string
+	KeyCreatedAt     time.Time
+	Disabled         bool
+	KeyResetRequired bool
+}
+
+// HealthChecker is implemented by stores that can be unreachable, like a database
+type HealthChecker interface {
+	// CheckHealth returns why the store can't be used right now
+	CheckHealth(ctx context.Context) error
+}
+
+func publicKeyFromBytes(pubkeyBytes []byte) *rsa.PublicKey {
+	// Convert the big integer bytes to a big.Int
+	pubkeyInt := new(big.Int).SetBytes(pubkeyBytes)
+
+	// Construct the RSA public key
+	return &rsa.PublicKey{
+		N: pubkeyInt,
+		E: 65537, // Commonly used public exponent
+	}
+}
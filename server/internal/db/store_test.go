@@ -0,0 +1,254 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+// testStore checks the behaviour every Store implementation must have
+func testStore(t *testing.T, store Store) {
+	firstKey := bytes.Repeat([]byte{0xA1}, 256)
+	secondKey := bytes.Repeat([]byte{0xB2}, 256)
+	thirdKey := bytes.Repeat([]byte{0xC3}, 256)
+	verifier := []byte("verifier")
+
+	if err := store.CreateNewUser("alice", 1, "RSA", firstKey, [][]byte{verifier}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if err := store.CreateNewUser("bob", 1, "RSA", firstKey, nil); !errors.Is(err, ErrPubKeyInUse) {
+		t.Errorf("Expected ErrPubKeyInUse when registering a public key twice, got %v", err)
+	}
+	if err := store.CreateNewUser("alice", 1, "RSA", thirdKey, nil); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected ErrUserExists when registering a username twice, got %v", err)
+	}
+	if exists, err := store.UserExists("alice"); err != nil || !exists {
+		t.Errorf("Expected alice to exist (err: %v)", err)
+	}
+	if _, err := store.GetUserPubKey("bob"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound for an unknown user, got %v", err)
+	}
+
+	pubKey, err := store.GetUserPubKey("alice")
+	if err != nil || !bytes.Equal(pubKey.N.Bytes(), firstKey) {
+		t.Fatalf("Unexpected public key (err: %v)", err)
+	}
+	if algorithm, _, err := store.GetUserKeyInfo("alice"); err != nil || algorithm != "RSA" {
+		t.Errorf("Unexpected key info %q (err: %v)", algorithm, err)
+	}
+
+	if err = store.RotateUserPubKey("alice", secondKey, thirdKey); !errors.Is(err, ErrPubKeyChanged) {
+		t.Errorf("Expected ErrPubKeyChanged when the old key does not match, got %v", err)
+	}
+	if err = store.RotateUserPubKey("alice", firstKey, secondKey); err != nil {
+		t.Fatalf("Error rotating public key: %v", err)
+	}
+
+	if err = store.RehashUser("alice", "alice-v2", 2); err != nil {
+		t.Fatalf("Error rehashing user: %v", err)
+	}
+	if counts, err := store.CountUsersByHashVersion(); err != nil || counts[2] != 1 || counts[1] != 0 {
+		t.Errorf("Unexpected hash version counts %v (err: %v)", counts, err)
+	}
+
+	if err = store.RecoverUser("alice-v2", []byte("wrong"), thirdKey); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("Expected ErrInvalidRecoveryCode, got %v", err)
+	}
+	if err = store.RequireKeyReset("alice-v2"); err != nil {
+		t.Fatalf("Error requiring a key reset: %v", err)
+	}
+	if user, err := store.GetUser("alice-v2"); err != nil || !user.KeyResetRequired || user.HashVersion != 2 {
+		t.Errorf("Expected a key reset to be required, got %+v (err: %v)", user, err)
+	}
+	if err = store.RecoverUser("alice-v2", verifier, thirdKey); err != nil {
+		t.Fatalf("Error recovering user: %v", err)
+	}
+	if err = store.RecoverUser("alice-v2", verifier, firstKey); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("Expected a recovery code to be usable only once, got %v", err)
+	}
+	pubKey, err = store.GetUserPubKey("alice-v2")
+	if err != nil || !bytes.Equal(pubKey.N.Bytes(), thirdKey) {
+		t.Errorf("Expected the recovered key to be bound (err: %v)", err)
+	}
+	if user, err := store.GetUser("alice-v2"); err != nil || user.KeyResetRequired {
+		t.Errorf("Expected the new key to satisfy the key reset, got %+v (err: %v)", user, err)
+	}
+
+	if err = store.SetUserDisabled("alice-v2", true); err != nil {
+		t.Fatalf("Error disabling user: %v", err)
+	}
+	if err = store.SetUserDisabled("bob", true); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound when disabling an unknown user, got %v", err)
+	}
+	if err = store.CreateNewUser("carol", 2, "RSA", firstKey, [][]byte{verifier}); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	if err = store.RehashUser("carol", "alice-v2", 2); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Expected ErrUserExists when rehashing onto a taken username, got %v", err)
+	}
+	users, err := store.ListUsers()
+	if err != nil || len(users) != 2 || users[0].Username != "alice-v2" || !users[0].Disabled || users[1].Disabled {
+		t.Errorf("Unexpected users %+v (err: %v)", users, err)
+	}
+
+	if err = store.DeleteUser("alice-v2"); err != nil {
+		t.Fatalf("Error deleting user: %v", err)
+	}
+	if _, err = store.GetUser("alice-v2"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected a deleted user to be gone, got %v", err)
+	}
+	if err = store.RecoverUser("alice-v2", verifier, secondKey); !errors.Is(err, ErrInvalidRecoveryCode) {
+		t.Errorf("Expected the recovery codes of a deleted user to be gone, got %v", err)
+	}
+	if err = store.CreateNewUser("alice", 2, "RSA", thirdKey, nil); err != nil {
+		t.Errorf("Expected the key of a deleted user to be free again: %v", err)
+	}
+
+	testAnnouncements(t, store)
+	testSuspensions(t, store)
+	testContacts(t, store)
+}
+
+func testAnnouncements(t *testing.T, store Store) {
+	now := time.Unix(1700000000, 0)
+	for _, announcement := range []Announcement{
+		{ID: "later", Text: "Upgrade tonight", CreatedAt: now, SendAt: now.Add(time.Hour), Persistent: true},
+		{ID: "now", Text: "Maintenance", CreatedAt: now, SendAt: now, ExpiresAt: now.Add(2 * time.Hour), Persistent: true},
+		{ID: "live", Text: "Hello", CreatedAt: now, SendAt: now},
+	} {
+		if err := store.AddAnnouncement(announcement); err != nil {
+			t.Fatalf("Error adding announcement: %v", err)
+		}
+	}
+	due, err := store.DueAnnouncements(now)
+	if err != nil || len(due) != 2 || due[0].ID != "now" || !due[0].ExpiresAt.Equal(now.Add(2*time.Hour)) || due[1].Persistent {
+		t.Fatalf("Expected the two announcements due now, got %+v (err: %v)", due, err)
+	}
+	for _, announcement := range due {
+		if err = store.MarkAnnouncementSent(announcement.ID, now); err != nil {
+			t.Fatalf("Error marking announcement sent: %v", err)
+		}
+		if err = store.RecordAnnouncementDeliveries(announcement.ID, []string{"carol"}); err != nil {
+			t.Fatalf("Error recording deliveries: %v", err)
+		}
+	}
+	if due, err = store.DueAnnouncements(now.Add(time.Hour)); err != nil || len(due) != 1 || due[0].ID != "later" {
+		t.Errorf("Expected only the scheduled announcement to be due, got %+v (err: %v)", due, err)
+	}
+
+	// Only the persistent announcements are delivered to users who were offline, until they expire
+	if undelivered, err := store.UndeliveredAnnouncements("carol", now); err != nil || len(undelivered) != 0 {
+		t.Errorf("Expected nothing for a user who got the announcements, got %+v (err: %v)", undelivered, err)
+	}
+	if err = store.RehashUser("alice", "alice-v3", 3); err != nil {
+		t.Fatalf("Error rehashing user: %v", err)
+	}
+	undelivered, err := store.UndeliveredAnnouncements("alice-v3", now)
+	if err != nil || len(undelivered) != 1 || undelivered[0].ID != "now" || undelivered[0].SentAt.IsZero() {
+		t.Fatalf("Expected the persistent announcement for a user who was offline, got %+v (err: %v)", undelivered, err)
+	}
+	if err = store.RecordAnnouncementDeliveries("now", []string{"alice-v3"}); err != nil {
+		t.Fatalf("Error recording delivery: %v", err)
+	}
+	if undelivered, err = store.UndeliveredAnnouncements("alice-v3", now); err != nil || len(undelivered) != 0 {
+		t.Errorf("Expected a delivered announcement to be delivered once, got %+v (err: %v)", undelivered, err)
+	}
+	if undelivered, err = store.UndeliveredAnnouncements("dave", now.Add(2*time.Hour)); err != nil || len(undelivered) != 0 {
+		t.Errorf("Expected an expired announcement not to be delivered, got %+v (err: %v)", undelivered, err)
+	}
+	if announcements, err := store.ListAnnouncements(); err != nil || len(announcements) != 3 || announcements[2].ID != "later" {
+		t.Errorf("Expected every announcement in the order they are sent, got %+v (err: %v)", announcements, err)
+	}
+}
+
+func testSuspensions(t *testing.T, store Store) {
+	now := time.Unix(1700000000, 0)
+	if _, err := store.SuspendUser(Suspension{Username: "dave", Reason: "spam", CreatedAt: now}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Expected ErrUserNotFound when suspending an unknown user, got %v", err)
+	}
+	if _, err := store.ActiveSuspension("carol", now); !errors.Is(err, ErrNotSuspended) {
+		t.Errorf("Expected ErrNotSuspended, got %v", err)
+	}
+	for _, suspension := range []Suspension{
+		{Username: "carol", Reason: "spam", Moderator: "ops", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{Username: "carol", Reason: "more spam", Moderator: "ops", CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)},
+	} {
+		if _, err := store.SuspendUser(suspension); err != nil {
+			t.Fatalf("Error suspending user: %v", err)
+		}
+	}
+	if suspension, err := store.ActiveSuspension("carol", now); err != nil || suspension.Reason != "more spam" || suspension.Moderator != "ops" {
+		t.Errorf("Expected the suspension that ends last, got %+v (err: %v)", suspension, err)
+	}
+	if _, err := store.ActiveSuspension("carol", now.Add(24*time.Hour)); !errors.Is(err, ErrNotSuspended) {
+		t.Errorf("Expected the suspensions to expire, got %v", err)
+	}
+
+	if _, err := store.SuspendUser(Suspension{Username: "carol", Reason: "ban", Moderator: "admin", CreatedAt: now}); err != nil {
+		t.Fatalf("Error banning user: %v", err)
+	}
+	if suspension, err := store.ActiveSuspension("carol", now.Add(48*time.Hour)); err != nil || !suspension.ExpiresAt.IsZero() {
+		t.Errorf("Expected a ban not to expire, got %+v (err: %v)", suspension, err)
+	}
+	if err := store.RehashUser("carol", "carol-v3", 3); err != nil {
+		t.Fatalf("Error rehashing user: %v", err)
+	}
+	if lifted, err := store.LiftSuspensions("carol-v3", "admin", now.Add(2*time.Hour)); err != nil || lifted != 2 {
+		t.Errorf("Expected the two active suspensions to be lifted, got %d (err: %v)", lifted, err)
+	}
+	if _, err := store.ActiveSuspension("carol-v3", now.Add(2*time.Hour)); !errors.Is(err, ErrNotSuspended) {
+		t.Errorf("Expected no suspension after lifting them, got %v", err)
+	}
+	suspensions, err := store.ListSuspensions("carol-v3")
+	if err != nil || len(suspensions) != 3 || !suspensions[0].LiftedAt.IsZero() || suspensions[2].LiftedBy != "admin" {
+		t.Errorf("Expected the history of suspensions, got %+v (err: %v)", suspensions, err)
+	}
+}
+
+func testContacts(t *testing.T, store Store) {
+	now := time.Unix(1700000000, 0)
+	if err := store.CreateNewUser("frank", 1, "RSA", bytes.Repeat([]byte{0xD4}, 256), nil); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	for _, pair := range [][2]string{{"erin", "frank"}, {"grace", "erin"}, {"frank", "erin"}, {"erin", "erin"}} {
+		if err := store.AddContact(pair[0], pair[1]); err != nil {
+			t.Fatalf("Error adding contact: %v", err)
+		}
+	}
+	contacts, err := store.AddKeyRevocations("erin", "Erin", now)
+	if err != nil || len(contacts) != 2 || contacts[0] != "frank" || contacts[1] != "grace" {
+		t.Fatalf("Expected both contacts of erin to be told, got %v (err: %v)", contacts, err)
+	}
+	if _, err = store.AddKeyRevocations("erin", "Erin", now.Add(time.Minute)); err != nil {
+		t.Fatalf("Error adding key revocations again: %v", err)
+	}
+	if err = store.RehashUser("frank", "frank-v3", 3); err != nil {
+		t.Fatalf("Error rehashing user: %v", err)
+	}
+	pending, err := store.PendingKeyRevocations("frank-v3")
+	if err != nil || len(pending) != 1 || pending[0].Username != "Erin" || !pending[0].RevokedAt.Equal(now.Add(time.Minute)) {
+		t.Fatalf("Expected one notice for the rehashed contact, got %+v (err: %v)", pending, err)
+	}
+	if err = store.DeleteKeyRevocation("frank-v3", "Erin"); err != nil {
+		t.Fatalf("Error deleting notice: %v", err)
+	}
+	if pending, err = store.PendingKeyRevocations("frank-v3"); err != nil || len(pending) != 0 {
+		t.Errorf("Expected a delivered notice to be gone, got %+v (err: %v)", pending, err)
+	}
+	if pending, err = store.PendingKeyRevocations("erin"); err != nil || len(pending) != 0 {
+		t.Errorf("Expected no notice about the user's own key, got %+v (err: %v)", pending, err)
+	}
+
+	// A deleted user is no longer anybody's contact
+	if err = store.DeleteUser("frank-v3"); err != nil {
+		t.Fatalf("Error deleting user: %v", err)
+	}
+	if contacts, err = store.AddKeyRevocations("erin", "Erin", now); err != nil || len(contacts) != 1 || contacts[0] != "grace" {
+		t.Errorf("Expected only the remaining contact, got %v (err: %v)", contacts, err)
+	}
+}
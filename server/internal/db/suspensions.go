@@ -0,0 +1,144 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const createSuspensionsTableSQL = `CREATE TABLE IF NOT EXISTS Suspensions(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    moderator TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    expires_at INTEGER NOT NULL DEFAULT 0,
+    lifted_at INTEGER NOT NULL DEFAULT 0,
+    lifted_by TEXT NOT NULL DEFAULT ''
+)`
+
+const createSuspensionsIndexSQL = `CREATE INDEX IF NOT EXISTS SuspensionsByUsername ON Suspensions(username)`
+
+const selectSuspensionSQL = `SELECT id, username, reason, moderator, created_at, expires_at, lifted_at, lifted_by FROM Suspensions`
+
+// ErrNotSuspended is returned when the user has no active suspension
+var ErrNotSuspended = errors.New("user is not suspended")
+
+// Suspension keeps a user from logging in until it expires or a moderator lifts it
+type Suspension struct {
+	ID        int64
+	Username  string // Blinded
+	Reason    string // Shown to the user
+	Moderator string // Who suspended the user
+	CreatedAt time.Time
+	ExpiresAt time.Time // Zero for a permanent suspension, a ban
+	LiftedAt  time.Time // Zero unless a moderator lifted it before it expired
+	LiftedBy  string
+}
+
+// Active reports whether the suspension keeps the user out at now
+func (s Suspension) Active(now time.Time) bool {
+	return s.LiftedAt.IsZero() && (s.ExpiresAt.IsZero() || now.Before(s.ExpiresAt))
+}
+
+// outlasts reports whether the suspension ends after other, a ban outlasts every suspension
+func (s Suspension) outlasts(other Suspension) bool {
+	if other.ExpiresAt.IsZero() {
+		return false
+	}
+	return s.ExpiresAt.IsZero() || s.ExpiresAt.After(other.ExpiresAt)
+}
+
+func scanSuspension(row interface{ Scan(dest ...any) error }) (Suspension, error) {
+	var suspension Suspension
+	var createdAt, expiresAt, liftedAt int64
+	err := row.Scan(&suspension.ID, &suspension.Username, &suspension.Reason, &suspension.Moderator, &createdAt, &expiresAt, &liftedAt, &suspension.LiftedBy)
+	suspension.CreatedAt = time.Unix(createdAt, 0)
+	suspension.ExpiresAt = timeOrZero(expiresAt)
+	suspension.LiftedAt = timeOrZero(liftedAt)
+	return suspension, err
+}
+
+func (db *SQLiteStore) querySuspensions(query string, args ...any) ([]Suspension, error) {
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading suspensions: %v", err)
+	}
+	defer rows.Close()
+
+	var suspensions []Suspension
+	for rows.Next() {
+		suspension, err := scanSuspension(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error reading suspension: %v", err)
+		}
+		suspensions = append(suspensions, suspension)
+	}
+	return suspensions, rows.Err()
+}
+
+func (db *SQLiteStore) SuspendUser(suspension Suspension) (int64, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM Users WHERE username = ?)", suspension.Username).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("error checking user: %v", err)
+	}
+	if !exists {
+		return 0, ErrUserNotFound
+	}
+	result, err := tx.Exec(
+		"INSERT INTO Suspensions(username, reason, moderator, created_at, expires_at) VALUES(?, ?, ?, ?, ?)",
+		suspension.Username, suspension.Reason, suspension.Moderator, suspension.CreatedAt.Unix(), unixOrZero(suspension.ExpiresAt),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting suspension: %v", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("error reading suspension ID: %v", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing suspension: %v", err)
+	}
+	return id, nil
+}
+
+func (db *SQLiteStore) ActiveSuspension(username string, now time.Time) (Suspension, error) {
+	// A ban first, then the suspension that ends last
+	row := db.conn.QueryRow(selectSuspensionSQL+` WHERE username = ? AND lifted_at = 0 AND (expires_at = 0 OR expires_at > ?)
+        ORDER BY expires_at = 0 DESC, expires_at DESC LIMIT 1`, username, now.Unix())
+	suspension, err := scanSuspension(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Suspension{}, ErrNotSuspended
+	}
+	if err != nil {
+		return Suspension{}, fmt.Errorf("error reading suspension: %v", err)
+	}
+	return suspension, nil
+}
+
+func (db *SQLiteStore) LiftSuspensions(username string, liftedBy string, now time.Time) (int, error) {
+	result, err := db.conn.Exec(
+		"UPDATE Suspensions SET lifted_at = ?, lifted_by = ? WHERE username = ? AND lifted_at = 0 AND (expires_at = 0 OR expires_at > ?)",
+		now.Unix(), liftedBy, username, now.Unix(),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error lifting suspensions: %v", err)
+	}
+	lifted, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error lifting suspensions: %v", err)
+	}
+	return int(lifted), nil
+}
+
+func (db *SQLiteStore) ListSuspensions(username string) ([]Suspension, error) {
+	return db.querySuspensions(selectSuspensionSQL+" WHERE username = ? ORDER BY created_at, id", username)
+}
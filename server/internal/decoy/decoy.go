@@ -0,0 +1,266 @@
+// Package decoy makes up public keys for usernames that are not registered, so the replies to lookups of
+// unknown usernames can't be told apart from the replies for registered ones.
+package decoy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMinResponseTime is how long every lookup of a username takes at least, unless the generator is given
+// another time, so the database lookups of registered usernames don't answer faster than the ones of unknown usernames
+const DefaultMinResponseTime = 250 * time.Millisecond
+
+const (
+	DefaultSecretPath = "resources/auth/decoy.key"
+	secretLength      = 32
+	// How many decoy keys are kept, the oldest is dropped first
+	cacheSize = 1024
+)
+
+// keySizes are the usual sizes of RSA keys, decoy keys get each one the key policy allows as often
+var keySizes = []int{2048, 3072, 4096}
+
+// Generator makes up the decoy keys of a server. The keys are derived from the username and a secret of the
+// deployment, so they are the same on every lookup and across restarts, like the key of a registered user, and
+// nobody without the secret can work out which key a username would get.
+type Generator struct {
+	secret          []byte
+	minResponseTime time.Duration
+
+	cacheMutex sync.Mutex
+	cache      map[string]*rsa.PublicKey
+	cacheOrder []string
+}
+
+// New returns a generator with the secret, or with a random one that only lasts as long as the generator when it is nil.
+// Pad makes every lookup take at least minResponseTime.
+func New(secret []byte, minResponseTime time.Duration) (*Generator, error) {
+	if secret == nil {
+		secret = make([]byte, secretLength)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, fmt.Errorf("error generating decoy secret: %v", err)
+		}
+	}
+	return &Generator{secret: secret, minResponseTime: minResponseTime, cache: make(map[string]*rsa.PublicKey)}, nil
+}
+
+// LoadSecret reads the base64 secret from the file, which is created with a new random secret the first time
+func LoadSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createSecret(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading decoy secret: %v", err)
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(secret) < secretLength {
+		return nil, fmt.Errorf("invalid decoy secret %s: must be at least %d bytes in base64", path, secretLength)
+	}
+	return secret, nil
+}
+
+func createSecret(path string) ([]byte, error) {
+	secret := make([]byte, secretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("error generating decoy secret: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("error creating decoy secret directory: %v", err)
+	}
+	// O_EXCL keeps a server that starts at the same time from overwriting the secret the other one uses
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error creating decoy secret: %v", err)
+	}
+	defer file.Close()
+	if _, err = fmt.Fprintln(file, base64.StdEncoding.EncodeToString(secret)); err != nil {
+		return nil, fmt.Errorf("error writing decoy secret: %v", err)
+	}
+	return secret, nil
+}
+
+// PublicKey returns the decoy key of the username. Its size is one of the usual key sizes of at least minBits,
+// picked from the username and the secret like the key itself, so the size doesn't give decoy keys away either.
+//
+// Making up a key takes longer than the minimum response time now and then. Lookups of registered usernames call it too,
+// so the first lookup of any username is as slow whether it is registered or not.
+func (g *Generator) PublicKey(username string, minBits int) (*rsa.PublicKey, error) {
+	random := g.stream(username)
+	bits, err := keySize(random, minBits)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := fmt.Sprintf("%d:%s", bits, username)
+	g.cacheMutex.Lock()
+	key, exists := g.cache[cacheKey]
+	g.cacheMutex.Unlock()
+	if exists {
+		return key, nil
+	}
+
+	key, err = generate(random, bits)
+	if err != nil {
+		return nil, err
+	}
+
+	g.cacheMutex.Lock()
+	defer g.cacheMutex.Unlock()
+	if cached, exists := g.cache[cacheKey]; exists {
+		return cached, nil
+	}
+	if len(g.cacheOrder) >= cacheSize {
+		delete(g.cache, g.cacheOrder[0])
+		g.cacheOrder = g.cacheOrder[1:]
+	}
+	g.cache[cacheKey] = key
+	g.cacheOrder = append(g.cacheOrder, cacheKey)
+	return key, nil
+}
+
+// stream is the random stream the decoy key of the username is made from
+func (g *Generator) stream(username string) *stream {
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write([]byte(username))
+	var seed [sha256.Size]byte
+	copy(seed[:], mac.Sum(nil))
+	return &stream{seed: seed}
+}
+
+// keySize reads the size of a decoy key from the stream, one of the keySizes of at least minBits.
+// The keys are minBits large when the policy asks for more than all of them.
+func keySize(random io.Reader, minBits int) (int, error) {
+	var allowed []int
+	for _, size := range keySizes {
+		if size >= minBits {
+			allowed = append(allowed, size)
+		}
+	}
+	if len(allowed) == 0 {
+		return minBits, nil
+	}
+	var choice [8]byte
+	if _, err := io.ReadFull(random, choice[:]); err != nil {
+		return 0, fmt.Errorf("error reading decoy key seed: %v", err)
+	}
+	return allowed[binary.BigEndian.Uint64(choice[:])%uint64(len(allowed))], nil
+}
+
+// Pad waits until the minimum response time has passed since start
+func (g *Generator) Pad(start time.Time) {
+	time.Sleep(time.Until(start.Add(g.minResponseTime)))
+}
+
+// generate makes an RSA public key out of two primes read from the stream.
+// rsa.GenerateKey can't be used, it doesn't return the same key for the same random input.
+func generate(random io.Reader, bits int) (*rsa.PublicKey, error) {
+	for {
+		p, err := prime(random, bits/2)
+		if err != nil {
+			return nil, err
+		}
+		q, err := prime(random, bits-bits/2)
+		if err != nil {
+			return nil, err
+		}
+		n := new(big.Int).Mul(p, q)
+		if p.Cmp(q) != 0 && n.BitLen() == bits {
+			return &rsa.PublicKey{N: n, E: 65537}, nil
+		}
+	}
+}
+
+// smallPrimes are the odd primes below 5000, candidates divisible by one of them are skipped without a primality test
+var smallPrimes = func() []uint64 {
+	var primes []uint64
+	for n := uint64(3); n < 5000; n += 2 {
+		if big.NewInt(int64(n)).ProbablyPrime(0) {
+			primes = append(primes, n)
+		}
+	}
+	return primes
+}()
+
+// prime returns the first prime from a random starting point, so generating a key takes about the same time every time
+func prime(random io.Reader, bits int) (*big.Int, error) {
+	candidate := make([]byte, (bits+7)/8)
+	topBits := uint(bits % 8)
+	if topBits == 0 {
+		topBits = 8
+	}
+	for {
+		if _, err := io.ReadFull(random, candidate); err != nil {
+			return nil, fmt.Errorf("error reading decoy key seed: %v", err)
+		}
+		// Set the two top bits so the product has the full size, like rsa.GenerateKey does, and make it odd
+		candidate[0] &= uint8(int(1<<topBits) - 1)
+		if topBits >= 2 {
+			candidate[0] |= 3 << (topBits - 2)
+		} else {
+			candidate[0] |= 1
+			candidate[1] |= 0x80
+		}
+		candidate[len(candidate)-1] |= 1
+		base := new(big.Int).SetBytes(candidate)
+
+		residues := make([]uint64, len(smallPrimes))
+		modulus := new(big.Int)
+		for i, small := range smallPrimes {
+			residues[i] = modulus.Mod(base, modulus.SetUint64(small)).Uint64()
+		}
+	search:
+		for delta := uint64(0); delta < 1<<20; delta += 2 {
+			for i, small := range smallPrimes {
+				if (residues[i]+delta)%small == 0 {
+					continue search
+				}
+			}
+			p := new(big.Int).Add(base, new(big.Int).SetUint64(delta))
+			if p.BitLen() != bits {
+				break
+			}
+			// The key is never used, so the Baillie-PSW test is enough. The public exponent must be coprime with p-1.
+			if p.ProbablyPrime(0) && new(big.Int).Mod(p, big.NewInt(65537)).Int64() != 1 {
+				return p, nil
+			}
+		}
+	}
+}
+
+// stream is a deterministic random stream, SHA-256 of the seed and a counter
+type stream struct {
+	seed    [sha256.Size]byte
+	counter uint64
+	buffer  []byte
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	read := 0
+	for read < len(p) {
+		if len(s.buffer) == 0 {
+			block := make([]byte, sha256.Size+8)
+			copy(block, s.seed[:])
+			binary.BigEndian.PutUint64(block[sha256.Size:], s.counter)
+			s.counter++
+			sum := sha256.Sum256(block)
+			s.buffer = sum[:]
+		}
+		n := copy(p[read:], s.buffer)
+		s.buffer = s.buffer[n:]
+		read += n
+	}
+	return read, nil
+}
@@ -0,0 +1,104 @@
+package decoy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecoyKeysAreStable(t *testing.T) {
+	secret, err := LoadSecret(filepath.Join(t.TempDir(), "auth", "decoy.key"))
+	if err != nil {
+		t.Fatalf("Error creating decoy secret: %v", err)
+	}
+	generator, _ := New(secret, DefaultMinResponseTime)
+	first, err := generator.PublicKey("nobody", 2048)
+	if err != nil {
+		t.Fatalf("Error making up a decoy key: %v", err)
+	}
+	if size, _ := keySize(generator.stream("nobody"), 2048); first.N.BitLen() != size || first.E != 65537 {
+		t.Errorf("Expected a %d bit key like a registered user's, got %d bits", size, first.N.BitLen())
+	}
+
+	// A restarted server has to make it up again the same way
+	restarted, _ := New(secret, DefaultMinResponseTime)
+	again, err := restarted.PublicKey("nobody", 2048)
+	if err != nil {
+		t.Fatalf("Error making up a decoy key again: %v", err)
+	}
+	if first.N.Cmp(again.N) != 0 {
+		t.Error("Expected the same decoy key for the same username")
+	}
+
+	other, err := generator.PublicKey("somebody", 2048)
+	if err != nil {
+		t.Fatalf("Error making up a second decoy key: %v", err)
+	}
+	if first.N.Cmp(other.N) == 0 {
+		t.Error("Expected every username to get its own decoy key")
+	}
+
+	// Another deployment has its own secret, so its decoy keys can't be worked out from this one's
+	elsewhere, _ := New(nil, DefaultMinResponseTime)
+	if key, err := elsewhere.PublicKey("nobody", 2048); err != nil || key.N.Cmp(first.N) == 0 {
+		t.Errorf("Expected another secret to make up another key, got %v", err)
+	}
+}
+
+func TestDecoyKeySizes(t *testing.T) {
+	generator, _ := New(nil, DefaultMinResponseTime)
+	sizes := func(minBits int) map[int]int {
+		counts := make(map[int]int)
+		for i := 0; i < 3000; i++ {
+			size, err := keySize(generator.stream(fmt.Sprintf("user%d", i)), minBits)
+			if err != nil {
+				t.Fatalf("Error picking a decoy key size: %v", err)
+			}
+			counts[size]++
+		}
+		return counts
+	}
+
+	counts := sizes(2048)
+	for _, size := range keySizes {
+		if counts[size] < 900 || counts[size] > 1100 {
+			t.Errorf("Expected about a third of the decoy keys to have %d bits, got %v", size, counts)
+		}
+	}
+	if counts = sizes(3000); len(counts) != 2 || counts[3072] < 1350 || counts[4096] < 1350 {
+		t.Errorf("Expected the sizes of at least 3000 bits to be picked as often, got %v", counts)
+	}
+	if counts = sizes(8192); len(counts) != 1 || counts[8192] != 3000 {
+		t.Errorf("Expected every decoy key to have the minimum size above the usual ones, got %v", counts)
+	}
+
+	// The size is the same on every lookup of a username, like the key
+	first, _ := keySize(generator.stream("nobody"), 2048)
+	again, _ := keySize(generator.stream("nobody"), 2048)
+	if first != again {
+		t.Errorf("Expected the same size for the same username, got %d and %d", first, again)
+	}
+}
+
+func TestLoadSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decoy.key")
+	created, err := LoadSecret(path)
+	if err != nil {
+		t.Fatalf("Error creating decoy secret: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a secret only the owner can read, got %v (%v)", info.Mode(), err)
+	}
+	loaded, err := LoadSecret(path)
+	if err != nil || string(loaded) != string(created) {
+		t.Errorf("Expected the stored secret to be kept, got %v", err)
+	}
+
+	if err = os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadSecret(path); err == nil {
+		t.Error("Expected a secret that is too short to be rejected")
+	}
+}
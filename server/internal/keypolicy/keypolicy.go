@@ -0,0 +1,86 @@
+package keypolicy
+
+import (
+	"fmt"
+	"math/big"
+	pb "server/resources/proto"
+	"strings"
+	"time"
+)
+
+const AlgorithmRSA = "RSA"
+
+// KeyPolicy decides which user keys the server accepts and for how long
+type KeyPolicy struct {
+	MinRSABits        int
+	AllowedAlgorithms []string
+	MaxKeyAge         time.Duration // Zero means keys never expire
+	GracePeriod       time.Duration // How long an expired key is still accepted, with a warning
+}
+
+// KeyStatus is the state of a stored key under the policy
+type KeyStatus struct {
+	Expired         bool      // The key is past its grace period and must be rejected
+	RenewalRequired bool      // The key is still accepted, but the user must rotate it
+	ExpiresAt       time.Time // When the key stops being accepted (zero if it never does)
+}
+
+func DefaultKeyPolicy() KeyPolicy {
+	return KeyPolicy{
+		MinRSABits:        2048,
+		AllowedAlgorithms: []string{AlgorithmRSA},
+		GracePeriod:       30 * 24 * time.Hour,
+	}
+}
+
+// CheckNewKey validates a key the user wants to register or rotate to
+func (p KeyPolicy) CheckNewKey(algorithm string, pubkey []byte) error {
+	if algorithm == "" {
+		algorithm = AlgorithmRSA
+	}
+	if !p.isAllowed(algorithm) {
+		return fmt.Errorf("key algorithm %s is not allowed", algorithm)
+	}
+	if bits := new(big.Int).SetBytes(pubkey).BitLen(); bits < p.MinRSABits {
+		return fmt.Errorf("key is %d bits, at least %d bits are required", bits, p.MinRSABits)
+	}
+	return nil
+}
+
+// Status checks a stored key. Keys that are older than the maximum age, or that no longer satisfy
+// the size and algorithm requirements, are accepted with a warning until the grace period is over.
+func (p KeyPolicy) Status(algorithm string, pubkey []byte, createdAt time.Time, now time.Time) KeyStatus {
+	status := KeyStatus{RenewalRequired: p.CheckNewKey(algorithm, pubkey) != nil}
+	if p.MaxKeyAge == 0 {
+		return status
+	}
+
+	expiresAt := createdAt.Add(p.MaxKeyAge)
+	status.ExpiresAt = expiresAt.Add(p.GracePeriod)
+	if now.After(expiresAt) {
+		status.RenewalRequired = true
+	}
+	if now.After(status.ExpiresAt) {
+		status.Expired = true
+	}
+	return status
+}
+
+func (p KeyPolicy) isAllowed(algorithm string) bool {
+	for _, allowed := range p.AllowedAlgorithms {
+		if strings.EqualFold(allowed, algorithm) {
+			return true
+		}
+	}
+	return false
+}
+
+// ToPacket reports the policy to clients
+func (p KeyPolicy) ToPacket() *pb.KeyPolicy {
+	return &pb.KeyPolicy{
+		MinRsaBits:         int32(p.MinRSABits),
+		AllowedAlgorithms:  p.AllowedAlgorithms,
+		MaxKeyAgeSeconds:   int64(p.MaxKeyAge.Seconds()),
+		GracePeriodSeconds: int64(p.GracePeriod.Seconds()),
+	}
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedaction(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var output bytes.Buffer
+	logger, err := New(&output, Options{Level: slog.LevelDebug, Format: "json", Redact: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("Login", KeyUser, "alice", KeyKey, &key.PublicKey, KeyToken, []byte("secret"))
+	logger.Info("Login", KeyUser, "alice")
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if strings.Contains(output.String(), "alice") || strings.Contains(output.String(), Fingerprint(&key.PublicKey)) {
+		t.Errorf("Expected the username and key to be redacted, got %s", output.String())
+	}
+	pseudonym := lines[0][strings.Index(lines[0], `"user":`):][:len(`"user":"u-`)+12]
+	if !strings.Contains(lines[1], pseudonym) {
+		t.Errorf("Expected the same user to get the same pseudonym, got %s", output.String())
+	}
+
+	output.Reset()
+	logger, _ = New(&output, Options{Level: slog.LevelInfo, Format: "text", Redact: false})
+	logger.Info("Login", KeyUser, "alice", KeyKey, &key.PublicKey, KeyToken, "secret")
+	logger.Debug("Not logged")
+	if !strings.Contains(output.String(), "user=alice") || !strings.Contains(output.String(), Fingerprint(&key.PublicKey)) {
+		t.Errorf("Expected the username and key fingerprint without redaction, got %s", output.String())
+	}
+	if strings.Contains(output.String(), "secret") || strings.Contains(output.String(), "Not logged") {
+		t.Errorf("Expected tokens and debug lines to be left out, got %s", output.String())
+	}
+}
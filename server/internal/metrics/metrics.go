@@ -0,0 +1,300 @@
+// Package metrics keeps the server's counters, gauges and histograms and writes them in the Prometheus text format.
+// They are process-wide, like the default registry of the Prometheus client, so every package can update its own.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry every metric of the server is added to
+var Default = NewRegistry()
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// Sample is one value of a metric that is collected when the metrics are written
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// Only used by histograms
+	bucketCounts []uint64
+	count        uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mutex      sync.Mutex
+	series     map[string]*series
+	collectors map[int]func() []Sample
+	nextID     int
+}
+
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+func (r *Registry) add(name string, help string, kind string, buckets []float64, labels []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, exists := r.families[name]; exists {
+		if existing.kind != kind || strings.Join(existing.labels, ",") != strings.Join(labels, ",") {
+			panic(fmt.Sprintf("metric %s is already registered with different labels or type", name))
+		}
+		return existing
+	}
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+		collectors: make(map[int]func() []Sample),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, exists := f.series[key]
+	if !exists {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.bucketCounts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter only goes up, like the number of packets received
+type Counter struct{ family *family }
+
+func (r *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{r.add(name, help, kindCounter, nil, labels)}
+	if len(labels) == 0 {
+		counter.Add(0)
+	}
+	return counter
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	c.family.mutex.Lock()
+	defer c.family.mutex.Unlock()
+	c.family.get(labelValues).value += value
+}
+
+// Gauge goes up and down, like the number of requests being handled
+type Gauge struct{ family *family }
+
+func (r *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{r.add(name, help, kindGauge, nil, labels)}
+	if len(labels) == 0 {
+		gauge.Add(0)
+	}
+	return gauge
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.family.mutex.Lock()
+	defer g.family.mutex.Unlock()
+	g.family.get(labelValues).value += value
+}
+
+// Histogram counts observations, like handling times, in buckets
+type Histogram struct{ family *family }
+
+// DefaultBuckets are latency buckets in seconds, from 1ms to 10s
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.add(name, help, kindHistogram, buckets, labels)}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.mutex.Lock()
+	defer h.family.mutex.Unlock()
+	s := h.family.get(labelValues)
+	for i, bound := range h.family.buckets {
+		if value <= bound {
+			s.bucketCounts[i]++
+		}
+	}
+	s.count++
+	s.value += value
+}
+
+// Collect adds a counter or gauge whose values are read when the metrics are written, like the number of
+// connected clients. Several collectors can be added for the same metric, their values are summed.
+// The returned function removes the collector again.
+func (r *Registry) Collect(name string, help string, gauge bool, labels []string, collector func() []Sample) (remove func()) {
+	kind := kindCounter
+	if gauge {
+		kind = kindGauge
+	}
+	f := r.add(name, help, kind, nil, labels)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	id := f.nextID
+	f.nextID++
+	f.collectors[id] = collector
+	return func() {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		delete(f.collectors, id)
+	}
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	counter := &countingWriter{writer: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.write(counter)
+	}
+	if err := counter.writer.Flush(); err != nil {
+		return counter.written, err
+	}
+	return counter.written, nil
+}
+
+func (f *family) write(w *countingWriter) {
+	f.mutex.Lock()
+	collectors := make([]func() []Sample, 0, len(f.collectors))
+	for _, collector := range f.collectors {
+		collectors = append(collectors, collector)
+	}
+	all := make(map[string]*series, len(f.series))
+	for key, s := range f.series {
+		copied := *s
+		copied.bucketCounts = append([]uint64(nil), s.bucketCounts...)
+		all[key] = &copied
+	}
+	f.mutex.Unlock()
+
+	// The collectors run without the lock, they may take locks of their own
+	for _, collector := range collectors {
+		for _, sample := range collector() {
+			key := strings.Join(sample.LabelValues, "\xff")
+			if s, exists := all[key]; exists {
+				s.value += sample.Value
+			} else {
+				all[key] = &series{labelValues: sample.LabelValues, value: sample.Value}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.printf("# HELP %s %s\n", f.name, escape(f.help, false))
+	w.printf("# TYPE %s %s\n", f.name, f.kind)
+	for _, key := range keys {
+		s := all[key]
+		if f.kind != kindHistogram {
+			w.printf("%s%s %s\n", f.name, f.labelString(s.labelValues, ""), formatValue(s.value))
+			continue
+		}
+		for i, bound := range f.buckets {
+			w.printf("%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, formatValue(bound)), s.bucketCounts[i])
+		}
+		w.printf("%s_bucket%s %d\n", f.name, f.labelString(s.labelValues, "+Inf"), s.count)
+		w.printf("%s_sum%s %s\n", f.name, f.labelString(s.labelValues, ""), formatValue(s.value))
+		w.printf("%s_count%s %d\n", f.name, f.labelString(s.labelValues, ""), s.count)
+	}
+}
+
+func (f *family) labelString(labelValues []string, le string) string {
+	var pairs []string
+	for i, label := range f.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escape(labelValues[i], true)))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(value string, quotes bool) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	if quotes {
+		value = strings.ReplaceAll(value, `"`, `\"`)
+	}
+	return value
+}
+
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	writer  *bufio.Writer
+	written int64
+}
+
+func (w *countingWriter) printf(format string, args ...any) {
+	n, _ := fmt.Fprintf(w.writer, format, args...)
+	w.written += int64(n)
+}
+
+// Handler serves the metrics to a Prometheus scraper
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := r.WriteTo(w); err != nil {
+			slog.Error("Error writing metrics", "error", err)
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextFormat(t *testing.T) {
+	registry := NewRegistry()
+	packets := registry.NewCounter("test_packets_total", "Packets, by type.", "packet")
+	packets.Inc("loginMessage")
+	packets.Add(2, "chat\"Message")
+	latency := registry.NewHistogram("test_duration_seconds", "Handling time.", []float64{0.1, 1}, "packet")
+	latency.Observe(0.5, "loginMessage")
+	removeFirst := registry.Collect("test_clients", "Connected clients.", true, nil, func() []Sample {
+		return []Sample{{Value: 2}}
+	})
+	registry.Collect("test_clients", "Connected clients.", true, nil, func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+
+	var output strings.Builder
+	if _, err := registry.WriteTo(&output); err != nil {
+		t.Fatalf("Error writing metrics: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE test_packets_total counter",
+		`test_packets_total{packet="loginMessage"} 1`,
+		`test_packets_total{packet="chat\"Message"} 2`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{packet="loginMessage",le="0.1"} 0`,
+		`test_duration_seconds_bucket{packet="loginMessage",le="1"} 1`,
+		`test_duration_seconds_bucket{packet="loginMessage",le="+Inf"} 1`,
+		`test_duration_seconds_sum{packet="loginMessage"} 0.5`,
+		`test_duration_seconds_count{packet="loginMessage"} 1`,
+		"# TYPE test_clients gauge",
+		"test_clients 5",
+	} {
+		if !strings.Contains(output.String(), line+"\n") {
+			t.Errorf("Expected the line %q in:\n%s", line, output.String())
+		}
+	}
+
+	removeFirst()
+	output.Reset()
+	registry.WriteTo(&output)
+	if !strings.Contains(output.String(), "test_clients 3\n") {
+		t.Errorf("Expected only the remaining collector to be counted, got:\n%s", output.String())
+	}
+}
@@ -0,0 +1,234 @@
+// Package netlimit decides which client connections the server serves, before their TLS handshake starts
+package netlimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes is a list of address ranges. It is written as "10.0.0.0/8,192.0.2.7" in the config,
+// a single address is a range of its own.
+type Prefixes []netip.Prefix
+
+func ParsePrefixes(value string) (Prefixes, error) {
+	var prefixes Prefixes
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		prefix, err := parsePrefix(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+func parsePrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR range", value)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR range", value)
+	}
+	return prefix.Masked(), nil
+}
+
+// Contains reports whether addr is in one of the ranges
+func (p Prefixes) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Prefixes) String() string {
+	values := make([]string, 0, len(p))
+	for _, prefix := range p {
+		values = append(values, prefix.String())
+	}
+	return strings.Join(values, ",")
+}
+
+// Set lets Prefixes be used as a command-line flag
+func (p *Prefixes) Set(value string) error {
+	prefixes, err := ParsePrefixes(value)
+	if err != nil {
+		return err
+	}
+	*p = prefixes
+	return nil
+}
+
+// UnmarshalJSON accepts a list of ranges or a comma-separated string
+func (p *Prefixes) UnmarshalJSON(data []byte) error {
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		var value string
+		if err = json.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("address ranges must be a list like [\"10.0.0.0/8\"]")
+		}
+		return p.Set(value)
+	}
+	return p.Set(strings.Join(values, ","))
+}
+
+// Config holds the limits of the connections. Zero turns a limit off.
+type Config struct {
+	Allow               Prefixes      // Only these addresses may connect, when the list is not empty
+	Deny                Prefixes      // These addresses may never connect, even when they are allowed
+	MaxConnections      int           // Open connections of every client together
+	MaxConnectionsPerIP int           // Open connections from one address
+	HandshakeTimeout    time.Duration // How long a client gets to finish the TLS handshake
+}
+
+// The reasons a connection is refused
+const (
+	ReasonDenied              = "denied"
+	ReasonMaxConnections      = "max_connections"
+	ReasonMaxConnectionsPerIP = "max_connections_per_ip"
+	ReasonHandshake           = "handshake"    // The TLS handshake failed or timed out
+	ReasonProxyHeader         = "proxy_header" // A trusted load balancer sent no valid PROXY header in time
+)
+
+// RejectedError is returned by Admit when a connection may not be served
+type RejectedError struct {
+	Reason string
+	Detail string
+}
+
+func (e *RejectedError) Error() string {
+	return "connection refused: " + e.Detail
+}
+
+// Limiter counts the open connections in total and per address
+type Limiter struct {
+	config Config
+
+	mutex    sync.Mutex
+	open     int
+	perIP    map[netip.Addr]int
+	rejected map[string]uint64
+}
+
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:   config,
+		perIP:    make(map[netip.Addr]int),
+		rejected: make(map[string]uint64),
+	}
+}
+
+// HandshakeTimeout is how long a client gets to finish the TLS handshake, zero for no limit
+func (l *Limiter) HandshakeTimeout() time.Duration {
+	return l.config.HandshakeTimeout
+}
+
+// Admit counts the connection from remote if it may be served, or returns a *RejectedError.
+// release must be called once the admitted connection is closed, calling it again has no effect.
+func (l *Limiter) Admit(remote net.Addr) (release func(), err error) {
+	addr, known := remoteAddr(remote)
+	if (len(l.config.Allow) > 0 || len(l.config.Deny) > 0) && !known {
+		return nil, l.reject(ReasonDenied, fmt.Sprintf("%v is not an IP address", remote))
+	}
+	if l.config.Deny.Contains(addr) {
+		return nil, l.reject(ReasonDenied, fmt.Sprintf("%v is on the deny list", addr))
+	}
+	if len(l.config.Allow) > 0 && !l.config.Allow.Contains(addr) {
+		return nil, l.reject(ReasonDenied, fmt.Sprintf("%v is not on the allow list", addr))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.config.MaxConnections > 0 && l.open >= l.config.MaxConnections {
+		return nil, l.rejectLocked(ReasonMaxConnections, fmt.Sprintf("%d connections are open", l.open))
+	}
+	if known && l.config.MaxConnectionsPerIP > 0 && l.perIP[addr] >= l.config.MaxConnectionsPerIP {
+		return nil, l.rejectLocked(ReasonMaxConnectionsPerIP, fmt.Sprintf("%d connections are open from %v", l.perIP[addr], addr))
+	}
+	l.open++
+	if known {
+		l.perIP[addr]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			l.open--
+			if known {
+				if l.perIP[addr]--; l.perIP[addr] <= 0 {
+					delete(l.perIP, addr)
+				}
+			}
+		})
+	}, nil
+}
+
+func remoteAddr(remote net.Addr) (netip.Addr, bool) {
+	if tcp, ok := remote.(*net.TCPAddr); ok {
+		addr, ok := netip.AddrFromSlice(tcp.IP)
+		return addr.Unmap(), ok
+	}
+	if remote == nil {
+		return netip.Addr{}, false
+	}
+	addrPort, err := netip.ParseAddrPort(remote.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
+
+// Reject counts a connection refused for a reason found outside of Admit, like a failed handshake
+func (l *Limiter) Reject(reason string, detail string) error {
+	return l.reject(reason, detail)
+}
+
+func (l *Limiter) reject(reason string, detail string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rejectLocked(reason, detail)
+}
+
+func (l *Limiter) rejectLocked(reason string, detail string) error {
+	l.rejected[reason]++
+	return &RejectedError{Reason: reason, Detail: detail}
+}
+
+// Open returns how many admitted connections have not been released
+func (l *Limiter) Open() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.open
+}
+
+// Rejected returns how many connections were refused, by reason
+func (l *Limiter) Rejected() map[string]uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return map[string]uint64{
+		ReasonDenied:              l.rejected[ReasonDenied],
+		ReasonMaxConnections:      l.rejected[ReasonMaxConnections],
+		ReasonMaxConnectionsPerIP: l.rejected[ReasonMaxConnectionsPerIP],
+		ReasonHandshake:           l.rejected[ReasonHandshake],
+		ReasonProxyHeader:         l.rejected[ReasonProxyHeader],
+	}
+}
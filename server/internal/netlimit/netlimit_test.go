@@ -0,0 +1,88 @@
+package netlimit
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+}
+
+func reason(err error) string {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		return rejected.Reason
+	}
+	return ""
+}
+
+func TestParsePrefixes(t *testing.T) {
+	prefixes, err := ParsePrefixes("10.1.2.3/8, 192.0.2.7,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("Error parsing prefixes: %v", err)
+	}
+	if prefixes.String() != "10.0.0.0/8,192.0.2.7/32,2001:db8::/32" {
+		t.Errorf("Expected the ranges to be masked, got %v", prefixes)
+	}
+	for _, value := range []string{"10.0.0.0/33", "example.com", "10.0.0/8"} {
+		if _, err = ParsePrefixes(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestAllowAndDeny(t *testing.T) {
+	allow, _ := ParsePrefixes("10.0.0.0/8")
+	deny, _ := ParsePrefixes("10.0.0.66")
+	limiter := New(Config{Allow: allow, Deny: deny})
+
+	if _, err := limiter.Admit(tcpAddr("10.0.0.1")); err != nil {
+		t.Errorf("Expected an allowed address to be admitted, got %v", err)
+	}
+	// An IPv4 address mapped into IPv6 is the same address
+	if _, err := limiter.Admit(tcpAddr("::ffff:10.0.0.66")); reason(err) != ReasonDenied {
+		t.Errorf("Expected a denied address to be refused, got %v", err)
+	}
+	if _, err := limiter.Admit(tcpAddr("192.0.2.1")); reason(err) != ReasonDenied {
+		t.Errorf("Expected an address that is not allowed to be refused, got %v", err)
+	}
+	if rejected := limiter.Rejected()[ReasonDenied]; rejected != 2 {
+		t.Errorf("Expected two denied connections, got %d", rejected)
+	}
+}
+
+func TestConnectionCounts(t *testing.T) {
+	limiter := New(Config{MaxConnections: 3, MaxConnectionsPerIP: 2})
+
+	first, err := limiter.Admit(tcpAddr("192.0.2.1"))
+	if err != nil {
+		t.Fatalf("Expected the first connection to be admitted, got %v", err)
+	}
+	if _, err = limiter.Admit(tcpAddr("192.0.2.1")); err != nil {
+		t.Fatalf("Expected the second connection to be admitted, got %v", err)
+	}
+	if _, err = limiter.Admit(tcpAddr("192.0.2.1")); reason(err) != ReasonMaxConnectionsPerIP {
+		t.Errorf("Expected a third connection from one address to be refused, got %v", err)
+	}
+	if _, err = limiter.Admit(tcpAddr("192.0.2.2")); err != nil {
+		t.Fatalf("Expected a connection from another address to be admitted, got %v", err)
+	}
+	if _, err = limiter.Admit(tcpAddr("192.0.2.3")); reason(err) != ReasonMaxConnections {
+		t.Errorf("Expected a fourth connection to be refused, got %v", err)
+	}
+
+	// Releasing twice only frees one connection
+	first()
+	first()
+	if open := limiter.Open(); open != 2 {
+		t.Errorf("Expected two open connections, got %d", open)
+	}
+	if _, err = limiter.Admit(tcpAddr("192.0.2.1")); err != nil {
+		t.Errorf("Expected a released connection to make room, got %v", err)
+	}
+	if _, err = limiter.Admit(tcpAddr("192.0.2.1")); err == nil {
+		t.Error("Expected the limits to be reached again")
+	}
+}
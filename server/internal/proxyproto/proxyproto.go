@@ -0,0 +1,178 @@
+// Package proxyproto reads the PROXY protocol header a TCP load balancer sends before the client's data,
+// version 1 (text) and 2 (binary), so the server sees the client's address instead of the balancer's
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// v2Signature starts every version 2 header
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxV1Length is the longest version 1 header, CRLF included
+const maxV1Length = 107
+
+// ErrMissingHeader is returned when the connection doesn't start with a PROXY header
+var ErrMissingHeader = errors.New("no PROXY protocol header")
+
+// Conn is a connection whose addresses are the ones the load balancer reported
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr is the client's address
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr is the address the client connected to on the load balancer
+func (c *Conn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// ProxyAddr is the address of the load balancer
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// ReadHeader reads the PROXY header at the start of conn and returns a connection that reports the client's
+// addresses. Health checks of the balancer (LOCAL and UNKNOWN) keep the balancer's addresses.
+// The caller sets the read deadline.
+func ReadHeader(conn net.Conn) (*Conn, error) {
+	reader := bufio.NewReader(conn)
+	wrapped := &Conn{Conn: conn, reader: reader, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+
+	start, err := reader.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %v", err)
+	}
+	switch {
+	case bytes.Equal(start, v2Signature):
+		err = wrapped.readV2()
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		err = wrapped.readV1()
+	default:
+		return nil, ErrMissingHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func (c *Conn) readV1() error {
+	line := make([]byte, 0, maxV1Length)
+	for len(line) < maxV1Length {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("error reading PROXY header: %v", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return c.parseV1(strings.TrimSuffix(string(line), "\r\n"))
+		}
+	}
+	return fmt.Errorf("PROXY header is longer than %d bytes", maxV1Length)
+}
+
+func (c *Conn) parseV1(line string) error {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid PROXY header %q", line)
+	}
+	source, err := parseV1Address(fields[2], fields[4])
+	if err != nil {
+		return fmt.Errorf("invalid PROXY header %q: %v", line, err)
+	}
+	destination, err := parseV1Address(fields[3], fields[5])
+	if err != nil {
+		return fmt.Errorf("invalid PROXY header %q: %v", line, err)
+	}
+	if source.Addr().Is4() != (fields[1] == "TCP4") || destination.Addr().Is4() != (fields[1] == "TCP4") {
+		return fmt.Errorf("invalid PROXY header %q: the addresses are not %s", line, fields[1])
+	}
+	c.remote = net.TCPAddrFromAddrPort(source)
+	c.local = net.TCPAddrFromAddrPort(destination)
+	return nil
+}
+
+func parseV1Address(ip string, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q", port)
+	}
+	return netip.AddrPortFrom(addr, uint16(number)), nil
+}
+
+// The version 2 commands and address families
+const (
+	v2Local = 0x20
+	v2Proxy = 0x21
+	v2TCP4  = 0x11
+	v2TCP6  = 0x21
+)
+
+func (c *Conn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return fmt.Errorf("error reading PROXY header: %v", err)
+	}
+	command, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return fmt.Errorf("error reading PROXY header: %v", err)
+	}
+
+	switch command {
+	case v2Local:
+		return nil
+	case v2Proxy:
+	default:
+		return fmt.Errorf("unsupported PROXY header version or command 0x%02x", command)
+	}
+	// The other families, like UDP and UNIX sockets, are kept as the balancer's addresses, the TLVs are skipped
+	switch family {
+	case v2TCP4:
+		if len(body) < 12 {
+			return fmt.Errorf("PROXY header too short for TCP over IPv4")
+		}
+		c.remote = tcpAddr(body[0:4], body[8:10])
+		c.local = tcpAddr(body[4:8], body[10:12])
+	case v2TCP6:
+		if len(body) < 36 {
+			return fmt.Errorf("PROXY header too short for TCP over IPv6")
+		}
+		c.remote = tcpAddr(body[0:16], body[32:34])
+		c.local = tcpAddr(body[16:32], body[34:36])
+	}
+	return nil
+}
+
+func tcpAddr(ip []byte, port []byte) *net.TCPAddr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, binary.BigEndian.Uint16(port)))
+}
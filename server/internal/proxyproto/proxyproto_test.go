@@ -0,0 +1,89 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// headerConn returns the server side of a connection the balancer writes data to
+func headerConn(t *testing.T, data []byte) net.Conn {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return server
+}
+
+func TestReadV1(t *testing.T) {
+	conn, err := ReadHeader(headerConn(t, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nhello")))
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	if conn.RemoteAddr().String() != "192.0.2.1:56324" || conn.LocalAddr().String() != "198.51.100.1:443" {
+		t.Errorf("Expected the client's addresses, got %v and %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	// The data after the header is left for the server
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "hello" {
+		t.Errorf("Expected to read the data after the header, got %q (%v)", data, err)
+	}
+
+	if conn, err = ReadHeader(headerConn(t, []byte("PROXY UNKNOWN\r\n"))); err != nil || conn.RemoteAddr() != conn.ProxyAddr() {
+		t.Errorf("Expected an UNKNOWN header to keep the balancer's address, got %v (%v)", conn, err)
+	}
+	for _, header := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 70000\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443 and a lot more data than a header may hold\r\n",
+	} {
+		if _, err = ReadHeader(headerConn(t, []byte(header))); err == nil {
+			t.Errorf("Expected %q to be rejected", header)
+		}
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	body := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	body = binary.BigEndian.AppendUint16(body, 56324)
+	body = binary.BigEndian.AppendUint16(body, 443)
+	// A TLV the server doesn't know is skipped
+	body = append(body, 0x04, 0x00, 0x02, 'o', 'k')
+	header := append([]byte{}, v2Signature...)
+	header = append(header, v2Proxy, v2TCP6)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	header = append(header, body...)
+
+	conn, err := ReadHeader(headerConn(t, append(header, "hello"...)))
+	if err != nil {
+		t.Fatalf("Error reading header: %v", err)
+	}
+	if conn.RemoteAddr().String() != "[2001:db8::1]:56324" || conn.LocalAddr().String() != "[2001:db8::2]:443" {
+		t.Errorf("Expected the client's addresses, got %v and %v", conn.RemoteAddr(), conn.LocalAddr())
+	}
+	if data, err := io.ReadAll(conn); err != nil || string(data) != "hello" {
+		t.Errorf("Expected to read the data after the header, got %q (%v)", data, err)
+	}
+
+	local := append(append([]byte{}, v2Signature...), v2Local, 0x00, 0x00, 0x00)
+	if conn, err = ReadHeader(headerConn(t, local)); err != nil || conn.RemoteAddr() != conn.ProxyAddr() {
+		t.Errorf("Expected a LOCAL header to keep the balancer's address, got %v (%v)", conn, err)
+	}
+	short := append(append([]byte{}, v2Signature...), v2Proxy, v2TCP4, 0x00, 0x04, 1, 2, 3, 4)
+	if _, err = ReadHeader(headerConn(t, short)); err == nil {
+		t.Error("Expected a header without the ports to be rejected")
+	}
+}
+
+func TestMissingHeader(t *testing.T) {
+	if _, err := ReadHeader(headerConn(t, []byte("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03\x00"))); !errors.Is(err, ErrMissingHeader) {
+		t.Errorf("Expected a TLS ClientHello to be missing the header, got %v", err)
+	}
+}
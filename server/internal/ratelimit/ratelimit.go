@@ -0,0 +1,337 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"server/internal/actions"
+	pb "server/resources/proto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is a token bucket that holds Requests tokens and refills all of them every Per.
+// It is written as "10/1m" in the config, "off" disables it.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func ParseLimit(value string) (Limit, error) {
+	if value == "off" || value == "0" {
+		return Limit{}, nil
+	}
+	requests, per, found := strings.Cut(value, "/")
+	if !found {
+		return Limit{}, fmt.Errorf("limit %q must be like \"10/1m\" or \"off\"", value)
+	}
+	count, err := strconv.Atoi(requests)
+	if err != nil || count < 0 {
+		return Limit{}, fmt.Errorf("limit %q must start with a number of requests", value)
+	}
+	duration, err := time.ParseDuration(per)
+	if err != nil || duration <= 0 {
+		return Limit{}, fmt.Errorf("limit %q must end with a positive duration", value)
+	}
+	return Limit{Requests: count, Per: duration}, nil
+}
+
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%v", l.Requests, l.Per)
+}
+
+// Set lets a Limit be used as a command-line flag
+func (l *Limit) Set(value string) error {
+	limit, err := ParseLimit(value)
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("limit must be a string like \"10/1m\" or \"off\"")
+	}
+	return l.Set(value)
+}
+
+// Config holds the limits of each scope. The connection limit counts every packet,
+// the other limits only count the requests that are expensive or can be used to guess accounts.
+type Config struct {
+	PerConnection Limit
+	PerIP         Limit
+	PerUsername   Limit         // Login, registration and recovery attempts for one username from one source IP
+	PerAccount    Limit         // Login and recovery attempts for one username from every source IP together
+	KeyLookups    Limit         // Public key lookups by one logged-in user
+	Lockout       time.Duration // How long a client that went over a limit is turned away
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PerConnection: Limit{Requests: 50, Per: time.Second},
+		PerIP:         Limit{Requests: 30, Per: 10 * time.Second},
+		PerUsername:   Limit{Requests: 10, Per: time.Minute},
+		PerAccount:    Limit{Requests: 30, Per: 10 * time.Minute},
+		KeyLookups:    Limit{Requests: 100, Per: time.Hour},
+		Lockout:       time.Minute,
+	}
+}
+
+// The scopes a request is limited in
+const (
+	ScopeConnection = "connection"
+	ScopeIP         = "ip"
+	ScopeUsername   = "username"
+	ScopeAccount    = "account"
+	ScopeKeyLookup  = "key_lookup"
+)
+
+// ScopeStats are the totals of one scope
+type ScopeStats struct {
+	Rejected  uint64 // Requests turned away
+	Lockouts  uint64 // Times a client went over the limit and was locked out
+	LockedOut int    // Clients currently locked out
+}
+
+type bucket struct {
+	tokens      float64
+	updated     time.Time
+	lockedUntil time.Time
+}
+
+// Limiter limits requests per connection, per source IP, per target username from each source IP and from all of
+// them together, and the key lookups of every user.
+// It implements actions.Limiter.
+type Limiter struct {
+	config Config
+	now    func() time.Time
+
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	stats     map[string]ScopeStats
+	lastPrune time.Time
+}
+
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:  config,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+		stats:   make(map[string]ScopeStats),
+	}
+}
+
+// How often buckets that are full again are forgotten
+const pruneInterval = time.Minute
+
+func (l *Limiter) Allow(request *actions.Request) error {
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.lastPrune) >= pruneInterval {
+		l.prune(now)
+	}
+
+	if err := l.take(ScopeConnection, connectionKey(request.Conn), l.config.PerConnection, now); err != nil {
+		return err
+	}
+	switch kind, username := classify(request.Message); kind {
+	case accountAttempt, accountGuess:
+		if err := l.take(ScopeIP, remoteIP(request.Conn), l.config.PerIP, now); err != nil {
+			return err
+		}
+		// Anyone can send a username before logging in, so the bucket is also keyed on the address.
+		// Otherwise failing logins in someone else's name would lock the real user out.
+		if err := l.take(ScopeUsername, remoteIP(request.Conn)+" "+username, l.config.PerUsername, now); err != nil {
+			return err
+		}
+		if kind == accountGuess {
+			// Attempts spread over many addresses still add up for the account, with a budget large enough
+			// that the attempts of one address can't use it up
+			return l.take(ScopeAccount, username, l.config.PerAccount, now)
+		}
+		return nil
+	case keyLookup:
+		if err := l.take(ScopeIP, remoteIP(request.Conn), l.config.PerIP, now); err != nil {
+			return err
+		}
+		// Key lookups need a login, so every user gets its own budget
+		return l.take(ScopeKeyLookup, request.Username, l.config.KeyLookups, now)
+	}
+	return nil
+}
+
+// Forget drops the bucket of a closed connection, even when it is locked out
+func (l *Limiter) Forget(conn net.Conn) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.buckets, ScopeConnection+":"+connectionKey(conn))
+}
+
+func connectionKey(conn net.Conn) string {
+	return fmt.Sprintf("%p", conn)
+}
+
+type requestKind int
+
+const (
+	otherRequest   requestKind = iota
+	accountAttempt             // Registration of an account
+	accountGuess               // Login or recovery of an account, which can be guessed at from many addresses
+	keyLookup                  // Lookup of another user's public key
+)
+
+// classify tells how a request is limited, and which username it targets
+func classify(message *pb.Message) (requestKind, string) {
+	switch packet := message.GetPacket().(type) {
+	case *pb.Message_LoginMessage:
+		if packet.LoginMessage.GetStatus() == pb.LoginPacket_REQUEST_TO_LOGIN {
+			return accountGuess, message.GetFromUsername()
+		}
+	case *pb.Message_RegisterMessage:
+		if packet.RegisterMessage.GetStatus() == pb.RegisterPacket_REQUEST_TO_REGISTER {
+			return accountAttempt, message.GetFromUsername()
+		}
+	case *pb.Message_RecoveryMessage:
+		if packet.RecoveryMessage.GetStatus() == pb.RecoveryPacket_REQUEST_TO_RECOVER {
+			return accountGuess, message.GetFromUsername()
+		}
+	case *pb.Message_ExchangeKeyMessage:
+		switch packet.ExchangeKeyMessage.GetStatus() {
+		case pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY, pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY_PASSIVE:
+			return keyLookup, message.GetExchangeKeyMessage().GetToUsername()
+		}
+	}
+	return otherRequest, ""
+}
+
+func remoteIP(conn net.Conn) string {
+	address := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+func (l *Limiter) take(scope string, key string, limit Limit, now time.Time) error {
+	if !limit.Enabled() {
+		return nil
+	}
+	b, exists := l.buckets[scope+":"+key]
+	if !exists {
+		b = &bucket{tokens: float64(limit.Requests), updated: now}
+		l.buckets[scope+":"+key] = b
+	}
+	if now.Before(b.lockedUntil) {
+		l.reject(scope, false)
+		return rejection(scope, b.lockedUntil.Sub(now))
+	}
+
+	b.tokens = refill(b, limit, now)
+	b.updated = now
+	if b.tokens < 1 {
+		retryAfter := l.config.Lockout
+		if retryAfter <= 0 {
+			// Without a lockout the client only waits for the next token
+			retryAfter = time.Duration((1 - b.tokens) / float64(limit.Requests) * float64(limit.Per))
+		}
+		b.lockedUntil = now.Add(retryAfter)
+		l.reject(scope, true)
+		return rejection(scope, retryAfter)
+	}
+	b.tokens--
+	return nil
+}
+
+func refill(b *bucket, limit Limit, now time.Time) float64 {
+	tokens := b.tokens + float64(now.Sub(b.updated))/float64(limit.Per)*float64(limit.Requests)
+	return min(tokens, float64(limit.Requests))
+}
+
+func (l *Limiter) reject(scope string, lockout bool) {
+	stats := l.stats[scope]
+	stats.Rejected++
+	if lockout {
+		stats.Lockouts++
+	}
+	l.stats[scope] = stats
+}
+
+func rejection(scope string, retryAfter time.Duration) *actions.RejectedError {
+	subject := map[string]string{
+		ScopeConnection: "this connection",
+		ScopeIP:         "your address",
+		ScopeUsername:   "this account from your address",
+		ScopeAccount:    "this account",
+		ScopeKeyLookup:  "key lookups",
+	}[scope]
+	retryAfter = max(retryAfter.Round(time.Second), time.Second)
+	return &actions.RejectedError{
+		Reason:     fmt.Sprintf("too many requests for %s, try again in %v", subject, retryAfter),
+		RetryAfter: retryAfter,
+	}
+}
+
+// prune forgets the buckets that are full again and not locked out, so they don't pile up
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		scope, _, _ := strings.Cut(key, ":")
+		if now.Before(b.lockedUntil) {
+			continue
+		}
+		if limit := l.limit(scope); !limit.Enabled() || refill(b, limit, now) >= float64(limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+func (l *Limiter) limit(scope string) Limit {
+	switch scope {
+	case ScopeConnection:
+		return l.config.PerConnection
+	case ScopeIP:
+		return l.config.PerIP
+	case ScopeKeyLookup:
+		return l.config.KeyLookups
+	case ScopeAccount:
+		return l.config.PerAccount
+	default:
+		return l.config.PerUsername
+	}
+}
+
+// Stats returns the totals of every scope
+func (l *Limiter) Stats() map[string]ScopeStats {
+	now := l.now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	snapshot := map[string]ScopeStats{
+		ScopeConnection: l.stats[ScopeConnection],
+		ScopeIP:         l.stats[ScopeIP],
+		ScopeUsername:   l.stats[ScopeUsername],
+		ScopeAccount:    l.stats[ScopeAccount],
+		ScopeKeyLookup:  l.stats[ScopeKeyLookup],
+	}
+	for key, b := range l.buckets {
+		if now.Before(b.lockedUntil) {
+			scope, _, _ := strings.Cut(key, ":")
+			stats := snapshot[scope]
+			stats.LockedOut++
+			snapshot[scope] = stats
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"errors"
+	"net"
+	"server/internal/actions"
+	pb "server/resources/proto"
+	"testing"
+	"time"
+)
+
+func loginRequest(conn net.Conn, username string) *actions.Request {
+	return &actions.Request{
+		Conn: conn,
+		Message: &pb.Message{
+			FromUsername: &username,
+			Packet: &pb.Message_LoginMessage{
+				LoginMessage: &pb.LoginPacket{Status: pb.LoginPacket_REQUEST_TO_LOGIN},
+			},
+		},
+		Packet: "loginMessage",
+	}
+}
+
+// addressedConn is a connection from the given remote address
+type addressedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addressedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("10/1m")
+	if err != nil || limit != (Limit{Requests: 10, Per: time.Minute}) {
+		t.Errorf("Expected 10 requests per minute, got %v (%v)", limit, err)
+	}
+	if limit, err = ParseLimit("off"); err != nil || limit.Enabled() {
+		t.Errorf("Expected a disabled limit, got %v (%v)", limit, err)
+	}
+	for _, value := range []string{"10", "ten/1m", "10/soon", "10/0s"} {
+		if _, err = ParseLimit(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Unix(0, 0)
+	limiter := New(Config{
+		PerUsername: Limit{Requests: 2, Per: time.Minute},
+		Lockout:     5 * time.Minute,
+	})
+	limiter.now = func() time.Time { return now }
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := limiter.Allow(loginRequest(conn, "alice")); err != nil {
+			t.Fatalf("Expected attempt %d to be allowed, got %v", i+1, err)
+		}
+	}
+	var rejected *actions.RejectedError
+	if err := limiter.Allow(loginRequest(conn, "alice")); !errors.As(err, &rejected) || rejected.RetryAfter != 5*time.Minute {
+		t.Fatalf("Expected a 5 minute lockout, got %v", err)
+	}
+	// Other usernames have their own bucket
+	if err := limiter.Allow(loginRequest(conn, "bob")); err != nil {
+		t.Errorf("Expected another username to be allowed, got %v", err)
+	}
+	// Failed attempts from one address don't lock the user out everywhere else
+	elsewhere := addressedConn{Conn: peer, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7), Port: 4000}}
+	if err := limiter.Allow(loginRequest(elsewhere, "alice")); err != nil {
+		t.Errorf("Expected the username to be allowed from another address, got %v", err)
+	}
+
+	// The lockout holds even after the bucket would have refilled
+	now = now.Add(2 * time.Minute)
+	if err := limiter.Allow(loginRequest(conn, "alice")); !errors.As(err, &rejected) || rejected.RetryAfter != 3*time.Minute {
+		t.Errorf("Expected the lockout to last 3 more minutes, got %v", err)
+	}
+	if stats := limiter.Stats()[ScopeUsername]; stats.Rejected != 2 || stats.Lockouts != 1 || stats.LockedOut != 1 {
+		t.Errorf("Unexpected username stats %+v", stats)
+	}
+
+	now = now.Add(3 * time.Minute)
+	if err := limiter.Allow(loginRequest(conn, "alice")); err != nil {
+		t.Errorf("Expected the lockout to be over, got %v", err)
+	}
+	if stats := limiter.Stats()[ScopeUsername]; stats.LockedOut != 0 {
+		t.Errorf("Expected nobody to be locked out, got %+v", stats)
+	}
+}
+
+func TestAttemptsFromManyAddresses(t *testing.T) {
+	limiter := New(Config{
+		PerUsername: Limit{Requests: 2, Per: time.Minute},
+		PerAccount:  Limit{Requests: 5, Per: time.Minute},
+		Lockout:     time.Minute,
+	})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	from := func(i int) net.Conn {
+		return addressedConn{Conn: conn, remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, byte(i)), Port: 4000}}
+	}
+
+	// Every address stays under its own limit, together they use up the account's
+	for i := 1; i <= 5; i++ {
+		if err := limiter.Allow(loginRequest(from(i), "alice")); err != nil {
+			t.Fatalf("Expected the attempt from address %d to be allowed, got %v", i, err)
+		}
+	}
+	var rejected *actions.RejectedError
+	if err := limiter.Allow(loginRequest(from(6), "alice")); !errors.As(err, &rejected) {
+		t.Fatalf("Expected the attempt from a sixth address to go over the account's limit, got %v", err)
+	}
+	if stats := limiter.Stats()[ScopeAccount]; stats.Rejected != 1 || stats.LockedOut != 1 {
+		t.Errorf("Unexpected account stats %+v", stats)
+	}
+	if stats := limiter.Stats()[ScopeUsername]; stats.Rejected != 0 {
+		t.Errorf("Expected no address to go over its own limit, got %+v", stats)
+	}
+	if err := limiter.Allow(loginRequest(from(6), "bob")); err != nil {
+		t.Errorf("Expected another account to be allowed, got %v", err)
+	}
+}
+
+func TestForgetConnection(t *testing.T) {
+	limiter := New(Config{PerConnection: Limit{Requests: 1, Per: time.Hour}, Lockout: time.Hour})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	request := &actions.Request{Conn: conn, Message: &pb.Message{}, Packet: "none"}
+
+	if err := limiter.Allow(request); err != nil {
+		t.Fatalf("Expected the first packet to be allowed, got %v", err)
+	}
+	if err := limiter.Allow(request); err == nil {
+		t.Fatal("Expected the second packet to lock the connection out")
+	}
+	// A connection that reuses the closed one's memory starts with a full bucket
+	limiter.Forget(conn)
+	if err := limiter.Allow(request); err != nil {
+		t.Errorf("Expected the bucket to be forgotten, got %v", err)
+	}
+	if stats := limiter.Stats()[ScopeConnection]; stats.LockedOut != 0 {
+		t.Errorf("Expected nobody to be locked out, got %+v", stats)
+	}
+}
+
+func TestKeyLookupBudget(t *testing.T) {
+	limiter := New(Config{KeyLookups: Limit{Requests: 1, Per: time.Hour}, Lockout: time.Minute})
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	lookup := func(username string) error {
+		return limiter.Allow(&actions.Request{
+			Conn: conn,
+			Message: &pb.Message{
+				FromUsername: &username,
+				Packet: &pb.Message_ExchangeKeyMessage{
+					ExchangeKeyMessage: &pb.ExchangeKeyPacket{Status: pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY},
+				},
+			},
+			Packet:   "exchangeKeyMessage",
+			Username: username,
+		})
+	}
+
+	if err := lookup("alice"); err != nil {
+		t.Fatalf("Expected the first lookup to be allowed, got %v", err)
+	}
+	if err := lookup("alice"); err == nil {
+		t.Error("Expected the second lookup to go over alice's budget")
+	}
+	if err := lookup("bob"); err != nil {
+		t.Errorf("Expected bob to have a budget of their own, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSpanExport(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent, err := ParseTraceparent(traceparent)
+	if err != nil || parent.Traceparent() != traceparent {
+		t.Fatalf("Expected the traceparent to round trip, got %q (%v)", parent.Traceparent(), err)
+	}
+	for _, malformed := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		if _, err = ParseTraceparent(malformed); err == nil {
+			t.Errorf("Expected %q to be rejected", malformed)
+		}
+	}
+
+	// Without a tracer nothing is exported, but the parent is passed on
+	if span := (*Tracer)(nil).Start(traceparent, "dispatch", KindServer); span.Traceparent() != traceparent {
+		t.Errorf("Expected a disabled span to pass the parent on, got %q", span.Traceparent())
+	}
+
+	var output bytes.Buffer
+	tracer := NewTracer("test", &output)
+	span := tracer.Start(traceparent, "handle chatMessage", KindInternal)
+	if span.Context().TraceID != parent.TraceID || span.Context().SpanID == parent.SpanID {
+		t.Errorf("Expected a child span in the same trace, got %q", span.Traceparent())
+	}
+	span.SetAttribute("chat.conn", 3)
+	span.RecordError(errors.New("recipient is not logged in"))
+	span.End()
+	span.End()
+	if root := tracer.Start("not a traceparent", "send", KindClient); root.Context().TraceID == parent.TraceID || !root.Context().IsValid() {
+		t.Errorf("Expected a new trace for a malformed parent, got %q", root.Traceparent())
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one exported span, got %s", output.String())
+	}
+	var request otlpRequest
+	if err = json.Unmarshal([]byte(lines[0]), &request); err != nil {
+		t.Fatalf("Expected an OTLP/JSON line, got %v", err)
+	}
+	exported := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if exported.TraceID != parent.TraceID.String() || exported.ParentSpanID != parent.SpanID.String() || exported.Kind != KindInternal {
+		t.Errorf("Expected the span to point to its parent, got %+v", exported)
+	}
+	if exported.Status.Code != statusError || *exported.Attributes[0].Value.IntValue != "3" {
+		t.Errorf("Expected the error and the attribute to be exported, got %+v", exported)
+	}
+}
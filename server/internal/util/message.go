@@ -5,48 +5,72 @@ import (
 	"fmt"
 	"google.golang.org/protobuf/proto"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"server/internal/metrics"
 	pb "server/resources/proto"
 )
 
+// DefaultMaxMessageSize is the largest message ReadMessage accepts, so a peer cannot make us allocate arbitrary amounts of memory
+const DefaultMaxMessageSize = 1 << 20
+
+var (
+	packetsSent     = metrics.Default.NewCounter("chat_packets_sent_total", "Packets written to connections, by packet type.", "packet")
+	packetsReceived = metrics.Default.NewCounter("chat_packets_received_total", "Packets read from connections, by packet type.", "packet")
+)
+
+// PacketName is the name of the message's packet field, like "loginMessage"
+func PacketName(message *pb.Message) string {
+	reflection := message.ProtoReflect()
+	field := reflection.WhichOneof(reflection.Descriptor().Oneofs().ByName("packet"))
+	if field == nil {
+		return "none"
+	}
+	return string(field.Name())
+}
+
 func SendMessage(conn net.Conn, message *pb.Message) error {
 	data, err := proto.Marshal(message)
 	if err != nil {
 		return fmt.Errorf("error marshalling message: %v", err)
 	}
 
-	// Write the length of the message
-	log.Println("SendMessage\t len: ", len(data))
-	err = binary.Write(conn, binary.BigEndian, uint32(len(data)))
-	if err != nil {
-		return fmt.Errorf("error writing message length: %v", err)
-	}
-
-	// Write the message itself
-	//log.Println("SendMessage data: ", data)
-	_, err = conn.Write(data)
+	// Write the length and the message in a single write, so messages sent to the same
+	// connection from different goroutines are never interleaved
+	frame := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	frame = append(frame, data...)
+	_, err = conn.Write(frame)
 	if err != nil {
 		return fmt.Errorf("error writing message: %v", err)
 	}
+	packet := PacketName(message)
+	packetsSent.Inc(packet)
+	slog.Debug("Sent message", "packet", packet, "bytes", len(data))
 
 	return nil
 }
 
-// ReadMessage reads a length-prefixed message from the connection
+// ReadMessage reads a length-prefixed message of at most DefaultMaxMessageSize bytes from the connection
 func ReadMessage(conn net.Conn) (*pb.Message, error) {
+	return ReadLimitedMessage(conn, DefaultMaxMessageSize)
+}
+
+// ReadLimitedMessage reads a length-prefixed message of at most maxSize bytes from the connection
+func ReadLimitedMessage(conn net.Conn, maxSize uint32) (*pb.Message, error) {
 	// Read the message length
 	var length uint32
 	err := binary.Read(conn, binary.BigEndian, &length)
-	log.Println("ReadMessage\t len: ", length)
 	if err != nil {
 		return nil, fmt.Errorf("error reading message length: %v", err)
 	}
 
+	if length > maxSize {
+		return nil, fmt.Errorf("message of %d bytes is larger than the maximum of %d bytes", length, maxSize)
+	}
+
 	// Read the message data
 	data := make([]byte, length)
 	_, err = io.ReadFull(conn, data)
-	//log.Println("ReadMessage data: ", data)
 	if err != nil {
 		return nil, fmt.Errorf("error reading message data: %v", err)
 	}
@@ -56,6 +80,9 @@ func ReadMessage(conn net.Conn) (*pb.Message, error) {
 	if err := proto.Unmarshal(data, message); err != nil {
 		return nil, fmt.Errorf("error unmarshalling message: %v", err)
 	}
+	packet := PacketName(message)
+	packetsReceived.Inc(packet)
+	slog.Debug("Read message", "packet", packet, "bytes", length)
 
 	return message, nil
 }
@@ -1,24 +1,14 @@
 package util
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"os"
 )
 
-func HashString(data string) string {
-	combined := os.Getenv("SERVER_HASH_PASSWORD") + data + os.Getenv("SERVER_HASH_SALT")
-	hasher := sha256.New()
-
-	hasher.Write([]byte(combined))
-	hashedBytes := hasher.Sum(nil)
-	return base64.StdEncoding.EncodeToString(hashedBytes)
-}
-
 func EncodeUsingPubK(msgBytes []byte, pubKey *rsa.PublicKey) ([]byte, error) {
 	if pubKey == nil {
 		return nil, errors.New("public key is nil")
@@ -44,6 +34,28 @@ func GenerateRandomToken(length int) ([]byte, error) {
 	return randomBytes, nil
 }
 
-func DebugPrintPublicKey(key *rsa.PublicKey) string {
-	return fmt.Sprintf("N: %x... (len: %d bits), E: %d", key.N.Bytes()[:20], key.N.BitLen(), key.E)
+// KeyRotationDigest is the digest a user signs with its current private key to prove ownership when rotating keys
+func KeyRotationDigest(username string, newPubKey []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte("key-rotation:" + username + ":"))
+	hasher.Write(newPubKey)
+	return hasher.Sum(nil)
+}
+
+// RecoveryCodeVerifier is what the server stores instead of the recovery code itself
+func RecoveryCodeVerifier(recoveryCode []byte) []byte {
+	hasher := sha256.New()
+	hasher.Write([]byte("recovery-code:"))
+	hasher.Write(recoveryCode)
+	return hasher.Sum(nil)
+}
+
+func VerifyKeyRotationSignature(pubKey *rsa.PublicKey, username string, newPubKey []byte, signature []byte) error {
+	if pubKey == nil {
+		return errors.New("public key is nil")
+	}
+	if err := rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, KeyRotationDigest(username, newPubKey), signature); err != nil {
+		return fmt.Errorf("invalid key rotation signature: %v", err)
+	}
+	return nil
 }
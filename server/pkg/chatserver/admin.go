@@ -0,0 +1,255 @@
+package chatserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"server/internal/actions"
+	"server/internal/adminapi"
+	"server/internal/db"
+	pb "server/resources/proto"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Session is a client connection, with the user logged in on it
+	Session = adminapi.Session
+	// AdminOptions configure the admin API handler
+	AdminOptions = adminapi.Options
+	// AdminCredentials are the tokens and client certificate subjects allowed to call the admin API, and their roles
+	AdminCredentials = adminapi.Credentials
+	// Announcement is a signed message to every user, sent right away or at a scheduled time
+	Announcement = adminapi.Announcement
+	// Suspension keeps a user from logging in until it expires or a moderator lifts it
+	Suspension = adminapi.Suspension
+)
+
+// LoadAdminCredentials reads the admin API credentials from a JSON file
+func LoadAdminCredentials(path string) (*AdminCredentials, error) {
+	return adminapi.LoadCredentials(path)
+}
+
+// NewAdminHandler serves the admin API of the server. Serve it over TLS, the callers send bearer tokens.
+func NewAdminHandler(s *Server, options AdminOptions) http.Handler {
+	return adminapi.NewHandler(s, options)
+}
+
+// session is what the server knows about a client connection from the moment it is accepted
+type session struct {
+	id          uint64 // The conn attribute of the connection's log lines
+	remote      string
+	connectedAt time.Time
+	certificate *tls.Certificate // The server certificate the client was shown, nil without TLS
+	// username is who logged in on the connection. It is kept when the user logs in again on another connection.
+	username string
+	// writeMutex is held by the writes with their own deadline, so one can't clear the deadline of another
+	writeMutex sync.Mutex
+}
+
+// Sessions returns the open client connections, oldest first
+func (s *Server) Sessions() []Session {
+	users := make(map[net.Conn]string)
+	for username, conn := range s.loggedInUsers.Snapshot() {
+		users[conn] = username
+	}
+
+	s.clientsMutex.Lock()
+	sessions := make([]Session, 0, len(s.clients))
+	for conn, client := range s.clients {
+		sessions = append(sessions, Session{ID: client.id, Remote: client.remote, User: users[conn], ConnectedAt: client.connectedAt})
+	}
+	s.clientsMutex.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Kick tells the client of a session why it is disconnected and closes the connection once
+// the message being handled is done
+func (s *Server) Kick(id uint64, reason string) error {
+	var kicked net.Conn
+	s.clientsMutex.Lock()
+	for conn, client := range s.clients {
+		if client.id == id {
+			kicked = conn
+			break
+		}
+	}
+	s.clientsMutex.Unlock()
+	if kicked == nil {
+		return fmt.Errorf("session %d: %w", id, adminapi.ErrNotFound)
+	}
+	s.kick(kicked, reason)
+	return nil
+}
+
+func (s *Server) kick(conn net.Conn, reason string) {
+	notice := &pb.Message{
+		Source: pb.Message_SERVER,
+		Packet: &pb.Message_ServerNoticeMessage{
+			ServerNoticeMessage: &pb.ServerNoticePacket{
+				Type:   pb.ServerNoticePacket_KICKED,
+				Reason: &reason,
+			},
+		},
+	}
+	if err := s.sendWithin(conn, notice, time.Now().Add(broadcastWriteTimeout)); err != nil {
+		s.logger.Warn("Error sending kicked notice", "error", err)
+	}
+	// Unblocks the client goroutine, which closes the connection
+	_ = conn.SetReadDeadline(time.Now())
+}
+
+// lookupUser finds the blinded username of an account, with ErrNotFound when there is none
+func (s *Server) lookupUser(username string) (string, error) {
+	blindedUsername, _, err := actions.LookupUsername(s.store, s.keyring, username)
+	if errors.Is(err, db.ErrUserNotFound) {
+		return "", fmt.Errorf("user %w", adminapi.ErrNotFound)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error looking up user: %v", err)
+	}
+	return blindedUsername, nil
+}
+
+// BlindUsername returns the username blinded with the current version, like new accounts and the audit log hold it
+func (s *Server) BlindUsername(username string) string {
+	return s.keyring.Current().Blind(username)
+}
+
+// DisableUser disables or enables the account of a user. Disabling also kicks the user's sessions,
+// kicked is how many there were.
+func (s *Server) DisableUser(username string, disabled bool) (kicked int, err error) {
+	blindedUsername, err := s.lookupUser(username)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.store.SetUserDisabled(blindedUsername, disabled); err != nil {
+		return 0, fmt.Errorf("error updating user: %v", err)
+	}
+	if !disabled {
+		return 0, nil
+	}
+	return s.kickUser(username, "This account has been disabled by an administrator"), nil
+}
+
+// RequireKeyReset refuses the current key of a user until the account is recovered with a new key, and kicks the
+// user's sessions, kicked is how many there were
+func (s *Server) RequireKeyReset(username string) (kicked int, err error) {
+	blindedUsername, err := s.lookupUser(username)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.store.RequireKeyReset(blindedUsername); err != nil {
+		return 0, fmt.Errorf("error updating user: %v", err)
+	}
+	return s.kickUser(username, "An administrator requires a new key, recover your account with a recovery code and a new key"), nil
+}
+
+// DeleteUser deletes the account of a user and kicks the user's sessions, kicked is how many there were
+func (s *Server) DeleteUser(username string) (kicked int, err error) {
+	blindedUsername, err := s.lookupUser(username)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.store.DeleteUser(blindedUsername); err != nil {
+		return 0, fmt.Errorf("error deleting user: %v", err)
+	}
+	return s.kickUser(username, "This account has been deleted by an administrator"), nil
+}
+
+// kickUser kicks every session the user logged in on and returns how many were kicked
+func (s *Server) kickUser(username string, reason string) int {
+	// The login that is being answered right now is not on its session yet
+	latest, online := s.loggedInUsers.Get(username)
+	var conns []net.Conn
+	s.clientsMutex.Lock()
+	for conn, client := range s.clients {
+		if client.username == username || (online && conn == latest) {
+			conns = append(conns, conn)
+		}
+	}
+	s.clientsMutex.Unlock()
+	for _, conn := range conns {
+		s.kick(conn, reason)
+	}
+	return len(conns)
+}
+
+// Suspend keeps a user from logging in until ExpiresAt, or for good when it is nil, and kicks the user's
+// sessions. The suspension's Reason and Moderator are required.
+func (s *Server) Suspend(username string, request Suspension) (Suspension, int, error) {
+	blindedUsername, err := s.lookupUser(username)
+	if err != nil {
+		return Suspension{}, 0, err
+	}
+	suspension := db.Suspension{
+		Username:  blindedUsername,
+		Reason:    request.Reason,
+		Moderator: request.Moderator,
+		CreatedAt: time.Now(),
+	}
+	if request.ExpiresAt != nil {
+		suspension.ExpiresAt = *request.ExpiresAt
+	}
+	if suspension.ID, err = s.store.SuspendUser(suspension); err != nil {
+		return Suspension{}, 0, fmt.Errorf("error suspending user: %v", err)
+	}
+	s.logger.Info("User suspended", "suspension", suspension.ID, "moderator", suspension.Moderator, "until", suspension.ExpiresAt)
+
+	kicked := s.kickUser(username, actions.SuspensionMessage(suspension))
+	return toAPISuspension(suspension, time.Now()), kicked, nil
+}
+
+// LiftSuspensions lets a suspended user log in again and returns how many suspensions were lifted
+func (s *Server) LiftSuspensions(username string, moderator string) (int, error) {
+	blindedUsername, err := s.lookupUser(username)
+	if err != nil {
+		return 0, err
+	}
+	lifted, err := s.store.LiftSuspensions(blindedUsername, moderator, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error lifting suspensions: %v", err)
+	}
+	return lifted, nil
+}
+
+// Suspensions returns every suspension of a user, oldest first
+func (s *Server) Suspensions(username string) ([]Suspension, error) {
+	blindedUsername, err := s.lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.store.ListSuspensions(blindedUsername)
+	if err != nil {
+		return nil, fmt.Errorf("error reading suspensions: %v", err)
+	}
+	now := time.Now()
+	suspensions := make([]Suspension, 0, len(stored))
+	for _, suspension := range stored {
+		suspensions = append(suspensions, toAPISuspension(suspension, now))
+	}
+	return suspensions, nil
+}
+
+func toAPISuspension(s db.Suspension, now time.Time) Suspension {
+	suspension := Suspension{
+		ID:        s.ID,
+		Reason:    s.Reason,
+		Moderator: s.Moderator,
+		CreatedAt: s.CreatedAt,
+		LiftedBy:  s.LiftedBy,
+		Active:    s.Active(now),
+	}
+	if !s.ExpiresAt.IsZero() {
+		suspension.ExpiresAt = &s.ExpiresAt
+	}
+	if !s.LiftedAt.IsZero() {
+		suspension.LiftedAt = &s.LiftedAt
+	}
+	return suspension
+}
@@ -0,0 +1,235 @@
+package chatserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"server/internal/announcement"
+	"server/internal/db"
+	"server/internal/util"
+	pb "server/resources/proto"
+	"time"
+)
+
+// announcementCheckInterval is how often the scheduled announcements are checked
+const announcementCheckInterval = time.Second
+
+var errNoAnnouncementKey = errors.New("the server has no key to sign announcements with")
+
+// announcementSigner is the key the announcements to a client are signed with: Options.AnnouncementKey, or the key
+// of the certificate the client was shown in its handshake, which is the one it verifies them against
+func (s *Server) announcementSigner(certificate *tls.Certificate) crypto.Signer {
+	if s.options.AnnouncementKey != nil {
+		return s.options.AnnouncementKey
+	}
+	if certificate == nil {
+		return nil
+	}
+	key, _ := certificate.PrivateKey.(crypto.Signer)
+	return key
+}
+
+// servedCertificate returns the certificate the client of conn was shown, nil when there was no TLS handshake
+func (s *Server) servedCertificate(conn net.Conn) *tls.Certificate {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	if client, open := s.clients[conn]; open {
+		return client.certificate
+	}
+	return nil
+}
+
+// announcementKey is Options.AnnouncementKey, or the key of the certificate the TLS config serves right now.
+// It is nil when the server has neither, and then no announcements can be sent.
+func (s *Server) announcementKey() crypto.Signer {
+	if s.options.AnnouncementKey != nil {
+		return s.options.AnnouncementKey
+	}
+	config := s.options.TLSConfig
+	if config == nil {
+		return nil
+	}
+	var cert *tls.Certificate
+	if len(config.Certificates) > 0 {
+		cert = &config.Certificates[0]
+	} else if config.GetCertificate != nil {
+		cert, _ = config.GetCertificate(&tls.ClientHelloInfo{})
+	}
+	if cert == nil {
+		return nil
+	}
+	key, _ := cert.PrivateKey.(crypto.Signer)
+	return key
+}
+
+// Announce stores the announcement and sends it to every connected client, or schedules it when its SendAt is in
+// the future. It returns the stored announcement and how many clients it was sent to right away.
+func (s *Server) Announce(request Announcement) (Announcement, int, error) {
+	if s.announcementKey() == nil {
+		return Announcement{}, 0, errNoAnnouncementKey
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Announcement{}, 0, fmt.Errorf("error generating announcement ID: %v", err)
+	}
+	now := time.Now()
+	stored := db.Announcement{
+		ID:         hex.EncodeToString(id),
+		Text:       request.Message,
+		CreatedAt:  now,
+		SendAt:     request.SendAt,
+		Persistent: request.Persistent,
+	}
+	if stored.SendAt.Before(now) {
+		stored.SendAt = now
+	}
+	if request.ExpiresAt != nil {
+		stored.ExpiresAt = *request.ExpiresAt
+	}
+
+	// Held until it is sent, so the scheduler can't send it too
+	s.announcementsMutex.Lock()
+	defer s.announcementsMutex.Unlock()
+	if err := s.store.AddAnnouncement(stored); err != nil {
+		return Announcement{}, 0, err
+	}
+	delivered := 0
+	if !stored.SendAt.After(now) {
+		var err error
+		if stored, delivered, err = s.sendAnnouncement(stored); err != nil {
+			return Announcement{}, 0, err
+		}
+	}
+	return toAPIAnnouncement(stored), delivered, nil
+}
+
+// Announcements returns the sent and scheduled announcements, in the order they are sent
+func (s *Server) Announcements() ([]Announcement, error) {
+	stored, err := s.store.ListAnnouncements()
+	if err != nil {
+		return nil, err
+	}
+	announcements := make([]Announcement, 0, len(stored))
+	for _, a := range stored {
+		announcements = append(announcements, toAPIAnnouncement(a))
+	}
+	return announcements, nil
+}
+
+func toAPIAnnouncement(a db.Announcement) Announcement {
+	announcement := Announcement{ID: a.ID, Message: a.Text, SendAt: a.SendAt, Persistent: a.Persistent}
+	if !a.ExpiresAt.IsZero() {
+		announcement.ExpiresAt = &a.ExpiresAt
+	}
+	if !a.SentAt.IsZero() {
+		announcement.SentAt = &a.SentAt
+	}
+	return announcement
+}
+
+// sendAnnouncement must be called with the announcements mutex held. It is marked sent before it is broadcast,
+// so a user who logs in meanwhile gets it at login.
+func (s *Server) sendAnnouncement(a db.Announcement) (db.Announcement, int, error) {
+	a.SentAt = time.Now().Truncate(time.Second)
+	if err := s.store.MarkAnnouncementSent(a.ID, a.SentAt); err != nil {
+		return a, 0, err
+	}
+	if a.Expired(a.SentAt) {
+		return a, 0, nil
+	}
+
+	// Signed once for every certificate the clients were shown, clients that connected before a certificate
+	// reload verify against the old one
+	notices := make(map[*tls.Certificate]*pb.Message)
+	conns := s.broadcast(func(conn net.Conn) (*pb.Message, error) {
+		certificate := s.servedCertificate(conn)
+		if notice, signed := notices[certificate]; signed {
+			return notice, nil
+		}
+		signer := s.announcementSigner(certificate)
+		if signer == nil {
+			return nil, errNoAnnouncementKey
+		}
+		notice, err := announcement.Notice(signer, a)
+		if err != nil {
+			return nil, err
+		}
+		notices[certificate] = notice
+		return notice, nil
+	}, nil)
+	s.logger.Info("Announcement sent", "announcement", a.ID, "clients", len(conns), "persistent", a.Persistent)
+	if a.Persistent {
+		var usernames []string
+		for _, conn := range conns {
+			if username := s.loggedInUsername(conn); username != "" {
+				usernames = append(usernames, s.BlindUsername(username))
+			}
+		}
+		if err := s.store.RecordAnnouncementDeliveries(a.ID, usernames); err != nil {
+			s.logger.Error("Error recording announcement deliveries", "announcement", a.ID, "error", err)
+		}
+	}
+	return a, len(conns), nil
+}
+
+// scheduleAnnouncements sends the scheduled announcements when they are due, until the shutdown starts
+func (s *Server) scheduleAnnouncements() {
+	ticker := time.NewTicker(announcementCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stopping:
+			return
+		case now := <-ticker.C:
+			s.sendDueAnnouncements(now)
+		}
+	}
+}
+
+func (s *Server) sendDueAnnouncements(now time.Time) {
+	s.announcementsMutex.Lock()
+	defer s.announcementsMutex.Unlock()
+	due, err := s.store.DueAnnouncements(now)
+	if err != nil {
+		s.logger.Error("Error reading scheduled announcements", "error", err)
+		return
+	}
+	for _, a := range due {
+		if _, _, err = s.sendAnnouncement(a); err != nil {
+			s.logger.Error("Error sending scheduled announcement", "announcement", a.ID, "error", err)
+		}
+	}
+}
+
+// deliverAnnouncements sends a user who just logged in the persistent announcements sent while they were offline
+func (s *Server) deliverAnnouncements(conn net.Conn, username string, logger *slog.Logger) {
+	key := s.announcementSigner(s.servedCertificate(conn))
+	if key == nil {
+		return
+	}
+	blindedUsername := s.BlindUsername(username)
+	pending, err := s.store.UndeliveredAnnouncements(blindedUsername, time.Now())
+	if err != nil {
+		logger.Error("Error reading announcements", "error", err)
+		return
+	}
+	for _, a := range pending {
+		notice, err := announcement.Notice(key, a)
+		if err != nil {
+			logger.Error("Error signing announcement", "announcement", a.ID, "error", err)
+			return
+		}
+		if err = util.SendMessage(conn, notice); err != nil {
+			logger.Warn("Error sending announcement", "announcement", a.ID, "error", err)
+			return
+		}
+		if err = s.store.RecordAnnouncementDeliveries(a.ID, []string{blindedUsername}); err != nil {
+			logger.Error("Error recording announcement delivery", "announcement", a.ID, "error", err)
+		}
+	}
+}
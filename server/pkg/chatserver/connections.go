@@ -0,0 +1,226 @@
+package chatserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"server/internal/netlimit"
+	"server/internal/proxyproto"
+	"sync"
+	"time"
+)
+
+// shedLogInterval is how often a refused connection is logged for each reason, the others are only counted
+const shedLogInterval = 10 * time.Second
+
+// The accept loop backs off between these delays when Accept keeps failing, like when no file descriptors are left
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// shedLog throttles the warnings about refused connections, so a flood of them can't flood the log
+type shedLog struct {
+	mutex      sync.Mutex
+	lastLogged map[string]time.Time
+	suppressed map[string]int
+}
+
+// allow reports whether a refusal for reason is logged now, and how many were left out since the last one
+func (l *shedLog) allow(reason string, now time.Time) (bool, int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lastLogged == nil {
+		l.lastLogged = make(map[string]time.Time)
+		l.suppressed = make(map[string]int)
+	}
+	if now.Sub(l.lastLogged[reason]) < shedLogInterval {
+		l.suppressed[reason]++
+		return false, 0
+	}
+	suppressed := l.suppressed[reason]
+	l.lastLogged[reason] = now
+	l.suppressed[reason] = 0
+	return true, suppressed
+}
+
+func (s *Server) handleConnections(listener net.Listener) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.shuttingDown.Load() {
+				return
+			}
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			s.logger.Error("Error accepting connection", "error", err, "retry_in", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.stopping:
+			}
+			continue
+		}
+		backoff = 0
+
+		s.clientsWG.Add(1)
+		go s.serveConnection(conn)
+	}
+}
+
+// serveConnection checks the connection limits before the TLS handshake, so a refused connection costs
+// next to nothing, then handles the client's messages until it disconnects. The PROXY header of a trusted
+// load balancer is read first, so the limits count the client's address.
+func (s *Server) serveConnection(conn net.Conn) {
+	defer s.clientsWG.Done()
+
+	ctx, cancel := s.handshakeContext()
+	defer cancel()
+
+	conn, err := s.readProxyHeader(ctx, conn)
+	if err != nil {
+		s.shed(conn, s.connectionLimiter.Reject(netlimit.ReasonProxyHeader, err.Error()))
+		return
+	}
+
+	release, err := s.connectionLimiter.Admit(conn.RemoteAddr())
+	if err != nil {
+		s.shed(conn, err)
+		return
+	}
+	defer release()
+
+	var certificate *tls.Certificate
+	if conn, certificate, err = s.handshake(ctx, conn); err != nil {
+		s.shed(conn, s.connectionLimiter.Reject(netlimit.ReasonHandshake, err.Error()))
+		return
+	}
+
+	connectionsAccepted.Inc()
+	client := &session{id: s.connectionIDs.Add(1), remote: conn.RemoteAddr().String(), connectedAt: time.Now(), certificate: certificate}
+	s.clientsMutex.Lock()
+	s.clients[conn] = client
+	s.clientsMutex.Unlock()
+	s.handleClient(conn, client.id)
+}
+
+// handshakeContext ends when the handshake timeout is over or the shutdown starts. The PROXY header and the
+// TLS handshake have to be done by then.
+func (s *Server) handshakeContext() (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout := s.connectionLimiter.HandshakeTimeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	go func() {
+		select {
+		case <-s.stopping:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// readProxyHeader returns a connection with the client's address when the connection comes from a trusted
+// load balancer, which must send a PROXY header. Other connections are served as they are.
+func (s *Server) readProxyHeader(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if len(s.options.TrustedProxies) == 0 {
+		return conn, nil
+	}
+	peer, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil || !s.options.TrustedProxies.Contains(peer.Addr()) {
+		return conn, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetReadDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetReadDeadline(time.Now()) })
+	defer stop()
+	proxied, err := proxyproto.ReadHeader(conn)
+	if err != nil {
+		return conn, fmt.Errorf("from trusted proxy %v: %v", peer.Addr(), err)
+	}
+	if !stop() {
+		return conn, fmt.Errorf("from trusted proxy %v: %v", peer.Addr(), ctx.Err())
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return proxied, nil
+}
+
+// handshake wraps the connection in TLS and completes the handshake before ctx ends. A connection from a
+// listener that terminates TLS itself gets the same timeout.
+func (s *Server) handshake(ctx context.Context, conn net.Conn) (net.Conn, *tls.Certificate, error) {
+	var served *tls.Certificate
+	if s.options.TLSConfig != nil {
+		conn = tls.Server(conn, recordServedCertificate(s.options.TLSConfig, &served))
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return conn, nil, nil
+	}
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return conn, nil, fmt.Errorf("TLS handshake timed out")
+		}
+		return conn, nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return conn, served, nil
+}
+
+// recordServedCertificate returns a copy of the config that stores the certificate it shows the client in served.
+// The client verifies the announcements against that certificate, even after the server's has been reloaded.
+func recordServedCertificate(config *tls.Config, served **tls.Certificate) *tls.Config {
+	recording := config.Clone()
+	// Without static certificates crypto/tls always asks GetCertificate
+	recording.Certificates = nil
+	recording.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		certificate, err := chooseCertificate(config, hello)
+		*served = certificate
+		return certificate, err
+	}
+	return recording
+}
+
+// chooseCertificate picks the certificate of the config like crypto/tls does
+func chooseCertificate(config *tls.Config, hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if config.GetCertificate != nil {
+		certificate, err := config.GetCertificate(hello)
+		if certificate != nil || err != nil {
+			return certificate, err
+		}
+	}
+	if len(config.Certificates) == 0 {
+		return nil, fmt.Errorf("no certificate configured")
+	}
+	for i := range config.Certificates {
+		if hello.SupportsCertificate(&config.Certificates[i]) == nil {
+			return &config.Certificates[i], nil
+		}
+	}
+	return &config.Certificates[0], nil
+}
+
+// shed closes a connection that was refused and logs why, at most once per reason every shedLogInterval
+func (s *Server) shed(conn net.Conn, err error) {
+	conn.Close()
+
+	reason := netlimit.ReasonDenied
+	var rejected *netlimit.RejectedError
+	if errors.As(err, &rejected) {
+		reason = rejected.Reason
+	}
+	connectionsRejected.Inc(reason)
+	if s.shuttingDown.Load() {
+		return
+	}
+	if log, suppressed := s.shedLog.allow(reason, time.Now()); log {
+		s.logger.Warn("Connection refused", "reason", reason, "remote", conn.RemoteAddr().String(), "error", err, "suppressed", suppressed)
+	}
+}
@@ -0,0 +1,106 @@
+package chatserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"server/internal/db"
+	"time"
+)
+
+// Version is the release of the server, set at build time with
+// -ldflags "-X server/pkg/chatserver.Version=1.2.3". The module version is used when it is empty.
+var Version = ""
+
+// readyTimeout bounds the database check of a readiness probe
+const readyTimeout = 2 * time.Second
+
+// BuildInfo describes the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision,omitempty"`   // The VCS commit the binary was built from
+	BuildTime string `json:"build_time,omitempty"` // The time of that commit
+	Modified  bool   `json:"modified,omitempty"`   // Whether the working tree had uncommitted changes
+	GoVersion string `json:"go_version"`
+}
+
+// ReadBuildInfo returns the version of the server and what the Go toolchain recorded in the binary
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{Version: Version, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Revision = setting.Value
+		case "vcs.time":
+			info.BuildTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// Ready returns why the server can't take clients right now: it was not started yet, it is shutting down,
+// or its store can't be used. It returns nil when the server is ready.
+func (s *Server) Ready(ctx context.Context) error {
+	s.lifecycleMutex.Lock()
+	started := s.started
+	s.lifecycleMutex.Unlock()
+	if s.shuttingDown.Load() {
+		return fmt.Errorf("shutting down")
+	}
+	if !started {
+		return fmt.Errorf("not started")
+	}
+	if checker, ok := s.options.Store.(db.HealthChecker); ok {
+		if err := checker.CheckHealth(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type healthResponse struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	Build  BuildInfo `json:"build"`
+}
+
+// HealthHandler serves the liveness check on /healthz, which succeeds as long as the process answers,
+// and the readiness check on /readyz, which fails with 503 Service Unavailable while Ready returns an error.
+// Both answer with the build information as JSON.
+func (s *Server) HealthHandler() http.Handler {
+	build := ReadBuildInfo()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok", Build: build})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+		if err := s.Ready(ctx); err != nil {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Error: err.Error(), Build: build})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ready", Build: build})
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	// Load balancers poll these, an old answer must not be served from a cache
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,755 @@
+// Package chatserver runs the chat server inside another program. Every Server has its own listener,
+// storage, settings and connected clients, so several servers can run in the same process.
+package chatserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"server/internal/actions"
+	"server/internal/audit"
+	"server/internal/blinding"
+	"server/internal/clientcert"
+	"server/internal/db"
+	"server/internal/decoy"
+	"server/internal/keypolicy"
+	"server/internal/metrics"
+	"server/internal/netlimit"
+	"server/internal/ratelimit"
+	"server/internal/tracing"
+	"server/internal/util"
+	pb "server/resources/proto"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long clients get to drain when Start's context is cancelled
+const DefaultShutdownTimeout = 10 * time.Second
+
+// DefaultMaxMessageSize is the largest packet a server reads from a client when Options.MaxMessageSize is 0
+const DefaultMaxMessageSize = util.DefaultMaxMessageSize
+
+// DefaultLookupResponseTime is how long a login or key lookup takes at least when Options.LookupResponseTime is 0
+const DefaultLookupResponseTime = decoy.DefaultMinResponseTime
+
+// broadcastWriteTimeout bounds the write of a broadcast message to one client
+const broadcastWriteTimeout = 5 * time.Second
+
+// ErrServerClosed is returned by Start after the server was shut down
+var ErrServerClosed = errors.New("chat server closed")
+
+var (
+	connectionsAccepted = metrics.Default.NewCounter("chat_connections_total", "Client connections accepted.")
+	connectionsRejected = metrics.Default.NewCounter("chat_connections_rejected_total", "Client connections refused, by reason (denied, max_connections, max_connections_per_ip, handshake or proxy_header).", "reason")
+)
+
+// MetricsHandler serves the metrics of every server in the process in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return metrics.Default.Handler()
+}
+
+// Store is the server's persistent state
+type Store = db.Store
+
+// OpenSQLiteStore opens (or creates) a SQLite database and migrates it to the latest schema
+func OpenSQLiteStore(dbPath string) (Store, error) {
+	return db.OpenSQLiteStore(dbPath)
+}
+
+// NewMemoryStore returns an empty store that lives in memory, for tests
+func NewMemoryStore() Store {
+	return db.NewMemoryStore()
+}
+
+type (
+	// MessageHandler handles one packet type for one client connection
+	MessageHandler = actions.MessageHandler
+	// HandlerFactory creates the handler of a packet type for every new connection
+	HandlerFactory = actions.HandlerFactory
+	// Connection is what a HandlerFactory gets to know about the connection and the server state
+	Connection = actions.Connection
+	// LoggedInUsers is the connection each logged-in user is on, safe to use from any handler
+	LoggedInUsers = actions.LoggedInUsers
+	// Request is one packet received from a client
+	Request = actions.Request
+	// HandleFunc is the rest of the middleware chain
+	HandleFunc = actions.HandleFunc
+	// Middleware wraps the handling of every packet
+	Middleware = actions.Middleware
+	// Limiter decides whether a request may be handled
+	Limiter = actions.Limiter
+	// RejectedError is returned by a Limiter to reject a request with a reason and when to retry
+	RejectedError = actions.RejectedError
+	// PacketStats are the request totals of one packet type
+	PacketStats = actions.PacketStats
+
+	// RateLimiter is the built-in Limiter, with token buckets per connection, source IP and username
+	RateLimiter = ratelimit.Limiter
+	// RateLimitConfig holds the limits of the RateLimiter
+	RateLimitConfig = ratelimit.Config
+	// RateLimit is one token bucket of a RateLimitConfig, like 10 requests per minute
+	RateLimit = ratelimit.Limit
+	// RateLimitStats are the rejection totals of one RateLimiter scope
+	RateLimitStats = ratelimit.ScopeStats
+
+	// AuditLog is the hash-chained record of logins, registrations, key lookups, rotations and recoveries
+	AuditLog = audit.Log
+	// AuditSink stores the audit records, in a file or in the SQLite database
+	AuditSink = audit.Sink
+
+	// Tracer writes a span for every packet the server dispatches and handles
+	Tracer = tracing.Tracer
+
+	// ConnectionLimits decide which connections are served, before their TLS handshake
+	ConnectionLimits = netlimit.Config
+	// ClientCertUsers map the subjects of client certificates to the usernames they may log in as
+	ClientCertUsers = clientcert.Users
+	// ClientCertificate lists the usernames the client certificates with one subject common name may log in as
+	ClientCertificate = clientcert.Certificate
+	// KeyPolicy decides which user keys the server accepts and for how long
+	KeyPolicy = keypolicy.KeyPolicy
+	// BlindingKeyring holds the versions of the username blinding, the newest one blinds new accounts
+	BlindingKeyring = blinding.Keyring
+	// AddressRanges is a list of CIDR ranges, like the allow and deny lists of the ConnectionLimits
+	AddressRanges = netlimit.Prefixes
+)
+
+// DefaultKeyPolicy accepts RSA keys of at least 2048 bits that never expire
+func DefaultKeyPolicy() KeyPolicy {
+	return keypolicy.DefaultKeyPolicy()
+}
+
+// LoadBlindingKeyring reads the username blinding keyring file, a missing file leaves only the legacy version
+func LoadBlindingKeyring(path string) (*BlindingKeyring, error) {
+	return blinding.LoadKeyring(path)
+}
+
+// LoadDecoySecret reads the secret of the decoy keys from a file, which is created with a new secret the first time
+func LoadDecoySecret(path string) ([]byte, error) {
+	return decoy.LoadSecret(path)
+}
+
+// LoadClientCertUsers reads the usernames of each client certificate subject from a JSON file
+func LoadClientCertUsers(path string) (*ClientCertUsers, error) {
+	return clientcert.LoadUsers(path)
+}
+
+// ParseAddressRanges parses comma-separated CIDR ranges and addresses, like "10.0.0.0/8,192.0.2.7"
+func ParseAddressRanges(value string) (AddressRanges, error) {
+	return netlimit.ParsePrefixes(value)
+}
+
+// OpenTracer exports the spans as OTLP/JSON lines to "stdout" or to a file path, "off" returns a nil Tracer
+func OpenTracer(target string) (*Tracer, error) {
+	return tracing.Open("chat-server", target)
+}
+
+// NewAuditLog continues the chain of the records already in the sink
+func NewAuditLog(sink AuditSink) (*AuditLog, error) {
+	return audit.New(sink)
+}
+
+// OpenAuditFile appends the audit records to a file, one JSON object per line. The file stays locked until the sink
+// is closed, so no other sink appends to it.
+func OpenAuditFile(path string) (AuditSink, error) {
+	return audit.OpenFile(path)
+}
+
+// DatabaseAuditSink keeps the audit records in the AuditLog table of a store opened with OpenSQLiteStore
+func DatabaseAuditSink(store Store) (AuditSink, error) {
+	sqlite, ok := store.(*db.SQLiteStore)
+	if !ok {
+		return nil, fmt.Errorf("only a SQLite store can hold the audit log")
+	}
+	return sqlite.AuditSink(), nil
+}
+
+// NewRateLimiter returns the built-in Limiter, to be passed as Options.RateLimiter
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return ratelimit.New(config)
+}
+
+type Options struct {
+	// Listener accepts the client connections. If it is nil, the server listens on Address.
+	Listener net.Listener
+	Address  string
+	// TLSConfig wraps the client connections in TLS. It can only be left out when Listener already terminates TLS.
+	TLSConfig *tls.Config
+	// Store is required, the server does not close it
+	Store Store
+	// Keyring blinds the usernames in the store and the audit log, only the legacy version is used when it is nil
+	Keyring *BlindingKeyring
+	// HashPassword and HashSalt are hashed with the username by the legacy blinding version of the Keyring
+	HashPassword string
+	HashSalt     string
+	// KeyPolicy decides which keys users may register and log in with, DefaultKeyPolicy() is used when it is nil
+	KeyPolicy *KeyPolicy
+	// DecoySecret derives the public keys unknown usernames get from lookups, so they stay the same across restarts.
+	// Load it with LoadDecoySecret. When it is nil, a random secret is used and the decoy keys change on restart.
+	DecoySecret []byte
+	// LookupResponseTime is how long every login and key lookup takes at least, so registered usernames don't
+	// answer faster than unknown ones. DefaultLookupResponseTime is used when it is 0.
+	LookupResponseTime time.Duration
+	// MaxMessageSize is the largest packet read from a client in bytes, DefaultMaxMessageSize is used when it is 0
+	MaxMessageSize uint32
+	// Logger gets every log line of the server, slog.Default() is used when it is nil
+	Logger *slog.Logger
+	// ShutdownTimeout is how long clients get to drain when Start's context is cancelled
+	ShutdownTimeout time.Duration
+	// RateLimiter, if set, is asked before every packet is handled
+	RateLimiter Limiter
+	// AuditLog, if set, records the security events of every client. The server does not close its sink.
+	AuditLog *AuditLog
+	// Tracer, if set, exports a span for every packet. The server passes the trace context on either way.
+	Tracer *Tracer
+	// ConnectionLimits are checked for every accepted connection, the zero value serves every connection
+	ConnectionLimits ConnectionLimits
+	// ClientCertUsers, if set, are the usernames each client certificate may log in as. TLSConfig has to require
+	// and verify client certificates, a client without one can't log in.
+	ClientCertUsers *ClientCertUsers
+	// TrustedProxies are the load balancers that send a PROXY protocol header (version 1 or 2) with the client's
+	// address. Connections from them must start with one, the other connections are served as they are.
+	TrustedProxies AddressRanges
+	// AnnouncementKey signs the announcements. When it is nil, every client gets them signed with the key of the
+	// certificate TLSConfig showed it in the handshake, which it verifies them against. Clients that connected
+	// before the certificate was reloaded keep getting them signed with the old key.
+	AnnouncementKey crypto.Signer
+	// Middleware wraps every packet after the built-in logging, metrics, panic recovery,
+	// authentication and rate limiting, the first one is the outermost
+	Middleware []Middleware
+}
+
+type Server struct {
+	options       Options
+	logger        *slog.Logger
+	store         db.Store
+	keyring       *blinding.Keyring
+	keyPolicy     keypolicy.KeyPolicy
+	decoys        *decoy.Generator
+	clients       map[net.Conn]*session
+	clientsMutex  sync.Mutex
+	clientsWG     sync.WaitGroup // Running client goroutines, waited for on shutdown
+	handlers      map[net.Conn]map[string]actions.MessageHandler
+	handlersMutex sync.Mutex
+	registry      *actions.Registry
+	middleware    []actions.Middleware
+	metrics       *actions.PacketMetrics
+	//
+	loggedInUsers *actions.LoggedInUsers
+	chatPeers     *actions.ChatPeers
+	//
+	connectionLimiter *netlimit.Limiter
+	shedLog           shedLog
+	//
+	announcementsMutex sync.Mutex // Held while announcements are sent, so each one is sent once
+	//
+	lifecycleMutex sync.Mutex
+	started        bool
+	listener       net.Listener
+	shuttingDown   atomic.Bool
+	stopping       chan struct{} // Closed when the shutdown starts
+	stopped        chan struct{} // Closed when Start returns
+	drainDeadline  time.Time
+	connectionIDs  atomic.Uint64 // Numbers the client connections in the logs
+}
+
+func New(options Options) (*Server, error) {
+	if options.Store == nil {
+		return nil, fmt.Errorf("a store is required")
+	}
+	if options.Listener == nil && options.TLSConfig == nil {
+		return nil, fmt.Errorf("a TLS config is required when no listener is given")
+	}
+	if options.Logger == nil {
+		options.Logger = slog.Default()
+	}
+	if options.Keyring == nil {
+		options.Keyring = blinding.LegacyKeyring()
+	}
+	options.Keyring = options.Keyring.WithLegacySecrets(options.HashPassword, options.HashSalt)
+	keyPolicy := keypolicy.DefaultKeyPolicy()
+	if options.KeyPolicy != nil {
+		keyPolicy = *options.KeyPolicy
+	}
+	if options.ShutdownTimeout == 0 {
+		options.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if options.LookupResponseTime == 0 {
+		options.LookupResponseTime = DefaultLookupResponseTime
+	}
+	if options.MaxMessageSize == 0 {
+		options.MaxMessageSize = DefaultMaxMessageSize
+	}
+	decoys, err := decoy.New(options.DecoySecret, options.LookupResponseTime)
+	if err != nil {
+		return nil, err
+	}
+	registry := actions.NewRegistry()
+	if err := actions.RegisterBuiltinHandlers(registry); err != nil {
+		return nil, err
+	}
+	metrics := actions.NewPacketMetrics()
+	middleware := []actions.Middleware{
+		actions.Logging(),
+		actions.Metrics(metrics),
+		actions.Recovery(),
+	}
+	// Packets from clients that aren't logged in are turned away before they can use up anyone's rate limit
+	middleware = append(middleware, actions.Authentication())
+	if options.RateLimiter != nil {
+		middleware = append(middleware, actions.RateLimit(options.RateLimiter))
+	}
+	middleware = append(middleware, options.Middleware...)
+	// Innermost, so the span only covers the handler and the handler sends in its trace
+	middleware = append(middleware, actions.Tracing(options.Tracer))
+
+	return &Server{
+		options:           options,
+		logger:            options.Logger,
+		store:             db.Instrument(options.Store),
+		keyring:           options.Keyring,
+		keyPolicy:         keyPolicy,
+		decoys:            decoys,
+		clients:           make(map[net.Conn]*session),
+		handlers:          make(map[net.Conn]map[string]actions.MessageHandler),
+		registry:          registry,
+		middleware:        middleware,
+		metrics:           metrics,
+		loggedInUsers:     actions.NewLoggedInUsers(),
+		chatPeers:         actions.NewChatPeers(),
+		connectionLimiter: netlimit.New(options.ConnectionLimits),
+		stopping:          make(chan struct{}),
+		stopped:           make(chan struct{}),
+	}, nil
+}
+
+// Handle registers the handler of a packet that can only be sent by a logged-in user. packet is a value of the
+// oneof wrapper type, like (*pb.Message_ChatMessage)(nil), and every packet type can only be registered once.
+// Handlers have to be registered before the server is started.
+func (s *Server) Handle(packet any, factory HandlerFactory) error {
+	return s.registry.Register(packet, factory)
+}
+
+// HandlePublic registers the handler of a packet that can be sent before the user logged in
+func (s *Server) HandlePublic(packet any, factory HandlerFactory) error {
+	return s.registry.RegisterPublic(packet, factory)
+}
+
+// Metrics returns the request totals of every packet type handled so far
+func (s *Server) Metrics() map[string]PacketStats {
+	return s.metrics.Snapshot()
+}
+
+// RateLimitStats returns the rejection totals of every scope of the built-in RateLimiter,
+// or nil when the server uses no limiter or a different one
+func (s *Server) RateLimitStats() map[string]RateLimitStats {
+	if limiter, ok := s.options.RateLimiter.(*RateLimiter); ok {
+		return limiter.Stats()
+	}
+	return nil
+}
+
+// RejectedConnections returns how many connections were refused by the ConnectionLimits, by reason
+func (s *Server) RejectedConnections() map[string]uint64 {
+	return s.connectionLimiter.Rejected()
+}
+
+// collectMetrics adds the server's gauges to the metrics while it runs, the returned function removes them again
+func (s *Server) collectMetrics() (remove func()) {
+	removers := []func(){
+		metrics.Default.Collect("chat_connected_clients", "Open client connections.", true, nil, func() []metrics.Sample {
+			s.clientsMutex.Lock()
+			defer s.clientsMutex.Unlock()
+			return []metrics.Sample{{Value: float64(len(s.clients))}}
+		}),
+		metrics.Default.Collect("chat_authenticated_users", "Users logged in on an open connection.", true, nil, func() []metrics.Sample {
+			return []metrics.Sample{{Value: float64(s.loggedInUsers.Len())}}
+		}),
+	}
+	if limiter, ok := s.options.RateLimiter.(*RateLimiter); ok {
+		scopeSamples := func(value func(stats RateLimitStats) float64) func() []metrics.Sample {
+			return func() []metrics.Sample {
+				var samples []metrics.Sample
+				for scope, stats := range limiter.Stats() {
+					samples = append(samples, metrics.Sample{LabelValues: []string{scope}, Value: value(stats)})
+				}
+				return samples
+			}
+		}
+		removers = append(removers,
+			metrics.Default.Collect("chat_rate_limit_rejections_total", "Requests rejected by the rate limiter, by scope.", false, []string{"scope"},
+				scopeSamples(func(stats RateLimitStats) float64 { return float64(stats.Rejected) })),
+			metrics.Default.Collect("chat_rate_limit_lockouts_total", "Clients locked out by the rate limiter, by scope.", false, []string{"scope"},
+				scopeSamples(func(stats RateLimitStats) float64 { return float64(stats.Lockouts) })),
+			metrics.Default.Collect("chat_rate_limit_locked_out", "Clients currently locked out by the rate limiter, by scope.", true, []string{"scope"},
+				scopeSamples(func(stats RateLimitStats) float64 { return float64(stats.LockedOut) })),
+		)
+	}
+	return func() {
+		for _, remove := range removers {
+			remove()
+		}
+	}
+}
+
+func (s *Server) getOrCreateHandler(conn net.Conn, logger *slog.Logger, registration actions.Registration) actions.MessageHandler {
+	s.handlersMutex.Lock()
+	defer s.handlersMutex.Unlock()
+
+	if _, exists := s.handlers[conn]; !exists {
+		s.handlers[conn] = make(map[string]actions.MessageHandler)
+	}
+
+	if handler, exists := s.handlers[conn][registration.Packet]; exists {
+		return handler
+	}
+
+	newHandler := registration.Factory(&actions.Connection{
+		Conn:            conn,
+		Store:           s.store,
+		Keyring:         s.keyring,
+		KeyPolicy:       s.keyPolicy,
+		Decoys:          s.decoys,
+		LoggedInUsers:   s.loggedInUsers,
+		ChatPeers:       s.chatPeers,
+		Logger:          logger,
+		AuditLog:        s.options.AuditLog,
+		ClientCertUsers: s.options.ClientCertUsers,
+	})
+	s.handlers[conn][registration.Packet] = newHandler
+	return newHandler
+}
+
+// loggedInUsername returns the user logged in on the connection, or an empty string
+func (s *Server) loggedInUsername(conn net.Conn) string {
+	return s.loggedInUsers.Username(conn)
+}
+
+// Start serves clients until ctx is cancelled or Shutdown is called.
+// It returns ErrServerClosed once every client connection has been closed.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	defer close(s.stopped)
+	defer s.collectMetrics()()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.stop(time.Now().Add(s.options.ShutdownTimeout))
+		case <-s.stopping:
+		}
+	}()
+
+	if s.announcementKey() != nil {
+		scheduled := make(chan struct{})
+		go func() {
+			defer close(scheduled)
+			s.scheduleAnnouncements()
+		}()
+		defer func() { <-scheduled }()
+	}
+
+	s.logger.Info("Chat server listening", "address", listener.Addr().String())
+	s.handleConnections(listener)
+
+	s.logger.Info("Shutting down, draining client connections")
+	s.drain()
+	return ErrServerClosed
+}
+
+func (s *Server) listen() (net.Listener, error) {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	if s.started {
+		return nil, fmt.Errorf("chat server already started")
+	}
+	if s.shuttingDown.Load() {
+		return nil, ErrServerClosed
+	}
+
+	listener := s.options.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.options.Address)
+		if err != nil {
+			return nil, fmt.Errorf("error starting TLS server: %v", err)
+		}
+	}
+	s.started = true
+	s.listener = listener
+	return listener, nil
+}
+
+// Addr is the address the server listens on, or nil before it was started
+func (s *Server) Addr() net.Addr {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown stops accepting connections and tells the connected clients the server is going away.
+// The clients get until ctx's deadline (or the shutdown timeout) to drain, and Shutdown waits for Start to return.
+func (s *Server) Shutdown(ctx context.Context) error {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(s.options.ShutdownTimeout)
+	}
+	s.stop(deadline)
+
+	s.lifecycleMutex.Lock()
+	started := s.started
+	s.lifecycleMutex.Unlock()
+	if !started {
+		return nil
+	}
+	select {
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop starts the shutdown, only the first call has an effect
+func (s *Server) stop(deadline time.Time) {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	if s.shuttingDown.Load() {
+		return
+	}
+	s.drainDeadline = deadline
+	s.shuttingDown.Store(true)
+	close(s.stopping)
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			s.logger.Error("Error closing listener", "error", err)
+		}
+	}
+}
+
+// drain tells every connected client that the server is going away and stops reading new messages.
+// The messages being handled get until the drain deadline to finish, then the remaining connections are closed.
+func (s *Server) drain() {
+	s.lifecycleMutex.Lock()
+	deadline := s.drainDeadline
+	s.lifecycleMutex.Unlock()
+
+	reason := "The server is shutting down"
+	notice := &pb.Message{
+		Source: pb.Message_SERVER,
+		Packet: &pb.Message_ServerNoticeMessage{
+			ServerNoticeMessage: &pb.ServerNoticePacket{
+				Type:   pb.ServerNoticePacket_GOING_AWAY,
+				Reason: &reason,
+			},
+		},
+	}
+
+	// Every client gets the notice at once, a client that stops reading only holds up its own
+	var notified sync.WaitGroup
+	for _, conn := range s.connections() {
+		notified.Add(1)
+		go func() {
+			defer notified.Done()
+			// Writes to a client that stops reading are abandoned at the deadline
+			if err := s.sendWithin(conn, notice, deadline); err != nil {
+				s.logger.Warn("Error sending going away notice", "error", err)
+			}
+			// Unblocks the client goroutine once it has finished handling its current message
+			_ = conn.SetReadDeadline(time.Now())
+		}()
+	}
+	notified.Wait()
+
+	drained := make(chan struct{})
+	go func() {
+		s.clientsWG.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Until(deadline)):
+		s.logger.Warn("Shutdown timeout reached, closing the remaining connections")
+		for _, conn := range s.connections() {
+			conn.Close()
+		}
+		<-drained
+	}
+}
+
+func (s *Server) removeHandlers(conn net.Conn) {
+	s.handlersMutex.Lock()
+	delete(s.handlers, conn)
+	s.handlersMutex.Unlock()
+	for _, username := range s.loggedInUsers.DeleteConn(conn) {
+		s.chatPeers.Remove(username)
+	}
+	// A new connection could get the same address and with it the bucket of this one
+	if limiter, ok := s.options.RateLimiter.(*RateLimiter); ok {
+		limiter.Forget(conn)
+	}
+}
+
+// sendWithin sends a message the server writes on its own, like a broadcast or a notice, and gives up at the deadline.
+// These writes take turns on a connection and each one puts back the deadline the connection had before, so
+// a broadcast can't cancel the deadline of a kick or of the shutdown.
+func (s *Server) sendWithin(conn net.Conn, message *pb.Message, deadline time.Time) error {
+	s.clientsMutex.Lock()
+	client := s.clients[conn]
+	s.clientsMutex.Unlock()
+	if client != nil {
+		client.writeMutex.Lock()
+		defer client.writeMutex.Unlock()
+	}
+
+	previous := s.writeDeadline()
+	if !previous.IsZero() && previous.Before(deadline) {
+		deadline = previous
+	}
+	_ = conn.SetWriteDeadline(deadline)
+	err := util.SendMessage(conn, message)
+	_ = conn.SetWriteDeadline(previous)
+	return err
+}
+
+// writeDeadline is the deadline every write to a client has, the drain deadline once the shutdown has started
+func (s *Server) writeDeadline() time.Time {
+	s.lifecycleMutex.Lock()
+	defer s.lifecycleMutex.Unlock()
+	if !s.shuttingDown.Load() {
+		return time.Time{}
+	}
+	return s.drainDeadline
+}
+
+// connections returns the open client connections, so they can be written to without holding the clients mutex
+func (s *Server) connections() []net.Conn {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	conns := make([]net.Conn, 0, len(s.clients))
+	for conn := range s.clients {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func (s *Server) removeClient(conn net.Conn) {
+	s.clientsMutex.Lock()
+	defer s.clientsMutex.Unlock()
+	delete(s.clients, conn)
+}
+
+func (s *Server) handleClient(conn net.Conn, connectionID uint64) {
+	defer conn.Close()
+	defer s.removeClient(conn)
+	defer s.removeHandlers(conn)
+
+	logger := s.logger.With("conn", connectionID)
+	logger.Debug("Client connected", "remote", conn.RemoteAddr().String())
+
+	for {
+		message, err := util.ReadLimitedMessage(conn, s.options.MaxMessageSize)
+		if err != nil {
+			if !s.shuttingDown.Load() {
+				logger.Info("Client disconnected", "error", err)
+			}
+			return
+		}
+
+		span := s.options.Tracer.Start(message.GetTraceparent(), "dispatch "+util.PacketName(message), tracing.KindServer)
+		span.SetAttribute("chat.conn", connectionID)
+		registration, exists := s.registry.Lookup(message)
+		if !exists {
+			logger.Warn("Unknown message type", "packet", util.PacketName(message))
+			span.RecordError(fmt.Errorf("unknown message type"))
+			span.End()
+			continue
+		}
+		if traceparent := span.Traceparent(); traceparent != "" {
+			message.Traceparent = &traceparent
+		}
+
+		request := &actions.Request{
+			Conn:     conn,
+			Message:  message,
+			Packet:   registration.Packet,
+			Public:   registration.Public,
+			Username: s.loggedInUsername(conn),
+			Logger:   logger,
+		}
+		messageContext := actions.NewMessageContext(s.getOrCreateHandler(conn, logger, registration), s.middleware...)
+		// Errors are logged by the logging middleware
+		span.RecordError(messageContext.ExecuteStrategy(request))
+		span.End()
+		if request.Username == "" {
+			if username := s.loggedInUsername(conn); username != "" {
+				s.clientsMutex.Lock()
+				if client, open := s.clients[conn]; open {
+					client.username = username
+				}
+				s.clientsMutex.Unlock()
+				s.deliverKeyRevocations(conn, username, logger)
+				s.deliverAnnouncements(conn, username, logger)
+			}
+		}
+	}
+}
+
+// deliverKeyRevocations tells a user who just logged in about the contacts that recovered their account with a new key
+// while the user was offline
+func (s *Server) deliverKeyRevocations(conn net.Conn, username string, logger *slog.Logger) {
+	blindedUsername, online := s.loggedInUsers.BlindedUsername(username)
+	if !online {
+		return
+	}
+	pending, err := s.store.PendingKeyRevocations(blindedUsername)
+	if err != nil {
+		logger.Error("Error reading key revoked notices", "error", err)
+		return
+	}
+	for _, revocation := range pending {
+		if err = util.SendMessage(conn, actions.KeyRevokedNotice(revocation.Username)); err != nil {
+			logger.Warn("Error sending key revoked notice", "error", err)
+			return
+		}
+		if err = s.store.DeleteKeyRevocation(blindedUsername, revocation.Username); err != nil {
+			logger.Error("Error deleting delivered key revoked notice", "error", err)
+		}
+	}
+}
+
+// broadcast sends every connected client except sender its message and returns the ones that got it.
+// A client that can't be written to is closed, its goroutine removes it.
+func (s *Server) broadcast(message func(client net.Conn) (*pb.Message, error), sender net.Conn) []net.Conn {
+	var sent []net.Conn
+	for _, client := range s.connections() {
+		if client == sender {
+			continue
+		}
+		clientMessage, err := message(client)
+		if err != nil {
+			s.logger.Warn("Error preparing broadcast to client", "error", err)
+			continue
+		}
+		// A client that stops reading must not hold up everyone else
+		if err = s.sendWithin(client, clientMessage, time.Now().Add(broadcastWriteTimeout)); err != nil {
+			s.logger.Warn("Error broadcasting to client", "error", err)
+			client.Close()
+			continue
+		}
+		sent = append(sent, client)
+	}
+	return sent
+}
@@ -0,0 +1,1253 @@
+package chatserver
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"server/internal/adminapi"
+	"server/internal/announcement"
+	"server/internal/blinding"
+	"server/internal/util"
+	pb "server/resources/proto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T) (*Server, string, <-chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		Store:    NewMemoryStore(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- server.Start(context.Background())
+	}()
+	return server, listener.Addr().String(), result
+}
+
+func sendMessage(t *testing.T, conn net.Conn, message *pb.Message) {
+	if err := util.SendMessage(conn, message); err != nil {
+		t.Fatalf("Error sending message: %v", err)
+	}
+}
+
+func readMessage(t *testing.T, conn net.Conn) *pb.Message {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := util.ReadMessage(conn)
+	if err != nil {
+		t.Fatalf("Error reading reply: %v", err)
+	}
+	return reply
+}
+
+func loginRequest(username string) *pb.Message {
+	return &pb.Message{
+		Source:       pb.Message_CLIENT,
+		FromUsername: &username,
+		Packet: &pb.Message_LoginMessage{
+			LoginMessage: &pb.LoginPacket{Status: pb.LoginPacket_REQUEST_TO_LOGIN},
+		},
+	}
+}
+
+// answerChallenge asks to log in with the user's private key and returns the server's answer to the decrypted token.
+// Whether the account may log in is only told once the token proved the key is owned.
+func answerChallenge(t *testing.T, conn net.Conn, username string, key *rsa.PrivateKey) *pb.LoginPacket {
+	sendMessage(t, conn, loginRequest(username))
+	challenge := readMessage(t, conn).GetLoginMessage()
+	if challenge.GetStatus() != pb.LoginPacket_ENCRYPTED_TOKEN {
+		t.Fatalf("Expected a login challenge like for any other user, got %v", challenge)
+	}
+	token, err := rsa.DecryptOAEP(sha256.New(), nil, key, challenge.GetToken(), nil)
+	if err != nil {
+		t.Fatalf("Error decrypting login token: %v", err)
+	}
+	sendMessage(t, conn, &pb.Message{
+		Source: pb.Message_CLIENT,
+		Packet: &pb.Message_LoginMessage{LoginMessage: &pb.LoginPacket{Status: pb.LoginPacket_DECRYPTED_TOKEN, Token: token}},
+	})
+	return readMessage(t, conn).GetLoginMessage()
+}
+
+// logIn logs in as a registered user with its private key
+func logIn(t *testing.T, address string, username string, key *rsa.PrivateKey) net.Conn {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	if reply := answerChallenge(t, conn, username, key); reply.GetStatus() != pb.LoginPacket_LOGIN_SUCCESS {
+		t.Fatalf("Expected to log in, got %v", reply)
+	}
+	return conn
+}
+
+// requestLogin asks to log in as an unknown user, which the server answers with a decoy challenge
+func requestLogin(t *testing.T, conn net.Conn) *pb.Message {
+	sendMessage(t, conn, loginRequest("nobody"))
+	return readMessage(t, conn)
+}
+
+func TestIndependentServers(t *testing.T) {
+	first, firstAddress, firstResult := startTestServer(t)
+	second, secondAddress, secondResult := startTestServer(t)
+
+	firstConn, err := net.Dial("tcp", firstAddress)
+	if err != nil {
+		t.Fatalf("Error connecting to first server: %v", err)
+	}
+	defer firstConn.Close()
+	secondConn, err := net.Dial("tcp", secondAddress)
+	if err != nil {
+		t.Fatalf("Error connecting to second server: %v", err)
+	}
+	defer secondConn.Close()
+
+	for _, conn := range []net.Conn{firstConn, secondConn} {
+		if reply := requestLogin(t, conn); reply.GetLoginMessage().GetStatus() != pb.LoginPacket_ENCRYPTED_TOKEN {
+			t.Fatalf("Expected a login challenge, got %v", reply)
+		}
+	}
+
+	// Shutting down the first server notifies its clients and leaves the second one running
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = first.Shutdown(ctx); err != nil {
+		t.Fatalf("Error shutting down first server: %v", err)
+	}
+	if err = <-firstResult; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Expected Start to return ErrServerClosed, got %v", err)
+	}
+	notice, err := util.ReadMessage(firstConn)
+	if err != nil {
+		t.Fatalf("Error reading going away notice: %v", err)
+	}
+	if notice.GetServerNoticeMessage().GetType() != pb.ServerNoticePacket_GOING_AWAY {
+		t.Errorf("Expected a going away notice, got %v", notice)
+	}
+	if _, err = util.ReadMessage(firstConn); err == nil {
+		t.Error("Expected the first server to close the connection")
+	}
+
+	if reply := requestLogin(t, secondConn); reply.GetLoginMessage().GetStatus() != pb.LoginPacket_ENCRYPTED_TOKEN {
+		t.Errorf("Expected the second server to keep serving, got %v", reply)
+	}
+	if err = second.Shutdown(ctx); err != nil {
+		t.Fatalf("Error shutting down second server: %v", err)
+	}
+	<-secondResult
+}
+
+func TestServersKeepTheirOwnKeyPolicy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(policy *KeyPolicy) *pb.RegisterPacket {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		server, err := New(Options{Listener: listener, Store: NewMemoryStore(), KeyPolicy: policy, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+		if err != nil {
+			t.Fatalf("Error creating server: %v", err)
+		}
+		go server.Start(context.Background())
+		defer server.Shutdown(context.Background())
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		username := "alice"
+		sendMessage(t, conn, &pb.Message{
+			Source:       pb.Message_CLIENT,
+			FromUsername: &username,
+			Packet: &pb.Message_RegisterMessage{RegisterMessage: &pb.RegisterPacket{
+				Status:    pb.RegisterPacket_REQUEST_TO_REGISTER,
+				PublicKey: key.N.Bytes(),
+			}},
+		})
+		return readMessage(t, conn).GetRegisterMessage()
+	}
+
+	strict := DefaultKeyPolicy()
+	strict.MinRSABits = 4096
+	if reply := register(&strict); reply.GetStatus() != pb.RegisterPacket_REGISTER_FAILED || reply.GetKeyPolicy().GetMinRsaBits() != 4096 {
+		t.Errorf("Expected a 2048 bit key to be refused by the strict server, got %v", reply)
+	}
+	if reply := register(nil); reply.GetStatus() != pb.RegisterPacket_REGISTER_SUCCESS {
+		t.Errorf("Expected the default policy to accept a 2048 bit key, got %v", reply)
+	}
+}
+
+func TestServersKeepTheirOwnSettings(t *testing.T) {
+	start := func(options Options) (*Server, string) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		options.Listener = listener
+		options.Store = NewMemoryStore()
+		options.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		server, err := New(options)
+		if err != nil {
+			t.Fatalf("Error creating server: %v", err)
+		}
+		go server.Start(context.Background())
+		t.Cleanup(func() { server.Shutdown(context.Background()) })
+		return server, listener.Addr().String()
+	}
+	small, smallAddress := start(Options{MaxMessageSize: 16, HashPassword: "first", HashSalt: "salt"})
+	large, largeAddress := start(Options{HashPassword: "second", HashSalt: "salt"})
+
+	if small.BlindUsername("alice") == large.BlindUsername("alice") {
+		t.Error("Expected each server to blind usernames with its own hash password")
+	}
+
+	smallConn, err := net.Dial("tcp", smallAddress)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer smallConn.Close()
+	sendMessage(t, smallConn, loginRequest("a-username-longer-than-the-limit"))
+	_ = smallConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if message, err := util.ReadMessage(smallConn); err == nil {
+		t.Errorf("Expected the server with the small limit to drop the client, got %v", message)
+	}
+
+	largeConn, err := net.Dial("tcp", largeAddress)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer largeConn.Close()
+	sendMessage(t, largeConn, loginRequest("a-username-longer-than-the-limit"))
+	if reply := readMessage(t, largeConn).GetLoginMessage(); reply.GetStatus() != pb.LoginPacket_ENCRYPTED_TOKEN {
+		t.Errorf("Expected the server with the default limit to answer, got %v", reply)
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	server, err := New(Options{Address: "127.0.0.1:0", Store: NewMemoryStore()})
+	if err == nil {
+		t.Fatalf("Expected a server without TLS config or listener to be rejected, got %v", server)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	server, err = New(Options{Listener: listener, Store: NewMemoryStore()})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	if err = server.Shutdown(context.Background()); err != nil {
+		t.Errorf("Error shutting down a server that was never started: %v", err)
+	}
+	if err = server.Start(context.Background()); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Expected starting a shut down server to fail with ErrServerClosed, got %v", err)
+	}
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	seen := make(chan string, 10)
+	server, err := New(Options{
+		Listener: listener,
+		Store:    NewMemoryStore(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Middleware: []Middleware{func(next HandleFunc) HandleFunc {
+			return func(request *Request) error {
+				seen <- request.Packet
+				return next(request)
+			}
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	if err = server.Handle((*pb.Message_ChatMessage)(nil), nil); err == nil {
+		t.Error("Expected registering a packet type twice to fail")
+	}
+	if err = server.Handle("chat", nil); err == nil {
+		t.Error("Expected registering something that is not a packet type to fail")
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	// The user list needs a logged in user, so the authentication stops it before the custom middleware
+	username := "nobody"
+	sendMessage(t, conn, &pb.Message{
+		Source:       pb.Message_CLIENT,
+		FromUsername: &username,
+		Packet: &pb.Message_UserListMessage{
+			UserListMessage: &pb.UserListPacket{Status: pb.UserListPacket_REQUEST_USER_LIST},
+		},
+	})
+	// The client gets the failure reply of its packet rather than waiting for one
+	if reply := readMessage(t, conn).GetUserListMessage(); reply.GetStatus() != pb.UserListPacket_ERROR {
+		t.Fatalf("Expected a failed user list reply, got %v", reply)
+	}
+	if reply := requestLogin(t, conn); reply.GetLoginMessage() == nil {
+		t.Fatalf("Expected a login reply, got %v", reply)
+	}
+
+	if packet := <-seen; packet != "loginMessage" {
+		t.Errorf("Expected the custom middleware to only see the login, got %s", packet)
+	}
+	// Packets are handled in order, so the user list was counted before the login was answered
+	if stats := server.Metrics()["userListMessage"]; stats.Requests != 1 || stats.Rejected != 1 {
+		t.Errorf("Expected one rejected user list request, got %+v", stats)
+	}
+}
+
+func TestRateLimitRejection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		Store:    NewMemoryStore(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		RateLimiter: NewRateLimiter(RateLimitConfig{
+			PerUsername: RateLimit{Requests: 2, Per: time.Minute},
+			Lockout:     time.Minute,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if reply := requestLogin(t, conn); reply.GetLoginMessage().GetRetryAfterSeconds() != 0 {
+			t.Fatalf("Expected attempt %d not to be rate limited, got %v", i+1, reply)
+		}
+	}
+	reply := requestLogin(t, conn).GetLoginMessage()
+	if reply.GetStatus() != pb.LoginPacket_LOGIN_FAILED || reply.GetRetryAfterSeconds() != 60 || reply.GetReason() == "" {
+		t.Errorf("Expected a failed login with a one minute lockout, got %v", reply)
+	}
+	if stats := server.Metrics()["loginMessage"]; stats.Rejected != 1 {
+		t.Errorf("Expected one rejected login, got %+v", stats)
+	}
+	if stats := server.RateLimitStats()["username"]; stats.Lockouts != 1 || stats.LockedOut != 1 {
+		t.Errorf("Expected one locked out username, got %+v", stats)
+	}
+}
+
+func TestUnauthenticatedRequestsUseNoRateLimit(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		Store:    NewMemoryStore(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		RateLimiter: NewRateLimiter(RateLimitConfig{
+			PerIP:      RateLimit{Requests: 1, Per: time.Minute},
+			KeyLookups: RateLimit{Requests: 1, Per: time.Minute},
+			Lockout:    time.Minute,
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	username, target := "mallory", "alice"
+	for i := 0; i < 3; i++ {
+		sendMessage(t, conn, &pb.Message{
+			Source:       pb.Message_CLIENT,
+			FromUsername: &username,
+			Packet: &pb.Message_ExchangeKeyMessage{ExchangeKeyMessage: &pb.ExchangeKeyPacket{
+				Status:     pb.ExchangeKeyPacket_REQUEST_FOR_USER_PUBLIC_KEY,
+				ToUsername: &target,
+			}},
+		})
+		if reply := readMessage(t, conn).GetExchangeKeyMessage(); reply.GetRetryAfterSeconds() != 0 {
+			t.Fatalf("Expected lookup %d to be rejected for the missing login, not rate limited, got %v", i+1, reply)
+		}
+	}
+	if stats := server.Metrics()["exchangeKeyMessage"]; stats.Rejected != 3 {
+		t.Errorf("Expected three rejected lookups, got %+v", stats)
+	}
+	for scope, stats := range server.RateLimitStats() {
+		if stats.Rejected != 0 {
+			t.Errorf("Expected no rejections in the %s scope, got %+v", scope, stats)
+		}
+	}
+	// The single request of the address is still left for a login
+	if reply := requestLogin(t, conn).GetLoginMessage(); reply.GetRetryAfterSeconds() != 0 {
+		t.Errorf("Expected the login not to be rate limited, got %v", reply)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	sink, err := OpenAuditFile(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatalf("Error opening audit log: %v", err)
+	}
+	defer sink.Close()
+	auditLog, err := NewAuditLog(sink)
+	if err != nil {
+		t.Fatalf("Error starting audit log: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		Store:    NewMemoryStore(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AuditLog: auditLog,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	requestLogin(t, conn)
+
+	records, err := sink.Records()
+	if err != nil || len(records) != 1 {
+		t.Fatalf("Expected one audit record, got %d (%v)", len(records), err)
+	}
+	if record := records[0]; record.Type != "login" || record.Outcome != "unknown_user" || record.User == "" || record.User == "nobody" {
+		t.Errorf("Expected a login of an unknown, blinded user, got %+v", record)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	tracePath := filepath.Join(t.TempDir(), "traces.jsonl")
+	tracer, err := OpenTracer(tracePath)
+	if err != nil {
+		t.Fatalf("Error opening trace export: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		Store:    NewMemoryStore(),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Tracer:   tracer,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	const traceID, clientSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	request := loginRequest("nobody")
+	traceparent := "00-" + traceID + "-" + clientSpanID + "-01"
+	request.Traceparent = &traceparent
+	sendMessage(t, conn, request)
+	readMessage(t, conn)
+	conn.Close()
+	// Every span has ended once the connections are drained
+	server.Shutdown(context.Background())
+	tracer.Close()
+
+	file, err := os.Open(tracePath)
+	if err != nil {
+		t.Fatalf("Error opening trace export: %v", err)
+	}
+	defer file.Close()
+	spans := make(map[string]map[string]any)
+	for scanner := bufio.NewScanner(file); scanner.Scan(); {
+		var line struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]any `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err = json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("Expected OTLP/JSON lines, got %v", err)
+		}
+		span := line.ResourceSpans[0].ScopeSpans[0].Spans[0]
+		spans[span["name"].(string)] = span
+	}
+	dispatch, handle := spans["dispatch loginMessage"], spans["handle loginMessage"]
+	if dispatch == nil || handle == nil {
+		t.Fatalf("Expected a dispatch and a handle span, got %v", spans)
+	}
+	if dispatch["traceId"] != traceID || dispatch["parentSpanId"] != clientSpanID {
+		t.Errorf("Expected the dispatch span to continue the client's trace, got %v", dispatch)
+	}
+	if handle["traceId"] != traceID || handle["parentSpanId"] != dispatch["spanId"] {
+		t.Errorf("Expected the handle span to be a child of the dispatch span, got %v", handle)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	store, err := OpenSQLiteStore(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	server, err := New(Options{Listener: listener, Store: store, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	handler := server.HealthHandler()
+	check := func(path string) (int, healthResponse) {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		var response healthResponse
+		if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Expected a JSON answer from %s, got %q", path, recorder.Body.String())
+		}
+		return recorder.Code, response
+	}
+
+	if code, response := check("/readyz"); code != http.StatusServiceUnavailable || response.Error != "not started" {
+		t.Errorf("Expected a server that was not started to be unready, got %d %+v", code, response)
+	}
+	go server.Start(context.Background())
+	for server.Addr() == nil {
+		time.Sleep(time.Millisecond)
+	}
+	if code, response := check("/readyz"); code != http.StatusOK || response.Build.GoVersion == "" {
+		t.Errorf("Expected a started server to be ready with its build info, got %d %+v", code, response)
+	}
+
+	store.Close()
+	if code, response := check("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a server without its database to be unready, got %d %+v", code, response)
+	}
+	server.Shutdown(context.Background())
+	if code, response := check("/readyz"); code != http.StatusServiceUnavailable || response.Error != "shutting down" {
+		t.Errorf("Expected a server that shut down to be unready, got %d %+v", code, response)
+	}
+	if code, _ := check("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected the liveness check to succeed, got %d", code)
+	}
+}
+
+// deadlineConn remembers the last write deadline set on it
+type deadlineConn struct {
+	net.Conn
+	writeDeadline time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(deadline time.Time) error {
+	c.writeDeadline = deadline
+	return c.Conn.SetWriteDeadline(deadline)
+}
+
+func TestBroadcastKeepsDrainDeadline(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	server, err := New(Options{Listener: listener, Store: NewMemoryStore(), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	go io.Copy(io.Discard, clientSide)
+	conn := &deadlineConn{Conn: serverSide}
+	server.clients[conn] = &session{id: 1}
+	message := func(net.Conn) (*pb.Message, error) { return &pb.Message{Source: pb.Message_SERVER}, nil }
+
+	if sent := server.broadcast(message, nil); len(sent) != 1 {
+		t.Fatalf("Expected the broadcast to reach the client, got %d", len(sent))
+	}
+	if !conn.writeDeadline.IsZero() {
+		t.Errorf("Expected no write deadline after a broadcast, got %v", conn.writeDeadline)
+	}
+
+	drainDeadline := time.Now().Add(time.Hour)
+	server.stop(drainDeadline)
+	if sent := server.broadcast(message, nil); len(sent) != 1 {
+		t.Fatalf("Expected the broadcast to reach the client, got %d", len(sent))
+	}
+	if !conn.writeDeadline.Equal(drainDeadline) {
+		t.Errorf("Expected the broadcast to put back the drain deadline %v, got %v", drainDeadline, conn.writeDeadline)
+	}
+	server.kick(conn, "Bye")
+	if !conn.writeDeadline.Equal(drainDeadline) {
+		t.Errorf("Expected the kick to put back the drain deadline %v, got %v", drainDeadline, conn.writeDeadline)
+	}
+}
+
+func TestLoginHonoursAccountFlags(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	scheme := blinding.LegacyKeyring().Current()
+	blindedUsername := scheme.Blind("alice")
+	if err = store.CreateNewUser(blindedUsername, scheme.Version, "RSA", key.N.Bytes(), nil); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{Listener: listener, Store: store, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+	login := func() *pb.LoginPacket {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		return answerChallenge(t, conn, "alice", key)
+	}
+
+	if reply := login(); reply.GetStatus() != pb.LoginPacket_LOGIN_SUCCESS {
+		t.Fatalf("Expected an active account to log in, got %v", reply)
+	}
+	store.SetUserDisabled(blindedUsername, true)
+	if reply := login(); reply.GetStatus() != pb.LoginPacket_LOGIN_FAILED || reply.GetReason() == "" {
+		t.Errorf("Expected a disabled account to be refused with a reason, got %v", reply)
+	}
+	store.SetUserDisabled(blindedUsername, false)
+	store.RequireKeyReset(blindedUsername)
+	if reply := login(); reply.GetStatus() != pb.LoginPacket_KEY_EXPIRED || reply.GetReason() == "" {
+		t.Errorf("Expected the key of an account that must reset it to be refused, got %v", reply)
+	}
+}
+
+func TestKickAndAnnounce(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener:        listener,
+		Store:           NewMemoryStore(),
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		AnnouncementKey: privateKey,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	requestLogin(t, conn) // The session is registered once the server answers
+
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Remote != conn.LocalAddr().String() {
+		t.Fatalf("Expected the connection to be listed, got %+v", sessions)
+	}
+	sent, delivered, err := server.Announce(Announcement{Message: "Maintenance at noon"})
+	if err != nil || delivered != 1 || sent.ID == "" || sent.SentAt == nil {
+		t.Errorf("Expected the announcement to reach one client, got %+v and %d (err: %v)", sent, delivered, err)
+	}
+	notice := readMessage(t, conn).GetServerNoticeMessage()
+	if notice.GetType() != pb.ServerNoticePacket_ANNOUNCEMENT || notice.GetReason() != "Maintenance at noon" {
+		t.Errorf("Expected the announcement, got %v", notice)
+	}
+	if signed, err := announcement.Verify(publicKey, notice); err != nil || signed.GetId() != sent.ID || signed.GetText() != "Maintenance at noon" {
+		t.Errorf("Expected a signed announcement, got %v (err: %v)", signed, err)
+	}
+
+	if err = server.Kick(sessions[0].ID+1, "spam"); err == nil {
+		t.Errorf("Expected kicking an unknown session to fail")
+	}
+	if err = server.Kick(sessions[0].ID, "spam"); err != nil {
+		t.Fatalf("Error kicking session: %v", err)
+	}
+	if notice := readMessage(t, conn).GetServerNoticeMessage(); notice.GetType() != pb.ServerNoticePacket_KICKED || notice.GetReason() != "spam" {
+		t.Errorf("Expected the kicked notice, got %v", notice)
+	}
+	if _, err = util.ReadMessage(conn); err == nil {
+		t.Errorf("Expected the server to close a kicked connection")
+	}
+}
+
+func TestDisableKicksEverySession(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	scheme := blinding.LegacyKeyring().Current()
+	if err = store.CreateNewUser(scheme.Blind("alice"), scheme.Version, "RSA", key.N.Bytes(), nil); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{Listener: listener, Store: store, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	// The second login takes over from the first, whose connection stays open
+	first := logIn(t, listener.Addr().String(), "alice", key)
+	defer first.Close()
+	second := logIn(t, listener.Addr().String(), "alice", key)
+	defer second.Close()
+	bystander, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer bystander.Close()
+	requestLogin(t, bystander)
+
+	if kicked, err := server.DisableUser("alice", true); err != nil || kicked != 2 {
+		t.Fatalf("Expected both sessions of alice to be kicked, got %d (err: %v)", kicked, err)
+	}
+	for _, conn := range []net.Conn{first, second} {
+		if notice := readMessage(t, conn).GetServerNoticeMessage(); notice.GetType() != pb.ServerNoticePacket_KICKED {
+			t.Errorf("Expected the kicked notice, got %v", notice)
+		}
+		if _, err = util.ReadMessage(conn); err == nil {
+			t.Errorf("Expected the server to close a kicked connection")
+		}
+	}
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].Remote != bystander.LocalAddr().String() {
+		t.Errorf("Expected only the other client to stay connected, got %+v", sessions)
+	}
+
+	// Deleting the account ends its sessions too
+	if _, err = server.DisableUser("alice", false); err != nil {
+		t.Fatalf("Error enabling user: %v", err)
+	}
+	third := logIn(t, listener.Addr().String(), "alice", key)
+	defer third.Close()
+	if kicked, err := server.DeleteUser("alice"); err != nil || kicked != 1 {
+		t.Fatalf("Expected the session of the deleted user to be kicked, got %d (err: %v)", kicked, err)
+	}
+	if notice := readMessage(t, third).GetServerNoticeMessage(); notice.GetType() != pb.ServerNoticePacket_KICKED {
+		t.Errorf("Expected the kicked notice, got %v", notice)
+	}
+	if _, err = server.DeleteUser("alice"); !errors.Is(err, adminapi.ErrNotFound) {
+		t.Errorf("Expected a deleted user not to be found, got %v", err)
+	}
+}
+
+func TestAnnouncementsForOfflineUsers(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	scheme := blinding.LegacyKeyring().Current()
+	if err = store.CreateNewUser(scheme.Blind("alice"), scheme.Version, "RSA", key.N.Bytes(), nil); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{Listener: listener, Store: store, Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), AnnouncementKey: key})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	expiresAt := time.Now().Add(time.Hour)
+	if _, delivered, err := server.Announce(Announcement{Message: "New terms", Persistent: true, ExpiresAt: &expiresAt}); err != nil || delivered != 0 {
+		t.Fatalf("Expected nobody to be online, got %d (err: %v)", delivered, err)
+	}
+	if _, _, err = server.Announce(Announcement{Message: "Later", SendAt: time.Now().Add(time.Hour), Persistent: true}); err != nil {
+		t.Fatalf("Error scheduling announcement: %v", err)
+	}
+
+	// The persistent announcement that was sent is delivered at the next login, once
+	for attempt := 0; attempt < 2; attempt++ {
+		conn := logIn(t, listener.Addr().String(), "alice", key)
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		message, err := util.ReadMessage(conn)
+		if attempt == 0 {
+			if err != nil {
+				t.Fatalf("Expected the announcement at login: %v", err)
+			}
+			signed, err := announcement.Verify(&key.PublicKey, message.GetServerNoticeMessage())
+			if err != nil || signed.GetText() != "New terms" || signed.GetExpiresAt() != expiresAt.Unix() {
+				t.Errorf("Expected the signed announcement, got %v (err: %v)", signed, err)
+			}
+		} else if err == nil {
+			t.Errorf("Expected the announcement to be delivered once, got %v", message)
+		}
+		conn.Close()
+	}
+
+	announcements, err := server.Announcements()
+	if err != nil || len(announcements) != 2 || announcements[0].SentAt == nil || announcements[1].SentAt != nil {
+		t.Errorf("Expected a sent and a scheduled announcement, got %+v (err: %v)", announcements, err)
+	}
+}
+
+func TestSuspension(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMemoryStore()
+	scheme := blinding.LegacyKeyring().Current()
+	if err = store.CreateNewUser(scheme.Blind("alice"), scheme.Version, "RSA", key.N.Bytes(), nil); err != nil {
+		t.Fatalf("Error creating user: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{Listener: listener, Store: store, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	conn := logIn(t, listener.Addr().String(), "alice", key)
+	defer conn.Close()
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	suspension, kicked, err := server.Suspend("alice", Suspension{Reason: "spam", Moderator: "ops", ExpiresAt: &until})
+	if err != nil || kicked != 1 || !suspension.Active {
+		t.Fatalf("Expected the logged in user to be suspended and kicked, got %+v and %d (err: %v)", suspension, kicked, err)
+	}
+	if notice := readMessage(t, conn).GetServerNoticeMessage(); notice.GetType() != pb.ServerNoticePacket_KICKED || !strings.Contains(notice.GetReason(), "spam") {
+		t.Errorf("Expected the kicked notice with the reason, got %v", notice)
+	}
+
+	login := func() *pb.LoginPacket {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		return answerChallenge(t, conn, "alice", key)
+	}
+	if reply := login(); reply.GetStatus() != pb.LoginPacket_SUSPENDED || reply.GetReason() != "spam" || reply.GetSuspendedUntil() != until.Unix() {
+		t.Errorf("Expected the login to be refused with the reason and end of the suspension, got %v", reply)
+	}
+	if lifted, err := server.LiftSuspensions("alice", "ops"); err != nil || lifted != 1 {
+		t.Fatalf("Expected the suspension to be lifted, got %d (err: %v)", lifted, err)
+	}
+	if reply := login(); reply.GetStatus() != pb.LoginPacket_LOGIN_SUCCESS {
+		t.Errorf("Expected to log in once the suspension was lifted, got %v", reply)
+	}
+	if _, _, err = server.Suspend("nobody", Suspension{Reason: "spam", Moderator: "ops"}); err == nil {
+		t.Errorf("Expected suspending an unknown user to fail, got %v", err)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		// Without a certificate, a client that never starts the handshake is the only one that gets far
+		TLSConfig:        &tls.Config{},
+		Store:            NewMemoryStore(),
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ConnectionLimits: ConnectionLimits{MaxConnectionsPerIP: 1, HandshakeTimeout: 100 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	// The first connection holds the only slot of its address until its handshake times out
+	first, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer first.Close()
+	time.Sleep(20 * time.Millisecond)
+	second, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer second.Close()
+
+	for _, conn := range []net.Conn{second, first} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected the server to close the connection, got %v", err)
+		}
+	}
+	rejected := server.RejectedConnections()
+	if rejected["max_connections_per_ip"] != 1 || rejected["handshake"] != 1 {
+		t.Errorf("Expected one connection over the per IP limit and one handshake timeout, got %v", rejected)
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	trusted, _ := ParseAddressRanges("127.0.0.1")
+	server, err := New(Options{
+		Listener:         listener,
+		Store:            NewMemoryStore(),
+		Logger:           slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ConnectionLimits: ConnectionLimits{MaxConnectionsPerIP: 1, HandshakeTimeout: time.Second},
+		TrustedProxies:   trusted,
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	// Both clients come through the same balancer, the per IP limit counts each one's own address
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer conn.Close()
+		if _, err = conn.Write([]byte("PROXY TCP4 " + client + " 198.51.100.1 40000 8080\r\n")); err != nil {
+			t.Fatalf("Error sending PROXY header: %v", err)
+		}
+		if reply := requestLogin(t, conn); reply.GetLoginMessage() == nil {
+			t.Fatalf("Expected a login reply for %s, got %v", client, reply)
+		}
+	}
+	var remotes []string
+	for _, session := range server.Sessions() {
+		remotes = append(remotes, session.Remote)
+	}
+	if strings.Join(remotes, ",") != "192.0.2.1:40000,192.0.2.2:40000" {
+		t.Errorf("Expected the sessions to have the clients' addresses, got %v", remotes)
+	}
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer conn.Close()
+	sendMessage(t, conn, loginRequest("alice"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// The server may reset the connection, since it never reads the whole request
+	if _, err = conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a trusted proxy without a PROXY header to be refused, got %v", err)
+	}
+	if rejected := server.RejectedConnections()["proxy_header"]; rejected != 1 {
+		t.Errorf("Expected one connection without a PROXY header, got %d", rejected)
+	}
+}
+
+// issueCertificate signs a certificate for commonName with the CA, or makes a CA when ca is nil
+func issueCertificate(t *testing.T, commonName string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, crypto.Signer(key)
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid, template.KeyUsage = true, true, x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey.(crypto.Signer)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca := issueCertificate(t, "device CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{issueCertificate(t, "chat server", &ca)},
+			ClientCAs:    roots,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+		},
+		Store:           NewMemoryStore(),
+		Logger:          slog.New(slog.NewTextHandler(io.Discard, nil)),
+		ClientCertUsers: &ClientCertUsers{Certificates: []ClientCertificate{{Subject: "alice-laptop", Usernames: []string{"alice"}}}},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	dial := func(certificates ...tls.Certificate) net.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certificates})
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	laptop := issueCertificate(t, "alice-laptop", &ca)
+	conn := dial(laptop)
+	// alice isn't registered, the decoy challenge shows the certificate was accepted
+	sendMessage(t, conn, loginRequest("alice"))
+	if reply := readMessage(t, conn).GetLoginMessage(); reply.GetStatus() != pb.LoginPacket_ENCRYPTED_TOKEN {
+		t.Errorf("Expected the laptop to get a challenge for alice, got %v", reply)
+	}
+	sendMessage(t, conn, loginRequest("bob"))
+	if reply := readMessage(t, conn).GetLoginMessage(); reply.GetStatus() != pb.LoginPacket_LOGIN_FAILED || reply.GetReason() == "" {
+		t.Errorf("Expected the laptop not to log in as bob, got %v", reply)
+	}
+
+	// The handshake fails without a certificate, which a TLS 1.3 client only sees when it reads
+	conn = dial()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err == nil {
+		_, err = conn.Read(make([]byte, 1))
+	}
+	if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a client without a certificate to be refused, got %v", err)
+	}
+}
+
+func TestAnnouncementsAfterCertificateReload(t *testing.T) {
+	ca := issueCertificate(t, "server CA", nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	var current atomic.Pointer[tls.Certificate]
+	first := issueCertificate(t, "chat server", &ca)
+	current.Store(&first)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{
+		Listener: listener,
+		// Serves the certificate like certs.Reloader does, the latest one loaded
+		TLSConfig: &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return current.Load(), nil
+		}},
+		Store:  NewMemoryStore(),
+		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		requestLogin(t, conn) // The session is registered once the server answers
+		return conn
+	}
+	before := dial()
+	renewed := issueCertificate(t, "chat server", &ca)
+	current.Store(&renewed)
+	after := dial()
+
+	if _, delivered, err := server.Announce(Announcement{Message: "Maintenance at noon"}); err != nil || delivered != 2 {
+		t.Fatalf("Expected the announcement to reach both clients, got %d (err: %v)", delivered, err)
+	}
+	// Each client verifies with the certificate of its own connection, like the client application does
+	for name, conn := range map[string]*tls.Conn{"before": before, "after": after} {
+		notice := readMessage(t, conn).GetServerNoticeMessage()
+		if _, err := announcement.Verify(conn.ConnectionState().PeerCertificates[0].PublicKey, notice); err != nil {
+			t.Errorf("Expected the client connected %s the reload to verify the announcement: %v", name, err)
+		}
+	}
+}
+
+func TestKeyRevokedNoticeForOfflineContacts(t *testing.T) {
+	keys := make(map[string]*rsa.PrivateKey)
+	store := NewMemoryStore()
+	scheme := blinding.LegacyKeyring().Current()
+	recoveryCode := []byte("recovery code")
+	for _, username := range []string{"alice", "bob", "carol", "alice-new"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[username] = key
+		if username == "alice-new" {
+			continue
+		}
+		if err = store.CreateNewUser(scheme.Blind(username), scheme.Version, "RSA", key.N.Bytes(), [][]byte{util.RecoveryCodeVerifier(recoveryCode)}); err != nil {
+			t.Fatalf("Error creating user: %v", err)
+		}
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	server, err := New(Options{Listener: listener, Store: store, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	go server.Start(context.Background())
+	defer server.Shutdown(context.Background())
+	address := listener.Addr().String()
+
+	// Alice and bob exchange keys, which makes them contacts, then both log out
+	alice := logIn(t, address, "alice", keys["alice"])
+	bob := logIn(t, address, "bob", keys["bob"])
+	from, to := "bob", "alice"
+	sendMessage(t, bob, &pb.Message{
+		Source:       pb.Message_CLIENT,
+		FromUsername: &from,
+		Packet: &pb.Message_ExchangeKeyMessage{ExchangeKeyMessage: &pb.ExchangeKeyPacket{
+			Status:     pb.ExchangeKeyPacket_REPLY_WITH_SYM_KEY,
+			ToUsername: &to,
+		}},
+	})
+	if reply := readMessage(t, alice).GetExchangeKeyMessage(); reply.GetStatus() != pb.ExchangeKeyPacket_REPLY_WITH_SYM_KEY {
+		t.Fatalf("Expected the key exchange to reach alice, got %v", reply)
+	}
+	alice.Close()
+	bob.Close()
+	for len(server.Sessions()) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Carol never exchanged keys with alice, so she is not told
+	carol := logIn(t, address, "carol", keys["carol"])
+	defer carol.Close()
+	recovering, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer recovering.Close()
+	sendMessage(t, recovering, &pb.Message{
+		Source:       pb.Message_CLIENT,
+		FromUsername: &to,
+		Packet: &pb.Message_RecoveryMessage{RecoveryMessage: &pb.RecoveryPacket{
+			Status:       pb.RecoveryPacket_REQUEST_TO_RECOVER,
+			RecoveryCode: recoveryCode,
+			NewPublicKey: keys["alice-new"].N.Bytes(),
+		}},
+	})
+	if reply := readMessage(t, recovering).GetRecoveryMessage(); reply.GetStatus() != pb.RecoveryPacket_RECOVERY_SUCCESS {
+		t.Fatalf("Expected the recovery to succeed, got %v", reply)
+	}
+	_ = carol.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if message, err := util.ReadMessage(carol); err == nil {
+		t.Errorf("Expected nothing for a user who is not a contact, got %v", message)
+	}
+
+	// Bob was offline, he is told once he logs in, and only once
+	for attempt := 0; attempt < 2; attempt++ {
+		bob = logIn(t, address, "bob", keys["bob"])
+		_ = bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		message, err := util.ReadMessage(bob)
+		if attempt == 0 {
+			if notice := message.GetRecoveryMessage(); err != nil || notice.GetStatus() != pb.RecoveryPacket_KEY_REVOKED || notice.GetUsername() != "alice" {
+				t.Errorf("Expected the key revoked notice at login, got %v (err: %v)", message, err)
+			}
+		} else if err == nil {
+			t.Errorf("Expected the notice to be delivered once, got %v", message)
+		}
+		bob.Close()
+		for len(server.Sessions()) > 2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}